@@ -2,6 +2,7 @@ package authentication // import "breve.us/authsvc/authentication"
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -11,11 +12,13 @@ import (
 	"github.com/gorilla/securecookie"
 
 	"breve.us/authsvc/common"
+	"breve.us/authsvc/user"
 )
 
 var (
 	loginPath     = "login/"
 	logoutPath    = "logout/"
+	passwordPath  = "password"
 	cookieName    = "authsvc-login-cookie"
 	redirectParam = "redirect_uri"
 	loginLifetime = 60 * 60 * 2 // 2 hours
@@ -186,6 +189,79 @@ func (m *loginHandler) clearLoginCookie(w http.ResponseWriter) {
 	})
 }
 
+// PasswordHandler returns a router that handles the password route, for
+// requests authenticated by the middleware. GET serves page, which shows
+// the form and any msg the change was refused with. The current password
+// is verified with checker before changer changes it, after which users,
+// if set, forgets what it held of the user.
+func PasswordHandler(authroot string, page http.Handler, checker common.PasswordChecker, changer common.PasswordChanger, users *user.Registry) *mux.Router {
+	h := &passwordHandler{root: authroot, checker: checker, changer: changer, users: users}
+
+	r := mux.NewRouter()
+	r.Handle(authroot+passwordPath, page).Methods("GET")
+	r.HandleFunc(authroot+passwordPath, h.passwordPOST).Methods("POST")
+	return r
+}
+
+type passwordHandler struct {
+	root    string
+	checker common.PasswordChecker
+	changer common.PasswordChanger
+	users   *user.Registry
+}
+
+func (m *passwordHandler) passwordPOST(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	username := common.GetUsername(r.Context())
+	if username == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch button := r.Form.Get("submit"); button {
+	case "Change":
+		current := r.Form.Get("current")
+		password := r.Form.Get("password")
+		switch {
+		case password == "":
+			m.refused(w, r, "a new password is required")
+			return
+		case password != r.Form.Get("confirm"):
+			m.refused(w, r, "the new passwords do not match")
+			return
+		case !m.checker.IsAuthenticated(username, current):
+			m.refused(w, r, common.ErrWrongPassword.Error())
+			return
+		}
+		err := m.changer.ChangePassword(username, current, password)
+		if e, ok := err.(*common.PasswordPolicyError); ok {
+			m.refused(w, r, e.Reason)
+			return
+		} else if err == common.ErrWrongPassword {
+			m.refused(w, r, err.Error())
+			return
+		} else if err != nil {
+			log.Printf("error changing password of %q: %v", username, err)
+			m.refused(w, r, "the password could not be changed")
+			return
+		}
+		if m.users != nil {
+			m.users.Invalidate(username)
+		}
+		common.Redirect(w, r, "/", map[string]string{"msg": "password changed"})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// refused sends the user back to the password page, saying why their
+// password was not changed.
+func (m *passwordHandler) refused(w http.ResponseWriter, r *http.Request, reason string) {
+	common.Redirect(w, r, m.root+passwordPath, map[string]string{"msg": reason})
+}
+
 func makeRedirect(target string, originalURL fmt.Stringer) fmt.Stringer {
 	var (
 		u   *url.URL
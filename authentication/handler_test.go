@@ -0,0 +1,87 @@
+package authentication // import "breve.us/authsvc/authentication"
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"breve.us/authsvc/common"
+)
+
+type fakeChecker map[string]string
+
+func (c fakeChecker) IsAuthenticated(username, password string) bool {
+	p, ok := c[username]
+	return ok && p == password
+}
+
+type fakeChanger struct {
+	passwords fakeChecker
+	err       error
+}
+
+func (c *fakeChanger) ChangePassword(username, oldPassword, newPassword string) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.passwords[username] = newPassword
+	return nil
+}
+
+func TestPasswordHandler(t *testing.T) {
+	passwords := fakeChecker{"alice": "old-secret"}
+	changer := &fakeChanger{passwords: passwords}
+	page := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("password page")) })
+	h := PasswordHandler("/auth/", page, passwords, changer, nil)
+
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		if form != nil {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r.WithContext(common.SetUsername(r.Context(), "alice")))
+		return w
+	}
+	change := func(current, password, confirm string) url.Values {
+		return url.Values{"submit": {"Change"}, "current": {current}, "password": {password}, "confirm": {confirm}}
+	}
+
+	if w := do("GET", "/auth/password", nil); w.Code != http.StatusOK || w.Body.String() != "password page" {
+		t.Errorf("GET expected the page, got %d %q", w.Code, w.Body.String())
+	}
+
+	changer.err = &common.PasswordPolicyError{Reason: "too short"}
+	for _, tc := range []struct {
+		name string
+		form url.Values
+		msg  string
+	}{
+		{"mismatch", change("old-secret", "new-secret", "other"), "the new passwords do not match"},
+		{"empty", change("old-secret", "", ""), "a new password is required"},
+		{"wrong current", change("guess", "new-secret", "new-secret"), common.ErrWrongPassword.Error()},
+		{"policy", change("old-secret", "new-secret", "new-secret"), "too short"},
+	} {
+		w := do("POST", "/auth/password", tc.form)
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if w.Code != http.StatusSeeOther || err != nil || loc.Path != "/auth/password" || loc.Query().Get("msg") != tc.msg {
+			t.Errorf("%s: POST expected a redirect to the page with %q, got %d %q", tc.name, tc.msg, w.Code, w.Header().Get("Location"))
+			continue
+		}
+		// The page the refusal is shown on must load.
+		if w = do("GET", loc.String(), nil); w.Code != http.StatusOK {
+			t.Errorf("%s: GET of %q expected the page, got %d", tc.name, loc, w.Code)
+		}
+	}
+
+	changer.err = nil
+	w := do("POST", "/auth/password", change("old-secret", "new-secret", "new-secret"))
+	if loc := w.Header().Get("Location"); w.Code != http.StatusSeeOther || loc != "/?msg=password+changed" {
+		t.Errorf("POST expected a redirect home, got %d %q", w.Code, loc)
+	}
+	if passwords["alice"] != "new-secret" {
+		t.Errorf("POST expected the password changed, got %q", passwords["alice"])
+	}
+}
@@ -0,0 +1,47 @@
+package authorization // import "breve.us/authsvc/authorization"
+
+import (
+	"log"
+	"net/http"
+
+	"breve.us/authsvc/client"
+	"breve.us/authsvc/user"
+)
+
+// allowed reports whether the access policy of the client lets username
+// use it, writing an audit record when it does not.
+func (h *OAuthHandler) allowed(r *http.Request, clientID, username string) bool {
+	return allowed(r, h.clients, h.opts.Users, clientID, username)
+}
+
+func allowed(r *http.Request, clients *client.Registry, users *user.Registry, clientID, username string) bool {
+	cl, err := clients.Get(clientID)
+	if err != nil {
+		auditDenied(r, clientID, username, "unknown client")
+		return false
+	}
+	if cl.Access == nil {
+		return true
+	}
+	var u *user.Details
+	if users != nil {
+		// An unknown user is refused by the policy, as is one that
+		// cannot be read, say while the directory is down.
+		if u, err = users.Get(username); err != nil && err != user.ErrNotFound {
+			auditDenied(r, clientID, username, "cannot read user: "+err.Error())
+			return false
+		}
+	}
+	if reason := cl.Access.Denied(u); reason != "" {
+		auditDenied(r, clientID, username, reason)
+		return false
+	}
+	return true
+}
+
+// auditDenied writes an audit record of a request refused by the access
+// policy of a client.
+func auditDenied(r *http.Request, clientID, username, reason string) {
+	log.Printf("audit: access_denied client=%q user=%q remote=%s %s %s: %s",
+		clientID, username, r.RemoteAddr, r.Method, r.URL.Path, reason)
+}
@@ -4,29 +4,31 @@ import (
 	"net/http"
 	"strings"
 
+	"breve.us/authsvc/client"
 	"breve.us/authsvc/common"
 	"breve.us/authsvc/user"
 )
 
-func newTokenRequestChecker(cache *tokenCache, users *user.Registry) common.RequestChecker {
-	return &requestChecker{tc: cache, ur: users}
+func newTokenRequestChecker(cache *tokenCache, users *user.Registry, clients *client.Registry) common.RequestChecker {
+	return &requestChecker{tc: cache, ur: users, cr: clients}
 }
 
 type requestChecker struct {
 	tc *tokenCache
 	ur *user.Registry
+	cr *client.Registry
 }
 
 func (c *requestChecker) IsAuthenticated(r *http.Request) string {
 	if tok := bearerToken(r); tok != "" {
-		if u, err := c.tc.Get(tok); err == nil {
-			if username, ok := u.(string); ok {
-				if d, err2 := c.ur.Get(username); err2 == nil {
-					if d.State == "active" {
-						return username
-					}
-				} else {
+		if g, err := c.tc.GetGrant(tok); err == nil {
+			if d, err2 := c.ur.Get(g.Username); err2 == nil {
+				// Tokens issued before grants recorded their client
+				// are not held to its access policy.
+				if d.State == "active" && (g.ClientID == "" || allowed(r, c.cr, c.ur, g.ClientID, g.Username)) {
+					return g.Username
 				}
+			} else {
 			}
 		}
 	}
@@ -1,6 +1,7 @@
 package authorization // import "breve.us/authsvc/authorization"
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/gob"
 	"errors"
@@ -25,6 +26,8 @@ import (
 func init() {
 	rand.Seed(time.Now().Unix())
 	gob.Register(&authorize{})
+	store.RegisterType("authorization.authorize", 1, &authorize{}, store.JSONCodec)
+	store.RegisterType("authorization.grant", 1, &grant{}, store.JSONCodec)
 }
 
 // Error Values
@@ -34,6 +37,7 @@ var (
 	ErrInvalidAuth         = errors.New("invalid auth")
 	ErrMissingRedirect     = errors.New("missing redirect_uri")
 	ErrInvalidResponseType = errors.New("response_type unsupported")
+	ErrAtomicCache         = errors.New("transient cache does not support atomic operations")
 )
 
 // Scopes
@@ -43,10 +47,21 @@ const (
 
 // Options encapsulates OAuth Handler options.
 type Options struct {
-	TokenTTL time.Duration
-	GrantTTL time.Duration
-	CacheDir string
-	Users    *user.Registry
+	TokenTTL      time.Duration
+	GrantTTL      time.Duration
+	SweepInterval time.Duration
+	SweepReport   store.ReportFn
+	CacheDir      string
+	Storage       string
+	SQLDriver     string
+	SQLDSN        string
+	Redis         *store.RedisConfig
+	Raft          *store.RaftConfig
+	CacheKeys     store.KeySource
+	Users         *user.Registry
+	// UserIDs, if set, records the IDs issued to LDAP users in the
+	// userids cache of the storage back-end.
+	UserIDs *user.IDTable
 }
 
 // RegisterAPI returns a router that handles OAuth routes.
@@ -69,61 +84,79 @@ func NewHandler(options *Options) (*OAuthHandler, error) {
 	if options.GrantTTL == 0 {
 		options.GrantTTL = 14 * 24 * time.Hour
 	}
+	if options.SweepInterval == 0 {
+		options.SweepInterval = 10 * time.Minute
+	}
 
-	var (
-		cache store.Cache
-		tok   *tokenCache
-	)
+	cs, err := openCaches(options)
+	if err != nil {
+		return nil, err
+	}
+	cache, cc, tc := cs.transient, cs.clients, cs.tokens
+	if options.UserIDs != nil {
+		options.UserIDs.SetCache(cs.userIDs)
+	}
+	codes, ok := cache.(store.CacheV2)
+	if !ok {
+		closeAll(cs.closers)
+		return nil, ErrAtomicCache
+	}
 
 	cr := client.NewRegistry(store.NewMemoryCache())
-
 	if validDir(options.CacheDir) {
-		var (
-			err    error
-			cc, tc store.Cache
-			fd     io.ReadCloser
-		)
-		if cache, err = store.NewBoltDBCache(path.Join(options.CacheDir, "transient.db"), "cache"); err != nil {
-			return nil, err
-		}
-		if cc, err = store.NewBoltDBCache(path.Join(options.CacheDir, "tokens.db"), "clients"); err != nil {
-			return nil, err
-		}
-		if tc, err = store.NewBoltDBCache(path.Join(options.CacheDir, "tokens.db"), "tokens"); err != nil {
-			return nil, err
-		}
-		tok = newTokenCache(cc, tc)
-
-		if fd, err = os.Open(path.Join(options.CacheDir, "clients.json")); err != nil {
+		fd, err := os.Open(path.Join(options.CacheDir, "clients.json"))
+		if err != nil {
+			closeAll(cs.closers)
 			return nil, err
 		}
 		defer func() { _ = fd.Close() }()
 		if err = cr.LoadFromJSON(fd); err != nil {
+			closeAll(cs.closers)
 			return nil, err
 		}
-	} else {
-		cache = store.NewMemoryCache()
-		tok = newTokenCache(store.NewMemoryCache(), store.NewMemoryCache())
 	}
+	// Tokens stored before keys were hashed are re-keyed once, as they
+	// are only ever looked up by their hash.
+	if _, err = migrateTokenKeys(cc, tc); err != nil {
+		closeAll(cs.closers)
+		return nil, err
+	}
+	tok := newTokenCache(cc, tc)
+
+	janitor := store.NewJanitor(options.SweepInterval, options.SweepReport)
+	janitor.Add("transient", cache)
+	janitor.Add("clients", cc)
+	janitor.Add("tokens", tc)
 
 	return &OAuthHandler{
 		opts:    options,
-		cache:   cache,
+		codes:   codes,
 		tokens:  tok,
 		clients: cr,
-		checker: newTokenRequestChecker(tok, options.Users),
+		checker: newTokenRequestChecker(tok, options.Users, cr),
+		janitor: janitor,
+		closers: append(cs.closers, cr),
 	}, nil
 }
 
 // OAuthHandler provides OAuth2 capabilities.
 type OAuthHandler struct {
 	opts    *Options
-	cache   store.Cache
+	codes   store.CacheV2
 	tokens  *tokenCache
 	clients *client.Registry
 	checker common.RequestChecker
+	janitor *store.Janitor
+	closers []io.Closer
 }
 
+// RunJanitor periodically evicts expired authorization codes and
+// tokens until ctx is cancelled.
+func (h *OAuthHandler) RunJanitor(ctx context.Context) { h.janitor.Run(ctx) }
+
+// Close releases the persistent caches held by the handler.
+func (h *OAuthHandler) Close() error { return closeAll(h.closers) }
+
 // IsAuthenticated checks the request for a Bearer token
 func (h *OAuthHandler) IsAuthenticated(r *http.Request) string { return h.checker.IsAuthenticated(r) }
 
@@ -156,7 +189,12 @@ func (h *OAuthHandler) handleAuthorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.addToCache(a)
+	if !h.allowed(r, a.ClientID, common.GetUsername(r.Context())) {
+		common.Redirect(w, r, a.RedirectURI, map[string]string{"error": "access_denied", "state": a.State})
+		return
+	}
+
+	h.addToCache(r.Context(), a)
 	common.Redirect(w, r, "/oauth/ask", map[string]string{"id": a.ID, "app": a.Application})
 }
 
@@ -166,7 +204,7 @@ func (h *OAuthHandler) handleApprove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	a, ok := h.checkCode(r.Form.Get("corr"))
+	a, ok := h.redeem(r.Context(), r.Form.Get("corr"))
 	if !ok {
 		common.JSONStatusResponse(http.StatusForbidden, w, "invalid correlation")
 		return
@@ -182,7 +220,14 @@ func (h *OAuthHandler) handleApprove(w http.ResponseWriter, r *http.Request) {
 	if username := common.GetUsername(r.Context()); username != "" {
 		a.Username = username
 	}
-	code := h.addToCache(a)
+	if !h.allowed(r, a.ClientID, a.Username) {
+		common.Redirect(w, r, a.RedirectURI, map[string]string{"error": "access_denied", "state": a.State})
+		return
+	}
+	// Issue a fresh code so the correlation id shown on the approval
+	// page can never be redeemed for a token.
+	a.ID = ""
+	code := h.addToCache(r.Context(), a)
 	common.Redirect(w, r, a.RedirectURI, map[string]string{"code": code, "state": a.State})
 }
 
@@ -192,12 +237,6 @@ func (h *OAuthHandler) handleToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	t, ok := h.checkCode(r.Form.Get("code"))
-	if !ok {
-		common.JSONStatusResponse(http.StatusForbidden, w, "invalid token")
-		return
-	}
-
 	creds, err := decodeClientCredentials(r)
 	if err != nil {
 		common.JSONStatusResponse(http.StatusForbidden, w, err.Error())
@@ -211,17 +250,21 @@ func (h *OAuthHandler) handleToken(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Form.Get("grant_type") {
 	case "authorization_code":
+		t, ok := h.redeem(r.Context(), r.Form.Get("code"))
+		if !ok || t.Username == "" {
+			common.JSONStatusResponse(http.StatusForbidden, w, "invalid token")
+			return
+		}
 		if t.ClientID != creds.ID {
 			common.JSONStatusResponse(http.StatusForbidden, w, "mismatching client ids")
 			return
 		}
-		switch err := h.cache.Delete(t.ID); err {
-		case nil, store.ErrNotFound:
-		default:
-			panic(err)
+		if !h.allowed(r, t.ClientID, t.Username) {
+			common.JSONStatusResponse(http.StatusForbidden, w, "access denied")
+			return
 		}
 		tok := generateRandomString()
-		h.addClient(tok, t.Username)
+		h.addClient(tok, &grant{Username: t.Username, ClientID: t.ClientID})
 		common.JSONResponse(w, &bearer{Token: tok, Type: "Bearer"})
 	default:
 		common.JSONStatusResponse(http.StatusForbidden, w, "unsupported grant type")
@@ -229,26 +272,28 @@ func (h *OAuthHandler) handleToken(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *OAuthHandler) addClient(tok string, username string) {
+func (h *OAuthHandler) addClient(tok string, g *grant) {
 	expire := time.Now().Add(h.opts.GrantTTL)
-	if err := h.tokens.PutUntil(expire, username, tok); err != nil {
+	if err := h.tokens.PutGrant(expire, tok, g); err != nil {
 		panic(err)
 	}
 }
 
-func (h *OAuthHandler) addToCache(a *authorize) string {
+func (h *OAuthHandler) addToCache(ctx context.Context, a *authorize) string {
 	if a.ID == "" {
 		a.ID = generateRandomString()
 	}
 	expire := time.Now().Add(h.opts.TokenTTL)
-	if err := h.cache.PutUntil(expire, a.ID, a); err != nil {
+	if err := h.codes.PutUntilContext(ctx, expire, a.ID, a); err != nil {
 		panic(err)
 	}
 	return a.ID
 }
 
-func (h *OAuthHandler) checkCode(code string) (*authorize, bool) {
-	switch v, err := h.cache.Get(code); err {
+// redeem atomically removes and returns the authorization stored under
+// code, so that concurrent requests cannot both use the same code.
+func (h *OAuthHandler) redeem(ctx context.Context, code string) (*authorize, bool) {
+	switch v, err := h.codes.GetAndDelete(ctx, code); err {
 	case nil:
 		a, ok := v.(*authorize)
 		return a, ok
@@ -257,6 +302,16 @@ func (h *OAuthHandler) checkCode(code string) (*authorize, bool) {
 	}
 }
 
+func closeAll(closers []io.Closer) error {
+	var err error
+	for i := len(closers) - 1; i >= 0; i-- {
+		if e := closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
 func validDir(dir string) bool {
 	if dir == "" {
 		return false
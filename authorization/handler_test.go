@@ -0,0 +1,172 @@
+package authorization // import "breve.us/authsvc/authorization"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"breve.us/authsvc/client"
+	"breve.us/authsvc/common"
+	"breve.us/authsvc/store"
+	"breve.us/authsvc/user"
+)
+
+const redirect = "https://app.example.com/callback"
+
+// newTestHandler returns a handler whose client app lets only ann in.
+func newTestHandler(t *testing.T, users store.Cache) *OAuthHandler {
+	h, err := NewHandler(&Options{Users: user.NewRegistry(users)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = h.Close() })
+	err = h.clients.Put(&client.Details{
+		ID:        "app",
+		Endpoints: []string{redirect},
+		Access:    &client.Policy{Allow: &client.Rules{Users: []string{"ann"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testUsers() store.Cache {
+	users := store.NewMemoryCache()
+	for _, name := range []string{"ann", "bob"} {
+		_ = users.Put(name, &user.Details{Username: name, State: user.Active})
+	}
+	return users
+}
+
+// serve sends a request as username through the handler's routes.
+func serve(h *OAuthHandler, method, target string, form url.Values, username string) *httptest.ResponseRecorder {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	r := httptest.NewRequest(method, target, body)
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if username != "" {
+		r = r.WithContext(common.SetUsername(r.Context(), username))
+	}
+	w := httptest.NewRecorder()
+	h.RegisterAPI("/oauth/").ServeHTTP(w, r)
+	return w
+}
+
+func location(t *testing.T, w *httptest.ResponseRecorder) *url.URL {
+	u, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusSeeOther || err != nil {
+		t.Fatalf("expected a redirect, got %d %q (%v)", w.Code, w.Header().Get("Location"), err)
+	}
+	return u
+}
+
+func TestAuthorizeAccessPolicy(t *testing.T) {
+	h := newTestHandler(t, testUsers())
+	target := "/oauth/authorize?" + url.Values{
+		"response_type": {"code"},
+		"client_id":     {"app"},
+		"redirect_uri":  {redirect},
+		"state":         {"xyz"},
+	}.Encode()
+
+	loc := location(t, serve(h, "GET", target, nil, "bob"))
+	if loc.Host != "app.example.com" || loc.Query().Get("error") != "access_denied" || loc.Query().Get("state") != "xyz" {
+		t.Errorf("authorize as bob expected access_denied, got %s", loc)
+	}
+	if loc = location(t, serve(h, "GET", target, nil, "ann")); loc.Path != "/oauth/ask" || loc.Query().Get("id") == "" {
+		t.Errorf("authorize as ann expected the approval page, got %s", loc)
+	}
+}
+
+func TestApproveAccessPolicy(t *testing.T) {
+	h := newTestHandler(t, testUsers())
+	for _, tc := range []struct {
+		username string
+		denied   bool
+	}{
+		{"bob", true},
+		{"ann", false},
+	} {
+		corr := h.addToCache(context.Background(), &authorize{ResponseType: "code", ClientID: "app", RedirectURI: redirect, State: "s"})
+		loc := location(t, serve(h, "POST", "/oauth/approve", url.Values{"corr": {corr}, "approve": {"Approve"}}, tc.username))
+		if denied := loc.Query().Get("error") == "access_denied"; denied != tc.denied || loc.Query().Get("state") != "s" {
+			t.Errorf("approve as %s expected denied %v, got %s", tc.username, tc.denied, loc)
+		}
+		if !tc.denied && loc.Query().Get("code") == "" {
+			t.Errorf("approve as %s expected a code, got %s", tc.username, loc)
+		}
+	}
+}
+
+func TestTokenAccessPolicy(t *testing.T) {
+	h := newTestHandler(t, testUsers())
+	token := func(username string) *httptest.ResponseRecorder {
+		code := h.addToCache(context.Background(), &authorize{ResponseType: "code", ClientID: "app", RedirectURI: redirect, Username: username})
+		return serve(h, "POST", "/oauth/token", url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {"app"}}, "")
+	}
+
+	if w := token("bob"); w.Code != http.StatusForbidden {
+		t.Errorf("token for bob expected %d, got %d %s", http.StatusForbidden, w.Code, w.Body)
+	}
+	w := token("ann")
+	var b bearer
+	if err := json.NewDecoder(w.Body).Decode(&b); w.Code != http.StatusOK || err != nil || b.Token == "" {
+		t.Fatalf("token for ann expected a bearer token, got %d (%v)", w.Code, err)
+	}
+
+	bearerRequest := func(tok string) *http.Request {
+		r := httptest.NewRequest("GET", "/api/v4/user", nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		return r
+	}
+	if got := h.IsAuthenticated(bearerRequest(b.Token)); got != "ann" {
+		t.Errorf("IsAuthenticated() with ann's token expected ann, got %q", got)
+	}
+
+	// The policy is checked on every request, not only when issuing.
+	cl, _ := h.clients.Get("app")
+	_ = h.clients.Put(&client.Details{ID: cl.ID, Endpoints: cl.Endpoints, Access: &client.Policy{Deny: &client.Rules{Users: []string{"ann"}}}})
+	if got := h.IsAuthenticated(bearerRequest(b.Token)); got != "" {
+		t.Errorf("IsAuthenticated() once ann is denied expected no user, got %q", got)
+	}
+
+	// Grants issued before they recorded their client have no policy.
+	h.addClient("LEGACY", &grant{Username: "ann"})
+	if got := h.IsAuthenticated(bearerRequest("LEGACY")); got != "ann" {
+		t.Errorf("IsAuthenticated() with a token without client expected ann, got %q", got)
+	}
+}
+
+type failingCache struct{ store.Cache }
+
+func (failingCache) Get(key string) (interface{}, error) { return nil, errors.New("ldap: server down") }
+
+func TestAccessAuditsLookupErrors(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	h := newTestHandler(t, failingCache{store.NewMemoryCache()})
+	r := httptest.NewRequest("GET", "/oauth/authorize", nil)
+	if h.allowed(r, "app", "ann") {
+		t.Error("allowed() when the user cannot be read expected a refusal")
+	}
+	if !strings.Contains(buf.String(), "ldap: server down") {
+		t.Errorf("allowed() expected the lookup error audited, got %q", buf.String())
+	}
+}
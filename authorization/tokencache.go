@@ -1,6 +1,9 @@
 package authorization // import "breve.us/authsvc/authorization"
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"time"
 
@@ -12,6 +15,24 @@ var (
 	errExpectSlice  = errors.New("tokenCache expects the value list to be a []string")
 )
 
+// grant records what a bearer token was issued for. Tokens issued before
+// grants were recorded hold only the username.
+type grant struct {
+	Username string
+	ClientID string
+}
+
+// grantOf returns the grant held in the tokens cache as v.
+func grantOf(v interface{}) (*grant, bool) {
+	switch g := v.(type) {
+	case *grant:
+		return g, true
+	case string:
+		return &grant{Username: g}, true
+	}
+	return nil, false
+}
+
 func newTokenCache(clients store.Cache, tokens store.Cache) *tokenCache {
 	return &tokenCache{clienttokens: clients, tokenclients: tokens}
 }
@@ -30,7 +51,7 @@ func (c *tokenCache) Put(key string, value interface{}) error {
 	if err := c.addToken(key, token); err != nil {
 		return err
 	}
-	if err := c.tokenclients.Put(token, key); err != nil {
+	if err := c.tokenclients.Put(tokenKey(token), key); err != nil {
 		return err
 	}
 	return nil
@@ -45,30 +66,47 @@ func (c *tokenCache) PutUntil(time time.Time, key string, value interface{}) err
 	if err := c.addToken(key, token); err != nil {
 		return err
 	}
-	if err := c.tokenclients.PutUntil(time, token, key); err != nil {
+	if err := c.tokenclients.PutUntil(time, tokenKey(token), key); err != nil {
 		return err
 	}
 	return nil
 }
 
+// PutGrant records token as issued for g until time.
+func (c *tokenCache) PutGrant(time time.Time, token string, g *grant) error {
+	if err := c.addToken(g.Username, token); err != nil {
+		return err
+	}
+	return c.tokenclients.PutUntil(time, tokenKey(token), g)
+}
+
 // Get expects to be given a token, and to return a client id.
 func (c *tokenCache) Get(token string) (interface{}, error) {
-	v, err := c.tokenclients.Get(token)
-	id, ok := v.(string)
+	g, err := c.GetGrant(token)
+	if err != nil {
+		return nil, err
+	}
+	return g.Username, nil
+}
+
+// GetGrant returns what token was issued for.
+func (c *tokenCache) GetGrant(token string) (*grant, error) {
+	v, err := c.lookup(token)
+	g, ok := grantOf(v)
 	switch err {
 	case nil:
 	case store.ErrExpired:
 		if ok {
-			_ = c.removeToken(id, token)
+			_ = c.removeToken(g.Username, token)
 		}
 		fallthrough
 	default:
-		return v, err
+		return nil, err
 	}
 	if !ok {
-		return v, errExpectString
+		return nil, errExpectString
 	}
-	return id, nil
+	return g, nil
 }
 
 // Delete removes token from the cache.
@@ -82,19 +120,26 @@ func (c *tokenCache) Delete(token string) error {
 
 // getIDByToken returns client ID that correlates to the token.
 func (c *tokenCache) getIDByToken(tok string) (string, error) {
-	v, err := c.tokenclients.Get(tok)
+	v, err := c.lookup(tok)
 	if err != nil {
 		return "", err
 	}
-	if id, ok := v.(string); ok {
-		return id, nil
+	if g, ok := grantOf(v); ok {
+		return g.Username, nil
 	}
 	return "", errExpectString
 }
 
-// GetTokenByID returns the token associated with a client ID.
+// lookup returns the entry of token. Only the hashed key is read, so
+// that a key read from the cache cannot be presented as a token.
+func (c *tokenCache) lookup(token string) (interface{}, error) {
+	return c.tokenclients.Get(tokenKey(token))
+}
+
+// getTokensByID returns the keys of the tokens associated with a client
+// ID.
 func (c *tokenCache) getTokensByID(id string) ([]string, error) {
-	v, err := c.Get(id)
+	v, err := c.clienttokens.Get(id)
 	if err != nil {
 		return nil, err
 	}
@@ -111,21 +156,105 @@ func (c *tokenCache) addToken(id string, token string) error {
 	default:
 		return err
 	}
-	toklist = append(toklist, token)
+	toklist = append(toklist, tokenKey(token))
 	return c.clienttokens.Put(id, toklist)
 }
 
 func (c *tokenCache) removeToken(id string, token string) error {
-	_ = c.tokenclients.Delete(token)
+	_ = c.tokenclients.Delete(tokenKey(token))
 	toklist, err := c.getTokensByID(id)
 	if err != nil {
 		return nil
 	}
 	var newlist []string
 	for _, tok := range toklist {
-		if tok != token {
+		if tok != tokenKey(token) {
 			newlist = append(newlist, tok)
 		}
 	}
 	return c.clienttokens.Put(id, newlist)
 }
+
+// tokenKey is the key a token is stored under, and the entry listing it
+// for its user, so that the bearer token itself never appears in the
+// tokens or clients caches.
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// isTokenKey reports whether key is the form tokenKey returns. Tokens
+// are never in this form, so it tells hashed keys from raw tokens.
+func isTokenKey(key string) bool {
+	if len(key) != hex.EncodedLen(sha256.Size) {
+		return false
+	}
+	for _, c := range key {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// migrateTokenKeys moves the entries written under the token itself,
+// before keys were hashed, to their hashed keys, and hashes the tokens
+// listed for each user, returning the number of entries moved. Entries
+// are moved with their expiry; when tokens cannot report it, they are
+// dropped rather than kept forever, and their users must log in again.
+func migrateTokenKeys(clients store.Cache, tokens store.Cache) (int, error) {
+	keys, err := tokens.Keys()
+	if err != nil {
+		return 0, err
+	}
+	e, expirer := tokens.(store.Expirer)
+	n := 0
+	for _, key := range keys {
+		if isTokenKey(key) {
+			continue
+		}
+		if expirer {
+			v, expire, err := e.GetWithExpiry(context.Background(), key)
+			switch err {
+			case nil:
+				if err = tokens.PutUntil(expire, tokenKey(key), v); err != nil {
+					return n, err
+				}
+				n++
+			case store.ErrExpired, store.ErrNotFound:
+			default:
+				return n, err
+			}
+		}
+		if err = tokens.Delete(key); err != nil && err != store.ErrNotFound {
+			return n, err
+		}
+	}
+
+	if keys, err = clients.Keys(); err != nil {
+		return n, err
+	}
+	for _, id := range keys {
+		v, err := clients.Get(id)
+		if err != nil {
+			continue
+		}
+		list, ok := v.([]string)
+		if !ok {
+			continue
+		}
+		changed := false
+		for i, tok := range list {
+			if !isTokenKey(tok) {
+				list[i], changed = tokenKey(tok), true
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err = clients.Put(id, list); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,73 @@
+package authorization // import "breve.us/authsvc/authorization"
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"breve.us/authsvc/store"
+)
+
+func TestTokenCacheLegacyKeys(t *testing.T) {
+	clients, tokens := store.NewMemoryCache(), store.NewMemoryCache()
+	c := newTokenCache(clients, tokens)
+
+	// Entries written before keys were hashed are under the token itself.
+	expire := time.Now().Add(time.Hour)
+	if err := tokens.PutUntil(expire, "OLDTOKEN", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.PutUntil(time.Now().Add(-time.Hour), "GONE", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := clients.Put("alice", []string{"OLDTOKEN", "GONE"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("OLDTOKEN"); err != store.ErrNotFound {
+		t.Errorf("Get() of a raw entry before migration expected ErrNotFound, got %v", err)
+	}
+
+	if n, err := migrateTokenKeys(clients, tokens); n != 1 || err != nil {
+		t.Fatalf("migrateTokenKeys() expected 1 entry moved, got %d (%v)", n, err)
+	}
+	if keys, _ := tokens.Keys(); !reflect.DeepEqual(keys, []string{tokenKey("OLDTOKEN")}) {
+		t.Errorf("migrateTokenKeys() expected only the hashed key left, got %v", keys)
+	}
+	if _, got, err := tokens.(store.Expirer).GetWithExpiry(context.Background(), tokenKey("OLDTOKEN")); !got.Equal(expire) || err != nil {
+		t.Errorf("migrateTokenKeys() expected the expiry kept, got %v (%v)", got, err)
+	}
+	if v, _ := clients.Get("alice"); !reflect.DeepEqual(v, []string{tokenKey("OLDTOKEN"), tokenKey("GONE")}) {
+		t.Errorf("migrateTokenKeys() expected the listed tokens hashed, got %v", v)
+	}
+	if n, err := migrateTokenKeys(clients, tokens); n != 0 || err != nil {
+		t.Errorf("migrateTokenKeys() twice expected nothing moved, got %d (%v)", n, err)
+	}
+
+	if u, err := c.Get("OLDTOKEN"); u != "alice" || err != nil {
+		t.Fatalf("Get() expected alice, got %v (%v)", u, err)
+	}
+	if _, err := c.Get(tokenKey("OLDTOKEN")); err != store.ErrNotFound {
+		t.Errorf("Get() of the stored key expected ErrNotFound, got %v", err)
+	}
+
+	if err := c.PutGrant(expire, "NEWTOKEN", &grant{Username: "alice", ClientID: "app"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := clients.Get("alice"); err != nil || len(v.([]string)) != 3 || v.([]string)[2] != tokenKey("NEWTOKEN") {
+		t.Errorf("PutGrant() expected the hashed token listed for alice, got %v (%v)", v, err)
+	}
+	if _, err := c.Get(tokenKey("NEWTOKEN")); err != store.ErrNotFound {
+		t.Errorf("Get() of a listed key expected ErrNotFound, got %v", err)
+	}
+
+	if err := c.Delete("OLDTOKEN"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("OLDTOKEN"); err != store.ErrNotFound {
+		t.Errorf("Get() after Delete() expected ErrNotFound, got %v", err)
+	}
+	if v, err := clients.Get("alice"); err != nil || len(v.([]string)) != 2 {
+		t.Errorf("Delete() expected two tokens left for alice, got %v (%v)", v, err)
+	}
+}
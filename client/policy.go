@@ -0,0 +1,109 @@
+package client // import "breve.us/authsvc/client"
+
+import (
+	"fmt"
+	"strings"
+
+	"breve.us/authsvc/user"
+)
+
+// Policy restricts the users who may use a client. A user matching any
+// deny rule is refused; otherwise, when allow rules are given, the user
+// must match them.
+type Policy struct {
+	Allow *Rules `json:"allow,omitempty"`
+	Deny  *Rules `json:"deny,omitempty"`
+}
+
+// Rules match users by username, group, email domain and state. Names,
+// groups and domains are compared without regard to case.
+type Rules struct {
+	Users        []string     `json:"users,omitempty"`
+	Groups       []string     `json:"groups,omitempty"`
+	EmailDomains []string     `json:"email_domains,omitempty"`
+	States       []user.State `json:"states,omitempty"`
+}
+
+// Denied returns why the policy refuses u, or "" if it lets u use the
+// client. A nil policy lets every user use the client.
+//
+// As allow rules, users, groups and email domains each name users who
+// are let in, while states further require the user to be in one of
+// them: users ["ann"] and groups ["ops"] let in ann and the members of
+// ops, and adding states ["active"] lets them in only while active.
+func (p *Policy) Denied(u *user.Details) string {
+	if p == nil {
+		return ""
+	}
+	if u == nil {
+		return "unknown user"
+	}
+	if r := p.Deny; r != nil {
+		if containsFold(r.Users, u.Username) {
+			return fmt.Sprintf("user %q is denied", u.Username)
+		}
+		if g := firstGroup(r.Groups, u.Groups); g != "" {
+			return fmt.Sprintf("group %q is denied", g)
+		}
+		if d := emailDomain(u.Email); d != "" && containsFold(r.EmailDomains, d) {
+			return fmt.Sprintf("email domain %q is denied", d)
+		}
+		if hasState(r.States, u.State) {
+			return fmt.Sprintf("state %q is denied", u.State)
+		}
+	}
+	if r := p.Allow; r != nil {
+		if len(r.States) > 0 && !hasState(r.States, u.State) {
+			return fmt.Sprintf("state %q is not allowed", u.State)
+		}
+		if len(r.Users) == 0 && len(r.Groups) == 0 && len(r.EmailDomains) == 0 {
+			return ""
+		}
+		if containsFold(r.Users, u.Username) || firstGroup(r.Groups, u.Groups) != "" {
+			return ""
+		}
+		if d := emailDomain(u.Email); d != "" && containsFold(r.EmailDomains, d) {
+			return ""
+		}
+		return fmt.Sprintf("user %q is not allowed", u.Username)
+	}
+	return ""
+}
+
+// containsFold reports whether list holds s, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstGroup returns the first of groups listed in rules, or "".
+func firstGroup(rules, groups []string) string {
+	for _, g := range groups {
+		if containsFold(rules, g) {
+			return g
+		}
+	}
+	return ""
+}
+
+func hasState(states []user.State, s user.State) bool {
+	for _, v := range states {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// emailDomain returns the domain of an email address, or "" if it has
+// none.
+func emailDomain(email string) string {
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		return email[i+1:]
+	}
+	return ""
+}
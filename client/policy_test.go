@@ -0,0 +1,51 @@
+package client // import "breve.us/authsvc/client"
+
+import (
+	"testing"
+
+	"breve.us/authsvc/user"
+)
+
+func TestPolicyDenied(t *testing.T) {
+	ann := &user.Details{Username: "ann", Email: "ann@Example.com", State: user.Active, Groups: []string{"Ops", "dev"}}
+	bob := &user.Details{Username: "bob", Email: "bob@other.org", State: user.Inactive}
+	for _, tc := range []struct {
+		name   string
+		policy *Policy
+		user   *user.Details
+		denied bool
+	}{
+		{"nil policy", nil, ann, false},
+		{"nil policy, nil user", nil, nil, false},
+		{"nil user", &Policy{}, nil, true},
+		{"empty policy", &Policy{}, bob, false},
+
+		{"allow user", &Policy{Allow: &Rules{Users: []string{"ann"}}}, ann, false},
+		{"allow user folded", &Policy{Allow: &Rules{Users: []string{"ANN"}}}, ann, false},
+		{"allow other user", &Policy{Allow: &Rules{Users: []string{"ann"}}}, bob, true},
+		{"allow group folded", &Policy{Allow: &Rules{Groups: []string{"ops"}}}, ann, false},
+		{"allow domain folded", &Policy{Allow: &Rules{EmailDomains: []string{"example.COM"}}}, ann, false},
+		{"allow domain other", &Policy{Allow: &Rules{EmailDomains: []string{"example.com"}}}, bob, true},
+		{"allow user or group", &Policy{Allow: &Rules{Users: []string{"bob"}, Groups: []string{"ops"}}}, ann, false},
+
+		{"allow state only", &Policy{Allow: &Rules{States: []user.State{user.Active}}}, ann, false},
+		{"allow state only, other", &Policy{Allow: &Rules{States: []user.State{user.Active}}}, bob, true},
+		{"allow state and user", &Policy{Allow: &Rules{Users: []string{"ann", "bob"}, States: []user.State{user.Active}}}, bob, true},
+		{"allow state and group", &Policy{Allow: &Rules{Groups: []string{"dev"}, States: []user.State{user.Active}}}, ann, false},
+		{"allow state, not group", &Policy{Allow: &Rules{Groups: []string{"hr"}, States: []user.State{user.Active}}}, ann, true},
+
+		{"deny user folded", &Policy{Deny: &Rules{Users: []string{"Ann"}}}, ann, true},
+		{"deny group", &Policy{Deny: &Rules{Groups: []string{"DEV"}}}, ann, true},
+		{"deny domain", &Policy{Deny: &Rules{EmailDomains: []string{"other.org"}}}, bob, true},
+		{"deny state", &Policy{Deny: &Rules{States: []user.State{user.Inactive}}}, bob, true},
+		{"deny other", &Policy{Deny: &Rules{Users: []string{"bob"}}}, ann, false},
+
+		{"deny beats allow user", &Policy{Allow: &Rules{Users: []string{"ann"}}, Deny: &Rules{Groups: []string{"ops"}}}, ann, true},
+		{"deny beats allow group", &Policy{Allow: &Rules{Groups: []string{"ops"}}, Deny: &Rules{Users: []string{"ann"}}}, ann, true},
+		{"deny beats allow state", &Policy{Allow: &Rules{States: []user.State{user.Active}}, Deny: &Rules{EmailDomains: []string{"example.com"}}}, ann, true},
+	} {
+		if reason := tc.policy.Denied(tc.user); (reason != "") != tc.denied {
+			t.Errorf("%s: Denied() expected denied %v, got %q", tc.name, tc.denied, reason)
+		}
+	}
+}
@@ -16,7 +16,9 @@ var (
 )
 
 func init() {
+	// gob still decodes records written before the versioned codecs.
 	gob.Register(&Details{})
+	store.RegisterType("client.Details", 1, &Details{}, store.JSONCodec)
 }
 
 // Details represents a registered client application
@@ -27,15 +29,26 @@ type Details struct {
 	Name string `json:"name"`
 	// Endpoints are the list of approved callback endpoints
 	Endpoints []string `json:"endpoints"`
+	// Access, if set, restricts the users who may use the client
+	Access *Policy `json:"access,omitempty"`
 }
 
 // Registry is the manager for all registered clients
 type Registry struct {
 	cache store.Cache
+	// memo holds decoded registrations until the cache reports that
+	// they changed.
+	memo *store.Memo
 }
 
 // NewRegistry returns an initialized ClientRegistry
-func NewRegistry(cache store.Cache) *Registry { return &Registry{cache: cache} }
+func NewRegistry(cache store.Cache) *Registry {
+	return &Registry{cache: cache, memo: store.NewMemo(cache)}
+}
+
+// Close stops the registry following changes to its cache. It does not
+// close the cache.
+func (c *Registry) Close() error { return c.memo.Close() }
 
 // VerifyClient returns true if the client is a registered client
 func (c *Registry) VerifyClient(client string) bool {
@@ -60,7 +73,7 @@ func (c *Registry) VerifyRedirect(client string, redirect string) bool {
 
 // Get returns a client registration by id, or an error if not found
 func (c *Registry) Get(id string) (*Details, error) {
-	v, err := c.cache.Get(id)
+	v, err := c.memo.Get(id)
 	if err != nil {
 		return nil, err
 	}
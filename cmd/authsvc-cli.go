@@ -17,6 +17,7 @@ func NewAPIApp(version string) *cli.App {
 		newUserCmd(),
 		newGenerateCmd(),
 		newBcryptCmd(),
+		newStoreCmd(),
 	}
 	return app
 }
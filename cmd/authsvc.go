@@ -1,10 +1,16 @@
 package cmd // import "breve.us/authsvc/cmd"
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"path"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -32,6 +38,18 @@ func NewAuthSvcApp(version string) *cli.App {
 		publicHomeFlag,
 		templateHomeFlag,
 		cacheDirFlag,
+		cacheKeysFlag,
+		sweepIntervalFlag,
+		storageFlag,
+		sqlDriverFlag,
+		sqlDSNFlag,
+		redisAddrFlag,
+		redisPassFlag,
+		redisDBFlag,
+		raftIDFlag,
+		raftPeersFlag,
+		raftBindFlag,
+		raftSecretFlag,
 		corsOriginsFlag,
 		hashFlag,
 		blockFlag,
@@ -40,10 +58,41 @@ func NewAuthSvcApp(version string) *cli.App {
 		loginPathFlag,
 		ldapHostFlag,
 		ldapPortFlag,
+		ldapServersFlag,
+		ldapBalanceFlag,
 		ldapTLSFlag,
+		ldapsFlag,
+		ldapCAFileFlag,
+		ldapCertFileFlag,
+		ldapKeyFileFlag,
+		ldapServerNameFlag,
+		ldapMinTLSFlag,
 		ldapAdminUserFlag,
 		ldapAdminPassFlag,
 		ldapBaseDNFlag,
+		ldapProfileFlag,
+		ldapObjectClassFlag,
+		ldapLoginAttributesFlag,
+		ldapFilterFlag,
+		ldapUsernameAttrFlag,
+		ldapEmailAttrFlag,
+		ldapNameAttrFlag,
+		ldapDisplayAttrFlag,
+		ldapPasswordAttrFlag,
+		ldapExtraAttributesFlag,
+		ldapGroupsFlag,
+		ldapGroupDepthFlag,
+		ldapGroupBaseDNFlag,
+		ldapGroupNameFlag,
+		ldapIDAttrFlag,
+		ldapLegacyIDsFlag,
+		ldapPoolSizeFlag,
+		ldapIdleTimeoutFlag,
+		ldapMaxLifetimeFlag,
+		ldapTimeoutFlag,
+		userCacheTTLFlag,
+		userCacheNegativeTTLFlag,
+		userCacheStaleTTLFlag,
 	}
 	return app
 }
@@ -53,28 +102,106 @@ func authSvc(ctx *cli.Context) error {
 	log.SetPrefix(logPrefixAuth)
 	log.SetFlags(log.LstdFlags | log.Llongfile)
 
-	ldapCfg := &store.LDAPConfig{
-		Host:     ctx.String(ldapHost),
-		Port:     ctx.Int(ldapPort),
-		UseTLS:   ctx.Bool(ldapTLS),
-		Username: ctx.String(ldapAdminUser),
-		Password: ctx.String(ldapAdminPass),
-		BaseDN:   ctx.String(ldapBaseDN),
+	ldapCfg, err := ldapConfig(ctx)
+	if err != nil {
+		return err
 	}
+	mapping, err := ldapMapping(ctx)
+	if err != nil {
+		return err
+	}
+	// The table records IDs once the storage back-end is opened.
+	mapping.IDs = user.NewIDTable(nil, ctx.BoolT(ldapLegacyIDs))
+	ldapCfg.Pool = store.NewLDAPPool(ldapCfg, store.LDAPPoolOptions{
+		MaxOpen:     ctx.Int(ldapPoolSize),
+		IdleTimeout: ctx.Duration(ldapIdleTimeout),
+		MaxLifetime: ctx.Duration(ldapMaxLifetime),
+		Timeout:     ctx.Duration(ldapTimeout),
+	})
+	defer func() { _ = ldapCfg.Pool.Close() }()
 
-	pchecker := common.PasswordCheckers(user.NewLDAPChecker(ldapCfg))
+	pchecker := common.PasswordCheckers(user.NewLDAPChecker(ldapCfg, mapping))
+	pchanger := common.PasswordChangers(user.NewLDAPPasswordChanger(ldapCfg, mapping))
 
-	userRegistry := user.NewRegistry(user.NewLDAPCache(ldapCfg))
+	users := user.NewLDAPCache(ldapCfg, mapping)
+	if ttl := ctx.Duration(userCacheTTL); ttl > 0 {
+		users = store.NewTieredCache(users, store.TieredOptions{
+			TTL:         ttl,
+			NegativeTTL: ctx.Duration(userCacheNegativeTTL),
+			StaleTTL:    ctx.Duration(userCacheStaleTTL),
+			MaxEntries:  10000,
+		})
+	}
+	defer func() { _ = users.Close() }()
+	userRegistry := user.NewRegistry(users)
+	defer func() { _ = userRegistry.Close() }()
 
 	provider, err := common.NewKeyProvider(ctx.String(crypthash), ctx.String(cryptblock))
 	if err != nil {
 		return err
 	}
 
-	oauthHandler, err := authorization.NewHandler(&authorization.Options{CacheDir: ctx.String(cacheDir), Users: userRegistry})
+	var keys store.KeySource
+	if spec := ctx.String(cacheKeys); spec != "" {
+		if keys, err = store.ParseKeyring(spec); err != nil {
+			return err
+		}
+	}
+
+	var raft *store.RaftConfig
+	if ctx.String(storage) == authorization.StorageRaft {
+		if raft, err = raftConfig(ctx); err != nil {
+			return err
+		}
+	}
+
+	oauthHandler, err := authorization.NewHandler(&authorization.Options{
+		CacheDir:  ctx.String(cacheDir),
+		Storage:   ctx.String(storage),
+		SQLDriver: ctx.String(sqlDriver),
+		SQLDSN:    ctx.String(sqlDSN),
+		Redis: &store.RedisConfig{
+			Addr:     ctx.String(redisAddr),
+			Password: ctx.String(redisPass),
+			DB:       ctx.Int(redisDB),
+		},
+		Raft:          raft,
+		CacheKeys:     keys,
+		Users:         userRegistry,
+		UserIDs:       mapping.IDs,
+		SweepInterval: ctx.Duration(sweepInterval),
+		SweepReport:   logSweep,
+	})
 	if err != nil {
+		if raft != nil {
+			// A node that started closed its listener on failing;
+			// otherwise no node owns it yet.
+			_ = raft.Listener.Close()
+		}
 		return err
 	}
+	defer func() { _ = oauthHandler.Close() }()
+
+	if dir := ctx.String(cacheDir); isDir(dir) {
+		snapshots, err := serveSnapshots(dir)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = snapshots.Close() }()
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if ctx.Bool(debug) {
+		go logLDAPPool(runCtx, ldapCfg.Pool, time.Minute)
+	}
+
+	janitorDone := make(chan struct{})
+	go func() {
+		defer close(janitorDone)
+		oauthHandler.RunJanitor(runCtx)
+	}()
 
 	authenticationMiddleware := authentication.NewMiddleware(&authentication.Options{
 		Realm:       realm,
@@ -119,6 +246,9 @@ func authSvc(ctx *cli.Context) error {
 	}
 	r := mux.NewRouter()
 
+	passwordHandler := authentication.PasswordHandler(authRoot, staticHandler, pchecker, pchanger, userRegistry)
+	r.Path(authRoot + "password").Handler(n.With(authenticationMiddleware, negroni.Wrap(passwordHandler)))
+
 	loginHandler := authentication.LoginHandler(authRoot, pchecker, provider, ctx.Bool(insecure))
 	r.PathPrefix(authRoot).Handler(n.With(negroni.Wrap(loginHandler)))
 
@@ -130,7 +260,7 @@ func authSvc(ctx *cli.Context) error {
 
 	r.NewRoute().Handler(n.With(negroni.Wrap(staticHandler)))
 
-	for _, rr := range []*mux.Router{r, loginHandler, oauthAPIHandler, userAPIHandler} {
+	for _, rr := range []*mux.Router{r, passwordHandler, loginHandler, oauthAPIHandler, userAPIHandler} {
 		if err = rr.Walk(fallbackOn(staticHandler)); err != nil {
 			return err
 		}
@@ -146,7 +276,89 @@ func authSvc(ctx *cli.Context) error {
 
 	log.Printf("%v version %v", ctx.App.Name, ctx.App.Version)
 	log.Printf("listening on %s\nstatic content from %q", s.Addr, staticAssets)
-	return s.ListenAndServe()
+
+	go shutdownOnSignal(runCtx, s)
+	if err = s.ListenAndServe(); err == http.ErrServerClosed {
+		err = nil
+	}
+	cancel()
+	<-janitorDone
+	return err
+}
+
+func shutdownOnSignal(ctx context.Context, s *http.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-sig:
+	}
+	log.Printf("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		log.Printf("error shutting down: %v", err)
+	}
+}
+
+func logSweep(name string, evicted int, err error) {
+	switch {
+	case err != nil:
+		log.Printf("error sweeping %s cache: %v", name, err)
+	case evicted > 0:
+		log.Printf("swept %d expired entries from %s cache", evicted, name)
+	}
+}
+
+// logLDAPPool logs the LDAP pool's counts every interval until ctx is
+// done.
+func logLDAPPool(ctx context.Context, pool *store.LDAPPool, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s := pool.Stats()
+			log.Printf("ldap pool: %d open, %d in use, %d idle, %d servers unhealthy; %d dials (%d failed), %d reused, %d waits (%d timed out), %d probe failures, %d expired, %d discarded, %d failovers",
+				s.Open, s.InUse, s.Idle, s.Unhealthy, s.Dials, s.DialErrors, s.Reused, s.Waits, s.Timeouts, s.ProbeFailures, s.Expired, s.Discarded, s.Failovers)
+		}
+	}
+}
+
+// raftConfig configures this process as a node of a raft cluster, and
+// listens for its peers.
+func raftConfig(ctx *cli.Context) (*store.RaftConfig, error) {
+	peers, err := store.ParseRaftPeers(ctx.String(raftPeers))
+	if err != nil {
+		return nil, err
+	}
+	id := ctx.String(raftID)
+	self, ok := peers[id]
+	if !ok {
+		return nil, store.ErrRaftConfig
+	}
+	secret := ctx.String(raftSecret)
+	if secret == "" {
+		return nil, store.ErrRaftSecret
+	}
+	bind := ctx.String(raftBind)
+	if bind == "" {
+		u, err := url.Parse(self)
+		if err != nil {
+			return nil, err
+		}
+		bind = u.Host
+	}
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+	return &store.RaftConfig{ID: id, Peers: peers, Secret: secret, Listener: ln}, nil
 }
 
 func fallbackOn(h http.Handler) func(*mux.Route, *mux.Router, []*mux.Route) error {
@@ -1,31 +1,81 @@
 package cmd // import "breve.us/authsvc/cmd"
 
-import "github.com/urfave/cli"
+import (
+	"time"
+
+	"github.com/urfave/cli"
+)
 
 const (
 	realm = "breve.us/authsvc"
 
 	logPrefixAuth = "[authsrv] "
 
-	listenPort   = "port"
-	listenIP     = "bind"
-	debug        = "debug"
-	corsOrigins  = "origins"
-	insecure     = "insecure"
-	publicHome   = "public"
-	templateHome = "templates"
-	crypthash    = "hash"
-	cryptblock   = "block"
-	cacheDir     = "cache"
-	loginPath    = "login"
+	listenPort    = "port"
+	listenIP      = "bind"
+	debug         = "debug"
+	corsOrigins   = "origins"
+	insecure      = "insecure"
+	publicHome    = "public"
+	templateHome  = "templates"
+	crypthash     = "hash"
+	cryptblock    = "block"
+	cacheDir      = "cache"
+	cacheKeys     = "cacheKeys"
+	sweepInterval = "sweep"
+	storage       = "storage"
+	sqlDriver     = "sqlDriver"
+	sqlDSN        = "sqlDSN"
+	redisAddr     = "redisAddr"
+	redisPass     = "redisPass"
+	redisDB       = "redisDB"
+	raftID        = "raftID"
+	raftPeers     = "raftPeers"
+	raftBind      = "raftBind"
+	raftSecret    = "raftSecret"
+	loginPath     = "login"
 
 	ldapHost      = "ldapHost"
 	ldapPort      = "ldapPort"
+	ldapServers   = "ldapServers"
+	ldapBalance   = "ldapBalance"
 	ldapTLS       = "ldapTLS"
+	ldaps         = "ldaps"
+	ldapCAFile    = "ldapCAFile"
+	ldapCertFile  = "ldapCertFile"
+	ldapKeyFile   = "ldapKeyFile"
+	ldapServer    = "ldapServerName"
+	ldapMinTLS    = "ldapMinTLS"
 	ldapAdminUser = "ldapAdminUser"
 	ldapAdminPass = "ldapAdminPass"
 	ldapBaseDN    = "ldapBaseDN"
 
+	ldapProfile         = "ldapProfile"
+	ldapObjectClass     = "ldapObjectClass"
+	ldapLoginAttributes = "ldapLoginAttributes"
+	ldapFilter          = "ldapFilter"
+	ldapUsernameAttr    = "ldapUsernameAttribute"
+	ldapEmailAttr       = "ldapEmailAttribute"
+	ldapNameAttr        = "ldapNameAttribute"
+	ldapDisplayAttr     = "ldapDisplayAttribute"
+	ldapPasswordAttr    = "ldapPasswordAttribute"
+	ldapExtraAttributes = "ldapExtraAttributes"
+	ldapGroups          = "ldapGroups"
+	ldapGroupDepth      = "ldapGroupDepth"
+	ldapGroupBaseDN     = "ldapGroupBaseDN"
+	ldapGroupName       = "ldapGroupNameAttribute"
+	ldapIDAttr          = "ldapIDAttribute"
+	ldapLegacyIDs       = "ldapLegacyIDs"
+
+	ldapPoolSize    = "ldapPoolSize"
+	ldapIdleTimeout = "ldapIdleTimeout"
+	ldapMaxLifetime = "ldapMaxLifetime"
+	ldapTimeout     = "ldapTimeout"
+
+	userCacheTTL         = "userCacheTTL"
+	userCacheNegativeTTL = "userCacheNegativeTTL"
+	userCacheStaleTTL    = "userCacheStaleTTL"
+
 	authRoot  = "/auth/"
 	oauthRoot = "/oauth/"
 )
@@ -86,6 +136,69 @@ var (
 		Usage:  "optional directory for persistent caches (if this is empty, or not a valid directory, in-memory caches will be used)",
 		EnvVar: "CACHE_DIR",
 	}
+	cacheKeysFlag = cli.StringFlag{
+		Name:   cacheKeys,
+		Usage:  "comma separated id=base64key list of keys for encrypting cached values at rest; the first key encrypts new values, the rest only decrypt (empty disables encryption; run \"store reencrypt\" on existing cache files before enabling it)",
+		EnvVar: "CACHE_KEYS",
+	}
+	sweepIntervalFlag = cli.DurationFlag{
+		Name:   sweepInterval,
+		Usage:  "how often to evict expired authorization codes and tokens from the caches (negative disables)",
+		EnvVar: "SWEEP_INTERVAL",
+		Value:  10 * time.Minute,
+	}
+	storageFlag = cli.StringFlag{
+		Name:   storage,
+		Usage:  "storage back-end for transient, clients and tokens caches: memory, boltdb, sql, redis or raft (default boltdb if the cache directory is valid, otherwise memory)",
+		EnvVar: "STORAGE",
+	}
+	sqlDriverFlag = cli.StringFlag{
+		Name:   sqlDriver,
+		Usage:  "database/sql driver for sql storage (sqlite3 or postgres)",
+		EnvVar: "SQL_DRIVER",
+		Value:  "sqlite3",
+	}
+	sqlDSNFlag = cli.StringFlag{
+		Name:   sqlDSN,
+		Usage:  "data source name for sql storage (defaults to authsvc.db in the cache directory for sqlite3)",
+		EnvVar: "SQL_DSN",
+	}
+	redisAddrFlag = cli.StringFlag{
+		Name:   redisAddr,
+		Usage:  "host:port of the redis server for redis storage",
+		EnvVar: "REDIS_ADDR",
+		Value:  "localhost:6379",
+	}
+	redisPassFlag = cli.StringFlag{
+		Name:   redisPass,
+		Usage:  "redis password",
+		EnvVar: "REDIS_PASS",
+	}
+	redisDBFlag = cli.IntFlag{
+		Name:   redisDB,
+		Usage:  "redis database number",
+		EnvVar: "REDIS_DB",
+	}
+	raftIDFlag = cli.StringFlag{
+		Name:   raftID,
+		Usage:  "ID of this node in the raft peer list, for raft storage",
+		EnvVar: "RAFT_ID",
+	}
+	raftPeersFlag = cli.StringFlag{
+		Name:   raftPeers,
+		Usage:  "comma separated id=URL list of every raft node, this one included, e.g. a=http://10.0.0.1:42002,b=http://10.0.0.2:42002",
+		EnvVar: "RAFT_PEERS",
+	}
+	raftBindFlag = cli.StringFlag{
+		Name:   raftBind,
+		Usage:  "address to serve raft replication on (defaults to the host and port of this node's URL)",
+		EnvVar: "RAFT_BIND",
+	}
+	raftSecretFlag = cli.StringFlag{
+		Name:   raftSecret,
+		Usage:  "shared secret raft nodes present to each other (required for raft storage)",
+		EnvVar: "RAFT_SECRET",
+	}
 	loginPathFlag = cli.StringFlag{
 		Name:   loginPath,
 		Usage:  "URL to login page for this application",
@@ -105,11 +218,53 @@ var (
 		EnvVar: "LDAP_PORT",
 		Value:  389,
 	}
+	ldapServersFlag = cli.StringFlag{
+		Name:   ldapServers,
+		Usage:  "comma separated ldap host[:port] list used instead of the ldap hostname and port, each holding the same directory",
+		EnvVar: "LDAP_SERVERS",
+	}
+	ldapBalanceFlag = cli.StringFlag{
+		Name:   ldapBalance,
+		Usage:  "how connections are spread over the ldap servers: ordered (fail over in the order listed) or round-robin",
+		EnvVar: "LDAP_BALANCE",
+		Value:  "ordered",
+	}
 	ldapTLSFlag = cli.BoolFlag{
 		Name:   ldapTLS,
-		Usage:  "whether to use TLS with ldap",
+		Usage:  "whether to use StartTLS with ldap",
 		EnvVar: "LDAP_TLS",
 	}
+	ldapsFlag = cli.BoolFlag{
+		Name:   ldaps,
+		Usage:  "whether to connect to ldap over TLS (LDAPS; the port defaults to 636)",
+		EnvVar: "LDAPS",
+	}
+	ldapCAFileFlag = cli.StringFlag{
+		Name:   ldapCAFile,
+		Usage:  "PEM file of the CAs trusted to sign the ldap server's certificate (defaults to the system roots)",
+		EnvVar: "LDAP_CA_FILE",
+	}
+	ldapCertFileFlag = cli.StringFlag{
+		Name:   ldapCertFile,
+		Usage:  "PEM client certificate for ldap servers requiring mutual TLS",
+		EnvVar: "LDAP_CERT_FILE",
+	}
+	ldapKeyFileFlag = cli.StringFlag{
+		Name:   ldapKeyFile,
+		Usage:  "PEM key of the ldap client certificate",
+		EnvVar: "LDAP_KEY_FILE",
+	}
+	ldapServerNameFlag = cli.StringFlag{
+		Name:   ldapServer,
+		Usage:  "name to verify the ldap server's certificate against (defaults to the ldap hostname)",
+		EnvVar: "LDAP_SERVER_NAME",
+	}
+	ldapMinTLSFlag = cli.StringFlag{
+		Name:   ldapMinTLS,
+		Usage:  "lowest TLS version accepted from the ldap server: 1.0, 1.1, 1.2 or 1.3",
+		EnvVar: "LDAP_MIN_TLS",
+		Value:  "1.2",
+	}
 	ldapAdminUserFlag = cli.StringFlag{
 		Name:   ldapAdminUser,
 		Usage:  "ldap admin username",
@@ -125,4 +280,132 @@ var (
 		Usage:  "base DN for LDAP searches",
 		EnvVar: "LDAP_BASE_DN",
 	}
+
+	ldapProfileFlag = cli.StringFlag{
+		Name:   ldapProfile,
+		Usage:  "ldap schema the attribute mapping defaults to: standard (inetOrgPerson) or ad (Active Directory)",
+		EnvVar: "LDAP_PROFILE",
+		Value:  "standard",
+	}
+	ldapObjectClassFlag = cli.StringFlag{
+		Name:   ldapObjectClass,
+		Usage:  "object class of the ldap entries that are users (defaults to the profile's: inetOrgPerson for standard)",
+		EnvVar: "LDAP_OBJECT_CLASS",
+	}
+	ldapLoginAttributesFlag = cli.StringFlag{
+		Name:   ldapLoginAttributes,
+		Usage:  "comma separated ldap attributes a login name is looked up by, in turn (defaults to the profile's: uid,mail for standard)",
+		EnvVar: "LDAP_LOGIN_ATTRIBUTES",
+	}
+	ldapFilterFlag = cli.StringFlag{
+		Name:   ldapFilter,
+		Usage:  "ldap search filter for a login, with {attr} replaced by the login attribute and {value} by the login name (defaults to the profile's: ({attr}={value}) for standard)",
+		EnvVar: "LDAP_FILTER",
+	}
+	ldapUsernameAttrFlag = cli.StringFlag{
+		Name:   ldapUsernameAttr,
+		Usage:  "ldap attribute of the username (defaults to the profile's: the login attribute that matched for standard)",
+		EnvVar: "LDAP_USERNAME_ATTRIBUTE",
+	}
+	ldapEmailAttrFlag = cli.StringFlag{
+		Name:   ldapEmailAttr,
+		Usage:  "ldap attribute of the email address (defaults to the profile's: mail for standard)",
+		EnvVar: "LDAP_EMAIL_ATTRIBUTE",
+	}
+	ldapNameAttrFlag = cli.StringFlag{
+		Name:   ldapNameAttr,
+		Usage:  "ldap attribute of the full name (defaults to the profile's: cn for standard)",
+		EnvVar: "LDAP_NAME_ATTRIBUTE",
+	}
+	ldapDisplayAttrFlag = cli.StringFlag{
+		Name:   ldapDisplayAttr,
+		Usage:  "ldap attribute of the name shown in place of the full name, when set (defaults to the profile's: displayName for standard)",
+		EnvVar: "LDAP_DISPLAY_ATTRIBUTE",
+	}
+	ldapPasswordAttrFlag = cli.StringFlag{
+		Name:   ldapPasswordAttr,
+		Usage:  "ldap attribute of the password (defaults to the profile's: userPassword for standard)",
+		EnvVar: "LDAP_PASSWORD_ATTRIBUTE",
+	}
+	ldapExtraAttributesFlag = cli.StringFlag{
+		Name:   ldapExtraAttributes,
+		Usage:  "comma separated further ldap attributes carried through with users",
+		EnvVar: "LDAP_EXTRA_ATTRIBUTES",
+	}
+
+	ldapGroupsFlag = cli.StringFlag{
+		Name:   ldapGroups,
+		Usage:  "where ldap group membership is read from: memberOf, groupOfNames, posixGroup or inChain (Active Directory); empty for none (defaults to the profile's: none for standard)",
+		EnvVar: "LDAP_GROUPS",
+	}
+	ldapGroupDepthFlag = cli.IntFlag{
+		Name:   ldapGroupDepth,
+		Usage:  "levels of nested ldap groups followed; 0 for the groups users belong to directly",
+		EnvVar: "LDAP_GROUP_DEPTH",
+		Value:  3,
+	}
+	ldapGroupBaseDNFlag = cli.StringFlag{
+		Name:   ldapGroupBaseDN,
+		Usage:  "base DN for ldap group searches (defaults to the base DN)",
+		EnvVar: "LDAP_GROUP_BASE_DN",
+	}
+	ldapGroupNameFlag = cli.StringFlag{
+		Name:   ldapGroupName,
+		Usage:  "ldap attribute naming a group; empty for its DN (defaults to the profile's: cn for standard)",
+		EnvVar: "LDAP_GROUP_NAME_ATTRIBUTE",
+	}
+	ldapIDAttrFlag = cli.StringFlag{
+		Name:   ldapIDAttr,
+		Usage:  "ldap attribute holding the stable identifier user IDs are derived from, such as entryUUID, objectGUID or nsUniqueId; empty for the DN (defaults to the profile's: entryUUID for standard)",
+		EnvVar: "LDAP_ID_ATTRIBUTE",
+	}
+	ldapLegacyIDsFlag = cli.BoolTFlag{
+		Name:   ldapLegacyIDs,
+		Usage:  "issue users first seen the ID derived from their DN, as before stable identifiers, so that existing accounts keep their IDs",
+		EnvVar: "LDAP_LEGACY_IDS",
+	}
+
+	ldapPoolSizeFlag = cli.IntFlag{
+		Name:   ldapPoolSize,
+		Usage:  "most ldap connections open at once",
+		EnvVar: "LDAP_POOL_SIZE",
+		Value:  10,
+	}
+	ldapIdleTimeoutFlag = cli.DurationFlag{
+		Name:   ldapIdleTimeout,
+		Usage:  "how long an unused ldap connection is kept open",
+		EnvVar: "LDAP_IDLE_TIMEOUT",
+		Value:  5 * time.Minute,
+	}
+	ldapMaxLifetimeFlag = cli.DurationFlag{
+		Name:   ldapMaxLifetime,
+		Usage:  "how long an ldap connection is used before it is replaced",
+		EnvVar: "LDAP_MAX_LIFETIME",
+		Value:  30 * time.Minute,
+	}
+	ldapTimeoutFlag = cli.DurationFlag{
+		Name:   ldapTimeout,
+		Usage:  "limit on connecting to ldap, waiting for a pooled connection, and each ldap operation",
+		EnvVar: "LDAP_TIMEOUT",
+		Value:  10 * time.Second,
+	}
+
+	userCacheTTLFlag = cli.DurationFlag{
+		Name:   userCacheTTL,
+		Usage:  "how long LDAP user lookups are cached (zero disables caching)",
+		EnvVar: "USER_CACHE_TTL",
+		Value:  time.Minute,
+	}
+	userCacheNegativeTTLFlag = cli.DurationFlag{
+		Name:   userCacheNegativeTTL,
+		Usage:  "how long unknown LDAP users are remembered as missing",
+		EnvVar: "USER_CACHE_NEGATIVE_TTL",
+		Value:  30 * time.Second,
+	}
+	userCacheStaleTTLFlag = cli.DurationFlag{
+		Name:   userCacheStaleTTL,
+		Usage:  "how long past its TTL a cached LDAP user may be served while it is refreshed",
+		EnvVar: "USER_CACHE_STALE_TTL",
+		Value:  5 * time.Minute,
+	}
 )
@@ -0,0 +1,144 @@
+package cmd // import "breve.us/authsvc/cmd"
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"breve.us/authsvc/store"
+	"breve.us/authsvc/user"
+)
+
+// ldapFlags are the flags of every command that talks to LDAP.
+var ldapFlags = []cli.Flag{
+	ldapHostFlag,
+	ldapPortFlag,
+	ldapServersFlag,
+	ldapBalanceFlag,
+	ldapTLSFlag,
+	ldapsFlag,
+	ldapCAFileFlag,
+	ldapCertFileFlag,
+	ldapKeyFileFlag,
+	ldapServerNameFlag,
+	ldapMinTLSFlag,
+	ldapBaseDNFlag,
+	ldapAdminUserFlag,
+	ldapAdminPassFlag,
+	ldapProfileFlag,
+	ldapObjectClassFlag,
+	ldapLoginAttributesFlag,
+	ldapFilterFlag,
+	ldapUsernameAttrFlag,
+	ldapEmailAttrFlag,
+	ldapNameAttrFlag,
+	ldapDisplayAttrFlag,
+	ldapPasswordAttrFlag,
+	ldapExtraAttributesFlag,
+	ldapGroupsFlag,
+	ldapGroupDepthFlag,
+	ldapGroupBaseDNFlag,
+	ldapGroupNameFlag,
+	ldapIDAttrFlag,
+}
+
+// ldapConfig returns the LDAP connection described by ldapFlags.
+func ldapConfig(ctx *cli.Context) (*store.LDAPConfig, error) {
+	minTLS, err := store.ParseTLSVersion(ctx.String(ldapMinTLS))
+	if err != nil {
+		return nil, err
+	}
+	cfg := &store.LDAPConfig{
+		Host:          ctx.String(ldapHost),
+		Port:          ctx.Int(ldapPort),
+		UseTLS:        ctx.Bool(ldapTLS),
+		LDAPS:         ctx.Bool(ldaps),
+		Username:      ctx.String(ldapAdminUser),
+		Password:      ctx.String(ldapAdminPass),
+		BaseDN:        ctx.String(ldapBaseDN),
+		CAFile:        ctx.String(ldapCAFile),
+		CertFile:      ctx.String(ldapCertFile),
+		KeyFile:       ctx.String(ldapKeyFile),
+		ServerName:    ctx.String(ldapServer),
+		MinTLSVersion: minTLS,
+		Balance:       ctx.String(ldapBalance),
+	}
+	if cfg.LDAPS && !ctx.IsSet(ldapPort) {
+		cfg.Port = 636
+	}
+	switch cfg.Balance {
+	case store.LDAPOrdered, store.LDAPRoundRobin:
+	default:
+		return nil, fmt.Errorf("unknown ldap balance %q", cfg.Balance)
+	}
+	for _, server := range splitList(ctx.String(ldapServers)) {
+		// Servers without a port use the ldap port.
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, strconv.Itoa(cfg.Port))
+		}
+		cfg.Servers = append(cfg.Servers, server)
+	}
+	// Fail now, rather than on the first connection.
+	if cfg.LDAPS || cfg.UseTLS {
+		if _, err = cfg.TLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// ldapMapping returns the attribute mapping described by ldapFlags: that
+// of the profile, with the attributes given explicitly replacing its own.
+func ldapMapping(ctx *cli.Context) (*user.LDAPMapping, error) {
+	var m user.LDAPMapping
+	switch profile := ctx.String(ldapProfile); profile {
+	case "standard":
+		m = user.DefaultLDAPMapping
+	case "ad":
+		m = user.ActiveDirectoryMapping
+	default:
+		return nil, fmt.Errorf("unknown ldap profile %q", profile)
+	}
+	for name, field := range map[string]*string{
+		ldapObjectClass:  &m.ObjectClass,
+		ldapFilter:       &m.Filter,
+		ldapUsernameAttr: &m.Username,
+		ldapEmailAttr:    &m.Email,
+		ldapNameAttr:     &m.Name,
+		ldapDisplayAttr:  &m.Display,
+		ldapPasswordAttr: &m.Password,
+		ldapIDAttr:       &m.ID,
+		ldapGroups:       &m.Groups,
+		ldapGroupBaseDN:  &m.GroupBaseDN,
+		ldapGroupName:    &m.GroupName,
+	} {
+		if ctx.IsSet(name) {
+			*field = ctx.String(name)
+		}
+	}
+	if ctx.IsSet(ldapLoginAttributes) {
+		m.LoginAttributes = splitList(ctx.String(ldapLoginAttributes))
+	}
+	if ctx.IsSet(ldapExtraAttributes) {
+		m.Extra = splitList(ctx.String(ldapExtraAttributes))
+	}
+	m.GroupDepth = ctx.Int(ldapGroupDepth)
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// splitList returns the non-empty items of a comma separated list.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,64 @@
+package cmd // import "breve.us/authsvc/cmd"
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/urfave/cli"
+
+	"breve.us/authsvc/user"
+)
+
+// mappingFor returns the mapping ldapFlags describe when given args.
+func mappingFor(t *testing.T, args ...string) (*user.LDAPMapping, error) {
+	var (
+		m   *user.LDAPMapping
+		err error
+	)
+	app := cli.NewApp()
+	app.Writer, app.ErrWriter = ioutil.Discard, ioutil.Discard
+	app.Flags = ldapFlags
+	app.Action = func(ctx *cli.Context) error {
+		m, err = ldapMapping(ctx)
+		return nil
+	}
+	if runErr := app.Run(append([]string{"authsvc"}, args...)); runErr != nil {
+		t.Fatal(runErr)
+	}
+	return m, err
+}
+
+func TestLDAPMappingFlags(t *testing.T) {
+	m, err := mappingFor(t)
+	if err != nil || m.ObjectClass != "inetOrgPerson" || m.GroupDepth != 3 {
+		t.Errorf("ldapMapping() expected the standard profile, got %+v (%v)", m, err)
+	}
+
+	// Attributes given explicitly replace the profile's, and the rest
+	// are kept.
+	m, err = mappingFor(t, "--ldapProfile", "ad", "--ldapLoginAttributes", "sAMAccountName, mail,", "--ldapExtraAttributes", "department", "--ldapEmailAttribute", "proxyAddresses", "--ldapGroupDepth", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := user.ActiveDirectoryMapping
+	want.LoginAttributes = []string{"sAMAccountName", "mail"}
+	want.Extra = []string{"department"}
+	want.Email = "proxyAddresses"
+	want.GroupDepth = 0
+	if !reflect.DeepEqual(m, &want) {
+		t.Errorf("ldapMapping() expected %+v, got %+v", want, m)
+	}
+
+	for _, args := range [][]string{
+		{"--ldapProfile", "novell"},
+		{"--ldapFilter", "(uid={attr})"},
+		{"--ldapLoginAttributes", "uid,(mail)"},
+		{"--ldapUsernameAttribute", "user name"},
+		{"--ldapGroups", "roles"},
+	} {
+		if m, err = mappingFor(t, args...); err == nil {
+			t.Errorf("ldapMapping(%v) expected an error, got %+v", args, m)
+		}
+	}
+}
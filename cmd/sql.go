@@ -0,0 +1,8 @@
+package cmd // import "breve.us/authsvc/cmd"
+
+// The database/sql drivers for sql storage. SQLite needs cgo; a build
+// made with CGO_ENABLED=0 links a stub that fails to open databases.
+import (
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
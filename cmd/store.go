@@ -0,0 +1,402 @@
+package cmd // import "breve.us/authsvc/cmd"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"breve.us/authsvc/authorization"
+	"breve.us/authsvc/store"
+)
+
+func newStoreCmd() cli.Command {
+	return cli.Command{
+		Name: "store",
+		Subcommands: cli.Commands{
+			newReencryptCmd(),
+			newBackupCmd(),
+			newRestoreCmd(),
+			newVerifyCmd(),
+			newMigrateCmd(),
+		},
+	}
+}
+
+func newReencryptCmd() cli.Command {
+	return cli.Command{
+		Name:      "reencrypt",
+		Usage:     "re-encrypt the values of stopped BoltDB cache files under the first key of --cacheKeys",
+		ArgsUsage: "FILE...",
+		Action:    reencrypt,
+		Flags: []cli.Flag{
+			cacheKeysFlag,
+		},
+	}
+}
+
+func reencrypt(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return errors.New("provide at least one BoltDB file to re-encrypt")
+	}
+	keys, err := store.ParseKeyring(ctx.String(cacheKeys))
+	if err != nil {
+		return err
+	}
+	for _, file := range ctx.Args() {
+		if _, err = os.Stat(file); err != nil {
+			return err
+		}
+		n, err := store.ReencryptBoltDB(file, keys)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		if _, err = fmt.Fprintf(ctx.App.Writer, "%s: re-encrypted %d values\n", file, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotSocket is the name of the unix socket in the cache directory
+// on which a running authsvc serves snapshots of its files.
+const snapshotSocket = "snapshot.sock"
+
+// backupFiles are the files in the cache directory that backups hold.
+// raft.db is not one: restoring a node's log would roll back the votes
+// it has cast, and a node without one is sent the caches by the leader.
+var backupFiles = []string{"transient.db", "tokens.db", "clients.json"}
+
+// serveSnapshots serves snapshots of the backup files in dir on its
+// snapshot socket, until the returned listener is closed.
+func serveSnapshots(dir string) (io.Closer, error) {
+	sock := filepath.Join(dir, snapshotSocket)
+	// A socket left by a previous run that did not exit cleanly
+	// would make Listen fail.
+	_ = os.Remove(sock)
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(sock, 0600); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	go func() { _ = http.Serve(ln, store.NewSnapshotHandler(dir, backupFiles...)) }()
+	return ln, nil
+}
+
+func isDir(dir string) bool {
+	s, err := os.Stat(dir)
+	return err == nil && s.IsDir()
+}
+
+// snapshotClient returns a client for the snapshot socket in dir, or
+// nil if no running authsvc answers on it.
+func snapshotClient(dir string) *http.Client {
+	sock := filepath.Join(dir, snapshotSocket)
+	cn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil
+	}
+	_ = cn.Close()
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}}
+}
+
+func newBackupCmd() cli.Command {
+	return cli.Command{
+		Name:      "backup",
+		Usage:     "write a consistent backup of the --cache directory to ARCHIVE (- for standard output), through a running authsvc if there is one",
+		ArgsUsage: "ARCHIVE",
+		Action:    backup,
+		Flags: []cli.Flag{
+			cacheDirFlag,
+		},
+	}
+}
+
+func backup(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("provide the archive to write")
+	}
+	dir := ctx.String(cacheDir)
+	if !isDir(dir) {
+		return fmt.Errorf("%q is not a cache directory", dir)
+	}
+	b, err := store.NewBackup()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = b.Close() }()
+
+	client := snapshotClient(dir)
+	for _, name := range backupFiles {
+		var f store.BackupFile
+		if client != nil {
+			f, err = addRemote(b, client, name)
+		} else {
+			f, err = addLocal(b, filepath.Join(dir, name), name)
+		}
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if _, err = fmt.Fprintf(ctx.App.ErrWriter, "%s: %d bytes, sha256 %s\n", f.Name, f.Size, f.SHA256); err != nil {
+			return err
+		}
+	}
+	return writeArchive(ctx.Args().First(), ctx.App.Writer, b)
+}
+
+func addRemote(b *store.Backup, client *http.Client, name string) (store.BackupFile, error) {
+	resp, err := client.Get("http://authsvc/" + name)
+	if err != nil {
+		return store.BackupFile{}, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return store.BackupFile{}, os.ErrNotExist
+	default:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return store.BackupFile{}, fmt.Errorf("snapshot failed: %s", strings.TrimSpace(string(msg)))
+	}
+	return b.Add(name, resp.Body)
+}
+
+func addLocal(b *store.Backup, file, name string) (store.BackupFile, error) {
+	if !strings.HasSuffix(name, ".db") {
+		fd, err := os.Open(file)
+		if err != nil {
+			return store.BackupFile{}, err
+		}
+		defer func() { _ = fd.Close() }()
+		return b.Add(name, fd)
+	}
+	if _, err := os.Stat(file); err != nil {
+		return store.BackupFile{}, err
+	}
+	r, w := io.Pipe()
+	go func() {
+		_, err := store.SnapshotBoltDB(file, w)
+		_ = w.CloseWithError(err)
+	}()
+	return b.Add(name, r)
+}
+
+// writeArchive writes b to the file archive, or to stdout for "-". The
+// file only appears once the archive is complete.
+func writeArchive(archive string, stdout io.Writer, b *store.Backup) error {
+	if archive == "-" {
+		_, err := b.WriteTo(stdout)
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(archive), ".backup")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err = b.WriteTo(tmp); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), archive)
+}
+
+func newRestoreCmd() cli.Command {
+	return cli.Command{
+		Name:      "restore",
+		Usage:     "verify ARCHIVE (- for standard input) and restore its files into the --cache directory of a stopped authsvc",
+		ArgsUsage: "ARCHIVE",
+		Action:    restore,
+		Flags: []cli.Flag{
+			cacheDirFlag,
+		},
+	}
+}
+
+func restore(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("provide the archive to restore")
+	}
+	dir := ctx.String(cacheDir)
+	if !isDir(dir) {
+		return fmt.Errorf("%q is not a cache directory", dir)
+	}
+	if snapshotClient(dir) != nil {
+		return errors.New("authsvc is running on this cache directory; stop it before restoring")
+	}
+	r, closer, err := openArchive(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = closer.Close() }()
+	// Archives written before raft.db was left out may hold it.
+	m, err := store.RestoreBackup(r, dir, backupFiles...)
+	if err != nil {
+		return err
+	}
+	return printManifest(ctx.App.Writer, "restored", m)
+}
+
+func newVerifyCmd() cli.Command {
+	return cli.Command{
+		Name:      "verify",
+		Usage:     "check the files of ARCHIVE (- for standard input) against its checksums",
+		ArgsUsage: "ARCHIVE",
+		Action:    verify,
+	}
+}
+
+func verify(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("provide the archive to verify")
+	}
+	r, closer, err := openArchive(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = closer.Close() }()
+	m, err := store.VerifyBackup(r)
+	if err != nil {
+		return err
+	}
+	return printManifest(ctx.App.Writer, "verified", m)
+}
+
+func openArchive(archive string) (io.Reader, io.Closer, error) {
+	if archive == "-" {
+		return os.Stdin, ioutil.NopCloser(nil), nil
+	}
+	fd, err := os.Open(archive)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fd, fd, nil
+}
+
+func printManifest(w io.Writer, verb string, m *store.BackupManifest) error {
+	for _, f := range m.Files {
+		if _, err := fmt.Fprintf(w, "%s %s: %d bytes, sha256 %s\n", verb, f.Name, f.Size, f.SHA256); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "backup taken %s\n", m.Created.Format(time.RFC3339))
+	return err
+}
+
+var (
+	fromFlag = cli.StringFlag{
+		Name:  "from",
+		Usage: "storage URI to copy from, e.g. boltdb:///var/lib/authsvc, sqlite3:///var/lib/authsvc/authsvc.db, postgres://host/db or redis://host:6379/0",
+	}
+	toFlag = cli.StringFlag{
+		Name:  "to",
+		Usage: "storage URI to copy to",
+	}
+	dryRunFlag = cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "list the keys that would be added or updated, without writing",
+	}
+)
+
+func newMigrateCmd() cli.Command {
+	return cli.Command{
+		Name:   "migrate",
+		Usage:  "copy the cache, clients and tokens buckets between storage back-ends of a stopped authsvc, keeping expiry times",
+		Action: migrate,
+		Flags: []cli.Flag{
+			fromFlag,
+			toFlag,
+			dryRunFlag,
+			cacheKeysFlag,
+		},
+	}
+}
+
+func migrate(ctx *cli.Context) error {
+	if ctx.String("from") == "" || ctx.String("to") == "" {
+		return errors.New("provide both --from and --to storage URIs")
+	}
+	var keys store.KeySource
+	if spec := ctx.String(cacheKeys); spec != "" {
+		var err error
+		if keys, err = store.ParseKeyring(spec); err != nil {
+			return err
+		}
+	}
+	from, closeFrom, err := openBuckets(ctx.String("from"), keys)
+	if err != nil {
+		return fmt.Errorf("--from: %v", err)
+	}
+	defer func() { _ = closeFrom.Close() }()
+	to, closeTo, err := openBuckets(ctx.String("to"), keys)
+	if err != nil {
+		return fmt.Errorf("--to: %v", err)
+	}
+	defer func() { _ = closeTo.Close() }()
+
+	dryRun := ctx.Bool("dry-run")
+	for _, bucket := range authorization.Buckets {
+		opts := store.MigrateOptions{
+			DryRun: dryRun,
+			Progress: func(done, total int) {
+				if done%1000 == 0 || done == total {
+					_, _ = fmt.Fprintf(ctx.App.ErrWriter, "%s: %d/%d\n", bucket, done, total)
+				}
+			},
+		}
+		if dryRun {
+			opts.Diff = func(key string, change store.MigrateChange) {
+				if mark, ok := diffMarks[change]; ok {
+					_, _ = fmt.Fprintf(ctx.App.Writer, "%s %s %s\n", mark, bucket, key)
+				}
+			}
+		}
+		stats, err := store.Migrate(context.Background(), from[bucket], to[bucket], opts)
+		if err != nil {
+			return fmt.Errorf("%s: %v", bucket, err)
+		}
+		if _, err = fmt.Fprintf(ctx.App.ErrWriter, "%s: %d added, %d updated, %d unchanged, %d expired, %d only in destination\n",
+			bucket, stats[store.MigrateAdd], stats[store.MigrateUpdate], stats[store.MigrateSame], stats[store.MigrateExpired], stats[store.MigrateExtra]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffMarks prefix the keys listed by a dry run.
+var diffMarks = map[store.MigrateChange]string{
+	store.MigrateAdd:    "+",
+	store.MigrateUpdate: "~",
+	store.MigrateExtra:  "?",
+}
+
+func openBuckets(uri string, keys store.KeySource) (map[string]store.Cache, io.Closer, error) {
+	options, err := authorization.ParseStorageURI(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	options.CacheKeys = keys
+	return authorization.OpenBuckets(options)
+}
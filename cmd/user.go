@@ -26,24 +26,20 @@ func newGetUserCmd() cli.Command {
 		Name:    "get",
 		Aliases: []string{"g"},
 		Action:  getUser,
-		Flags: []cli.Flag{
-			ldapHostFlag,
-			ldapPortFlag,
-			ldapBaseDNFlag,
-			ldapAdminUserFlag,
-			ldapAdminPassFlag,
-		},
+		Flags:   ldapFlags,
 	}
 }
 
 func getUser(ctx *cli.Context) error {
-	cache := user.NewLDAPCache(&store.LDAPConfig{
-		Host:     ctx.String(ldapHost),
-		Port:     ctx.Int(ldapPort),
-		Username: ctx.String(ldapAdminUser),
-		Password: ctx.String(ldapAdminPass),
-		BaseDN:   ctx.String(ldapBaseDN),
-	})
+	cfg, err := ldapConfig(ctx)
+	if err != nil {
+		return err
+	}
+	mapping, err := ldapMapping(ctx)
+	if err != nil {
+		return err
+	}
+	cache := user.NewLDAPCache(cfg, mapping)
 	uid := ctx.Args().First()
 	if uid == "" {
 		return errors.New("expecting uid as parameter")
@@ -61,31 +57,25 @@ func newCheckPasswordCmd() cli.Command {
 		Name:    "check",
 		Aliases: []string{"pwd", "c"},
 		Action:  checkPassword,
-		Flags: []cli.Flag{
-			ldapHostFlag,
-			ldapPortFlag,
-			ldapBaseDNFlag,
-			ldapAdminUserFlag,
-			ldapAdminPassFlag,
-		},
+		Flags:   ldapFlags,
 	}
 }
 
 func checkPassword(ctx *cli.Context) error {
-	checker := user.NewLDAPChecker(&store.LDAPConfig{
-		Host:     ctx.String(ldapHost),
-		Port:     ctx.Int(ldapPort),
-		Username: ctx.String(ldapAdminUser),
-		Password: ctx.String(ldapAdminPass),
-		BaseDN:   ctx.String(ldapBaseDN),
-	})
+	cfg, err := ldapConfig(ctx)
+	if err != nil {
+		return err
+	}
+	mapping, err := ldapMapping(ctx)
+	if err != nil {
+		return err
+	}
+	checker := user.NewLDAPChecker(cfg, mapping)
 	a := ctx.Args()
 	if ctx.NArg() < 2 {
 		return errors.New("expecting uid and pwd as parameters")
 	}
 
-	var err error
-
 	uid := a.Get(0)
 	pwd := a.Get(1)
 	if checker.IsAuthenticated(uid, pwd) {
@@ -101,30 +91,25 @@ func newListUsersCmd() cli.Command {
 		Name:    "list",
 		Aliases: []string{"ls"},
 		Action:  listUsers,
-		Flags: []cli.Flag{
-			ldapHostFlag,
-			ldapPortFlag,
-			ldapBaseDNFlag,
-			ldapAdminUserFlag,
-			ldapAdminPassFlag,
-		},
+		Flags:   ldapFlags,
 	}
 }
 
 func listUsers(ctx *cli.Context) error {
-	cfg := &store.LDAPConfig{
-		Host:     ctx.String(ldapHost),
-		Port:     ctx.Int(ldapPort),
-		Username: ctx.String(ldapAdminUser),
-		Password: ctx.String(ldapAdminPass),
-		BaseDN:   ctx.String(ldapBaseDN),
+	cfg, err := ldapConfig(ctx)
+	if err != nil {
+		return err
 	}
-	keys, err := user.NewLDAPCache(cfg).Keys()
+	mapping, err := ldapMapping(ctx)
 	if err != nil {
 		return err
 	}
-	for _, k := range keys {
-		fmt.Fprintf(ctx.App.Writer, "%s\n", k)
+	var werr error
+	if err = store.Range(user.NewLDAPCache(cfg, mapping), "", func(k string) bool {
+		_, werr = fmt.Fprintf(ctx.App.Writer, "%s\n", k)
+		return werr == nil
+	}); err != nil {
+		return err
 	}
-	return nil
+	return werr
 }
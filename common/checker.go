@@ -2,9 +2,20 @@ package common // import "breve.us/authsvc/common"
 
 import (
 	"context"
+	"errors"
 	"net/http"
 )
 
+// Errors
+var (
+	// ErrUnknownUser is returned by a PasswordChanger for users it does
+	// not hold.
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrWrongPassword is returned when the current password given to
+	// change it is not the user's.
+	ErrWrongPassword = errors.New("current password is incorrect")
+)
+
 //
 // Request Checkers
 //
@@ -71,6 +82,50 @@ func (c *passwordChecker) IsAuthenticated(username, password string) bool {
 	return false
 }
 
+//
+// Password Changers
+//
+
+// PasswordChanger describes functionality to change passwords. Callers
+// check oldPassword with a PasswordChecker first; a changer may check it
+// again.
+type PasswordChanger interface {
+	ChangePassword(username, oldPassword, newPassword string) error
+}
+
+// PasswordPolicyError is a new password refused by a password policy.
+// Its message is meant to be shown to the user.
+type PasswordPolicyError struct {
+	Reason string
+}
+
+func (e *PasswordPolicyError) Error() string { return e.Reason }
+
+// PasswordChangers combines multiple PasswordChangers, changing the
+// password with the first that holds the user.
+func PasswordChangers(changers ...PasswordChanger) PasswordChanger {
+	var valid []PasswordChanger
+	for _, cc := range changers {
+		if cc != nil {
+			valid = append(valid, cc)
+		}
+	}
+	return &passwordChanger{changers: valid}
+}
+
+type passwordChanger struct {
+	changers []PasswordChanger
+}
+
+func (c *passwordChanger) ChangePassword(username, oldPassword, newPassword string) error {
+	for _, cc := range c.changers {
+		if err := cc.ChangePassword(username, oldPassword, newPassword); err != ErrUnknownUser {
+			return err
+		}
+	}
+	return ErrUnknownUser
+}
+
 //
 // context.Context helpers
 //
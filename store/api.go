@@ -1,6 +1,7 @@
 package store // import "breve.us/authsvc/store"
 
 import (
+	"context"
 	"errors"
 	"time"
 )
@@ -18,12 +19,66 @@ type Cache interface {
 	Put(key string, value interface{}) error
 	PutUntil(time time.Time, key string, value interface{}) error
 	Get(key string) (interface{}, error)
+	// Delete removes key, returning ErrNotFound if it is not present.
 	Delete(key string) error
+	// Keys returns every key, sorted.
 	Keys() ([]string, error)
+	Close() error
+}
+
+// Clocked is implemented by caches that judge expiry by a clock which
+// can be replaced, mostly for tests.
+type Clocked interface {
+	SetClock(now func() time.Time)
+}
+
+// CacheV2 describes a context aware TTL cache with atomic primitives.
+// Expired entries are treated as absent by the atomic operations,
+// except GetAndDelete, which reports them with ErrExpired as Get does.
+type CacheV2 interface {
+	PutContext(ctx context.Context, key string, value interface{}) error
+	PutUntilContext(ctx context.Context, expire time.Time, key string, value interface{}) error
+	GetContext(ctx context.Context, key string) (interface{}, error)
+	DeleteContext(ctx context.Context, key string) error
+	KeysContext(ctx context.Context) ([]string, error)
+
+	// GetAndDelete removes key and returns the value it held.
+	GetAndDelete(ctx context.Context, key string) (interface{}, error)
+	// PutIfAbsent stores value only if key is not present, and reports
+	// whether it did. A zero expire never expires.
+	PutIfAbsent(ctx context.Context, expire time.Time, key string, value interface{}) (bool, error)
+	// CompareAndSwap replaces the value of key with new only if the
+	// current value is deeply equal to old, and reports whether it did.
+	// It returns ErrNotFound if key is not present.
+	CompareAndSwap(ctx context.Context, key string, old, new interface{}, expire time.Time) (bool, error)
 }
 
 type cacheValue struct {
 	Key    string
 	Expire time.Time
 	Value  interface{}
+
+	// outdated holds the record this value was decoded from, when that
+	// record needs rewriting in the current format.
+	outdated []byte
+}
+
+func (v *cacheValue) expired(now time.Time) bool {
+	return !v.Expire.IsZero() && v.Expire.Before(now)
+}
+
+// value returns the cached value, or nil for a nil entry.
+func (v *cacheValue) value() interface{} {
+	if v == nil {
+		return nil
+	}
+	return v.Value
+}
+
+// expiry returns the expiry time, or the zero time for a nil entry.
+func (v *cacheValue) expiry() time.Time {
+	if v == nil {
+		return time.Time{}
+	}
+	return v.Expire
 }
@@ -0,0 +1,385 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Errors
+var (
+	ErrDatabaseLocked = errors.New("database is in use by another process")
+	ErrBadArchive     = errors.New("malformed backup archive")
+	ErrChecksum       = errors.New("backup checksum mismatch")
+)
+
+// BackupFormat is the version of the archives written by Backup.
+const BackupFormat = 1
+
+// backupManifest is the name of the first entry of every archive.
+const backupManifest = "MANIFEST.json"
+
+// restoreLockTimeout is how long RestoreBackup waits for a BoltDB file
+// it is about to replace to be free.
+const restoreLockTimeout = 500 * time.Millisecond
+
+// BackupFile describes a file held in a backup archive.
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupManifest lists the contents of a backup archive.
+type BackupManifest struct {
+	Format  int          `json:"format"`
+	Created time.Time    `json:"created"`
+	Files   []BackupFile `json:"files"`
+}
+
+// Snapshot writes a consistent copy of the database to w from a single
+// read transaction, so writers are not blocked while it runs.
+func (b *BoltDB) Snapshot(w io.Writer) (int64, error) {
+	return b.snapshot(func(int64) io.Writer { return w })
+}
+
+// snapshot calls fn with the size of the copy before writing to the
+// writer it returns.
+func (b *BoltDB) snapshot(fn func(size int64) io.Writer) (int64, error) {
+	if b == nil {
+		return 0, ErrInternal
+	}
+	var n int64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(fn(tx.Size()))
+		return err
+	})
+	return n, err
+}
+
+// SnapshotBoltDB writes a consistent copy of the BoltDB file at path to
+// w. Files held open by this process are copied through the shared
+// handle; files held by another process return ErrDatabaseLocked.
+func SnapshotBoltDB(path string, w io.Writer) (int64, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	db, err := OpenBoltDB(path)
+	if err == bolt.ErrTimeout {
+		return 0, ErrDatabaseLocked
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = db.Close() }()
+	return db.Snapshot(w)
+}
+
+// NewSnapshotHandler returns a handler serving GET /<name> for each of
+// names in dir. Names ending in .db are BoltDB files, copied with
+// SnapshotBoltDB; others are served as they are.
+func NewSnapshotHandler(dir string, names ...string) http.Handler {
+	allowed := map[string]bool{}
+	for _, n := range names {
+		allowed[n] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if r.Method != http.MethodGet || !allowed[name] {
+			http.NotFound(w, r)
+			return
+		}
+		file := filepath.Join(dir, name)
+		if !strings.HasSuffix(name, ".db") {
+			http.ServeFile(w, r, file)
+			return
+		}
+		if _, err := os.Stat(file); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		db, err := OpenBoltDB(file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer func() { _ = db.Close() }()
+		// The length is set up front so that a copy cut short by an
+		// error reaches the client as a truncated body.
+		_, _ = db.snapshot(func(size int64) io.Writer {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			w.Header().Set("Content-Type", "application/octet-stream")
+			return w
+		})
+	})
+}
+
+// Backup collects files into a portable archive: a gzipped tar whose
+// first entry is a manifest of the sizes and SHA-256 sums of the rest.
+type Backup struct {
+	dir      string
+	manifest BackupManifest
+}
+
+// NewBackup returns an empty backup, staged in a temporary directory
+// until Close.
+func NewBackup() (*Backup, error) {
+	dir, err := ioutil.TempDir("", "authsvc-backup")
+	if err != nil {
+		return nil, err
+	}
+	return &Backup{dir: dir, manifest: BackupManifest{Format: BackupFormat, Created: time.Now().UTC()}}, nil
+}
+
+// Add stages the contents of r under name.
+func (b *Backup) Add(name string, r io.Reader) (BackupFile, error) {
+	if !validBackupName(name) {
+		return BackupFile{}, ErrBadArchive
+	}
+	fd, err := os.Create(filepath.Join(b.dir, name))
+	if err != nil {
+		return BackupFile{}, err
+	}
+	defer func() { _ = fd.Close() }()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(fd, h), r)
+	if err != nil {
+		return BackupFile{}, err
+	}
+	if err = fd.Close(); err != nil {
+		return BackupFile{}, err
+	}
+	f := BackupFile{Name: name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}
+	b.manifest.Files = append(b.manifest.Files, f)
+	return f, nil
+}
+
+// WriteTo writes the archive to w.
+func (b *Backup) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	gz := gzip.NewWriter(cw)
+	tw := tar.NewWriter(gz)
+	manifest, err := json.MarshalIndent(&b.manifest, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err = writeTarEntry(tw, backupManifest, int64(len(manifest)), b.manifest.Created, strings.NewReader(string(manifest))); err != nil {
+		return cw.n, err
+	}
+	for _, f := range b.manifest.Files {
+		fd, err := os.Open(filepath.Join(b.dir, f.Name))
+		if err != nil {
+			return cw.n, err
+		}
+		err = writeTarEntry(tw, f.Name, f.Size, b.manifest.Created, fd)
+		_ = fd.Close()
+		if err != nil {
+			return cw.n, err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return cw.n, err
+	}
+	err = gz.Close()
+	return cw.n, err
+}
+
+// Close removes the staged files.
+func (b *Backup) Close() error { return os.RemoveAll(b.dir) }
+
+func writeTarEntry(tw *tar.Writer, name string, size int64, mod time.Time, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: size, ModTime: mod, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// VerifyBackup reads a whole archive, checking every file against the
+// manifest, and returns the manifest.
+func VerifyBackup(r io.Reader) (*BackupManifest, error) {
+	return readBackup(r, func(BackupFile, io.Reader) error { return nil })
+}
+
+// RestoreBackup verifies an archive and writes its files into dir,
+// replacing files of the same names. Nothing is replaced unless the
+// whole archive verifies, and BoltDB files are only replaced when no
+// other process holds them, so the service must be stopped first.
+//
+// If names are given, only the files of those names are restored, and
+// the manifest returned lists only them.
+func RestoreBackup(r io.Reader, dir string, names ...string) (*BackupManifest, error) {
+	stage, err := ioutil.TempDir(dir, ".restore")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(stage) }()
+
+	restored := func(name string) bool {
+		for _, n := range names {
+			if n == name {
+				return true
+			}
+		}
+		return len(names) == 0
+	}
+	m, err := readBackup(r, func(f BackupFile, r io.Reader) error {
+		if !restored(f.Name) {
+			return nil
+		}
+		fd, err := os.OpenFile(filepath.Join(stage, f.Name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(fd, r); err != nil {
+			_ = fd.Close()
+			return err
+		}
+		return fd.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	files := m.Files[:0]
+	for _, f := range m.Files {
+		if restored(f.Name) {
+			files = append(files, f)
+		}
+	}
+	m.Files = files
+	for _, f := range m.Files {
+		if !strings.HasSuffix(f.Name, ".db") {
+			continue
+		}
+		if err = checkBoltFile(filepath.Join(stage, f.Name)); err != nil {
+			return nil, err
+		}
+		if err = checkBoltFile(filepath.Join(dir, f.Name)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	for _, f := range m.Files {
+		if err = os.Rename(filepath.Join(stage, f.Name), filepath.Join(dir, f.Name)); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// checkBoltFile opens the BoltDB file at path read-only, which checks
+// its metadata, and reports ErrDatabaseLocked if another process holds
+// it.
+func checkBoltFile(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: restoreLockTimeout})
+	if err == bolt.ErrTimeout {
+		return ErrDatabaseLocked
+	}
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// readBackup reads the manifest and then each file, passing files to fn
+// as they are read. Checksums are compared as each file ends, so fn may
+// see data that later fails to verify.
+func readBackup(r io.Reader, fn func(BackupFile, io.Reader) error) (*BackupManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, ErrBadArchive
+	}
+	defer func() { _ = gz.Close() }()
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != backupManifest {
+		return nil, ErrBadArchive
+	}
+	m := &BackupManifest{}
+	if err = json.NewDecoder(tr).Decode(m); err != nil || m.Format != BackupFormat {
+		return nil, ErrBadArchive
+	}
+	files := map[string]BackupFile{}
+	for _, f := range m.Files {
+		if !validBackupName(f.Name) || f.Name == backupManifest {
+			return nil, ErrBadArchive
+		}
+		files[f.Name] = f
+	}
+
+	seen := map[string]bool{}
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		f, ok := files[hdr.Name]
+		if !ok || seen[f.Name] || hdr.Typeflag != tar.TypeReg {
+			return nil, ErrBadArchive
+		}
+		seen[f.Name] = true
+		h := sha256.New()
+		cr := &countingReader{r: io.TeeReader(tr, h)}
+		if err = fn(f, cr); err != nil {
+			return nil, err
+		}
+		if _, err = io.Copy(ioutil.Discard, cr); err != nil {
+			return nil, err
+		}
+		if cr.n != f.Size || hex.EncodeToString(h.Sum(nil)) != f.SHA256 {
+			return nil, ErrChecksum
+		}
+	}
+	if len(seen) != len(files) {
+		return nil, ErrBadArchive
+	}
+	return m, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// validBackupName accepts plain file names, so archives cannot write
+// outside the directory they are restored into.
+func validBackupName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
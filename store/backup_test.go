@@ -0,0 +1,183 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupRestore(t *testing.T) {
+	src, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(src) }()
+
+	c, err := NewBoltDBCache(filepath.Join(src, "tokens.db"), "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Put("token", "value")
+	_ = c.PutUntil(future(), "expiring", "value")
+
+	b, err := NewBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = b.Close() }()
+	var snap bytes.Buffer
+	if _, err = SnapshotBoltDB(filepath.Join(src, "tokens.db"), &snap); err != nil {
+		t.Fatalf("SnapshotBoltDB() of an open database unexpected error %v", err)
+	}
+	_ = c.Close()
+	if _, err = b.Add("tokens.db", &snap); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Add("clients.json", strings.NewReader(`[]`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Add("../escape", strings.NewReader("")); err != ErrBadArchive {
+		t.Errorf("Add() of a path expected %v, got %v", ErrBadArchive, err)
+	}
+	var archive bytes.Buffer
+	if _, err = b.WriteTo(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := VerifyBackup(bytes.NewReader(archive.Bytes()))
+	if err != nil || len(m.Files) != 2 {
+		t.Fatalf("VerifyBackup() expected 2 files, got %+v (%v)", m, err)
+	}
+
+	dst, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dst) }()
+	if _, err = RestoreBackup(bytes.NewReader(archive.Bytes()), dst); err != nil {
+		t.Fatalf("RestoreBackup() unexpected error %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dst, "clients.json")); string(data) != "[]" || err != nil {
+		t.Errorf("RestoreBackup() expected clients.json, got %q (%v)", data, err)
+	}
+	c, err = NewBoltDBCache(filepath.Join(dst, "tokens.db"), "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Get("token"); v != "value" || err != nil {
+		t.Errorf("Get() from restored database expected value, got %v (%v)", v, err)
+	}
+	if _, err = RestoreBackup(bytes.NewReader(archive.Bytes()), dst); err != ErrDatabaseLocked {
+		t.Errorf("RestoreBackup() over an open database expected %v, got %v", ErrDatabaseLocked, err)
+	}
+	_ = c.Close()
+	if entries, _ := ioutil.ReadDir(dst); len(entries) != 2 {
+		t.Errorf("RestoreBackup() expected no staging files left, got %d entries", len(entries))
+	}
+
+	only, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(only) }()
+	if m, err = RestoreBackup(bytes.NewReader(archive.Bytes()), only, "clients.json"); err != nil || len(m.Files) != 1 {
+		t.Fatalf("RestoreBackup() of named files expected 1 file, got %+v (%v)", m, err)
+	}
+	if _, err = os.Stat(filepath.Join(only, "tokens.db")); !os.IsNotExist(err) {
+		t.Errorf("RestoreBackup() of named files expected tokens.db left out, got %v", err)
+	}
+}
+
+// tamperedArchive writes an archive whose manifest does not match its
+// contents.
+func tamperedArchive(t *testing.T, manifest BackupManifest, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	data, _ := json.Marshal(&manifest)
+	if err := writeTarEntry(tw, backupManifest, int64(len(data)), time.Now(), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := writeTarEntry(tw, name, int64(len(content)), time.Now(), strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = tw.Close()
+	_ = gz.Close()
+	return buf.Bytes()
+}
+
+func TestVerifyBackup(t *testing.T) {
+	// sha256("[]")
+	const sum = "4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945"
+	tests := []struct {
+		name     string
+		manifest BackupManifest
+		files    map[string]string
+		err      error
+	}{
+		{"ok", BackupManifest{Format: BackupFormat, Files: []BackupFile{{"clients.json", 2, sum}}}, map[string]string{"clients.json": "[]"}, nil},
+		{"checksum", BackupManifest{Format: BackupFormat, Files: []BackupFile{{"clients.json", 2, sum}}}, map[string]string{"clients.json": "{}"}, ErrChecksum},
+		{"size", BackupManifest{Format: BackupFormat, Files: []BackupFile{{"clients.json", 3, sum}}}, map[string]string{"clients.json": "[]"}, ErrChecksum},
+		{"missing", BackupManifest{Format: BackupFormat, Files: []BackupFile{{"clients.json", 2, sum}}}, nil, ErrBadArchive},
+		{"unlisted", BackupManifest{Format: BackupFormat}, map[string]string{"clients.json": "[]"}, ErrBadArchive},
+		{"format", BackupManifest{Format: BackupFormat + 1}, nil, ErrBadArchive},
+		{"path", BackupManifest{Format: BackupFormat, Files: []BackupFile{{"../clients.json", 2, sum}}}, map[string]string{"../clients.json": "[]"}, ErrBadArchive},
+	}
+	for _, tc := range tests {
+		if _, err := VerifyBackup(bytes.NewReader(tamperedArchive(t, tc.manifest, tc.files))); err != tc.err {
+			t.Errorf("%s: VerifyBackup() expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+	if _, err := VerifyBackup(strings.NewReader("not an archive")); err != ErrBadArchive {
+		t.Errorf("VerifyBackup() of garbage expected %v, got %v", ErrBadArchive, err)
+	}
+}
+
+func TestSnapshotHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	c, err := NewBoltDBCache(filepath.Join(dir, "transient.db"), "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	_ = c.Put("code", "value")
+	_ = ioutil.WriteFile(filepath.Join(dir, "clients.json"), []byte("[]"), 0600)
+	_ = ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("x"), 0600)
+
+	srv := httptest.NewServer(NewSnapshotHandler(dir, "transient.db", "tokens.db", "clients.json"))
+	defer srv.Close()
+	for name, status := range map[string]int{
+		"transient.db": http.StatusOK,
+		"clients.json": http.StatusOK,
+		"tokens.db":    http.StatusNotFound,
+		"secret":       http.StatusNotFound,
+	} {
+		resp, err := http.Get(srv.URL + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("GET %s expected %d, got %d", name, status, resp.StatusCode)
+		}
+		if name == "transient.db" && int64(len(body)) != resp.ContentLength {
+			t.Errorf("GET %s expected %d bytes, got %d", name, resp.ContentLength, len(body))
+		}
+	}
+}
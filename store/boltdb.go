@@ -2,7 +2,10 @@ package store // import "breve.us/authsvc/store"
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"sync"
 	"time"
@@ -10,22 +13,22 @@ import (
 	"github.com/boltdb/bolt"
 )
 
-// NewBoltDBCache implementes Cache with a BoltDB back-end;
+// NewBoltDBCache implementes Cache with a BoltDB back-end. Caches
+// created for the same path share a single open database, each scoped
+// to its own bucket. The database is closed when the last cache
+// sharing it is closed.
 func NewBoltDBCache(path string, bucket string) (Cache, error) {
-	if bucket == "" {
-		bucket = defaultBucket
-	}
-	cache := &bcache{
-		path:   path,
-		bucket: bucket,
+	db, err := OpenBoltDB(path)
+	if err != nil {
+		return nil, err
 	}
-	switch db, err := cache.open(); err {
-	case nil:
-		err = db.Close()
-		return cache, err
-	default:
+	cache, err := db.Cache(bucket)
+	if err != nil {
+		_ = db.Close()
 		return nil, err
 	}
+	cache.(*bcache).owned = true
+	return cache, nil
 }
 
 const (
@@ -36,62 +39,201 @@ func init() {
 	gob.Register(time.Now())
 }
 
+// BoltDB is a reference counted handle to an open BoltDB file that
+// can hand out any number of bucket scoped caches.
+type BoltDB struct {
+	path string
+	refs int
+	db   *bolt.DB
+
+	// watchers are shared by every cache of a bucket.
+	watchMu  sync.Mutex
+	watchers map[string]*watchers
+}
+
+var (
+	boltMu  sync.Mutex
+	boltDBs = map[string]*BoltDB{}
+)
+
+// OpenBoltDB returns a shared handle to the BoltDB file at path,
+// opening the file if no other handle currently holds it. Each call
+// must be balanced by a call to Close.
+func OpenBoltDB(path string) (*BoltDB, error) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	boltMu.Lock()
+	defer boltMu.Unlock()
+
+	if b, ok := boltDBs[key]; ok {
+		b.refs++
+		return b, nil
+	}
+	db, err := bolt.Open(key, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	b := &BoltDB{path: key, refs: 1, db: db}
+	boltDBs[key] = b
+	return b, nil
+}
+
+// Cache returns a Cache backed by bucket in this database. The cache
+// does not own the database handle; closing it is a no-op.
+func (b *BoltDB) Cache(bucket string) (Cache, error) {
+	if b == nil {
+		return nil, ErrInternal
+	}
+	if bucket == "" {
+		bucket = defaultBucket
+	}
+	if err := b.db.Update(createBucket(bucket)); err != nil {
+		return nil, err
+	}
+	b.watchMu.Lock()
+	defer b.watchMu.Unlock()
+	if b.watchers == nil {
+		b.watchers = map[string]*watchers{}
+	}
+	w, ok := b.watchers[bucket]
+	if !ok {
+		w = &watchers{}
+		b.watchers[bucket] = w
+	}
+	return &bcache{now: time.Now, db: b, bucket: bucket, watch: w}, nil
+}
+
+// Close releases this handle, closing the underlying database when no
+// other handles remain.
+func (b *BoltDB) Close() error {
+	if b == nil {
+		return ErrInternal
+	}
+
+	boltMu.Lock()
+	defer boltMu.Unlock()
+
+	if b.refs == 0 {
+		return nil
+	}
+	b.refs--
+	if b.refs > 0 {
+		return nil
+	}
+	delete(boltDBs, b.path)
+	return b.db.Close()
+}
+
 type bcache struct {
-	sync.Once
 	now    clockFn
-	path   string
+	db     *BoltDB
 	bucket string
+	watch  *watchers
+	owned  bool
+	closed sync.Once
 }
 
 func (m *bcache) Put(key string, value interface{}) error {
-	if m == nil {
-		return ErrInternal
-	}
-	return m.put(key, &cacheValue{Key: key, Value: value})
+	return m.PutContext(context.Background(), key, value)
 }
 
 func (m *bcache) PutUntil(expire time.Time, key string, value interface{}) error {
+	return m.PutUntilContext(context.Background(), expire, key, value)
+}
+
+func (m *bcache) Get(key string) (interface{}, error) {
+	return m.GetContext(context.Background(), key)
+}
+
+func (m *bcache) Delete(key string) error {
+	return m.DeleteContext(context.Background(), key)
+}
+
+func (m *bcache) Keys() ([]string, error) {
+	return m.KeysContext(context.Background())
+}
+
+func (m *bcache) PutContext(ctx context.Context, key string, value interface{}) error {
+	return m.PutUntilContext(ctx, time.Time{}, key, value)
+}
+
+func (m *bcache) PutUntilContext(ctx context.Context, expire time.Time, key string, value interface{}) error {
 	if m == nil {
 		return ErrInternal
 	}
-	return m.put(key, &cacheValue{Key: key, Expire: expire, Value: value})
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := m.put(key, &cacheValue{Key: key, Expire: expire, Value: value}); err != nil {
+		return err
+	}
+	m.notify(EventPut, key)
+	return nil
 }
 
-func (m *bcache) Get(key string) (interface{}, error) {
+func (m *bcache) GetContext(ctx context.Context, key string) (interface{}, error) {
+	v, err := m.getValue(ctx, key)
+	return v.value(), err
+}
+
+func (m *bcache) GetWithExpiry(ctx context.Context, key string) (interface{}, time.Time, error) {
+	v, err := m.getValue(ctx, key)
+	return v.value(), v.expiry(), err
+}
+
+func (m *bcache) getValue(ctx context.Context, key string) (*cacheValue, error) {
 	if m == nil {
 		return nil, ErrInternal
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	v, err := m.get(key)
 	if err != nil {
 		return nil, err
 	}
-	if m.now == nil {
-		m.now = time.Now
-	}
-	if !v.Expire.IsZero() && v.Expire.Before(m.now()) {
-		_ = m.remove(key)
-		return v.Value, ErrExpired
+	if v.expired(m.now()) {
+		if m.remove(key) == nil {
+			m.notify(EventExpire, key)
+		}
+		return v, ErrExpired
 	}
-	return v.Value, nil
+	return v, nil
 }
 
-func (m *bcache) Delete(key string) error {
+func (m *bcache) DeleteContext(ctx context.Context, key string) error {
 	if m == nil {
 		return ErrInternal
 	}
-	return m.remove(key)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := m.db.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(m.bucket))
+		if b.Get([]byte(key)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(key))
+	}); err != nil {
+		return err
+	}
+	m.notify(EventDelete, key)
+	return nil
 }
 
-func (m *bcache) Keys() ([]string, error) {
+func (m *bcache) KeysContext(ctx context.Context) ([]string, error) {
 	var keys []string
-
-	db, err := m.open()
-	if err != nil {
+	if m == nil {
+		return keys, ErrInternal
+	}
+	if err := ctx.Err(); err != nil {
 		return keys, err
 	}
-	defer func() { _ = db.Close() }()
 
-	if err := db.View(func(tx *bolt.Tx) error {
+	if err := m.db.db.View(func(tx *bolt.Tx) error {
 		return tx.Bucket([]byte(m.bucket)).ForEach(func(k, v []byte) error {
 			keys = append(keys, string(k))
 			return nil
@@ -103,61 +245,252 @@ func (m *bcache) Keys() ([]string, error) {
 	return keys, nil
 }
 
-func (m *bcache) put(key string, v *cacheValue) error {
-	db, err := m.open()
+func (m *bcache) GetAndDelete(ctx context.Context, key string) (interface{}, error) {
+	if m == nil {
+		return nil, ErrInternal
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var v *cacheValue
+	if err := m.db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(m.bucket))
+		data := b.Get([]byte(key))
+		if data == nil {
+			return ErrNotFound
+		}
+		var err error
+		if v, err = decodeValue(data); err != nil {
+			return err
+		}
+		return b.Delete([]byte(key))
+	}); err != nil {
+		return nil, err
+	}
+	m.notify(EventDelete, key)
+	if v.expired(m.now()) {
+		return v.Value, ErrExpired
+	}
+	return v.Value, nil
+}
+
+func (m *bcache) PutIfAbsent(ctx context.Context, expire time.Time, key string, value interface{}) (bool, error) {
+	if m == nil {
+		return false, ErrInternal
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	data, err := encodeValue(&cacheValue{Key: key, Expire: expire, Value: value})
 	if err != nil {
-		return err
+		return false, err
 	}
-	defer func() { _ = db.Close() }()
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err = enc.Encode(v); err != nil {
-		return err
+	stored := false
+	err = m.db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(m.bucket))
+		if old := b.Get([]byte(key)); old != nil {
+			if v, err := decodeValue(old); err == nil && !v.expired(m.now()) {
+				return nil
+			}
+		}
+		stored = true
+		return b.Put([]byte(key), data)
+	})
+	if stored && err == nil {
+		m.notify(EventPut, key)
 	}
-	return db.Update(func(tx *bolt.Tx) error { return tx.Bucket([]byte(m.bucket)).Put([]byte(key), buf.Bytes()) })
+	return stored, err
 }
 
-func (m *bcache) get(key string) (*cacheValue, error) {
-	db, err := m.open()
+func (m *bcache) CompareAndSwap(ctx context.Context, key string, old, new interface{}, expire time.Time) (bool, error) {
+	if m == nil {
+		return false, ErrInternal
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	data, err := encodeValue(&cacheValue{Key: key, Expire: expire, Value: new})
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+	swapped := false
+	err = m.db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(m.bucket))
+		cur := b.Get([]byte(key))
+		if cur == nil {
+			return ErrNotFound
+		}
+		v, err := decodeValue(cur)
+		if err != nil {
+			return err
+		}
+		if v.expired(m.now()) {
+			return ErrNotFound
+		}
+		if !reflect.DeepEqual(v.Value, old) {
+			return nil
+		}
+		swapped = true
+		return b.Put([]byte(key), data)
+	})
+	if swapped && err == nil {
+		m.notify(EventPut, key)
+	}
+	return swapped, err
+}
+
+// Scan walks the bucket with a Bolt cursor, using the last key of each
+// page as the cursor for the next.
+func (m *bcache) Scan(prefix string, cursor string, limit int) ([]string, string, error) {
+	if m == nil {
+		return nil, "", ErrInternal
+	}
+	if limit <= 0 {
+		limit = DefaultScanLimit
+	}
+	start := prefix
+	if cursor > start {
+		start = cursor
+	}
+	var (
+		page []string
+		next string
+	)
+	err := m.db.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(m.bucket)).Cursor()
+		k, _ := c.Seek([]byte(start))
+		if k != nil && cursor != "" && string(k) == cursor {
+			k, _ = c.Next()
+		}
+		for ; k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			if len(page) == limit {
+				next = page[len(page)-1]
+				break
+			}
+			page = append(page, string(k))
+		}
+		return nil
+	})
+	return page, next, err
+}
+
+// Range holds a read transaction open while fn runs.
+func (m *bcache) Range(prefix string, fn func(key string) bool) error {
+	if m == nil {
+		return ErrInternal
+	}
+	return m.db.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(m.bucket)).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			if !fn(string(k)) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (m *bcache) Sweep(now time.Time) (int, error) {
+	if m == nil {
+		return 0, ErrInternal
+	}
+	var expired [][]byte
+	err := m.db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(m.bucket))
+		expired = expired[:0]
+		if err := b.ForEach(func(k, data []byte) error {
+			if v, err := decodeValue(data); err == nil && v.expired(now) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	events := make([]Event, len(expired))
+	for i, k := range expired {
+		events[i] = Event{Type: EventExpire, Key: string(k)}
+	}
+	m.watch.notify(&events)
+	return len(expired), nil
+}
+
+func (m *bcache) SetClock(now func() time.Time) { m.now = now }
+
+// Watch reports changes made through any cache of this bucket in this
+// process; other processes cannot open the file at the same time.
+func (m *bcache) Watch(prefix string, fn func(Event)) func() { return m.watch.Watch(prefix, fn) }
+
+func (m *bcache) notify(t EventType, key string) {
+	m.watch.notify(&[]Event{{Type: t, Key: key}})
+}
+
+// Close releases the database handle if this cache owns it.
+func (m *bcache) Close() error {
+	if m == nil {
+		return ErrInternal
+	}
+	var err error
+	if m.owned {
+		m.closed.Do(func() { err = m.db.Close() })
 	}
-	defer func() { _ = db.Close() }()
-	v := &cacheValue{}
-	if err = db.View(func(tx *bolt.Tx) error {
+	return err
+}
+
+func (m *bcache) put(key string, v *cacheValue) error {
+	data, err := encodeValue(v)
+	if err != nil {
+		return err
+	}
+	return m.db.db.Batch(func(tx *bolt.Tx) error { return tx.Bucket([]byte(m.bucket)).Put([]byte(key), data) })
+}
+
+func (m *bcache) get(key string) (*cacheValue, error) {
+	var v *cacheValue
+	if err := m.db.db.View(func(tx *bolt.Tx) error {
 		data := tx.Bucket([]byte(m.bucket)).Get([]byte(key))
 		if data == nil {
 			return ErrNotFound
 		}
-		buf := bytes.NewBuffer(data)
-		dec := gob.NewDecoder(buf)
-		return dec.Decode(v)
+		var err error
+		v, err = decodeValue(data)
+		return err
 	}); err != nil {
 		return nil, err
 	}
+	if v.outdated != nil {
+		_ = m.upgrade(key, v)
+	}
 	return v, nil
 }
 
-func (m *bcache) remove(key string) error {
-	db, err := m.open()
+// upgrade rewrites an outdated record in the current format, unless it
+// has changed since it was read.
+func (m *bcache) upgrade(key string, v *cacheValue) error {
+	data, err := encodeValue(v)
 	if err != nil {
 		return err
 	}
-	defer func() { _ = db.Close() }()
-	return db.Update(deleteKey(m.bucket, key))
+	return m.db.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(m.bucket))
+		if !bytes.Equal(b.Get([]byte(key)), v.outdated) {
+			return nil
+		}
+		return b.Put([]byte(key), data)
+	})
 }
 
-func (m *bcache) open() (*bolt.DB, error) {
-	db, err := bolt.Open(m.path, 0600, nil)
-	if err == nil {
-		m.Do(func() {
-			err = db.Update(createBucket(m.bucket))
-		})
-	}
-	if err != nil {
-		return nil, err
-	}
-	return db, nil
+func (m *bcache) remove(key string) error {
+	return m.db.db.Batch(deleteKey(m.bucket, key))
 }
 
 func createBucket(bucket string) func(*bolt.Tx) error {
@@ -1,9 +1,12 @@
 package store // import "breve.us/authsvc/store"
 
 import (
+	"context"
 	"encoding/gob"
+	"fmt"
 	"io/ioutil"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -22,7 +25,7 @@ type factory func(func() time.Time) Cache
 type testFn func(string, Cache, testCase, *testing.T)
 
 var (
-	memoryFactory factory = func(now func() time.Time) Cache { return &memory{now: now, data: map[string]*cacheValue{}} }
+	memoryFactory factory = func(now func() time.Time) Cache { return newMemory(MemoryOptions{}, now) }
 	boltFactory   factory = func(now func() time.Time) Cache {
 		name, err := tempFile()
 		if err != nil {
@@ -38,10 +41,189 @@ var (
 
 func TestMemoryCache(t *testing.T) {
 	testCache(memoryFactory, t)
+	testAtomic(memoryFactory, t)
+	testScan(memoryFactory, t)
 }
 
+func TestMemoryCacheConcurrent(t *testing.T) {
+	shared := newMemory(MemoryOptions{Shards: 4}, present)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			testCache(func(func() time.Time) Cache {
+				return &prefixed{Cache: shared, prefix: fmt.Sprintf("%d/", i)}
+			}, t)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMemoryCacheLRU(t *testing.T) {
+	m := newMemory(MemoryOptions{Shards: 1, MaxEntries: 2}, present)
+	_ = m.Put("a", "1")
+	_ = m.Put("b", "2")
+	_, _ = m.Get("a")
+	_ = m.Put("c", "3")
+	if keys, _ := m.Keys(); !reflect.DeepEqual(keys, []string{"a", "c"}) {
+		t.Errorf("Keys() expected least recently used entry evicted, got %v", keys)
+	}
+
+	m = newMemory(MemoryOptions{Shards: 1, MaxBytes: 10, SizeFn: func(interface{}) int64 { return 4 }}, present)
+	_ = m.Put("a", "1")
+	_ = m.Put("b", "2")
+	_ = m.Put("c", "3")
+	if keys, _ := m.Keys(); !reflect.DeepEqual(keys, []string{"b", "c"}) {
+		t.Errorf("Keys() expected byte budget to evict oldest entry, got %v", keys)
+	}
+
+	// Sizes are only estimated for caches bounded in bytes.
+	sized := 0
+	m = newMemory(MemoryOptions{MaxEntries: 2, SizeFn: func(interface{}) int64 { sized++; return 4 }}, present)
+	_ = m.Put("a", "1")
+	_, _ = m.PutIfAbsent(context.Background(), time.Time{}, "b", "2")
+	_, _ = m.CompareAndSwap(context.Background(), "a", "1", "3", time.Time{})
+	if sized != 0 {
+		t.Errorf("Put() without MaxBytes expected no size estimates, got %d", sized)
+	}
+}
+
+func TestMemoryCacheLimits(t *testing.T) {
+	for _, opts := range []MemoryOptions{
+		{MaxEntries: 5},
+		{MaxEntries: 20},
+		{MaxEntries: 100},
+		{MaxBytes: 1000, SizeFn: func(interface{}) int64 { return 4 }},
+		{MaxEntries: 30, MaxBytes: 150, SizeFn: func(interface{}) int64 { return 2 }},
+	} {
+		m := newMemory(opts, present)
+		for i := 0; i < 1000; i++ {
+			_ = m.Put(fmt.Sprintf("%03d", i), "value")
+		}
+		keys, _ := m.Keys()
+		if opts.MaxEntries > 0 && len(keys) > opts.MaxEntries {
+			t.Errorf("Keys() with MaxEntries %d expected at most that many, got %d", opts.MaxEntries, len(keys))
+		}
+		var bytes int64
+		for _, s := range m.shards {
+			bytes += s.bytes
+		}
+		if opts.MaxBytes > 0 && bytes > opts.MaxBytes {
+			t.Errorf("MaxBytes %d expected at most that many bytes held, got %d", opts.MaxBytes, bytes)
+		}
+	}
+}
+
+// prefixed namespaces a shared cache so concurrent test runs do not
+// collide on keys.
+type prefixed struct {
+	Cache
+	prefix string
+}
+
+func (p *prefixed) Put(key string, value interface{}) error { return p.Cache.Put(p.prefix+key, value) }
+func (p *prefixed) PutUntil(expire time.Time, key string, value interface{}) error {
+	return p.Cache.PutUntil(expire, p.prefix+key, value)
+}
+func (p *prefixed) Get(key string) (interface{}, error) { return p.Cache.Get(p.prefix + key) }
+func (p *prefixed) Delete(key string) error             { return p.Cache.Delete(p.prefix + key) }
+
 func TestBoltDBCache(t *testing.T) {
 	testCache(boltFactory, t)
+	testAtomic(boltFactory, t)
+	testScan(boltFactory, t)
+}
+
+func testAtomic(fn factory, t *testing.T) {
+	ctx := context.Background()
+	c, ok := fn(present).(CacheV2)
+	if !ok {
+		t.Fatalf("expected cache to implement CacheV2")
+	}
+
+	if ok, err := c.PutIfAbsent(ctx, future(), "key", "one"); !ok || err != nil {
+		t.Errorf("PutIfAbsent() on empty key expected true, got %v (%v)", ok, err)
+	}
+	if ok, err := c.PutIfAbsent(ctx, future(), "key", "two"); ok || err != nil {
+		t.Errorf("PutIfAbsent() on present key expected false, got %v (%v)", ok, err)
+	}
+	if ok, err := c.CompareAndSwap(ctx, "key", "two", "three", future()); ok || err != nil {
+		t.Errorf("CompareAndSwap() with stale value expected false, got %v (%v)", ok, err)
+	}
+	if ok, err := c.CompareAndSwap(ctx, "key", "one", "three", future()); !ok || err != nil {
+		t.Errorf("CompareAndSwap() with current value expected true, got %v (%v)", ok, err)
+	}
+	if ok, err := c.CompareAndSwap(ctx, "missing", "one", "three", future()); ok || err != ErrNotFound {
+		t.Errorf("CompareAndSwap() on missing key expected %v, got %v (%v)", ErrNotFound, ok, err)
+	}
+	if v, err := c.GetAndDelete(ctx, "key"); v != "three" || err != nil {
+		t.Errorf("GetAndDelete() expected three, got %v (%v)", v, err)
+	}
+	if v, err := c.GetAndDelete(ctx, "key"); v != nil || err != ErrNotFound {
+		t.Errorf("GetAndDelete() twice expected %v, got %v (%v)", ErrNotFound, v, err)
+	}
+
+	if err := c.PutUntilContext(ctx, past(), "old", "stale"); err != nil {
+		t.Errorf("PutUntilContext() unexpected error %v", err)
+	}
+	if ok, err := c.PutIfAbsent(ctx, time.Time{}, "old", "fresh"); !ok || err != nil {
+		t.Errorf("PutIfAbsent() over expired key expected true, got %v (%v)", ok, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.GetContext(cancelled, "old"); err != context.Canceled {
+		t.Errorf("GetContext() with cancelled context expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func testScan(fn factory, t *testing.T) {
+	c := fn(present)
+	defer func() { _ = c.Close() }()
+	for _, k := range []string{"a:1", "b:1", "b:2", "b:3", "b:4", "b:5", "c:1"} {
+		if err := c.Put(k, k); err != nil {
+			t.Fatalf("Put(%q) unexpected error %v", k, err)
+		}
+	}
+
+	var got []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		keys, next, err := Scan(c, "b:", cursor, 2)
+		if err != nil {
+			t.Fatalf("Scan() unexpected error %v", err)
+		}
+		if len(keys) > 2 {
+			t.Errorf("Scan() expected at most 2 keys, got %v", keys)
+		}
+		got = append(got, keys...)
+		if next == "" {
+			if pages != 2 {
+				t.Errorf("Scan() expected 3 pages, got %d", pages+1)
+			}
+			break
+		}
+		cursor = next
+	}
+	if !reflect.DeepEqual(got, []string{"b:1", "b:2", "b:3", "b:4", "b:5"}) {
+		t.Errorf("Scan() expected b:1..b:5, got %v", got)
+	}
+
+	got = nil
+	if err := Range(c, "b:", func(k string) bool {
+		got = append(got, k)
+		return len(got) < 3
+	}); err != nil {
+		t.Errorf("Range() unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(got, []string{"b:1", "b:2", "b:3"}) {
+		t.Errorf("Range() expected to stop after b:3, got %v", got)
+	}
+
+	if keys, next, err := Scan(c, "z:", "", 10); len(keys) != 0 || next != "" || err != nil {
+		t.Errorf("Scan() of unknown prefix expected nothing, got %v %q (%v)", keys, next, err)
+	}
 }
 
 func testCache(fn factory, t *testing.T) {
@@ -181,3 +363,67 @@ func tempFile() (string, error) {
 	name := f.Name()
 	return name, f.Close()
 }
+
+func TestBoltDBShared(t *testing.T) {
+	name, err := tempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, err := NewBoltDBCache(name, "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	two, err := NewBoltDBCache(name, "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if one.(*bcache).db != two.(*bcache).db {
+		t.Errorf("expected caches on the same file to share a database handle")
+	}
+	if err = one.Put("key", "one"); err != nil {
+		t.Errorf("Put() unexpected error %v", err)
+	}
+	if _, err = two.Get("key"); err != ErrNotFound {
+		t.Errorf("Get() expected %v from a different bucket, got %v", ErrNotFound, err)
+	}
+	if err = one.Close(); err != nil {
+		t.Errorf("Close() unexpected error %v", err)
+	}
+	if err = two.Put("key", "two"); err != nil {
+		t.Errorf("Put() after sibling Close() unexpected error %v", err)
+	}
+	if err = two.Close(); err != nil {
+		t.Errorf("Close() unexpected error %v", err)
+	}
+	if _, ok := boltDBs[one.(*bcache).db.path]; ok {
+		t.Errorf("expected database to be released after last Close()")
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	for name, fn := range map[string]factory{"memory": memoryFactory, "bolt": boltFactory} {
+		cache := fn(present)
+		_ = cache.PutUntil(past(), "old", "value")
+		_ = cache.PutUntil(future(), "new", "value")
+		_ = cache.Put("forever", "value")
+
+		var reported int
+		j := NewJanitor(time.Minute, func(_ string, n int, err error) {
+			if err != nil {
+				t.Errorf("%q: Sweep() unexpected error %v", name, err)
+			}
+			reported += n
+		})
+		j.now = present
+		if !j.Add(name, cache) {
+			t.Fatalf("%q: Add() expected cache to implement Sweeper", name)
+		}
+		if n := j.Sweep(); n != 1 || reported != 1 {
+			t.Errorf("%q: Sweep() expected 1 eviction, got %d (reported %d)", name, n, reported)
+		}
+		if keys, _ := cache.Keys(); !reflect.DeepEqual(keys, []string{"forever", "new"}) {
+			t.Errorf("%q: Keys() after Sweep() got %v", name, keys)
+		}
+		_ = cache.Close()
+	}
+}
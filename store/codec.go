@@ -0,0 +1,312 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Errors
+var (
+	ErrUnknownCodec     = errors.New("unknown codec")
+	ErrUnknownType      = errors.New("unknown stored type")
+	ErrUnknownVersion   = errors.New("stored type version is newer than registered")
+	ErrMissingMigration = errors.New("missing migration for stored type version")
+	ErrCorruptRecord    = errors.New("corrupt stored record")
+)
+
+// Codec serializes the values held by persistent caches.
+type Codec interface {
+	// Name identifies the codec in stored records.
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Codecs
+var (
+	GobCodec  Codec = gobCodec{}
+	JSONCodec Codec = jsonCodec{}
+)
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// Migration upgrades a stored value by one schema version. decode
+// unmarshals the stored data, in the shape of the old version, into a
+// value of the caller's choosing; the returned value must have the
+// shape of the next version.
+type Migration func(decode func(v interface{}) error) (interface{}, error)
+
+type storedType struct {
+	name       string
+	version    int
+	typ        reflect.Type
+	codec      Codec
+	migrations map[int]Migration
+}
+
+var (
+	typesMu     sync.RWMutex
+	typesByName = map[string]*storedType{}
+	typesByType = map[reflect.Type]*storedType{}
+	codecs      = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(GobCodec)
+	RegisterCodec(JSONCodec)
+	RegisterType("string", 1, "", GobCodec)
+	RegisterType("[]string", 1, []string{}, GobCodec)
+	RegisterType("[]byte", 1, []byte{}, GobCodec)
+}
+
+// RegisterCodec makes c available for decoding stored records.
+func RegisterCodec(c Codec) {
+	typesMu.Lock()
+	defer typesMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+// RegisterType records that values of prototype's type are stored under
+// name at the given schema version using codec. Records written with
+// an older version are upgraded by registered migrations when read.
+// Values of unregistered types are stored with gob, and need
+// gob.Register.
+func RegisterType(name string, version int, prototype interface{}, codec Codec) {
+	typesMu.Lock()
+	defer typesMu.Unlock()
+	codecs[codec.Name()] = codec
+	t := &storedType{name: name, version: version, typ: reflect.TypeOf(prototype), codec: codec, migrations: map[int]Migration{}}
+	if old, ok := typesByName[name]; ok {
+		t.migrations = old.migrations
+		delete(typesByType, old.typ)
+	}
+	typesByName[name] = t
+	typesByType[t.typ] = t
+}
+
+// RegisterMigration registers fn to upgrade records of the named type
+// from version from to from+1.
+func RegisterMigration(name string, from int, fn Migration) {
+	typesMu.Lock()
+	defer typesMu.Unlock()
+	t, ok := typesByName[name]
+	if !ok {
+		t = &storedType{name: name, migrations: map[int]Migration{}}
+		typesByName[name] = t
+	}
+	t.migrations[from] = fn
+}
+
+// Records are framed as a magic prefix and format version, followed by
+// the codec name, type name, type version, expiry, key and the encoded
+// value. The leading zero byte never starts a gob stream, which tells
+// them apart from records written before the envelope existed.
+var recordMagic = []byte{0, 'a', 's', 1}
+
+// gobValue carries values of unregistered types through gob.
+type gobValue struct {
+	Value interface{}
+}
+
+func encodeValue(v *cacheValue) ([]byte, error) {
+	typesMu.RLock()
+	t, ok := typesByType[reflect.TypeOf(v.Value)]
+	typesMu.RUnlock()
+
+	var (
+		codec   = GobCodec
+		name    string
+		version int
+		data    []byte
+		err     error
+	)
+	if ok {
+		codec, name, version = t.codec, t.name, t.version
+		data, err = codec.Marshal(v.Value)
+	} else {
+		data, err = codec.Marshal(&gobValue{Value: v.Value})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{}, recordMagic...)
+	out = appendString(out, codec.Name())
+	out = appendString(out, name)
+	out = appendUvarint(out, uint64(version))
+	out = appendVarint(out, expireNanos(v.Expire))
+	out = appendString(out, v.Key)
+	return append(out, data...), nil
+}
+
+// decodeValue decodes a stored record, upgrading its value to the
+// registered version of its type. Records that needed upgrading,
+// including those written before the envelope, are kept on the value
+// so that callers can write them back.
+func decodeValue(data []byte) (*cacheValue, error) {
+	if !bytes.HasPrefix(data, recordMagic) {
+		v := &cacheValue{}
+		if err := GobCodec.Unmarshal(data, v); err != nil {
+			return nil, err
+		}
+		v.outdated = append([]byte{}, data...)
+		return v, nil
+	}
+	r := &recordReader{data: data[len(recordMagic):]}
+	codecName, name := r.string(), r.string()
+	version, expire, key := int(r.uvarint()), r.varint(), r.string()
+	if r.err != nil {
+		return nil, r.err
+	}
+	v := &cacheValue{Key: key}
+	if expire != 0 {
+		v.Expire = time.Unix(0, expire)
+	}
+
+	typesMu.RLock()
+	codec, ok := codecs[codecName]
+	t := typesByName[name]
+	typesMu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	if name == "" {
+		gv := &gobValue{}
+		if err := codec.Unmarshal(r.data, gv); err != nil {
+			return nil, err
+		}
+		v.Value = gv.Value
+		return v, nil
+	}
+	if t == nil || t.typ == nil {
+		return nil, ErrUnknownType
+	}
+	value, err := t.decode(codec, version, r.data)
+	if err != nil {
+		return nil, err
+	}
+	v.Value = value
+	if version != t.version || codec != t.codec {
+		v.outdated = append([]byte{}, data...)
+	}
+	return v, nil
+}
+
+// decode runs any migrations needed to bring data from version up to
+// the registered version, then decodes it into a new value of the type.
+func (t *storedType) decode(codec Codec, version int, data []byte) (interface{}, error) {
+	if version > t.version {
+		return nil, ErrUnknownVersion
+	}
+	for ; version < t.version; version++ {
+		m, ok := t.migrations[version]
+		if !ok {
+			return nil, ErrMissingMigration
+		}
+		raw := data
+		next, err := m(func(v interface{}) error { return codec.Unmarshal(raw, v) })
+		if err != nil {
+			return nil, err
+		}
+		if data, err = codec.Marshal(next); err != nil {
+			return nil, err
+		}
+	}
+	if t.typ.Kind() == reflect.Ptr {
+		p := reflect.New(t.typ.Elem())
+		if err := codec.Unmarshal(data, p.Interface()); err != nil {
+			return nil, err
+		}
+		return p.Interface(), nil
+	}
+	p := reflect.New(t.typ)
+	if err := codec.Unmarshal(data, p.Interface()); err != nil {
+		return nil, err
+	}
+	return p.Elem().Interface(), nil
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+type recordReader struct {
+	data []byte
+	err  error
+}
+
+func (r *recordReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = ErrCorruptRecord
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *recordReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = ErrCorruptRecord
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *recordReader) string() string {
+	n := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if n > uint64(len(r.data)) {
+		r.err = ErrCorruptRecord
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
@@ -0,0 +1,146 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+type personV1 struct {
+	First string
+	Last  string
+}
+
+type personV2 struct {
+	FullName string
+}
+
+// restoreTypes puts the type registry back as it is now when t ends, so
+// that the types a test registers do not leak into other tests.
+func restoreTypes(t *testing.T) {
+	typesMu.Lock()
+	defer typesMu.Unlock()
+	clones := map[*storedType]*storedType{}
+	clone := func(st *storedType) *storedType {
+		if c, ok := clones[st]; ok {
+			return c
+		}
+		c := *st
+		c.migrations = map[int]Migration{}
+		for from, fn := range st.migrations {
+			c.migrations[from] = fn
+		}
+		clones[st] = &c
+		return &c
+	}
+	byName, byType, savedCodecs := map[string]*storedType{}, map[reflect.Type]*storedType{}, map[string]Codec{}
+	for name, st := range typesByName {
+		byName[name] = clone(st)
+	}
+	for typ, st := range typesByType {
+		byType[typ] = clone(st)
+	}
+	for name, c := range codecs {
+		savedCodecs[name] = c
+	}
+	t.Cleanup(func() {
+		typesMu.Lock()
+		defer typesMu.Unlock()
+		typesByName, typesByType, codecs = byName, byType, savedCodecs
+	})
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	restoreTypes(t)
+	RegisterType("store.tt", 1, &tt{}, JSONCodec)
+	for _, value := range []interface{}{"", "value", []string(nil), []string{"a", "b"}, []byte{1, 2}, &tt{KeyOne: "x", KeyTwo: "y"}, time.Unix(5, 0), nil} {
+		v := &cacheValue{Key: "k", Expire: future(), Value: value}
+		data, err := encodeValue(v)
+		if err != nil {
+			t.Fatalf("encodeValue(%#v) unexpected error %v", value, err)
+		}
+		got, err := decodeValue(data)
+		if err != nil {
+			t.Fatalf("decodeValue(%#v) unexpected error %v", value, err)
+		}
+		if got.Key != "k" || !got.Expire.Equal(future()) || got.outdated != nil {
+			t.Errorf("decodeValue(%#v) expected key, expiry and current format, got %+v", value, got)
+		}
+		if !reflect.DeepEqual(got.Value, value) {
+			t.Errorf("decodeValue() expected %#v, got %#v", value, got.Value)
+		}
+	}
+}
+
+func TestCodecLegacyRecord(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&cacheValue{Key: "k", Value: &tt{KeyOne: "old"}}); err != nil {
+		t.Fatal(err)
+	}
+	v, err := decodeValue(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := v.Value.(*tt); !ok || got.KeyOne != "old" || !bytes.Equal(v.outdated, buf.Bytes()) {
+		t.Errorf("decodeValue() of gob record expected outdated *tt, got %+v", v)
+	}
+}
+
+func TestCodecMigration(t *testing.T) {
+	restoreTypes(t)
+	RegisterType("store.person", 1, &personV1{}, JSONCodec)
+	data, err := encodeValue(&cacheValue{Key: "k", Value: &personV1{First: "Ada", Last: "Lovelace"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterType("store.person", 2, &personV2{}, GobCodec)
+	if _, err = decodeValue(data); err != ErrMissingMigration {
+		t.Errorf("decodeValue() without migration expected %v, got %v", ErrMissingMigration, err)
+	}
+	RegisterMigration("store.person", 1, func(decode func(interface{}) error) (interface{}, error) {
+		var old personV1
+		if err := decode(&old); err != nil {
+			return nil, err
+		}
+		return &personV2{FullName: old.First + " " + old.Last}, nil
+	})
+	v, err := decodeValue(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := v.Value.(*personV2); !ok || got.FullName != "Ada Lovelace" || v.outdated == nil {
+		t.Errorf("decodeValue() expected outdated migrated person, got %+v", v)
+	}
+}
+
+func TestBoltDBUpgradesRecords(t *testing.T) {
+	name, err := tempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewBoltDBCache(name, "upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	b := c.(*bcache)
+
+	var buf bytes.Buffer
+	_ = gob.NewEncoder(&buf).Encode(&cacheValue{Key: "k", Value: "legacy"})
+	_ = b.db.db.Update(func(tx *bolt.Tx) error { return tx.Bucket([]byte("upgrade")).Put([]byte("k"), buf.Bytes()) })
+
+	if v, err := c.Get("k"); v != "legacy" || err != nil {
+		t.Errorf("Get() of legacy record expected legacy, got %v (%v)", v, err)
+	}
+	_ = b.db.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket([]byte("upgrade")).Get([]byte("k")); !bytes.HasPrefix(data, recordMagic) {
+			t.Errorf("Get() expected the legacy record to be rewritten, got %q", data)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,504 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Errors
+var (
+	ErrUnknownKey = errors.New("unknown encryption key")
+	ErrInvalidKey = errors.New("invalid encryption key")
+	ErrDecrypt    = errors.New("cannot decrypt value")
+	ErrUnsealed   = errors.New("value is not encrypted")
+)
+
+// MinKeySize is the minimum length of a master key in a KeySource.
+const MinKeySize = 16
+
+// KeySource supplies the master keys used to encrypt cache values. Keys
+// are identified by ID so that values written under an older key can
+// still be read after rotation. The key material for an ID must never
+// change.
+type KeySource interface {
+	// Current returns the ID of the key used to encrypt new values.
+	Current() string
+	// Key returns the key with the given ID.
+	Key(id string) ([]byte, error)
+}
+
+// NewKeyring returns a KeySource holding keys by ID, encrypting new
+// values with the key named current.
+func NewKeyring(current string, keys map[string][]byte) (KeySource, error) {
+	if len(keys[current]) == 0 {
+		return nil, ErrUnknownKey
+	}
+	for id, k := range keys {
+		if id == "" || len(id) > 255 || len(k) < MinKeySize {
+			return nil, ErrInvalidKey
+		}
+	}
+	return &keyring{current: current, keys: keys}, nil
+}
+
+// ParseKeyring parses a comma separated list of id=base64key pairs. The
+// first key listed is used to encrypt new values.
+func ParseKeyring(spec string) (KeySource, error) {
+	var current string
+	keys := map[string][]byte{}
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return nil, ErrInvalidKey
+		}
+		k, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, ErrInvalidKey
+		}
+		if current == "" {
+			current = parts[0]
+		}
+		keys[parts[0]] = k
+	}
+	return NewKeyring(current, keys)
+}
+
+type keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (k *keyring) Current() string { return k.current }
+
+func (k *keyring) Key(id string) ([]byte, error) {
+	if key, ok := k.keys[id]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// NewEncryptedCache wraps c so that values are sealed with AES-GCM
+// before they reach it. Each value is bound to its cache key and tagged
+// with the ID of the key that sealed it and its expiry, which is
+// authenticated so it cannot be extended in the wrapped cache. Keys are
+// not encrypted. Values written before encryption was enabled are
+// refused with ErrUnsealed; ReencryptBoltDB migrates them.
+func NewEncryptedCache(c Cache, keys KeySource) Cache {
+	return &encryptedCache{c: c, keys: keys, aeads: map[string]cipher.AEAD{}, now: time.Now}
+}
+
+type encryptedCache struct {
+	c    Cache
+	keys KeySource
+	now  func() time.Time
+
+	mu    sync.Mutex
+	aeads map[string]cipher.AEAD
+}
+
+const (
+	sealedMagic   = 0xae
+	sealedVersion = 1
+	// sealedHeader is the length of the header before the key ID.
+	sealedHeader = 11
+)
+
+func (e *encryptedCache) Put(key string, value interface{}) error {
+	data, err := e.seal(key, value, time.Time{})
+	if err != nil {
+		return err
+	}
+	return e.c.Put(key, data)
+}
+
+func (e *encryptedCache) PutUntil(expire time.Time, key string, value interface{}) error {
+	data, err := e.seal(key, value, expire)
+	if err != nil {
+		return err
+	}
+	return e.c.PutUntil(expire, key, data)
+}
+
+func (e *encryptedCache) Get(key string) (interface{}, error) {
+	return e.opened(key)(e.c.Get(key))
+}
+
+func (e *encryptedCache) Delete(key string) error { return e.c.Delete(key) }
+func (e *encryptedCache) Keys() ([]string, error) { return e.c.Keys() }
+func (e *encryptedCache) Close() error            { return e.c.Close() }
+
+func (e *encryptedCache) PutContext(ctx context.Context, key string, value interface{}) error {
+	return e.PutUntilContext(ctx, time.Time{}, key, value)
+}
+
+func (e *encryptedCache) PutUntilContext(ctx context.Context, expire time.Time, key string, value interface{}) error {
+	c, err := e.v2()
+	if err != nil {
+		return err
+	}
+	data, err := e.seal(key, value, expire)
+	if err != nil {
+		return err
+	}
+	return c.PutUntilContext(ctx, expire, key, data)
+}
+
+func (e *encryptedCache) GetContext(ctx context.Context, key string) (interface{}, error) {
+	c, err := e.v2()
+	if err != nil {
+		return nil, err
+	}
+	return e.opened(key)(c.GetContext(ctx, key))
+}
+
+// GetWithExpiry needs the wrapped cache to implement Expirer, but
+// returns the sealed expiry rather than the one stored beside the value.
+func (e *encryptedCache) GetWithExpiry(ctx context.Context, key string) (interface{}, time.Time, error) {
+	c, ok := e.c.(Expirer)
+	if !ok {
+		return nil, time.Time{}, ErrNotSupported
+	}
+	raw, _, err := c.GetWithExpiry(ctx, key)
+	switch err {
+	case nil, ErrExpired:
+	default:
+		return raw, time.Time{}, err
+	}
+	v, expire, oerr := e.open(key, raw)
+	if oerr != nil {
+		return nil, time.Time{}, oerr
+	}
+	return v, expire, e.expired(expire, err)
+}
+
+func (e *encryptedCache) DeleteContext(ctx context.Context, key string) error {
+	c, err := e.v2()
+	if err != nil {
+		return err
+	}
+	return c.DeleteContext(ctx, key)
+}
+
+func (e *encryptedCache) KeysContext(ctx context.Context) ([]string, error) {
+	c, err := e.v2()
+	if err != nil {
+		return nil, err
+	}
+	return c.KeysContext(ctx)
+}
+
+func (e *encryptedCache) GetAndDelete(ctx context.Context, key string) (interface{}, error) {
+	c, err := e.v2()
+	if err != nil {
+		return nil, err
+	}
+	return e.opened(key)(c.GetAndDelete(ctx, key))
+}
+
+func (e *encryptedCache) PutIfAbsent(ctx context.Context, expire time.Time, key string, value interface{}) (bool, error) {
+	c, err := e.v2()
+	if err != nil {
+		return false, err
+	}
+	data, err := e.seal(key, value, expire)
+	if err != nil {
+		return false, err
+	}
+	return c.PutIfAbsent(ctx, expire, key, data)
+}
+
+// CompareAndSwap compares against the decrypted value, then swaps on
+// the exact ciphertext it read, so a concurrent write still fails the
+// swap.
+func (e *encryptedCache) CompareAndSwap(ctx context.Context, key string, old, new interface{}, expire time.Time) (bool, error) {
+	c, err := e.v2()
+	if err != nil {
+		return false, err
+	}
+	raw, err := c.GetContext(ctx, key)
+	switch err {
+	case nil:
+	case ErrExpired:
+		return false, ErrNotFound
+	default:
+		return false, err
+	}
+	v, sealedExpire, err := e.open(key, raw)
+	if err != nil {
+		return false, err
+	}
+	if e.expired(sealedExpire, nil) != nil {
+		return false, ErrNotFound
+	}
+	if !reflect.DeepEqual(v, old) {
+		return false, nil
+	}
+	data, err := e.seal(key, new, expire)
+	if err != nil {
+		return false, err
+	}
+	return c.CompareAndSwap(ctx, key, raw, data, expire)
+}
+
+func (e *encryptedCache) Sweep(now time.Time) (int, error) {
+	if s, ok := e.c.(Sweeper); ok {
+		return s.Sweep(now)
+	}
+	return 0, nil
+}
+
+func (e *encryptedCache) Scan(prefix string, cursor string, limit int) ([]string, string, error) {
+	return Scan(e.c, prefix, cursor, limit)
+}
+
+func (e *encryptedCache) Range(prefix string, fn func(key string) bool) error {
+	return Range(e.c, prefix, fn)
+}
+
+func (e *encryptedCache) SetClock(now func() time.Time) {
+	e.now = now
+	if c, ok := e.c.(Clocked); ok {
+		c.SetClock(now)
+	}
+}
+
+func (e *encryptedCache) v2() (CacheV2, error) {
+	if c, ok := e.c.(CacheV2); ok {
+		return c, nil
+	}
+	return nil, ErrNotSupported
+}
+
+// opened adapts a Get style result, decrypting the value while keeping
+// ErrExpired, and reporting it when the sealed expiry has passed.
+func (e *encryptedCache) opened(key string) func(interface{}, error) (interface{}, error) {
+	return func(raw interface{}, err error) (interface{}, error) {
+		switch err {
+		case nil, ErrExpired:
+		default:
+			return raw, err
+		}
+		v, expire, oerr := e.open(key, raw)
+		if oerr != nil {
+			return nil, oerr
+		}
+		return v, e.expired(expire, err)
+	}
+}
+
+// expired returns ErrExpired if the sealed expiry has passed, or err.
+func (e *encryptedCache) expired(expire time.Time, err error) error {
+	if !expire.IsZero() && !e.now().Before(expire) {
+		return ErrExpired
+	}
+	return err
+}
+
+func (e *encryptedCache) seal(key string, value interface{}, expire time.Time) ([]byte, error) {
+	plain, err := encodeValue(&cacheValue{Value: value})
+	if err != nil {
+		return nil, err
+	}
+	return e.sealBytes(key, plain, expire)
+}
+
+// open decrypts a sealed value, returning it with its sealed expiry.
+func (e *encryptedCache) open(key string, raw interface{}) (interface{}, time.Time, error) {
+	data, ok := raw.([]byte)
+	if !ok || !isSealed(data) {
+		return nil, time.Time{}, ErrUnsealed
+	}
+	plain, _, err := e.openBytes(key, data)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	v, err := decodeValue(plain)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return v.Value, sealedExpiry(data), nil
+}
+
+// sealBytes lays out a sealed value as magic, version, expiry in Unix
+// nanoseconds (0 for none), key ID length, key ID, nonce and
+// ciphertext. The header and cache key are authenticated as additional
+// data.
+func (e *encryptedCache) sealBytes(key string, plain []byte, expire time.Time) ([]byte, error) {
+	id := e.keys.Current()
+	aead, err := e.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, sealedHeader, sealedHeader+len(id))
+	out[0], out[1], out[10] = sealedMagic, sealedVersion, byte(len(id))
+	if !expire.IsZero() {
+		binary.BigEndian.PutUint64(out[2:10], uint64(expire.UnixNano()))
+	}
+	out = append(out, id...)
+	header := len(out)
+	out = append(out, make([]byte, aead.NonceSize())...)
+	nonce := out[header:]
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, plain, additionalData(out[:header], key)), nil
+}
+
+// openBytes decrypts a sealed value, returning the plaintext and the ID
+// of the key that sealed it.
+func (e *encryptedCache) openBytes(key string, data []byte) ([]byte, string, error) {
+	header := sealedHeader + int(data[sealedHeader-1])
+	if len(data) < header {
+		return nil, "", ErrDecrypt
+	}
+	id := string(data[sealedHeader:header])
+	aead, err := e.aead(id)
+	if err != nil {
+		return nil, id, err
+	}
+	if len(data) < header+aead.NonceSize() {
+		return nil, id, ErrDecrypt
+	}
+	nonce := data[header : header+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, data[header+aead.NonceSize():], additionalData(data[:header], key))
+	if err != nil {
+		return nil, id, ErrDecrypt
+	}
+	return plain, id, nil
+}
+
+func (e *encryptedCache) aead(id string) (cipher.AEAD, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if aead, ok := e.aeads[id]; ok {
+		return aead, nil
+	}
+	master, err := e.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(deriveKey(master))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	e.aeads[id] = aead
+	return aead, nil
+}
+
+// deriveKey derives the AES-256 key for cache values from a master key,
+// so the same master key can safely serve other purposes.
+func deriveKey(master []byte) []byte {
+	mac := hmac.New(sha256.New, master)
+	_, _ = io.WriteString(mac, "breve.us/authsvc/store cache values")
+	return mac.Sum(nil)
+}
+
+func additionalData(header []byte, key string) []byte {
+	return append(append([]byte{}, header...), key...)
+}
+
+func isSealed(data []byte) bool {
+	return len(data) > sealedHeader && data[0] == sealedMagic && data[1] == sealedVersion
+}
+
+// sealedExpiry returns the expiry in the header of a sealed value.
+func sealedExpiry(data []byte) time.Time {
+	if n := binary.BigEndian.Uint64(data[2:10]); n != 0 {
+		return time.Unix(0, int64(n))
+	}
+	return time.Time{}
+}
+
+// ReencryptBoltDB rewrites every value in every bucket of the BoltDB
+// file at path under the current key of keys, and returns the number
+// of values rewritten. Values sealed under other keys in keys, or
+// stored without encryption, are sealed anew; values already under the
+// current key are left alone. Values are sealed with the expiry they
+// were stored with. The file must not be open elsewhere.
+func ReencryptBoltDB(path string, keys KeySource) (int, error) {
+	db, err := OpenBoltDB(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = db.Close() }()
+
+	e := &encryptedCache{keys: keys, aeads: map[string]cipher.AEAD{}}
+	n := 0
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(_ []byte, b *bolt.Bucket) error {
+			var pending [][2][]byte
+			if err := b.ForEach(func(k, v []byte) error {
+				pending = append(pending, [2][]byte{append([]byte{}, k...), v})
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, kv := range pending {
+				changed, data, err := e.reseal(string(kv[0]), kv[1])
+				if err != nil {
+					return err
+				}
+				if !changed {
+					continue
+				}
+				if err = b.Put(kv[0], data); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// reseal re-encrypts one encoded cacheValue under the current key,
+// reporting whether it changed.
+func (e *encryptedCache) reseal(key string, encoded []byte) (bool, []byte, error) {
+	v, err := decodeValue(encoded)
+	if err != nil {
+		return false, nil, err
+	}
+	var sealed []byte
+	if data, ok := v.Value.([]byte); ok && isSealed(data) {
+		plain, id, err := e.openBytes(key, data)
+		if err != nil {
+			return false, nil, err
+		}
+		if id == e.keys.Current() {
+			return false, nil, nil
+		}
+		if sealed, err = e.sealBytes(key, plain, sealedExpiry(data)); err != nil {
+			return false, nil, err
+		}
+	} else if sealed, err = e.seal(key, v.Value, v.Expire); err != nil {
+		return false, nil, err
+	}
+	v.Value = sealed
+	data, err := encodeValue(v)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, data, nil
+}
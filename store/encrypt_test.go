@@ -0,0 +1,146 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func testKeyring(t *testing.T, current string, ids ...string) KeySource {
+	keys := map[string][]byte{}
+	for _, id := range ids {
+		keys[id] = bytes.Repeat([]byte(id[:1]), MinKeySize)
+	}
+	k, err := NewKeyring(current, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestEncryptedCache(t *testing.T) {
+	keys := testKeyring(t, "k1", "k1")
+	encryptedFactory := func(now func() time.Time) Cache {
+		c := NewEncryptedCache(newMemory(MemoryOptions{}, now), keys)
+		c.(Clocked).SetClock(now)
+		return c
+	}
+	testCache(encryptedFactory, t)
+	testAtomic(encryptedFactory, t)
+	testScan(encryptedFactory, t)
+
+	inner := NewMemoryCache()
+	c := NewEncryptedCache(inner, keys)
+	_ = inner.Put("legacy", "plain")
+	if v, err := c.Get("legacy"); v != nil || err != ErrUnsealed {
+		t.Errorf("Get() of unencrypted value expected %v, got %v (%v)", ErrUnsealed, v, err)
+	}
+
+	_ = c.Put("token", "secret")
+	raw, _ := inner.Get("token")
+	if data, ok := raw.([]byte); !ok || bytes.Contains(data, []byte("secret")) {
+		t.Errorf("Put() expected ciphertext in the inner cache, got %v", raw)
+	}
+
+	_ = inner.Put("moved", raw)
+	if _, err := c.Get("moved"); err != ErrDecrypt {
+		t.Errorf("Get() of value sealed for another key expected %v, got %v", ErrDecrypt, err)
+	}
+
+	rotated := NewEncryptedCache(inner, testKeyring(t, "k2", "k1", "k2"))
+	if v, err := rotated.Get("token"); v != "secret" || err != nil {
+		t.Errorf("Get() after rotation expected secret, got %v (%v)", v, err)
+	}
+	if _, err := NewEncryptedCache(inner, testKeyring(t, "k2", "k2")).Get("token"); err != ErrUnknownKey {
+		t.Errorf("Get() without the sealing key expected %v, got %v", ErrUnknownKey, err)
+	}
+}
+
+func TestEncryptedCacheExpiry(t *testing.T) {
+	now := present()
+	clock := func() time.Time { return now }
+	inner := newMemory(MemoryOptions{}, clock)
+	c := NewEncryptedCache(inner, testKeyring(t, "k1", "k1"))
+	c.(Clocked).SetClock(clock)
+
+	expire := now.Add(time.Minute)
+	_ = c.PutUntil(expire, "token", "secret")
+	raw, _ := inner.Get("token")
+	if _, got, err := c.(Expirer).GetWithExpiry(context.Background(), "token"); !got.Equal(expire) || err != nil {
+		t.Errorf("GetWithExpiry() expected %v, got %v (%v)", expire, got, err)
+	}
+
+	// Storing the ciphertext again without an expiry must not extend it.
+	_ = inner.Put("token", raw)
+	now = expire
+	if _, err := c.Get("token"); err != ErrExpired {
+		t.Errorf("Get() past the sealed expiry expected %v, got %v", ErrExpired, err)
+	}
+	if ok, err := c.(CacheV2).CompareAndSwap(context.Background(), "token", "secret", "other", time.Time{}); ok || err != ErrNotFound {
+		t.Errorf("CompareAndSwap() past the sealed expiry expected %v, got %v (%v)", ErrNotFound, ok, err)
+	}
+
+	// Nor can the expiry in the header be rewritten.
+	forged := append([]byte{}, raw.([]byte)...)
+	forged[2]++
+	_ = inner.Put("token", forged)
+	if _, err := c.Get("token"); err != ErrDecrypt {
+		t.Errorf("Get() with a rewritten expiry expected %v, got %v", ErrDecrypt, err)
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	k, err := ParseKeyring("new=MDEyMzQ1Njc4OWFiY2RlZg==, old=ZmVkY2JhOTg3NjU0MzIxMA==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Current() != "new" {
+		t.Errorf("Current() expected new, got %q", k.Current())
+	}
+	if key, err := k.Key("old"); string(key) != "fedcba9876543210" || err != nil {
+		t.Errorf("Key(old) expected fedcba9876543210, got %q (%v)", key, err)
+	}
+	for _, spec := range []string{"", "nokey", "short=c2hvcnQ=", "bad=!!!"} {
+		if _, err := ParseKeyring(spec); err != ErrInvalidKey {
+			t.Errorf("ParseKeyring(%q) expected %v, got %v", spec, ErrInvalidKey, err)
+		}
+	}
+}
+
+func TestReencryptBoltDB(t *testing.T) {
+	name, err := tempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenBoltDB(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, _ := db.Cache("tokens")
+	clients, _ := db.Cache("clients")
+	_ = NewEncryptedCache(tokens, testKeyring(t, "k1", "k1")).PutUntil(future(), "a", "one")
+	_ = clients.Put("b", "two")
+	_ = db.Close()
+
+	keys := testKeyring(t, "k2", "k1", "k2")
+	if n, err := ReencryptBoltDB(name, keys); n != 2 || err != nil {
+		t.Errorf("ReencryptBoltDB() expected 2 values, got %d (%v)", n, err)
+	}
+	if n, err := ReencryptBoltDB(name, keys); n != 0 || err != nil {
+		t.Errorf("ReencryptBoltDB() twice expected 0 values, got %d (%v)", n, err)
+	}
+
+	db, err = OpenBoltDB(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	only := testKeyring(t, "k2", "k2")
+	for bucket, kv := range map[string][2]string{"tokens": {"a", "one"}, "clients": {"b", "two"}} {
+		c, _ := db.Cache(bucket)
+		if v, err := NewEncryptedCache(c, only).Get(kv[0]); v != kv[1] || err != nil {
+			t.Errorf("Get(%q) from %s expected %s, got %v (%v)", kv[0], bucket, kv[1], v, err)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"testing"
+	"time"
+)
+
+// RunCacheTests runs the table driven cache tests for caches that are
+// tested from outside the package.
+func RunCacheTests(t *testing.T, fn func(now func() time.Time) Cache) {
+	testCache(fn, t)
+	testAtomic(fn, t)
+}
@@ -0,0 +1,89 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Sweeper is implemented by caches that can evict all entries that
+// expired before now in a single pass, returning the number evicted.
+type Sweeper interface {
+	Sweep(now time.Time) (int, error)
+}
+
+// ReportFn receives the outcome of sweeping the named cache.
+type ReportFn func(name string, evicted int, err error)
+
+// NewJanitor returns a Janitor that sweeps its caches every interval.
+// If report is nil, sweep results are discarded.
+func NewJanitor(interval time.Duration, report ReportFn) *Janitor {
+	if report == nil {
+		report = func(string, int, error) {}
+	}
+	return &Janitor{interval: interval, report: report, now: time.Now}
+}
+
+// Janitor periodically evicts expired entries from caches that
+// implement Sweeper.
+type Janitor struct {
+	mu       sync.Mutex
+	interval time.Duration
+	report   ReportFn
+	now      clockFn
+	caches   []namedSweeper
+}
+
+type namedSweeper struct {
+	name string
+	s    Sweeper
+}
+
+// Add registers cache with the janitor under name. Caches that do not
+// implement Sweeper are ignored, and Add reports whether the cache was
+// registered.
+func (j *Janitor) Add(name string, cache Cache) bool {
+	s, ok := cache.(Sweeper)
+	if !ok {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.caches = append(j.caches, namedSweeper{name: name, s: s})
+	return true
+}
+
+// Sweep runs one pass over every registered cache and returns the
+// total number of entries evicted.
+func (j *Janitor) Sweep() int {
+	j.mu.Lock()
+	caches := append([]namedSweeper(nil), j.caches...)
+	j.mu.Unlock()
+
+	total := 0
+	now := j.now()
+	for _, c := range caches {
+		n, err := c.s.Sweep(now)
+		total += n
+		j.report(c.name, n, err)
+	}
+	return total
+}
+
+// Run sweeps the caches every interval until ctx is cancelled. It
+// blocks, so callers will normally run it in its own goroutine.
+func (j *Janitor) Run(ctx context.Context) {
+	if j.interval <= 0 {
+		return
+	}
+	t := time.NewTicker(j.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			j.Sweep()
+		}
+	}
+}
@@ -1,9 +1,16 @@
 package store // import "breve.us/authsvc/store"
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	ldap "gopkg.in/ldap.v2"
@@ -13,37 +20,224 @@ import (
 var (
 	ErrNotImplemented = errors.New("not implemented")
 	ErrNotSupported   = errors.New("not supported")
+
+	ErrInvalidCAFile     = errors.New("no certificates found in ldap CA file")
+	ErrInvalidTLSVersion = errors.New("invalid TLS version")
+	ErrInvalidRange      = errors.New("invalid ldap attribute range")
+
+	// ErrPasswordChangeUnknown is returned when the connection is lost
+	// after a password change was sent, so it may or may not have been
+	// made.
+	ErrPasswordChangeUnknown = errors.New("ldap connection lost during password change")
 )
 
 // LDAPConfig describes connection details to an LDAP server
 type LDAPConfig struct {
 	Host     string
 	Port     int
-	UseTLS   bool
+	UseTLS   bool // StartTLS after connecting
+	LDAPS    bool // TLS from the start, usually on port 636
 	Username string
 	Password string
 	BaseDN   string
+
+	// CAFile is a PEM bundle of the CAs trusted to sign the server's
+	// certificate, instead of the system roots.
+	CAFile string
+	// CertFile and KeyFile are a PEM client certificate and key, for
+	// servers that require mutual TLS.
+	CertFile string
+	KeyFile  string
+	// ServerName is the name the server's certificate is checked
+	// against, when it is not Host.
+	ServerName string
+	// MinTLSVersion is the lowest TLS version accepted, such as
+	// tls.VersionTLS12, the default.
+	MinTLSVersion uint16
+
+	// Servers lists host:port endpoints to use instead of Host and
+	// Port, all holding the same directory.
+	Servers []string
+	// Balance chooses between Servers: LDAPOrdered, the default,
+	// prefers them in the order listed, and LDAPRoundRobin spreads
+	// connections across them in turn.
+	Balance string
+
+	// Pool, if set, supplies the connections used by Do and
+	// Authenticate; otherwise each call connects afresh.
+	Pool *LDAPPool
 }
 
-// Connect is a helper function for connecting to LDAP
-func (c *LDAPConfig) Connect() (*ldap.Conn, error) {
-	cn, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", c.Host, c.Port))
-	if err != nil {
-		return nil, err
+// LDAP Balance
+const (
+	LDAPOrdered    = "ordered"
+	LDAPRoundRobin = "round-robin"
+)
+
+// servers returns the endpoints to connect to.
+func (c *LDAPConfig) servers() []string {
+	if len(c.Servers) > 0 {
+		return c.Servers
 	}
+	return []string{net.JoinHostPort(c.Host, strconv.Itoa(c.Port))}
+}
 
-	if c.UseTLS {
-		if err = cn.StartTLS(&tls.Config{InsecureSkipVerify: false}); err != nil {
-			cn.Close()
+// TLSConfig returns the TLS configuration for LDAPS and StartTLS,
+// reading the CA and client certificate files.
+func (c *LDAPConfig) TLSConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: c.Host, MinVersion: c.MinTLSVersion}
+	if c.ServerName != "" {
+		config.ServerName = c.ServerName
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if c.CAFile != "" {
+		data, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
 			return nil, err
 		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, ErrInvalidCAFile
+		}
 	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// ParseTLSVersion parses a TLS version such as 1.2.
+func ParseTLSVersion(version string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(version), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, ErrInvalidTLSVersion
+	}
+}
 
-	if err = cn.Bind(c.Username, c.Password); err != nil {
+// DefaultLDAPTimeout bounds dialing and each operation of connections
+// that are not pooled.
+const DefaultLDAPTimeout = 10 * time.Second
+
+// Connect is a helper function for connecting to LDAP, trying each
+// server in order.
+func (c *LDAPConfig) Connect() (*ldap.Conn, error) {
+	var err error
+	for _, server := range c.servers() {
+		var cn *ldap.Conn
+		if cn, err = c.dial(server, DefaultLDAPTimeout); err == nil || !IsLDAPNetworkError(err) {
+			return cn, err
+		}
+	}
+	return nil, err
+}
+
+// Do runs fn on a connection bound as Username, from Pool if it is set.
+// fn must only read, as it is run again on the next server if the
+// connection fails.
+func (c *LDAPConfig) Do(ctx context.Context, fn func(*ldap.Conn) error) error {
+	if c.Pool != nil {
+		return c.Pool.Do(ctx, fn)
+	}
+	var err error
+	for _, server := range c.servers() {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		var cn *ldap.Conn
+		if cn, err = c.dial(server, DefaultLDAPTimeout); err != nil {
+			if IsLDAPNetworkError(err) {
+				continue
+			}
+			return err
+		}
+		err = fn(cn)
 		cn.Close()
-		return nil, err
+		if !IsLDAPNetworkError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// Authenticate checks password by binding as dn, on a connection from
+// Pool if it is set.
+func (c *LDAPConfig) Authenticate(ctx context.Context, dn, password string) error {
+	if c.Pool != nil {
+		return c.Pool.Authenticate(ctx, dn, password)
+	}
+	if password == "" {
+		return ErrInvalidCredentials
+	}
+	return c.Do(ctx, func(cn *ldap.Conn) error {
+		err := cn.Bind(dn, password)
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return ErrInvalidCredentials
+		}
+		return err
+	})
+}
+
+// ChangePassword changes the password of dn from oldPassword to
+// newPassword with the Password Modify extended operation of RFC 3062,
+// bound as dn, on a connection from Pool if it is set. Password policy
+// refusals are returned as the server reports them, with the result code
+// it gives, such as LDAPResultConstraintViolation.
+func (c *LDAPConfig) ChangePassword(ctx context.Context, dn, oldPassword, newPassword string) error {
+	if c.Pool != nil {
+		return c.Pool.ChangePassword(ctx, dn, oldPassword, newPassword)
+	}
+	if oldPassword == "" {
+		return ErrInvalidCredentials
+	}
+	var err error
+	for _, server := range c.servers() {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		var cn *ldap.Conn
+		if cn, err = c.dial(server, DefaultLDAPTimeout); err != nil {
+			if IsLDAPNetworkError(err) {
+				continue
+			}
+			return err
+		}
+		_, err = changePassword(cn, dn, oldPassword, newPassword)
+		cn.Close()
+		if !IsLDAPNetworkError(err) {
+			break
+		}
+	}
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return ErrInvalidCredentials
+	}
+	return err
+}
+
+// changePassword binds cn as dn and changes its password, reporting
+// whether the bind succeeded.
+func changePassword(cn *ldap.Conn, dn, oldPassword, newPassword string) (bool, error) {
+	if err := cn.Bind(dn, oldPassword); err != nil {
+		return false, err
 	}
-	return cn, nil
+	_, err := cn.PasswordModify(ldap.NewPasswordModifyRequest(dn, oldPassword, newPassword))
+	if IsLDAPNetworkError(err) {
+		return true, ErrPasswordChangeUnknown
+	}
+	return true, err
 }
 
 // NewLDAPCache returns a cache suitable for interacting with LDAP
@@ -63,22 +257,59 @@ func (c *ldapCache) PutUntil(time time.Time, key string, value interface{}) erro
 	return ErrNotSupported
 }
 
+func (c *ldapCache) DeleteContext(ctx context.Context, key string) error { return ErrNotSupported }
+func (c *ldapCache) PutContext(ctx context.Context, key string, value interface{}) error {
+	return ErrNotSupported
+}
+func (c *ldapCache) PutUntilContext(ctx context.Context, time time.Time, key string, value interface{}) error {
+	return ErrNotSupported
+}
+func (c *ldapCache) GetAndDelete(ctx context.Context, key string) (interface{}, error) {
+	return nil, ErrNotSupported
+}
+func (c *ldapCache) PutIfAbsent(ctx context.Context, expire time.Time, key string, value interface{}) (bool, error) {
+	return false, ErrNotSupported
+}
+func (c *ldapCache) CompareAndSwap(ctx context.Context, key string, old, new interface{}, expire time.Time) (bool, error) {
+	return false, ErrNotSupported
+}
+
+func (c *ldapCache) Close() error { return nil }
+
 func (c *ldapCache) Get(key string) (interface{}, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+func (c *ldapCache) GetContext(ctx context.Context, key string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	det, fn := c.recordFn(c.config.BaseDN, key)
-	if err := c.doWithConnection(fn); err != nil {
+	if err := c.config.Do(ctx, fn); err != nil {
 		return nil, err
 	}
 	return det, nil
 }
 
 func (c *ldapCache) Keys() ([]string, error) {
+	return c.KeysContext(context.Background())
+}
+
+func (c *ldapCache) KeysContext(ctx context.Context) ([]string, error) {
 	var keys []string
-	if err := c.doWithConnection(func(cn *ldap.Conn) error {
-		filter := fmt.Sprintf("(objectClass=%s)", c.class)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.config.Do(ctx, func(cn *ldap.Conn) error {
+		filter, err := LDAPEqual("objectClass", c.class).Build()
+		if err != nil {
+			return err
+		}
 		res, err := SearchLDAP(cn, c.config.BaseDN, filter, "dn")
 		if err != nil {
 			return err
 		}
+		keys = keys[:0]
 		for _, item := range res.Entries {
 			keys = append(keys, item.DN)
 		}
@@ -86,10 +317,98 @@ func (c *ldapCache) Keys() ([]string, error) {
 	}); err != nil {
 		return nil, err
 	}
+	sort.Strings(keys)
 	return keys, nil
 }
 
-// SearchLDAP wraps constructing and running a boilerplate ldap search
+// ldapPageSize is the number of entries requested per page of a paged
+// search.
+const ldapPageSize = 500
+
+// Scan re-runs the paged search for each call, so the cursor is the
+// offset of the next key; results follow the server's ordering.
+func (c *ldapCache) Scan(prefix string, cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		limit = DefaultScanLimit
+	}
+	offset := 0
+	if cursor != "" {
+		var err error
+		if offset, err = strconv.Atoi(cursor); err != nil || offset < 0 {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+	var page []string
+	next, n := "", 0
+	if err := c.Range(prefix, func(key string) bool {
+		n++
+		if n <= offset {
+			return true
+		}
+		if len(page) == limit {
+			next = strconv.Itoa(offset + limit)
+			return false
+		}
+		page = append(page, key)
+		return true
+	}); err != nil {
+		return nil, "", err
+	}
+	return page, next, nil
+}
+
+// Range streams the DNs of matching entries page by page, stopping the
+// search as soon as fn returns false. A search that fails part way
+// resumes on the next server, skipping the entries already seen.
+func (c *ldapCache) Range(prefix string, fn func(key string) bool) error {
+	seen := map[string]bool{}
+	return c.config.Do(context.Background(), func(cn *ldap.Conn) error {
+		filter, err := LDAPEqual("objectClass", c.class).Build()
+		if err != nil {
+			return err
+		}
+		return SearchLDAPPaged(cn, c.config.BaseDN, filter, ldapPageSize, func(e *ldap.Entry) bool {
+			if !strings.HasPrefix(e.DN, prefix) || seen[e.DN] {
+				return true
+			}
+			seen[e.DN] = true
+			return fn(e.DN)
+		}, "dn")
+	})
+}
+
+// SearchLDAPPaged runs a search using the simple paged results control,
+// calling fn for each entry as pages arrive until fn returns false.
+// Referrals, which Active Directory returns for the parts of the tree
+// held by other domains, are not followed.
+func SearchLDAPPaged(cn *ldap.Conn, basedn string, filter string, pageSize uint32, fn func(*ldap.Entry) bool, attributes ...string) error {
+	paging := ldap.NewControlPaging(pageSize)
+	r := ldap.NewSearchRequest(
+		basedn,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0, 0, false,
+		filter, attributes, []ldap.Control{paging})
+	for {
+		res, err := cn.Search(r)
+		if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultReferral) {
+			return err
+		}
+		for _, e := range res.Entries {
+			if !fn(e) {
+				return nil
+			}
+		}
+		ctrl, ok := ldap.FindControl(res.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+		if err != nil || !ok || len(ctrl.Cookie) == 0 {
+			return nil
+		}
+		paging.SetCookie(ctrl.Cookie)
+	}
+}
+
+// SearchLDAP wraps constructing and running a boilerplate ldap search.
+// A search ending in a referral returns the entries found before it.
 func SearchLDAP(cn *ldap.Conn, basedn string, filter string, attributes ...string) (*ldap.SearchResult, error) {
 	r := ldap.NewSearchRequest(
 		basedn,
@@ -97,15 +416,58 @@ func SearchLDAP(cn *ldap.Conn, basedn string, filter string, attributes ...strin
 		ldap.NeverDerefAliases,
 		0, 0, false,
 		filter, attributes, nil)
-	return cn.Search(r)
+	res, err := cn.Search(r)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultReferral) && res != nil {
+		return res, nil
+	}
+	return res, err
 }
 
-func (c *ldapCache) doWithConnection(fn func(cn *ldap.Conn) error) error {
-	cn, err := c.config.Connect()
-	if err != nil {
-		return err
-	}
-	defer cn.Close()
+// LDAPMatchingRuleInChain is Active Directory's LDAP_MATCHING_RULE_IN_CHAIN,
+// which follows a DN valued attribute through nested entries.
+const LDAPMatchingRuleInChain = "1.2.840.113556.1.4.1941"
 
-	return fn(cn)
+// LDAPAttributeValues returns every value of attr in e. Active Directory
+// returns attributes with many values, such as the member attribute of a
+// large group, in ranges named "attr;range=low-high"; the ranges after
+// the first are fetched from cn.
+func LDAPAttributeValues(cn *ldap.Conn, e *ldap.Entry, attr string) ([]string, error) {
+	values := e.GetAttributeValues(attr)
+	prefix := strings.ToLower(attr) + ";range="
+	for {
+		next := ""
+		for _, a := range e.Attributes {
+			name := strings.ToLower(a.Name)
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			values = append(values, a.Values...)
+			bounds := strings.SplitN(name[len(prefix):], "-", 2)
+			if len(bounds) != 2 || bounds[1] == "*" {
+				return values, nil
+			}
+			high, err := strconv.Atoi(bounds[1])
+			if err != nil {
+				return values, ErrInvalidRange
+			}
+			next = fmt.Sprintf("%s;range=%d-*", attr, high+1)
+		}
+		if next == "" {
+			return values, nil
+		}
+		r := ldap.NewSearchRequest(
+			e.DN,
+			ldap.ScopeBaseObject,
+			ldap.NeverDerefAliases,
+			0, 0, false,
+			"(objectClass=*)", []string{next}, nil)
+		res, err := cn.Search(r)
+		if err != nil {
+			return values, err
+		}
+		if len(res.Entries) != 1 {
+			return values, ErrNotFound
+		}
+		e = res.Entries[0]
+	}
 }
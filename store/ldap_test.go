@@ -0,0 +1,316 @@
+package store_test // import "breve.us/authsvc/store"
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	ldap "gopkg.in/ldap.v2"
+
+	"breve.us/authsvc/store"
+	"breve.us/authsvc/store/storetest"
+)
+
+// testCA issues certificates for TLS tests.
+type testCA struct {
+	t    *testing.T
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	file string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{t: t, cert: cert, key: key, pool: x509.NewCertPool()}
+	ca.pool.AddCert(cert)
+	ca.file = tempPath(t, "ca.pem")
+	if err = ioutil.WriteFile(ca.file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+// issue returns a certificate for name, and the files holding it and
+// its key.
+func (ca *testCA) issue(name string, usage x509.ExtKeyUsage) (tls.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certFile, keyFile := tempPath(ca.t, name+".pem"), tempPath(ca.t, name+".key")
+	_ = ioutil.WriteFile(certFile, certPEM, 0600)
+	_ = ioutil.WriteFile(keyFile, keyPEM, 0600)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return cert, certFile, keyFile
+}
+
+func TestLDAPS(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, _, _ := ca.issue("ldap.example.com", x509.ExtKeyUsageServerAuth)
+	_, certFile, keyFile := ca.issue("authsvc", x509.ExtKeyUsageClientAuth)
+	srv := storetest.NewLDAPSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+		MaxVersion:   tls.VersionTLS12,
+	})
+	defer srv.Close()
+
+	valid := store.LDAPConfig{
+		Host:       srv.Host(),
+		Port:       srv.Port(),
+		LDAPS:      true,
+		CAFile:     ca.file,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "ldap.example.com",
+	}
+	tests := []struct {
+		name string
+		edit func(*store.LDAPConfig)
+		ok   bool
+	}{
+		{"valid", func(*store.LDAPConfig) {}, true},
+		{"system roots", func(c *store.LDAPConfig) { c.CAFile = "" }, false},
+		{"host name", func(c *store.LDAPConfig) { c.ServerName = "" }, false},
+		{"no client certificate", func(c *store.LDAPConfig) { c.CertFile, c.KeyFile = "", "" }, false},
+		{"minimum version", func(c *store.LDAPConfig) { c.MinTLSVersion = tls.VersionTLS13 }, false},
+		{"plain", func(c *store.LDAPConfig) { c.LDAPS = false }, false},
+	}
+	for _, tc := range tests {
+		cfg := valid
+		tc.edit(&cfg)
+		cn, err := cfg.Connect()
+		if err == nil {
+			_, err = store.SearchLDAP(cn, "dc=example,dc=com", "(uid=alice)", "uid")
+			cn.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: Connect() expected success %v, got %v", tc.name, tc.ok, err)
+		}
+	}
+
+	bad := valid
+	bad.CAFile = certFile + ".missing"
+	if _, err := bad.TLSConfig(); err == nil {
+		t.Error("TLSConfig() with a missing CA file expected an error")
+	}
+	bad.CAFile = keyFile
+	if _, err := bad.TLSConfig(); err != store.ErrInvalidCAFile {
+		t.Errorf("TLSConfig() with a CA file of no certificates expected %v, got %v", store.ErrInvalidCAFile, err)
+	}
+}
+
+func TestLDAPSHandshakeTimeout(t *testing.T) {
+	// A server that accepts connections but never speaks TLS.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	go func() {
+		for {
+			cn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = cn.Close() }()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	cfg := &store.LDAPConfig{Host: addr.IP.String(), Port: addr.Port, LDAPS: true}
+	cfg.Pool = store.NewLDAPPool(cfg, store.LDAPPoolOptions{Timeout: 100 * time.Millisecond})
+	defer func() { _ = cfg.Pool.Close() }()
+	start := time.Now()
+	if err := cfg.Authenticate(context.Background(), "uid=alice", "secret"); err == nil {
+		t.Error("Authenticate() against a silent server expected an error")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Authenticate() expected to give up after the timeout, took %v", d)
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	for in, want := range map[string]uint16{"1.2": tls.VersionTLS12, "TLS1.3": tls.VersionTLS13, "10": tls.VersionTLS10} {
+		if v, err := store.ParseTLSVersion(in); v != want || err != nil {
+			t.Errorf("ParseTLSVersion(%q) expected %x, got %x (%v)", in, want, v, err)
+		}
+	}
+	if _, err := store.ParseTLSVersion("1.4"); err != store.ErrInvalidTLSVersion {
+		t.Errorf("ParseTLSVersion(1.4) expected %v, got %v", store.ErrInvalidTLSVersion, err)
+	}
+}
+
+// newADServer returns a directory in which alice belongs to admins
+// through engineering, and engineering has more members than the server
+// returns at once.
+func newADServer(t *testing.T) (*storetest.LDAPServer, *store.LDAPConfig) {
+	srv, cfg := newPoolServer(t)
+	srv.SetRangeLimit(2)
+	alice := "uid=alice,dc=example,dc=com"
+	srv.Add("cn=engineering,dc=example,dc=com", map[string][]string{
+		"objectClass": {"group"},
+		"cn":          {"engineering"},
+		"member":      {"uid=bob,dc=example,dc=com", alice, "uid=carol,dc=example,dc=com", "uid=dave,dc=example,dc=com", "uid=erin,dc=example,dc=com"},
+	})
+	srv.Add("cn=admins,dc=example,dc=com", map[string][]string{
+		"objectClass": {"group"},
+		"cn":          {"admins"},
+		"member":      {"cn=engineering,dc=example,dc=com"},
+	})
+	srv.Add("cn=sales,dc=example,dc=com", map[string][]string{
+		"objectClass": {"group"},
+		"cn":          {"sales"},
+		"member":      {"uid=bob,dc=example,dc=com"},
+	})
+	return srv, cfg
+}
+
+func TestLDAPAttributeValues(t *testing.T) {
+	_, cfg := newADServer(t)
+	var members []string
+	if err := cfg.Do(context.Background(), func(cn *ldap.Conn) error {
+		res, err := store.SearchLDAP(cn, "dc=example,dc=com", "(cn=engineering)", "member")
+		if err != nil || len(res.Entries) != 1 {
+			return fmt.Errorf("expected 1 entry, got %v (%v)", res, err)
+		}
+		if v := res.Entries[0].GetAttributeValues("member"); len(v) != 0 {
+			t.Errorf("expected member in ranges, got %v", v)
+		}
+		members, err = store.LDAPAttributeValues(cn, res.Entries[0], "member")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 5 || members[1] != "uid=alice,dc=example,dc=com" || members[4] != "uid=erin,dc=example,dc=com" {
+		t.Errorf("LDAPAttributeValues() expected 5 members, got %v", members)
+	}
+}
+
+func TestLDAPMatchingRuleInChain(t *testing.T) {
+	_, cfg := newADServer(t)
+	var groups []string
+	if err := cfg.Do(context.Background(), func(cn *ldap.Conn) error {
+		res, err := store.SearchLDAP(cn, "dc=example,dc=com", store.LDAPExtensible("member", store.LDAPMatchingRuleInChain, "uid=alice,dc=example,dc=com").String(), "dn")
+		for _, e := range res.Entries {
+			groups = append(groups, e.DN)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(groups)
+	if len(groups) != 2 || groups[0] != "cn=admins,dc=example,dc=com" || groups[1] != "cn=engineering,dc=example,dc=com" {
+		t.Errorf("expected alice's direct and nested groups, got %v", groups)
+	}
+	if f := store.LDAPExtensible("member", store.LDAPMatchingRuleInChain, "cn=a(b),dc=x").String(); f != `(member:1.2.840.113556.1.4.1941:=cn=a\28b\29,dc=x)` {
+		t.Errorf("LDAPExtensible() expected the DN escaped, got %s", f)
+	}
+}
+
+func TestSearchLDAPReferral(t *testing.T) {
+	srv, cfg := newPoolServer(t)
+	srv.SetReferral("ldap://other.example.com/dc=other,dc=example,dc=com")
+	if err := cfg.Do(context.Background(), func(cn *ldap.Conn) error {
+		res, err := store.SearchLDAP(cn, "dc=example,dc=com", "(uid=alice)", "uid")
+		if err != nil || len(res.Entries) != 1 {
+			t.Errorf("SearchLDAP() ending in a referral expected alice, got %v (%v)", res, err)
+		}
+		n := 0
+		err = store.SearchLDAPPaged(cn, "dc=example,dc=com", "(uid=alice)", 10, func(*ldap.Entry) bool {
+			n++
+			return true
+		}, "uid")
+		if err != nil || n != 1 {
+			t.Errorf("SearchLDAPPaged() ending in a referral expected alice, got %d (%v)", n, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLDAPChangePassword(t *testing.T) {
+	const alice = "uid=alice,dc=example,dc=com"
+	for _, pooled := range []bool{false, true} {
+		srv, cfg := newPoolServer(t)
+		srv.SetMinPasswordLength(8)
+		if pooled {
+			cfg.Pool = store.NewLDAPPool(cfg, store.LDAPPoolOptions{MaxOpen: 1})
+			defer func() { _ = cfg.Pool.Close() }()
+		}
+		ctx := context.Background()
+
+		if err := cfg.ChangePassword(ctx, alice, "wrong", "new-secret"); err != store.ErrInvalidCredentials {
+			t.Errorf("pooled %v: ChangePassword() with the wrong password expected ErrInvalidCredentials, got %v", pooled, err)
+		}
+		if err := cfg.ChangePassword(ctx, alice, "alice-secret", "short"); !ldap.IsErrorWithCode(err, ldap.LDAPResultConstraintViolation) {
+			t.Errorf("pooled %v: ChangePassword() with a short password expected a constraint violation, got %v", pooled, err)
+		}
+		if err := cfg.ChangePassword(ctx, alice, "alice-secret", "new-secret"); err != nil {
+			t.Fatalf("pooled %v: ChangePassword() unexpected error %v", pooled, err)
+		}
+		if err := cfg.Authenticate(ctx, alice, "alice-secret"); err != store.ErrInvalidCredentials {
+			t.Errorf("pooled %v: Authenticate() with the old password expected ErrInvalidCredentials, got %v", pooled, err)
+		}
+		if err := cfg.Authenticate(ctx, alice, "new-secret"); err != nil {
+			t.Errorf("pooled %v: Authenticate() with the new password unexpected error %v", pooled, err)
+		}
+		// The pooled connection is bound as the service again.
+		if err := cfg.Do(ctx, search); err != nil {
+			t.Errorf("pooled %v: Do() after ChangePassword() unexpected error %v", pooled, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// Errors
+var (
+	ErrInvalidLDAPAttribute = errors.New("invalid ldap attribute description")
+	ErrInvalidLDAPFilter    = errors.New("invalid ldap filter")
+)
+
+// ldapAttribute matches an RFC 4512 attribute description: a name or
+// numeric OID, followed by options such as ";binary" or ";lang-en".
+var ldapAttribute = regexp.MustCompile(`^(?:[A-Za-z][A-Za-z0-9-]*|(?:0|[1-9][0-9]*)(?:\.(?:0|[1-9][0-9]*))+)(?:;[A-Za-z0-9-]+)*$`)
+
+// ldapOID matches a matching rule: a name or numeric OID.
+var ldapOID = regexp.MustCompile(`^(?:[A-Za-z][A-Za-z0-9-]*|(?:0|[1-9][0-9]*)(?:\.(?:0|[1-9][0-9]*))+)$`)
+
+// ValidLDAPAttribute reports whether attr is an attribute description
+// that can be placed in a search filter as it is.
+func ValidLDAPAttribute(attr string) bool { return ldapAttribute.MatchString(attr) }
+
+// EscapeLDAPFilterValue escapes value for use as an assertion value in a
+// search filter, as RFC 4515 requires for '*', '(', ')', '\' and NUL, so
+// that it matches only itself. Bytes outside printable ASCII are escaped
+// too, so that any byte string survives the trip.
+func EscapeLDAPFilterValue(value string) string {
+	const hex = "0123456789abcdef"
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '*', c == '(', c == ')', c == '\\', c < 0x20, c >= 0x7f:
+			b.WriteByte('\\')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0xf])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// LDAPFilter is a search filter under construction. Filters are built
+// from attribute descriptions, which are checked, and values, which are
+// escaped, so that no input can change the shape of the filter; the first
+// invalid part is reported by Build.
+type LDAPFilter struct {
+	filter string
+	err    error
+}
+
+// LDAPEqual returns a filter matching entries with value in attr.
+func LDAPEqual(attr, value string) LDAPFilter {
+	if !ValidLDAPAttribute(attr) {
+		return LDAPFilter{err: ErrInvalidLDAPAttribute}
+	}
+	return LDAPFilter{filter: "(" + attr + "=" + EscapeLDAPFilterValue(value) + ")"}
+}
+
+// LDAPPresent returns a filter matching entries with any value in attr.
+func LDAPPresent(attr string) LDAPFilter {
+	if !ValidLDAPAttribute(attr) {
+		return LDAPFilter{err: ErrInvalidLDAPAttribute}
+	}
+	return LDAPFilter{filter: "(" + attr + "=*)"}
+}
+
+// LDAPExtensible returns a filter matching entries with value in attr
+// under the matching rule rule.
+func LDAPExtensible(attr, rule, value string) LDAPFilter {
+	if !ValidLDAPAttribute(attr) || !ldapOID.MatchString(rule) {
+		return LDAPFilter{err: ErrInvalidLDAPAttribute}
+	}
+	return LDAPFilter{filter: "(" + attr + ":" + rule + ":=" + EscapeLDAPFilterValue(value) + ")"}
+}
+
+// LDAPAnd returns a filter matching entries that every filter matches.
+func LDAPAnd(filters ...LDAPFilter) LDAPFilter { return ldapSet("&", filters) }
+
+// LDAPOr returns a filter matching entries that any filter matches.
+func LDAPOr(filters ...LDAPFilter) LDAPFilter { return ldapSet("|", filters) }
+
+// LDAPNot returns a filter matching entries that f does not.
+func LDAPNot(f LDAPFilter) LDAPFilter {
+	if f.err != nil {
+		return f
+	}
+	return LDAPFilter{filter: "(!" + f.filter + ")"}
+}
+
+func ldapSet(op string, filters []LDAPFilter) LDAPFilter {
+	if len(filters) == 0 {
+		return LDAPFilter{err: ErrInvalidLDAPFilter}
+	}
+	s := "(" + op
+	for _, f := range filters {
+		if f.err != nil {
+			return f
+		}
+		s += f.filter
+	}
+	return LDAPFilter{filter: s + ")"}
+}
+
+// LDAPTemplate returns the filter template describes for value in attr,
+// with each {attr} replaced by attr and each {value} by value, escaped.
+// The template is written by an administrator; it must be a whole filter
+// once filled in.
+func LDAPTemplate(template, attr, value string) LDAPFilter {
+	if !ValidLDAPAttribute(attr) {
+		return LDAPFilter{err: ErrInvalidLDAPAttribute}
+	}
+	s := strings.NewReplacer("{attr}", attr, "{value}", EscapeLDAPFilterValue(value)).Replace(template)
+	if _, err := ldap.CompileFilter(s); err != nil {
+		return LDAPFilter{err: ErrInvalidLDAPFilter}
+	}
+	return LDAPFilter{filter: s}
+}
+
+// Build returns the filter, or the error in the first invalid part of it.
+func (f LDAPFilter) Build() (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	return f.filter, nil
+}
+
+// String returns the filter, or "" if it is invalid.
+func (f LDAPFilter) String() string { return f.filter }
@@ -0,0 +1,143 @@
+package store_test // import "breve.us/authsvc/store"
+
+import (
+	"testing"
+
+	ber "gopkg.in/asn1-ber.v1"
+	ldap "gopkg.in/ldap.v2"
+
+	"breve.us/authsvc/store"
+)
+
+// injections are login names that would widen a filter built from them
+// without escaping.
+var injections = []string{"*", "a*", "*)(uid=*", "alice)(|(uid=*", `\2a`, "alice\x00", "(", ")", `\`, "é", "\xff"}
+
+func TestLDAPFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		filter store.LDAPFilter
+		want   string
+		err    error
+	}{
+		{"equal", store.LDAPEqual("uid", "alice"), "(uid=alice)", nil},
+		{"escaped", store.LDAPEqual("cn", `a*(b)\c`+"\x00"), `(cn=a\2a\28b\29\5cc\00)`, nil},
+		{"options", store.LDAPEqual("cn;lang-en", "x"), "(cn;lang-en=x)", nil},
+		{"oid", store.LDAPEqual("2.5.4.3", "x"), "(2.5.4.3=x)", nil},
+		{"present", store.LDAPPresent("mail"), "(mail=*)", nil},
+		{"and", store.LDAPAnd(store.LDAPEqual("objectClass", "user"), store.LDAPNot(store.LDAPPresent("x"))), "(&(objectClass=user)(!(x=*)))", nil},
+		{"or", store.LDAPOr(store.LDAPEqual("uid", "a"), store.LDAPEqual("mail", "a")), "(|(uid=a)(mail=a))", nil},
+		{"extensible", store.LDAPExtensible("member", store.LDAPMatchingRuleInChain, "cn=a"), "(member:1.2.840.113556.1.4.1941:=cn=a)", nil},
+		{"template", store.LDAPTemplate("(&(objectClass=user)({attr}={value}))", "uid", "*"), `(&(objectClass=user)(uid=\2a))`, nil},
+		{"bad attribute", store.LDAPEqual("uid=*)(cn", "x"), "", store.ErrInvalidLDAPAttribute},
+		{"bad oid", store.LDAPEqual("1.02", "x"), "", store.ErrInvalidLDAPAttribute},
+		{"bad rule", store.LDAPExtensible("member", "1.2:=x", "x"), "", store.ErrInvalidLDAPAttribute},
+		{"nested error", store.LDAPAnd(store.LDAPPresent("a"), store.LDAPPresent("")), "", store.ErrInvalidLDAPAttribute},
+		{"empty set", store.LDAPOr(), "", store.ErrInvalidLDAPFilter},
+		{"bad template", store.LDAPTemplate("({attr}={value}", "uid", "x"), "", store.ErrInvalidLDAPFilter},
+		{"template attribute", store.LDAPTemplate("({attr}={value})", "uid)(cn", "x"), "", store.ErrInvalidLDAPAttribute},
+	} {
+		if got, err := tc.filter.Build(); got != tc.want || err != tc.err {
+			t.Errorf("%s: Build() expected %q (%v), got %q (%v)", tc.name, tc.want, tc.err, got, err)
+		}
+	}
+}
+
+func TestLDAPFilterInjection(t *testing.T) {
+	srv, cfg := newPoolServer(t)
+	srv.Add("uid=bob,dc=example,dc=com", map[string][]string{
+		"objectClass": {"inetOrgPerson"},
+		"uid":         {"bob"},
+	})
+	cn, err := cfg.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	for _, login := range injections {
+		filter, err := store.LDAPTemplate("({attr}={value})", "uid", login).Build()
+		if err != nil {
+			t.Fatalf("LDAPTemplate(%q) unexpected error %v", login, err)
+		}
+		if res, err := store.SearchLDAP(cn, cfg.BaseDN, filter, "dn"); err != nil || len(res.Entries) != 0 {
+			t.Errorf("SearchLDAP(%q) expected no entries, got %v (%v)", filter, res, err)
+		}
+	}
+	filter, _ := store.LDAPTemplate("({attr}={value})", "uid", "alice").Build()
+	if res, err := store.SearchLDAP(cn, cfg.BaseDN, filter, "dn"); err != nil || len(res.Entries) != 1 {
+		t.Errorf("SearchLDAP(%q) expected alice, got %v (%v)", filter, res, err)
+	}
+}
+
+// equality returns the attribute and value of a compiled equality filter.
+func equality(t *testing.T, p *ber.Packet) (string, string) {
+	if p.Tag != ldap.FilterEqualityMatch || len(p.Children) != 2 {
+		t.Fatalf("expected an equality match, got %s", ldap.FilterMap[uint64(p.Tag)])
+	}
+	return p.Children[0].Data.String(), p.Children[1].Data.String()
+}
+
+func compile(t *testing.T, filter string) *ber.Packet {
+	p, err := ldap.CompileFilter(filter)
+	if err != nil {
+		t.Fatalf("CompileFilter(%q) unexpected error %v", filter, err)
+	}
+	return p
+}
+
+func FuzzEscapeLDAPFilterValue(f *testing.F) {
+	for _, s := range append(injections, "", "alice", "cn=a,dc=b") {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		filter, err := store.LDAPEqual("uid", value).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attr, got := equality(t, compile(t, filter)); attr != "uid" || got != value {
+			t.Errorf("LDAPEqual(uid, %q) compiled to %s=%q", value, attr, got)
+		}
+	})
+}
+
+func FuzzLDAPTemplate(f *testing.F) {
+	for _, s := range injections {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		filter, err := store.LDAPTemplate("(&(objectCategory=person)({attr}={value}))", "sAMAccountName", value).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := compile(t, filter)
+		if p.Tag != ldap.FilterAnd || len(p.Children) != 2 {
+			t.Fatalf("LDAPTemplate(%q) built %q, which is not the template's shape", value, filter)
+		}
+		if attr, got := equality(t, p.Children[1]); attr != "sAMAccountName" || got != value {
+			t.Errorf("LDAPTemplate(%q) compiled to %s=%q", value, attr, got)
+		}
+	})
+}
+
+func FuzzValidLDAPAttribute(f *testing.F) {
+	for _, s := range []string{"uid", "cn;lang-en", "2.5.4.3", "1.", "uid=*", "a)(b", "", "-a", "a b"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, attr string) {
+		filter, err := store.LDAPPresent(attr).Build()
+		if !store.ValidLDAPAttribute(attr) {
+			if err != store.ErrInvalidLDAPAttribute {
+				t.Errorf("LDAPPresent(%q) expected ErrInvalidLDAPAttribute, got %q (%v)", attr, filter, err)
+			}
+			return
+		}
+		p, err := ldap.CompileFilter(filter)
+		if err != nil || p.Tag != ldap.FilterPresent || p.Data.String() != attr {
+			t.Errorf("LDAPPresent(%q) built %q, which does not test presence of it (%v)", attr, filter, err)
+		}
+		if got, _ := equality(t, compile(t, store.LDAPEqual(attr, "x").String())); got != attr {
+			t.Errorf("LDAPEqual(%q) compiled to attribute %q", attr, got)
+		}
+	})
+}
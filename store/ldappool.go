@@ -0,0 +1,534 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// LDAP Pool Errors
+var (
+	ErrPoolClosed         = errors.New("ldap pool closed")
+	ErrPoolTimeout        = errors.New("timed out waiting for an ldap connection")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrNoLDAPServer       = errors.New("no ldap server available")
+)
+
+// LDAPPoolOptions configures an LDAPPool. Zero values take the defaults
+// noted.
+type LDAPPoolOptions struct {
+	// MaxOpen caps the connections open at once; callers wait for one
+	// to be returned beyond it. Defaults to 10.
+	MaxOpen int
+	// MaxIdle caps the connections kept open while unused. Defaults to
+	// MaxOpen.
+	MaxIdle int
+	// IdleTimeout closes connections left unused for longer. Defaults
+	// to 5 minutes.
+	IdleTimeout time.Duration
+	// MaxLifetime closes connections open for longer, once they are
+	// returned. Defaults to 30 minutes.
+	MaxLifetime time.Duration
+	// Timeout bounds dialing, waiting for a connection, and each
+	// operation. Defaults to 10 seconds.
+	Timeout time.Duration
+	// ProbeAfter is how long a connection may sit idle before it is
+	// probed, by binding again, before being handed out. Defaults to 30
+	// seconds.
+	ProbeAfter time.Duration
+	// Backoff is how long a server that could not be reached is skipped
+	// for, doubling with each further failure up to MaxBackoff. Defaults
+	// to 1 second, and MaxBackoff to 1 minute.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// LDAPPoolStats counts the use of an LDAPPool.
+type LDAPPoolStats struct {
+	Open  int // connections open
+	InUse int // connections handed out
+	Idle  int // connections waiting to be used
+
+	Unhealthy int // servers skipped until their backoff ends
+
+	Dials         uint64 // connections opened
+	DialErrors    uint64 // connections that failed to open or bind
+	Reused        uint64 // operations run on an idle connection
+	Waits         uint64 // operations that waited for a connection
+	Timeouts      uint64 // operations that gave up waiting
+	ProbeFailures uint64 // idle connections found dead by a probe
+	Expired       uint64 // connections closed for idleness or age
+	Discarded     uint64 // connections closed after a network error
+	Failovers     uint64 // operations retried on another server
+}
+
+// LDAPPool keeps connections to the configured LDAP servers open and
+// bound as the configured user, so that operations do not pay for
+// dialing, StartTLS and a bind each time. It is safe for concurrent use.
+//
+// New connections go to the servers as the config's Balance says, and
+// a server that cannot be reached is skipped until its backoff ends.
+type LDAPPool struct {
+	config  *LDAPConfig
+	opts    LDAPPoolOptions
+	now     clockFn
+	slots   chan struct{}
+	servers []string
+
+	mu     sync.Mutex
+	idle   []*ldapConn
+	health map[string]*ldapHealth
+	next   int
+	closed bool
+	stats  LDAPPoolStats
+}
+
+type ldapConn struct {
+	cn      *ldap.Conn
+	server  string
+	created time.Time
+	used    time.Time
+}
+
+// ldapHealth tracks the failures of one server.
+type ldapHealth struct {
+	failures int
+	retryAt  time.Time
+}
+
+// NewLDAPPool returns a pool of connections described by config.
+func NewLDAPPool(config *LDAPConfig, opts LDAPPoolOptions) *LDAPPool {
+	if opts.MaxOpen <= 0 {
+		opts.MaxOpen = 10
+	}
+	if opts.MaxIdle <= 0 || opts.MaxIdle > opts.MaxOpen {
+		opts.MaxIdle = opts.MaxOpen
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = 5 * time.Minute
+	}
+	if opts.MaxLifetime <= 0 {
+		opts.MaxLifetime = 30 * time.Minute
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.ProbeAfter <= 0 {
+		opts.ProbeAfter = 30 * time.Second
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.MaxBackoff < opts.Backoff {
+		opts.MaxBackoff = time.Minute
+		if opts.MaxBackoff < opts.Backoff {
+			opts.MaxBackoff = opts.Backoff
+		}
+	}
+	servers := config.servers()
+	health := make(map[string]*ldapHealth, len(servers))
+	for _, server := range servers {
+		health[server] = &ldapHealth{}
+	}
+	return &LDAPPool{
+		config:  config,
+		opts:    opts,
+		now:     time.Now,
+		slots:   make(chan struct{}, opts.MaxOpen),
+		servers: servers,
+		health:  health,
+	}
+}
+
+// Do runs fn on a pooled connection bound as the configured user. fn
+// must not rebind the connection; use Authenticate to check passwords.
+// Connections that fail with a network error are closed rather than
+// returned to the pool, and fn is run again on another server, so it
+// must only read.
+func (p *LDAPPool) Do(ctx context.Context, fn func(*ldap.Conn) error) error {
+	return p.failover(ctx, func(c *ldapConn) (bool, error) {
+		err := fn(c.cn)
+		return IsLDAPNetworkError(err), err
+	})
+}
+
+// Authenticate checks password by binding as dn, then binds the
+// connection as the configured user again before returning it to the
+// pool. Empty passwords are refused, as servers treat them as an
+// anonymous bind.
+func (p *LDAPPool) Authenticate(ctx context.Context, dn, password string) error {
+	if password == "" {
+		return ErrInvalidCredentials
+	}
+	err := p.failover(ctx, func(c *ldapConn) (bool, error) {
+		err := c.cn.Bind(dn, password)
+		return IsLDAPNetworkError(err) || c.cn.Bind(p.config.Username, p.config.Password) != nil, err
+	})
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return ErrInvalidCredentials
+	}
+	return err
+}
+
+// ChangePassword binds as dn with oldPassword and changes its password
+// to newPassword, then binds the connection as the configured user again
+// before returning it to the pool. Only a failed bind is tried again on
+// another server; a change interrupted once sent, which may have been
+// made, returns ErrPasswordChangeUnknown.
+func (p *LDAPPool) ChangePassword(ctx context.Context, dn, oldPassword, newPassword string) error {
+	if oldPassword == "" {
+		return ErrInvalidCredentials
+	}
+	err := p.failover(ctx, func(c *ldapConn) (bool, error) {
+		bound, err := changePassword(c.cn, dn, oldPassword, newPassword)
+		if err == ErrPasswordChangeUnknown || (!bound && IsLDAPNetworkError(err)) {
+			return true, err
+		}
+		return c.cn.Bind(p.config.Username, p.config.Password) != nil, err
+	})
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return ErrInvalidCredentials
+	}
+	return err
+}
+
+// failover runs fn on a pooled connection, and again on a connection to
+// each other server while fn reports the connection broken by a network
+// error.
+func (p *LDAPPool) failover(ctx context.Context, fn func(*ldapConn) (bool, error)) error {
+	var (
+		tried   = map[string]bool{}
+		lastErr error
+	)
+	for {
+		c, err := p.get(ctx, tried)
+		if err != nil {
+			if err == ErrNoLDAPServer && lastErr != nil {
+				return lastErr
+			}
+			return err
+		}
+		if lastErr != nil {
+			p.count(func(s *LDAPPoolStats) { s.Failovers++ })
+		}
+		broken, err := fn(c)
+		p.put(c, broken)
+		if !broken || !IsLDAPNetworkError(err) {
+			return err
+		}
+		tried[c.server] = true
+		lastErr = err
+	}
+}
+
+// Stats returns the pool's current counts.
+func (p *LDAPPool) Stats() LDAPPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats
+	s.Idle = len(p.idle)
+	s.InUse = s.Open - s.Idle
+	now := p.now()
+	for _, h := range p.health {
+		if now.Before(h.retryAt) {
+			s.Unhealthy++
+		}
+	}
+	return s
+}
+
+// Close closes the idle connections, and those in use as they are
+// returned. Later operations fail with ErrPoolClosed.
+func (p *LDAPPool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.stats.Open -= len(idle)
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.cn.Close()
+	}
+	return nil
+}
+
+// get takes a connection slot, waiting up to Timeout for one, then
+// reuses an idle connection or dials a new one, to a server not in
+// exclude.
+func (p *LDAPPool) get(ctx context.Context, exclude map[string]bool) (*ldapConn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		p.count(func(s *LDAPPoolStats) { s.Waits++ })
+		timer := time.NewTimer(p.opts.Timeout)
+		defer timer.Stop()
+		select {
+		case p.slots <- struct{}{}:
+		case <-timer.C:
+			p.count(func(s *LDAPPoolStats) { s.Timeouts++ })
+			return nil, ErrPoolTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	for {
+		c, err := p.takeIdle(exclude)
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			break
+		}
+		if p.now().Sub(c.used) < p.opts.ProbeAfter {
+			p.count(func(s *LDAPPoolStats) { s.Reused++ })
+			return c, nil
+		}
+		if c.cn.Bind(p.config.Username, p.config.Password) == nil {
+			p.count(func(s *LDAPPoolStats) { s.Reused++ })
+			return c, nil
+		}
+		c.cn.Close()
+		p.count(func(s *LDAPPoolStats) {
+			s.ProbeFailures++
+			s.Open--
+		})
+	}
+
+	err := ErrNoLDAPServer
+	for _, server := range p.candidates(exclude) {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var cn *ldap.Conn
+		if cn, err = p.config.dial(server, p.opts.Timeout); err != nil {
+			p.count(func(s *LDAPPoolStats) { s.DialErrors++ })
+			if IsLDAPNetworkError(err) {
+				p.failed(server)
+				continue
+			}
+			break
+		}
+		p.healthy(server)
+		now := p.now()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.closed {
+			cn.Close()
+			<-p.slots
+			return nil, ErrPoolClosed
+		}
+		p.stats.Dials++
+		p.stats.Open++
+		return &ldapConn{cn: cn, server: server, created: now, used: now}, nil
+	}
+	<-p.slots
+	return nil, err
+}
+
+// candidates returns the servers to dial, in the order to try them:
+// those not in exclude nor backing off, as listed or starting from the
+// next in turn.
+func (p *LDAPPool) candidates(exclude map[string]bool) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	start := 0
+	if p.config.Balance == LDAPRoundRobin {
+		start = p.next % len(p.servers)
+		p.next++
+	}
+	now := p.now()
+	servers := make([]string, 0, len(p.servers))
+	for i := range p.servers {
+		server := p.servers[(start+i)%len(p.servers)]
+		if !exclude[server] && !now.Before(p.health[server].retryAt) {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// failed backs off from server, and closes its idle connections.
+func (p *LDAPPool) failed(server string) {
+	p.mu.Lock()
+	h := p.health[server]
+	backoff := p.opts.MaxBackoff
+	if h.failures < 32 && p.opts.Backoff<<uint(h.failures) < backoff {
+		backoff = p.opts.Backoff << uint(h.failures)
+	}
+	h.failures++
+	h.retryAt = p.now().Add(backoff)
+	var dropped []*ldapConn
+	idle := p.idle[:0]
+	for _, c := range p.idle {
+		if c.server == server {
+			dropped = append(dropped, c)
+		} else {
+			idle = append(idle, c)
+		}
+	}
+	p.idle = idle
+	p.stats.Open -= len(dropped)
+	p.stats.Discarded += uint64(len(dropped))
+	p.mu.Unlock()
+	for _, c := range dropped {
+		c.cn.Close()
+	}
+}
+
+// healthy clears the failures of server.
+func (p *LDAPPool) healthy(server string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	*p.health[server] = ldapHealth{}
+}
+
+// takeIdle returns the most recently used idle connection to a server
+// not in exclude, closing any that have outlived the pool's limits.
+func (p *LDAPPool) takeIdle(exclude map[string]bool) (*ldapConn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+		return nil, ErrPoolClosed
+	}
+	var (
+		c       *ldapConn
+		expired []*ldapConn
+		now     = p.now()
+	)
+	for i := len(p.idle) - 1; i >= 0 && c == nil; i-- {
+		e := p.idle[i]
+		switch {
+		case p.expired(e, now):
+			expired = append(expired, e)
+		case exclude[e.server]:
+			continue
+		default:
+			c = e
+		}
+		p.idle = append(p.idle[:i], p.idle[i+1:]...)
+	}
+	p.stats.Expired += uint64(len(expired))
+	p.stats.Open -= len(expired)
+	p.mu.Unlock()
+	for _, e := range expired {
+		e.cn.Close()
+	}
+	return c, nil
+}
+
+// put returns a connection to the pool, or closes it if it is broken,
+// too old, or not wanted.
+func (p *LDAPPool) put(c *ldapConn, broken bool) {
+	defer func() { <-p.slots }()
+	now := p.now()
+	c.used = now
+	p.mu.Lock()
+	keep := !broken && !p.closed && len(p.idle) < p.opts.MaxIdle && now.Sub(c.created) < p.opts.MaxLifetime
+	if keep {
+		p.idle = append(p.idle, c)
+	} else {
+		p.stats.Open--
+		switch {
+		case broken:
+			p.stats.Discarded++
+		case !p.closed:
+			p.stats.Expired++
+		}
+	}
+	p.mu.Unlock()
+	if !keep {
+		c.cn.Close()
+	}
+}
+
+func (p *LDAPPool) expired(c *ldapConn, now time.Time) bool {
+	return now.Sub(c.used) >= p.opts.IdleTimeout || now.Sub(c.created) >= p.opts.MaxLifetime
+}
+
+func (p *LDAPPool) count(fn func(*LDAPPoolStats)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn(&p.stats)
+}
+
+// dial connects to server and binds within timeout, and sets timeout as
+// the limit on every operation of the connection.
+func (c *LDAPConfig) dial(server string, timeout time.Duration) (*ldap.Conn, error) {
+	var (
+		tlsConfig *tls.Config
+		err       error
+	)
+	if c.LDAPS || c.UseTLS {
+		if tlsConfig, err = c.TLSConfig(); err != nil {
+			return nil, err
+		}
+		if host, _, err := net.SplitHostPort(server); err == nil && c.ServerName == "" {
+			tlsConfig.ServerName = host
+		}
+	}
+	nc, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	if c.LDAPS {
+		tc := tls.Client(nc, tlsConfig)
+		_ = nc.SetDeadline(time.Now().Add(timeout))
+		if err = tc.Handshake(); err != nil {
+			_ = nc.Close()
+			return nil, ldap.NewError(ldap.ErrorNetwork, err)
+		}
+		_ = nc.SetDeadline(time.Time{})
+		nc = tc
+	}
+	cn := ldap.NewConn(nc, c.LDAPS)
+	cn.Start()
+	cn.SetTimeout(timeout)
+
+	if c.UseTLS && !c.LDAPS {
+		if err = cn.StartTLS(tlsConfig); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	if err = cn.Bind(c.Username, c.Password); err != nil {
+		cn.Close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+// ldapConnErrors prefix the errors ldap.v2 reports, without a result
+// code, for an operation that ran past the connection's timeout or whose
+// connection failed under it.
+var ldapConnErrors = []string{
+	"ldap: connection timed out",
+	"unable to read LDAP response packet",
+	"unable to send request",
+}
+
+// IsLDAPNetworkError reports whether err means the connection is no
+// longer usable, because it failed or an operation on it timed out. Such
+// errors end a read run by LDAPConfig.Do, so that it is tried again on
+// another server.
+func IsLDAPNetworkError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		return true
+	}
+	for _, prefix := range ldapConnErrors {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+package store_test // import "breve.us/authsvc/store"
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	ldap "gopkg.in/ldap.v2"
+
+	"breve.us/authsvc/store"
+	"breve.us/authsvc/store/storetest"
+)
+
+const (
+	serviceDN   = "cn=service,dc=example,dc=com"
+	servicePass = "service-secret"
+)
+
+// newPoolServer returns a directory holding the service account and one
+// user, and a config that binds as the service account.
+func newPoolServer(t *testing.T) (*storetest.LDAPServer, *store.LDAPConfig) {
+	srv := storetest.NewLDAPServer(t)
+	t.Cleanup(srv.Close)
+	srv.Add(serviceDN, map[string][]string{"cn": {"service"}, "userPassword": {servicePass}})
+	srv.Add("uid=alice,dc=example,dc=com", map[string][]string{
+		"objectClass":  {"inetOrgPerson"},
+		"uid":          {"alice"},
+		"userPassword": {"alice-secret"},
+	})
+	return srv, &store.LDAPConfig{
+		Host:     srv.Host(),
+		Port:     srv.Port(),
+		Username: serviceDN,
+		Password: servicePass,
+		BaseDN:   "dc=example,dc=com",
+	}
+}
+
+func search(cn *ldap.Conn) error {
+	_, err := store.SearchLDAP(cn, "dc=example,dc=com", "(uid=alice)", "uid")
+	return err
+}
+
+func TestLDAPPoolReuse(t *testing.T) {
+	srv, cfg := newPoolServer(t)
+	cfg.Pool = store.NewLDAPPool(cfg, store.LDAPPoolOptions{})
+	defer func() { _ = cfg.Pool.Close() }()
+
+	c := store.NewLDAPCache(cfg, "inetOrgPerson", recordFn)
+	for i := 0; i < 5; i++ {
+		if v, err := c.Get("alice"); err != nil || v.(*storetest.Record).Name != "alice" {
+			t.Fatalf("Get() expected alice, got %v (%v)", v, err)
+		}
+	}
+	if err := cfg.Authenticate(context.Background(), "uid=alice,dc=example,dc=com", "alice-secret"); err != nil {
+		t.Errorf("Authenticate() unexpected error %v", err)
+	}
+	for _, password := range []string{"wrong", ""} {
+		if err := cfg.Authenticate(context.Background(), "uid=alice,dc=example,dc=com", password); err != store.ErrInvalidCredentials {
+			t.Errorf("Authenticate(%q) expected %v, got %v", password, store.ErrInvalidCredentials, err)
+		}
+	}
+	if _, err := c.Get("alice"); err != nil {
+		t.Errorf("Get() after Authenticate() unexpected error %v", err)
+	}
+	if n := srv.Conns(); n != 1 {
+		t.Errorf("expected 1 connection, got %d", n)
+	}
+	if s := cfg.Pool.Stats(); s.Dials != 1 || s.Reused != 7 || s.Open != 1 || s.Idle != 1 {
+		t.Errorf("Stats() expected 1 dial and 7 reuses, got %+v", s)
+	}
+}
+
+func TestLDAPPoolTimeouts(t *testing.T) {
+	srv, cfg := newPoolServer(t)
+	pool := store.NewLDAPPool(cfg, store.LDAPPoolOptions{MaxOpen: 1, Timeout: 100 * time.Millisecond})
+	defer func() { _ = pool.Close() }()
+
+	// A connection held past Timeout makes others give up waiting.
+	var wg sync.WaitGroup
+	held := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = pool.Do(context.Background(), func(*ldap.Conn) error {
+			close(held)
+			time.Sleep(300 * time.Millisecond)
+			return nil
+		})
+	}()
+	<-held
+	if err := pool.Do(context.Background(), search); err != store.ErrPoolTimeout {
+		t.Errorf("Do() with the pool exhausted expected %v, got %v", store.ErrPoolTimeout, err)
+	}
+	wg.Wait()
+
+	// A slow operation fails, and its connection is not reused.
+	srv.SetLatency(300 * time.Millisecond)
+	if err := pool.Do(context.Background(), search); err == nil {
+		t.Error("Do() on a slow server expected an error")
+	}
+	srv.SetLatency(0)
+	if err := pool.Do(context.Background(), search); err != nil {
+		t.Errorf("Do() after a timeout unexpected error %v", err)
+	}
+	if s := pool.Stats(); s.Waits != 1 || s.Timeouts != 1 || s.Discarded != 1 || s.Dials != 2 {
+		t.Errorf("Stats() expected a wait, a timeout, a discard and 2 dials, got %+v", s)
+	}
+}
+
+func TestLDAPPoolExpiryAndProbes(t *testing.T) {
+	srv, cfg := newPoolServer(t)
+	pool := store.NewLDAPPool(cfg, store.LDAPPoolOptions{IdleTimeout: 50 * time.Millisecond, ProbeAfter: time.Nanosecond})
+	defer func() { _ = pool.Close() }()
+
+	_ = pool.Do(context.Background(), search)
+	time.Sleep(100 * time.Millisecond)
+	_ = pool.Do(context.Background(), search)
+	if s := pool.Stats(); s.Expired != 1 || s.Dials != 2 {
+		t.Errorf("Stats() expected an idle connection to expire, got %+v", s)
+	}
+
+	// Once the service account cannot bind, the probe of the idle
+	// connection fails, as does dialing a new one.
+	srv.Remove(serviceDN)
+	if err := pool.Do(context.Background(), search); err == nil {
+		t.Error("Do() without a valid service account expected an error")
+	}
+	if s := pool.Stats(); s.ProbeFailures != 1 || s.DialErrors != 1 || s.Open != 0 {
+		t.Errorf("Stats() expected a probe failure and a dial error, got %+v", s)
+	}
+
+	_ = pool.Close()
+	if err := pool.Do(context.Background(), search); err != store.ErrPoolClosed {
+		t.Errorf("Do() after Close() expected %v, got %v", store.ErrPoolClosed, err)
+	}
+}
+
+// newReplicas returns n directories holding the same entries, and a
+// config listing them all.
+func newReplicas(t *testing.T, n int) ([]*storetest.LDAPServer, *store.LDAPConfig) {
+	var (
+		servers []*storetest.LDAPServer
+		cfg     *store.LDAPConfig
+	)
+	for i := 0; i < n; i++ {
+		srv, c := newPoolServer(t)
+		if cfg == nil {
+			cfg = c
+		}
+		servers = append(servers, srv)
+		cfg.Servers = append(cfg.Servers, net.JoinHostPort(srv.Host(), strconv.Itoa(srv.Port())))
+	}
+	return servers, cfg
+}
+
+func TestLDAPPoolFailover(t *testing.T) {
+	servers, cfg := newReplicas(t, 2)
+	cfg.Pool = store.NewLDAPPool(cfg, store.LDAPPoolOptions{Backoff: time.Minute})
+	defer func() { _ = cfg.Pool.Close() }()
+
+	c := store.NewLDAPCache(cfg, "inetOrgPerson", recordFn)
+	if _, err := c.Get("alice"); err != nil {
+		t.Fatalf("Get() unexpected error %v", err)
+	}
+	if servers[0].Conns() != 1 || servers[1].Conns() != 0 {
+		t.Fatalf("ordered pool expected to use the first server, got %d and %d connections", servers[0].Conns(), servers[1].Conns())
+	}
+
+	// The pooled connection to the first server drops; the search is run
+	// again on the second.
+	servers[0].Close()
+	if _, err := c.Get("alice"); err != nil {
+		t.Errorf("Get() after the first server failed unexpected error %v", err)
+	}
+	if err := cfg.Authenticate(context.Background(), "uid=alice,dc=example,dc=com", "alice-secret"); err != nil {
+		t.Errorf("Authenticate() after the first server failed unexpected error %v", err)
+	}
+	if keys, err := c.Keys(); err != nil || len(keys) != 1 {
+		t.Errorf("Keys() expected 1 key, got %v (%v)", keys, err)
+	}
+	if s := cfg.Pool.Stats(); s.Failovers != 1 || s.Dials != 2 {
+		t.Errorf("Stats() expected a failover to the second server, got %+v", s)
+	}
+
+	// Servers that cannot be dialed back off, and are skipped until the
+	// backoff ends.
+	servers[1].Close()
+	if _, err := c.Get("alice"); err == nil {
+		t.Error("Get() with every server down expected an error")
+	}
+	if err := cfg.Pool.Do(context.Background(), search); err == nil || err == store.ErrNoLDAPServer {
+		t.Errorf("Do() dialing the second server expected its error, got %v", err)
+	}
+	if err := cfg.Pool.Do(context.Background(), search); err != store.ErrNoLDAPServer {
+		t.Errorf("Do() with every server backing off expected %v, got %v", store.ErrNoLDAPServer, err)
+	}
+	if s := cfg.Pool.Stats(); s.Unhealthy != 2 || s.DialErrors != 2 || s.Open != 0 {
+		t.Errorf("Stats() expected both servers backing off after a dial error each, got %+v", s)
+	}
+}
+
+func TestLDAPPoolRoundRobin(t *testing.T) {
+	servers, cfg := newReplicas(t, 3)
+	cfg.Balance = store.LDAPRoundRobin
+	pool := store.NewLDAPPool(cfg, store.LDAPPoolOptions{})
+	defer func() { _ = pool.Close() }()
+
+	// Holding every connection open makes each operation dial.
+	var wg sync.WaitGroup
+	held := make(chan struct{})
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = pool.Do(context.Background(), func(*ldap.Conn) error {
+				<-held
+				return nil
+			})
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); pool.Stats().InUse < 6 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	close(held)
+	wg.Wait()
+	for i, srv := range servers {
+		if n := srv.Conns(); n != 2 {
+			t.Errorf("server %d expected 2 connections, got %d", i, n)
+		}
+	}
+}
+
+func TestLDAPConfigFailover(t *testing.T) {
+	servers, cfg := newReplicas(t, 2)
+	servers[0].Close()
+	if err := cfg.Do(context.Background(), search); err != nil {
+		t.Errorf("Do() without a pool unexpected error %v", err)
+	}
+	if servers[1].Conns() != 1 {
+		t.Errorf("expected a connection to the second server, got %d", servers[1].Conns())
+	}
+}
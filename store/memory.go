@@ -1,75 +1,410 @@
 package store // import "breve.us/authsvc/store"
 
 import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/gob"
+	"hash/fnv"
+	"reflect"
 	"sort"
+	"sync"
 	"time"
 )
 
-// NewMemoryCache implementes Cache with an in-memory store
+// NewMemoryCache implementes Cache with an unbounded in-memory store
 func NewMemoryCache() Cache {
-	return &memory{data: map[string]*cacheValue{}}
+	return NewBoundedMemoryCache(MemoryOptions{})
+}
+
+// MemoryOptions configures an in-memory cache. Zero values leave the
+// corresponding limit unbounded.
+type MemoryOptions struct {
+	// Shards is the number of independently locked partitions.
+	Shards int
+	// MaxEntries bounds the number of entries held by the cache.
+	MaxEntries int
+	// MaxBytes bounds the estimated size of the keys and values held
+	// by the cache.
+	MaxBytes int64
+	// SizeFn estimates the size of a value in bytes. If nil, a gob
+	// encoding based estimate is used.
+	SizeFn func(interface{}) int64
+}
+
+const defaultShards = 16
+
+// NewBoundedMemoryCache implements Cache with a sharded in-memory store
+// that evicts the least recently used entries once its limits are
+// reached.
+func NewBoundedMemoryCache(opts MemoryOptions) Cache {
+	return newMemory(opts, time.Now)
+}
+
+func newMemory(opts MemoryOptions, now clockFn) *memory {
+	if opts.Shards <= 0 {
+		opts.Shards = defaultShards
+	}
+	// Every shard needs a share of each limit, as a zero share would
+	// leave it unbounded.
+	if opts.MaxEntries > 0 && opts.Shards > opts.MaxEntries {
+		opts.Shards = opts.MaxEntries
+	}
+	if opts.MaxBytes > 0 && int64(opts.Shards) > opts.MaxBytes {
+		opts.Shards = int(opts.MaxBytes)
+	}
+	if opts.SizeFn == nil {
+		opts.SizeFn = estimateSize
+	}
+	m := &memory{now: now, size: opts.SizeFn}
+	for i := 0; i < opts.Shards; i++ {
+		m.shards = append(m.shards, &shard{
+			items:      map[string]*list.Element{},
+			lru:        list.New(),
+			maxEntries: perShard(int64(opts.MaxEntries), opts.Shards, i),
+			maxBytes:   perShard(opts.MaxBytes, opts.Shards, i),
+		})
+	}
+	return m
+}
+
+// perShard returns the share of total held by shard i, spreading the
+// remainder over the first shards so that the shares add up to total.
+func perShard(total int64, shards int, i int) int64 {
+	if total <= 0 {
+		return 0
+	}
+	n := total / int64(shards)
+	if int64(i) < total%int64(shards) {
+		n++
+	}
+	return n
 }
 
 type clockFn func() time.Time
 
 type memory struct {
-	now  clockFn
-	data map[string]*cacheValue
+	now    clockFn
+	size   func(interface{}) int64
+	shards []*shard
+	watch  watchers
+}
+
+type shard struct {
+	mu         sync.Mutex
+	items      map[string]*list.Element
+	lru        *list.List
+	maxEntries int64
+	maxBytes   int64
+	bytes      int64
+}
+
+type memoryEntry struct {
+	v    *cacheValue
+	size int64
 }
 
 func (m *memory) Put(key string, value interface{}) error {
-	if m == nil || m.data == nil {
-		return ErrInternal
-	}
-	m.data[key] = &cacheValue{Key: key, Value: value}
-	return nil
+	return m.PutContext(context.Background(), key, value)
 }
 
 func (m *memory) PutUntil(expire time.Time, key string, value interface{}) error {
-	if m == nil || m.data == nil {
+	return m.PutUntilContext(context.Background(), expire, key, value)
+}
+
+func (m *memory) Get(key string) (interface{}, error) {
+	return m.GetContext(context.Background(), key)
+}
+
+func (m *memory) Delete(key string) error {
+	return m.DeleteContext(context.Background(), key)
+}
+
+func (m *memory) Keys() ([]string, error) {
+	return m.KeysContext(context.Background())
+}
+
+func (m *memory) PutContext(ctx context.Context, key string, value interface{}) error {
+	return m.PutUntilContext(ctx, time.Time{}, key, value)
+}
+
+func (m *memory) PutUntilContext(ctx context.Context, expire time.Time, key string, value interface{}) error {
+	if m == nil || m.shards == nil {
 		return ErrInternal
 	}
-	m.data[key] = &cacheValue{Key: key, Expire: expire, Value: value}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Deferred first, so watchers are told after the lock is released.
+	var events []Event
+	defer m.watch.notify(&events)
+	s := m.shard(key)
+	size := m.entrySize(s, key, value)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events = s.put(&cacheValue{Key: key, Expire: expire, Value: value}, size)
 	return nil
 }
 
-func (m *memory) Get(key string) (interface{}, error) {
-	if m == nil || m.data == nil {
+func (m *memory) GetContext(ctx context.Context, key string) (interface{}, error) {
+	v, err := m.getValue(ctx, key)
+	return v.value(), err
+}
+
+func (m *memory) GetWithExpiry(ctx context.Context, key string) (interface{}, time.Time, error) {
+	v, err := m.getValue(ctx, key)
+	return v.value(), v.expiry(), err
+}
+
+func (m *memory) getValue(ctx context.Context, key string) (*cacheValue, error) {
+	if m == nil || m.shards == nil {
 		return nil, ErrInternal
 	}
-	v, ok := m.data[key]
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var events []Event
+	defer m.watch.notify(&events)
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.items[key]
 	if !ok {
 		return nil, ErrNotFound
 	}
-	if m.now == nil {
-		m.now = time.Now
-	}
-	if !v.Expire.IsZero() && v.Expire.Before(m.now()) {
-		delete(m.data, key)
-		return v.Value, ErrExpired
+	v := e.Value.(*memoryEntry).v
+	if v.expired(m.now()) {
+		s.remove(e)
+		events = append(events, Event{Type: EventExpire, Key: key})
+		return v, ErrExpired
 	}
-	return v.Value, nil
+	s.lru.MoveToFront(e)
+	return v, nil
 }
 
-func (m *memory) Delete(key string) error {
-	if m == nil || m.data == nil {
+func (m *memory) DeleteContext(ctx context.Context, key string) error {
+	if m == nil || m.shards == nil {
 		return ErrInternal
 	}
-	_, ok := m.data[key]
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var events []Event
+	defer m.watch.notify(&events)
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.items[key]
 	if !ok {
 		return ErrNotFound
 	}
-	delete(m.data, key)
+	s.remove(e)
+	events = append(events, Event{Type: EventDelete, Key: key})
 	return nil
 }
 
-func (m *memory) Keys() ([]string, error) {
+func (m *memory) GetAndDelete(ctx context.Context, key string) (interface{}, error) {
+	if m == nil || m.shards == nil {
+		return nil, ErrInternal
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var events []Event
+	defer m.watch.notify(&events)
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.items[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	s.remove(e)
+	events = append(events, Event{Type: EventDelete, Key: key})
+	v := e.Value.(*memoryEntry).v
+	if v.expired(m.now()) {
+		return v.Value, ErrExpired
+	}
+	return v.Value, nil
+}
+
+func (m *memory) PutIfAbsent(ctx context.Context, expire time.Time, key string, value interface{}) (bool, error) {
+	if m == nil || m.shards == nil {
+		return false, ErrInternal
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	var events []Event
+	defer m.watch.notify(&events)
+	s := m.shard(key)
+	size := m.entrySize(s, key, value)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[key]; ok && !e.Value.(*memoryEntry).v.expired(m.now()) {
+		return false, nil
+	}
+	events = s.put(&cacheValue{Key: key, Expire: expire, Value: value}, size)
+	return true, nil
+}
+
+func (m *memory) CompareAndSwap(ctx context.Context, key string, old, new interface{}, expire time.Time) (bool, error) {
+	if m == nil || m.shards == nil {
+		return false, ErrInternal
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	var events []Event
+	defer m.watch.notify(&events)
+	s := m.shard(key)
+	size := m.entrySize(s, key, new)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.items[key]
+	if !ok || e.Value.(*memoryEntry).v.expired(m.now()) {
+		return false, ErrNotFound
+	}
+	if !reflect.DeepEqual(e.Value.(*memoryEntry).v.Value, old) {
+		return false, nil
+	}
+	events = s.put(&cacheValue{Key: key, Expire: expire, Value: new}, size)
+	return true, nil
+}
+
+func (m *memory) KeysContext(ctx context.Context) ([]string, error) {
 	var keys []string
+	if err := ctx.Err(); err != nil {
+		return keys, err
+	}
 	if m != nil {
-		for k := range m.data {
-			keys = append(keys, k)
+		for _, s := range m.shards {
+			s.mu.Lock()
+			for k := range s.items {
+				keys = append(keys, k)
+			}
+			s.mu.Unlock()
 		}
 	}
 	sort.Strings(keys)
 	return keys, nil
 }
+
+func (m *memory) Scan(prefix string, cursor string, limit int) ([]string, string, error) {
+	keys, err := m.Keys()
+	if err != nil {
+		return nil, "", err
+	}
+	page, next := scanSorted(keys, prefix, cursor, limit)
+	return page, next, nil
+}
+
+func (m *memory) Range(prefix string, fn func(key string) bool) error {
+	keys, err := m.Keys()
+	if err != nil {
+		return err
+	}
+	rangeSorted(keys, prefix, fn)
+	return nil
+}
+
+func (m *memory) Sweep(now time.Time) (int, error) {
+	if m == nil || m.shards == nil {
+		return 0, ErrInternal
+	}
+	var events []Event
+	for _, s := range m.shards {
+		s.mu.Lock()
+		for key, e := range s.items {
+			if e.Value.(*memoryEntry).v.expired(now) {
+				s.remove(e)
+				events = append(events, Event{Type: EventExpire, Key: key})
+			}
+		}
+		s.mu.Unlock()
+	}
+	m.watch.notify(&events)
+	return len(events), nil
+}
+
+func (m *memory) SetClock(now func() time.Time) { m.now = now }
+
+func (m *memory) Watch(prefix string, fn func(Event)) func() { return m.watch.Watch(prefix, fn) }
+
+func (m *memory) Close() error { return nil }
+
+func (m *memory) shard(key string) *shard {
+	if len(m.shards) == 1 {
+		return m.shards[0]
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return m.shards[h.Sum32()%uint32(len(m.shards))]
+}
+
+// put stores v, evicting entries as needed, and returns the events for
+// watchers; callers must hold s.mu.
+// entrySize estimates the size of an entry of s, which is only needed
+// when s is bounded in bytes. It is called before taking s.mu, as the
+// estimate may encode the value.
+func (m *memory) entrySize(s *shard, key string, value interface{}) int64 {
+	if s.maxBytes <= 0 {
+		return 0
+	}
+	return int64(len(key)) + m.size(value)
+}
+
+func (s *shard) put(v *cacheValue, size int64) []Event {
+	if e, ok := s.items[v.Key]; ok {
+		s.remove(e)
+	}
+	s.items[v.Key] = s.lru.PushFront(&memoryEntry{v: v, size: size})
+	s.bytes += size
+	events := []Event{{Type: EventPut, Key: v.Key}}
+	for s.over() {
+		evicted := s.lru.Back()
+		s.remove(evicted)
+		events = append(events, Event{Type: EventExpire, Key: evicted.Value.(*memoryEntry).v.Key})
+	}
+	return events
+}
+
+// over reports whether the shard exceeds its limits. A single entry is
+// always retained, even if it alone exceeds the byte budget.
+func (s *shard) over() bool {
+	if s.lru.Len() <= 1 {
+		return false
+	}
+	if s.maxEntries > 0 && int64(s.lru.Len()) > s.maxEntries {
+		return true
+	}
+	return s.maxBytes > 0 && s.bytes > s.maxBytes
+}
+
+func (s *shard) remove(e *list.Element) {
+	me := s.lru.Remove(e).(*memoryEntry)
+	delete(s.items, me.v.Key)
+	s.bytes -= me.size
+}
+
+func estimateSize(value interface{}) int64 {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	case []string:
+		var n int64
+		for _, s := range v {
+			n += int64(len(s))
+		}
+		return n
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return 64
+	}
+	return int64(buf.Len())
+}
@@ -0,0 +1,146 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+// Expirer is implemented by caches that can report when a value
+// expires, so that it can be copied elsewhere with the same expiry.
+type Expirer interface {
+	// GetWithExpiry is GetContext, also returning the expiry time; the
+	// zero time means the value does not expire.
+	GetWithExpiry(ctx context.Context, key string) (interface{}, time.Time, error)
+}
+
+// MigrateChange classifies a key compared between two caches.
+type MigrateChange int
+
+// Migrate Changes
+const (
+	// MigrateAdd is a key only in the source.
+	MigrateAdd MigrateChange = iota
+	// MigrateUpdate is a key whose value or expiry differs.
+	MigrateUpdate
+	// MigrateSame is a key with the same value and expiry in both.
+	MigrateSame
+	// MigrateExpired is a key that expired in the source, and is not
+	// copied.
+	MigrateExpired
+	// MigrateExtra is a key only in the destination, which is left
+	// alone.
+	MigrateExtra
+)
+
+func (c MigrateChange) String() string {
+	switch c {
+	case MigrateAdd:
+		return "add"
+	case MigrateUpdate:
+		return "update"
+	case MigrateSame:
+		return "same"
+	case MigrateExpired:
+		return "expired"
+	case MigrateExtra:
+		return "extra"
+	default:
+		return "unknown"
+	}
+}
+
+// MigrateOptions configures Migrate.
+type MigrateOptions struct {
+	// DryRun compares the caches without writing to the destination.
+	DryRun bool
+	// Diff, if set, is called with every key and how it compares.
+	Diff func(key string, change MigrateChange)
+	// Progress, if set, is called after each source key with the
+	// number of keys done and the total.
+	Progress func(done, total int)
+}
+
+// MigrateStats counts keys by how they compared.
+type MigrateStats map[MigrateChange]int
+
+// Migrate copies every unexpired value in from to to, keeping expiry
+// times when from implements Expirer. Keys whose value and expiry
+// already match are not rewritten, and keys only in to are kept.
+func Migrate(ctx context.Context, from, to Cache, opts MigrateOptions) (MigrateStats, error) {
+	stats := MigrateStats{}
+	report := func(key string, change MigrateChange) {
+		stats[change]++
+		if opts.Diff != nil {
+			opts.Diff(key, change)
+		}
+	}
+
+	keys, err := from.Keys()
+	if err != nil {
+		return stats, err
+	}
+	seen := make(map[string]bool, len(keys))
+	progress := func(done int) {
+		if opts.Progress != nil {
+			opts.Progress(done, len(keys))
+		}
+	}
+	for i, key := range keys {
+		if err = ctx.Err(); err != nil {
+			return stats, err
+		}
+		seen[key] = true
+		value, expire, err := getWithExpiry(ctx, from, key)
+		switch err {
+		case nil:
+		case ErrExpired, ErrNotFound:
+			// Keys that expire, or are deleted, while the migration
+			// runs are not copied.
+			report(key, MigrateExpired)
+			progress(i + 1)
+			continue
+		default:
+			return stats, err
+		}
+
+		change := MigrateAdd
+		old, oldExpire, err := getWithExpiry(ctx, to, key)
+		switch err {
+		case nil:
+			change = MigrateUpdate
+			if oldExpire.Equal(expire) && reflect.DeepEqual(old, value) {
+				change = MigrateSame
+			}
+		case ErrExpired, ErrNotFound:
+		default:
+			return stats, err
+		}
+		if change != MigrateSame && !opts.DryRun {
+			if err = to.PutUntil(expire, key, value); err != nil {
+				return stats, err
+			}
+		}
+		report(key, change)
+		progress(i + 1)
+	}
+
+	existing, err := to.Keys()
+	if err != nil {
+		return stats, err
+	}
+	for _, key := range existing {
+		if !seen[key] {
+			report(key, MigrateExtra)
+		}
+	}
+	return stats, nil
+}
+
+func getWithExpiry(ctx context.Context, c Cache, key string) (interface{}, time.Time, error) {
+	if e, ok := c.(Expirer); ok {
+		return e.GetWithExpiry(ctx, key)
+	}
+	v, err := c.Get(key)
+	return v, time.Time{}, err
+}
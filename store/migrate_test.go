@@ -0,0 +1,69 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	from := newMemory(MemoryOptions{}, present)
+	_ = from.Put("forever", "one")
+	_ = from.PutUntil(future(), "expiring", "two")
+	_ = from.PutUntil(past(), "expired", "three")
+	_ = from.Put("changed", "new")
+	_ = from.Put("same", "value")
+
+	to := boltFactory(present)
+	defer func() { _ = to.Close() }()
+	_ = to.Put("changed", "old")
+	_ = to.Put("same", "value")
+	_ = to.Put("extra", "kept")
+
+	diff := map[string]MigrateChange{}
+	stats, err := Migrate(context.Background(), from, to, MigrateOptions{
+		DryRun: true,
+		Diff:   func(key string, change MigrateChange) { diff[key] = change },
+	})
+	if err != nil {
+		t.Fatalf("Migrate() dry run unexpected error %v", err)
+	}
+	want := map[string]MigrateChange{
+		"forever":  MigrateAdd,
+		"expiring": MigrateAdd,
+		"expired":  MigrateExpired,
+		"changed":  MigrateUpdate,
+		"same":     MigrateSame,
+		"extra":    MigrateExtra,
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("Migrate() dry run expected %v, got %v", want, diff)
+	}
+	if stats[MigrateAdd] != 2 || stats[MigrateExtra] != 1 {
+		t.Errorf("Migrate() dry run expected 2 added and 1 extra, got %v", stats)
+	}
+	if _, err = to.Get("forever"); err != ErrNotFound {
+		t.Errorf("Migrate() dry run expected no writes, got %v", err)
+	}
+
+	var done, total int
+	if _, err = Migrate(context.Background(), from, to, MigrateOptions{
+		Progress: func(d, n int) { done, total = d, n },
+	}); err != nil {
+		t.Fatalf("Migrate() unexpected error %v", err)
+	}
+	if done != 4 || total != 4 {
+		t.Errorf("Migrate() expected progress to reach 4/4, got %d/%d", done, total)
+	}
+	if v, exp, err := to.(Expirer).GetWithExpiry(context.Background(), "expiring"); v != "two" || !exp.Equal(future()) || err != nil {
+		t.Errorf("Migrate() expected expiry %v to be kept, got %v until %v (%v)", future(), v, exp, err)
+	}
+	for key, value := range map[string]string{"forever": "one", "changed": "new", "extra": "kept"} {
+		if v, err := to.Get(key); v != value || err != nil {
+			t.Errorf("Get(%q) after Migrate() expected %v, got %v (%v)", key, value, v, err)
+		}
+	}
+	if _, err = to.Get("expired"); err != ErrNotFound {
+		t.Errorf("Migrate() expected expired keys to be skipped, got %v", err)
+	}
+}
@@ -0,0 +1,1026 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Raft Errors
+var (
+	ErrNotLeader   = errors.New("raft: not the leader")
+	ErrNoLeader    = errors.New("raft: no leader elected")
+	ErrRaftConfig  = errors.New("raft: node must be one of its peers")
+	ErrRaftPeers   = errors.New("raft: invalid peer list")
+	ErrRaftClosed  = errors.New("raft: node closed")
+	ErrRaftAuth    = errors.New("raft: unauthorized peer")
+	ErrRaftSecret  = errors.New("raft: a shared secret is required")
+	ErrRaftReplica = errors.New("raft: entry replaced by a new leader")
+)
+
+// RaftConfig configures a node of a replicated store.
+type RaftConfig struct {
+	// ID names this node; it must be a key of Peers.
+	ID string
+	// Peers maps the ID of every node, this one included, to the base
+	// URL its transport is served on, such as http://10.0.0.1:42002.
+	Peers map[string]string
+	// Path is the BoltDB file holding the log and the replicated
+	// buckets.
+	Path string
+	// Secret must be presented by peers on every request.
+	Secret string
+	// Listener, if set, serves the transport until the node is closed.
+	Listener net.Listener
+
+	// HeartbeatInterval is how often the leader contacts followers.
+	HeartbeatInterval time.Duration
+	// ElectionTimeout is how long a follower waits to hear from a
+	// leader before standing for election; each wait is randomised
+	// between it and twice it.
+	ElectionTimeout time.Duration
+	// ApplyTimeout bounds how long an operation waits to be committed.
+	ApplyTimeout time.Duration
+	// SnapshotEntries is how many applied entries the log keeps before
+	// they are compacted; zero keeps 8192.
+	SnapshotEntries int
+}
+
+// ParseRaftPeers parses a comma separated list of id=URL pairs naming
+// every node of a cluster.
+func ParseRaftPeers(spec string) (map[string]string, error) {
+	peers := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, ErrRaftPeers
+		}
+		if u, err := url.Parse(parts[1]); err != nil || u.Host == "" {
+			return nil, ErrRaftPeers
+		}
+		if _, dup := peers[parts[0]]; dup {
+			return nil, ErrRaftPeers
+		}
+		peers[parts[0]] = parts[1]
+	}
+	return peers, nil
+}
+
+const (
+	raftFollower = iota
+	raftCandidate
+	raftLeader
+)
+
+const (
+	raftMetaBucket = "raft"
+	raftLogBucket  = "raft.log"
+	raftDataPrefix = "data."
+
+	// raftBatch and raftBatchSize cap the entries sent in one append
+	// request, though at least one entry is always sent.
+	raftBatch     = 256
+	raftBatchSize = 1 << 20
+)
+
+var (
+	raftTermKey         = []byte("term")
+	raftVoteKey         = []byte("vote")
+	raftAppliedKey      = []byte("applied")
+	raftSnapshotKey     = []byte("snapshot")
+	raftSnapshotTermKey = []byte("snapshot.term")
+)
+
+// raftEntry is one entry of the replicated log. A nil Command is the
+// no-op a new leader commits to learn the commit index.
+type raftEntry struct {
+	Term    uint64
+	Command []byte
+}
+
+// raftWaiter is a proposal waiting for its entry to be applied.
+type raftWaiter struct {
+	term uint64
+	ch   chan raftResult
+}
+
+// RaftNode is a member of a cluster replicating buckets of a BoltDB
+// file with the Raft consensus algorithm. Writes through any node are
+// committed by the leader once a majority of peers hold them, and reads
+// confirm with a majority that they see every committed write.
+//
+// Membership is fixed by the configuration. Applied entries are
+// compacted from the log, the buckets standing in for them, so a node
+// too far behind, or one that has lost its file, is sent the leader's
+// buckets whole.
+type RaftNode struct {
+	cfg       RaftConfig
+	db        *BoltDB
+	transport raftTransport
+	server    *http.Server
+
+	mu          sync.Mutex
+	state       int
+	term        uint64
+	votedFor    string
+	leader      string
+	lastIndex   uint64
+	lastTerm    uint64
+	commitIndex uint64
+	applied     uint64
+	// snapIndex and snapTerm are the last entry compacted from the log.
+	snapIndex  uint64
+	snapTerm   uint64
+	deadline   time.Time
+	heartbeat  time.Time
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	sending    map[string]bool
+	waiters    map[uint64]raftWaiter
+	appliedCh  chan struct{}
+
+	// applyMu is held while the buckets are written, by the applier or
+	// by a snapshot replacing them.
+	applyMu sync.Mutex
+
+	watchMu  sync.Mutex
+	watchers map[string]*watchers
+
+	commitCh chan struct{}
+	kickCh   chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+	closed   sync.Once
+}
+
+// NewRaftNode opens the node's database and starts it as a follower.
+func NewRaftNode(cfg RaftConfig) (*RaftNode, error) {
+	if _, ok := cfg.Peers[cfg.ID]; !ok || cfg.ID == "" {
+		return nil, ErrRaftConfig
+	}
+	if cfg.Secret == "" {
+		return nil, ErrRaftSecret
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = 100 * time.Millisecond
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = 10 * cfg.HeartbeatInterval
+	}
+	if cfg.ApplyTimeout <= 0 {
+		cfg.ApplyTimeout = 5 * time.Second
+	}
+	if cfg.SnapshotEntries <= 0 {
+		cfg.SnapshotEntries = 8192
+	}
+	db, err := OpenBoltDB(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	n := &RaftNode{
+		cfg:        cfg,
+		db:         db,
+		transport:  newHTTPTransport(cfg.Peers, cfg.Secret),
+		nextIndex:  map[string]uint64{},
+		matchIndex: map[string]uint64{},
+		sending:    map[string]bool{},
+		waiters:    map[uint64]raftWaiter{},
+		appliedCh:  make(chan struct{}),
+		commitCh:   make(chan struct{}, 1),
+		kickCh:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	if err = n.load(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	n.resetDeadline()
+	if cfg.Listener != nil {
+		n.server = &http.Server{Handler: n.Handler()}
+		go func() { _ = n.server.Serve(cfg.Listener) }()
+	}
+	n.wg.Add(2)
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+// load reads the persistent state left by a previous run.
+func (n *RaftNode) load() error {
+	return n.db.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(raftMetaBucket))
+		if err != nil {
+			return err
+		}
+		log, err := tx.CreateBucketIfNotExists([]byte(raftLogBucket))
+		if err != nil {
+			return err
+		}
+		n.term = decodeIndex(meta.Get(raftTermKey))
+		n.votedFor = string(meta.Get(raftVoteKey))
+		n.applied = decodeIndex(meta.Get(raftAppliedKey))
+		n.commitIndex = n.applied
+		n.snapIndex = decodeIndex(meta.Get(raftSnapshotKey))
+		n.snapTerm = decodeIndex(meta.Get(raftSnapshotTermKey))
+		n.lastIndex, n.lastTerm = n.snapIndex, n.snapTerm
+		if k, v := log.Cursor().Last(); k != nil {
+			e, err := decodeEntry(v)
+			if err != nil {
+				return err
+			}
+			n.lastIndex, n.lastTerm = decodeIndex(k), e.Term
+		}
+		return nil
+	})
+}
+
+// Leader returns the ID of the node this node believes leads the
+// cluster, or the empty string if it knows of none.
+func (n *RaftNode) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// IsLeader reports whether this node is the leader.
+func (n *RaftNode) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state == raftLeader
+}
+
+// Close stops the node and releases its database.
+func (n *RaftNode) Close() error {
+	var err error
+	n.closed.Do(func() {
+		close(n.done)
+		if n.server != nil {
+			_ = n.server.Close()
+		}
+		n.wg.Wait()
+		err = n.db.Close()
+	})
+	return err
+}
+
+func (n *RaftNode) quorum() int { return len(n.cfg.Peers)/2 + 1 }
+
+// resetDeadline picks the time to stand for election if no leader is
+// heard from. The caller holds n.mu.
+func (n *RaftNode) resetDeadline() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.deadline = time.Now().Add(timeout)
+}
+
+func (n *RaftNode) run() {
+	defer n.wg.Done()
+	t := time.NewTicker(n.cfg.HeartbeatInterval / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-t.C:
+			n.tick()
+		case <-n.kickCh:
+			n.mu.Lock()
+			if n.state == raftLeader {
+				n.broadcast()
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+func (n *RaftNode) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	switch {
+	case n.state == raftLeader && now.Sub(n.heartbeat) >= n.cfg.HeartbeatInterval:
+		n.broadcast()
+	case n.state != raftLeader && now.After(n.deadline):
+		n.startElection()
+	}
+}
+
+// kick asks the leader to replicate new entries now rather than at the
+// next heartbeat.
+func (n *RaftNode) kick() {
+	select {
+	case n.kickCh <- struct{}{}:
+	default:
+	}
+}
+
+// setTerm moves to a newer term as a follower. The caller holds n.mu.
+func (n *RaftNode) setTerm(term uint64) error {
+	n.state = raftFollower
+	n.term = term
+	n.votedFor = ""
+	n.leader = ""
+	return n.saveState()
+}
+
+// saveState persists the term and vote. The caller holds n.mu.
+func (n *RaftNode) saveState() error {
+	return n.db.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(raftMetaBucket))
+		if err := meta.Put(raftTermKey, encodeIndex(n.term)); err != nil {
+			return err
+		}
+		return meta.Put(raftVoteKey, []byte(n.votedFor))
+	})
+}
+
+func (n *RaftNode) startElection() {
+	n.state = raftCandidate
+	n.term++
+	n.votedFor = n.cfg.ID
+	n.leader = ""
+	n.resetDeadline()
+	if err := n.saveState(); err != nil {
+		return
+	}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	req := voteRequest{Term: n.term, Candidate: n.cfg.ID, LastIndex: n.lastIndex, LastTerm: n.lastTerm}
+	for id := range n.cfg.Peers {
+		if id == n.cfg.ID {
+			continue
+		}
+		go func(id string) {
+			var resp voteResponse
+			ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+			defer cancel()
+			if err := n.transport.call(ctx, id, "vote", &req, &resp); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				_ = n.setTerm(resp.Term)
+				return
+			}
+			if n.state != raftCandidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+			if votes++; votes == n.quorum() {
+				n.becomeLeader()
+			}
+		}(id)
+	}
+}
+
+// becomeLeader takes over the cluster, appending a no-op so that
+// entries of earlier terms are committed. The caller holds n.mu.
+func (n *RaftNode) becomeLeader() {
+	n.state = raftLeader
+	n.leader = n.cfg.ID
+	for id := range n.cfg.Peers {
+		n.nextIndex[id] = n.lastIndex + 1
+		n.matchIndex[id] = 0
+	}
+	if _, err := n.appendLocal(nil); err != nil {
+		_ = n.setTerm(n.term)
+		return
+	}
+	n.broadcast()
+}
+
+// appendLocal appends a command to the leader's log. The caller holds
+// n.mu.
+func (n *RaftNode) appendLocal(command []byte) (uint64, error) {
+	index := n.lastIndex + 1
+	if err := n.writeEntries(index, []raftEntry{{Term: n.term, Command: command}}); err != nil {
+		return 0, err
+	}
+	n.matchIndex[n.cfg.ID] = index
+	n.advanceCommit()
+	return index, nil
+}
+
+// writeEntries replaces the log from index on with entries. The caller
+// holds n.mu.
+func (n *RaftNode) writeEntries(index uint64, entries []raftEntry) error {
+	err := n.db.db.Update(func(tx *bolt.Tx) error {
+		log := tx.Bucket([]byte(raftLogBucket))
+		c := log.Cursor()
+		for k, _ := c.Seek(encodeIndex(index)); k != nil; k, _ = c.Seek(encodeIndex(index)) {
+			if err := log.Delete(k); err != nil {
+				return err
+			}
+		}
+		for i, e := range entries {
+			data, err := encodeEntry(&e)
+			if err != nil {
+				return err
+			}
+			if err = log.Put(encodeIndex(index+uint64(i)), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	n.lastIndex = index + uint64(len(entries)) - 1
+	n.lastTerm = entries[len(entries)-1].Term
+	return nil
+}
+
+// termAt returns the term of the entry at index, zero for index zero.
+// The terms of compacted entries are unknown, but for the last.
+func (n *RaftNode) termAt(index uint64) (uint64, bool) {
+	if index == n.snapIndex {
+		return n.snapTerm, true
+	}
+	if index < n.snapIndex {
+		return 0, false
+	}
+	if index == n.lastIndex {
+		return n.lastTerm, true
+	}
+	var (
+		term uint64
+		ok   bool
+	)
+	_ = n.db.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket([]byte(raftLogBucket)).Get(encodeIndex(index)); data != nil {
+			if e, err := decodeEntry(data); err == nil {
+				term, ok = e.Term, true
+			}
+		}
+		return nil
+	})
+	return term, ok
+}
+
+func (n *RaftNode) entriesFrom(index uint64) ([]raftEntry, error) {
+	var entries []raftEntry
+	err := n.db.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(raftLogBucket)).Cursor()
+		size := 0
+		for k, v := c.Seek(encodeIndex(index)); k != nil && len(entries) < raftBatch; k, v = c.Next() {
+			if size += len(v); size > raftBatchSize && len(entries) > 0 {
+				break
+			}
+			e, err := decodeEntry(v)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, *e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// broadcast sends append requests to every follower without one in
+// flight. The caller holds n.mu.
+func (n *RaftNode) broadcast() {
+	n.heartbeat = time.Now()
+	for id := range n.cfg.Peers {
+		if id == n.cfg.ID || n.sending[id] {
+			continue
+		}
+		n.sending[id] = true
+		go n.replicate(id)
+	}
+}
+
+// appendRequest builds the next append request for a follower. The
+// caller holds n.mu.
+func (n *RaftNode) appendRequest(id string) (*appendRequest, error) {
+	next := n.nextIndex[id]
+	// A follower behind the compacted entries is sent a snapshot by
+	// replicate; a heartbeat to it starts after them.
+	if next <= n.snapIndex {
+		next = n.snapIndex + 1
+	}
+	prevTerm, ok := n.termAt(next - 1)
+	if !ok {
+		return nil, ErrInternal
+	}
+	entries, err := n.entriesFrom(next)
+	if err != nil {
+		return nil, err
+	}
+	return &appendRequest{
+		Term:      n.term,
+		Leader:    n.cfg.ID,
+		PrevIndex: next - 1,
+		PrevTerm:  prevTerm,
+		Entries:   entries,
+		Commit:    n.commitIndex,
+	}, nil
+}
+
+func (n *RaftNode) replicate(id string) {
+	n.mu.Lock()
+	if n.state != raftLeader {
+		n.sending[id] = false
+		n.mu.Unlock()
+		return
+	}
+	if n.nextIndex[id] <= n.snapIndex {
+		term := n.term
+		n.mu.Unlock()
+		n.sendSnapshot(id, term)
+		return
+	}
+	req, err := n.appendRequest(id)
+	n.mu.Unlock()
+
+	var resp appendResponse
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+		err = n.transport.call(ctx, id, "append", req, &resp)
+		cancel()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sending[id] = false
+	if err != nil {
+		return
+	}
+	if resp.Term > n.term {
+		_ = n.setTerm(resp.Term)
+		return
+	}
+	if n.state != raftLeader || n.term != req.Term {
+		return
+	}
+	if !resp.Success {
+		// Back up to the follower's log, and try again.
+		next := req.PrevIndex
+		if resp.LastIndex+1 < next {
+			next = resp.LastIndex + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[id] = next
+		n.kick()
+		return
+	}
+	match := req.PrevIndex + uint64(len(req.Entries))
+	if match > n.matchIndex[id] {
+		n.matchIndex[id] = match
+	}
+	n.nextIndex[id] = match + 1
+	n.advanceCommit()
+	if n.nextIndex[id] <= n.lastIndex {
+		n.kick()
+	}
+}
+
+// advanceCommit commits the latest entry of this term held by a
+// majority. The caller holds n.mu.
+func (n *RaftNode) advanceCommit() {
+	for index := n.lastIndex; index > n.commitIndex; index-- {
+		if term, _ := n.termAt(index); term != n.term {
+			break
+		}
+		count := 0
+		for id := range n.cfg.Peers {
+			if n.matchIndex[id] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.setCommit(index)
+			return
+		}
+	}
+}
+
+// setCommit records a new commit index and wakes the applier. The
+// caller holds n.mu.
+func (n *RaftNode) setCommit(index uint64) {
+	if index <= n.commitIndex {
+		return
+	}
+	n.commitIndex = index
+	n.signalCommit()
+}
+
+// signalCommit wakes the applier.
+func (n *RaftNode) signalCommit() {
+	select {
+	case n.commitCh <- struct{}{}:
+	default:
+	}
+}
+
+func (n *RaftNode) handleVote(req *voteRequest) (*voteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.term {
+		if err := n.setTerm(req.Term); err != nil {
+			return nil, err
+		}
+	}
+	resp := &voteResponse{Term: n.term}
+	if req.Term < n.term || (n.votedFor != "" && n.votedFor != req.Candidate) {
+		return resp, nil
+	}
+	// Only vote for candidates whose log is at least as up to date.
+	if req.LastTerm < n.lastTerm || (req.LastTerm == n.lastTerm && req.LastIndex < n.lastIndex) {
+		return resp, nil
+	}
+	n.votedFor = req.Candidate
+	if err := n.saveState(); err != nil {
+		return nil, err
+	}
+	n.resetDeadline()
+	resp.Granted = true
+	return resp, nil
+}
+
+func (n *RaftNode) handleAppend(req *appendRequest) (*appendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.term {
+		if err := n.setTerm(req.Term); err != nil {
+			return nil, err
+		}
+	}
+	resp := &appendResponse{Term: n.term, LastIndex: n.lastIndex}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	n.state = raftFollower
+	n.leader = req.Leader
+	n.resetDeadline()
+
+	if req.PrevIndex > n.lastIndex {
+		return resp, nil
+	}
+	// Compacted entries are committed, so they match the leader's; skip
+	// those sent again.
+	if match := req.PrevIndex + uint64(len(req.Entries)); match <= n.snapIndex {
+		if req.Commit < match {
+			match = req.Commit
+		}
+		n.setCommit(match)
+		resp.Success = true
+		return resp, nil
+	} else if req.PrevIndex < n.snapIndex {
+		skip := n.snapIndex - req.PrevIndex
+		req.PrevIndex, req.PrevTerm = n.snapIndex, req.Entries[skip-1].Term
+		req.Entries = req.Entries[skip:]
+	}
+	if term, ok := n.termAt(req.PrevIndex); !ok || term != req.PrevTerm {
+		resp.LastIndex = req.PrevIndex - 1
+		return resp, nil
+	}
+	// Skip the entries already held, and replace the log from the
+	// first that differs.
+	for i, e := range req.Entries {
+		index := req.PrevIndex + 1 + uint64(i)
+		if term, ok := n.termAt(index); ok && index <= n.lastIndex && term == e.Term {
+			continue
+		}
+		if err := n.writeEntries(index, req.Entries[i:]); err != nil {
+			return nil, err
+		}
+		break
+	}
+	last := req.PrevIndex + uint64(len(req.Entries))
+	if req.Commit < last {
+		last = req.Commit
+	}
+	n.setCommit(last)
+	resp.Success = true
+	resp.LastIndex = n.lastIndex
+	return resp, nil
+}
+
+func (n *RaftNode) applyLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.done:
+			n.mu.Lock()
+			for index, w := range n.waiters {
+				w.ch <- raftResult{Err: ErrRaftClosed.Error()}
+				delete(n.waiters, index)
+			}
+			n.mu.Unlock()
+			return
+		case <-n.commitCh:
+			if err := n.applyCommitted(); err != nil {
+				time.AfterFunc(n.cfg.HeartbeatInterval, n.signalCommit)
+				continue
+			}
+			_ = n.compact()
+		}
+	}
+}
+
+// applyCommitted applies the committed entries to the buckets, in one
+// transaction with the new applied index.
+func (n *RaftNode) applyCommitted() error {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	from, to := n.applied+1, n.commitIndex
+	n.mu.Unlock()
+	if from > to {
+		return nil
+	}
+
+	type applied struct {
+		term   uint64
+		result raftResult
+	}
+	results := map[uint64]applied{}
+	var events map[string][]Event
+	err := n.db.db.Update(func(tx *bolt.Tx) error {
+		results = map[uint64]applied{}
+		events = map[string][]Event{}
+		c := tx.Bucket([]byte(raftLogBucket)).Cursor()
+		index := from
+		for k, v := c.Seek(encodeIndex(from)); k != nil && index <= to; k, v = c.Next() {
+			e, err := decodeEntry(v)
+			if err != nil {
+				return err
+			}
+			if e.Command != nil {
+				cmd, err := decodeCommand(e.Command)
+				if err != nil {
+					return err
+				}
+				result, changes := applyCommand(tx, cmd)
+				result.Index = index
+				results[index] = applied{term: e.Term, result: result}
+				events[cmd.Bucket] = append(events[cmd.Bucket], changes...)
+			}
+			index++
+		}
+		return tx.Bucket([]byte(raftMetaBucket)).Put(raftAppliedKey, encodeIndex(to))
+	})
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.applied = to
+	close(n.appliedCh)
+	n.appliedCh = make(chan struct{})
+	for index, w := range n.waiters {
+		if index > to {
+			continue
+		}
+		if a, ok := results[index]; ok && a.term == w.term {
+			w.ch <- a.result
+		} else {
+			w.ch <- raftResult{Err: ErrRaftReplica.Error()}
+		}
+		delete(n.waiters, index)
+	}
+	n.mu.Unlock()
+
+	for bucket, changes := range events {
+		n.bucketWatchers(bucket).notify(&changes)
+	}
+	return nil
+}
+
+// propose replicates command through the leader, and returns the result
+// of applying it once this node has applied it too.
+func (n *RaftNode) propose(ctx context.Context, command []byte) (raftResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.ApplyTimeout)
+	defer cancel()
+	for {
+		n.mu.Lock()
+		state, leader := n.state, n.leader
+		n.mu.Unlock()
+
+		var (
+			result raftResult
+			err    error
+		)
+		switch {
+		case state == raftLeader:
+			result, err = n.proposeLocal(ctx, command)
+		case leader != "":
+			err = n.transport.call(ctx, leader, "propose", &proposeRequest{Command: command}, &result)
+		default:
+			err = ErrNoLeader
+		}
+		if err == nil {
+			return result, n.waitApplied(ctx, result.Index)
+		}
+		// Only retry when the command cannot have been appended.
+		if err != ErrNotLeader && err != ErrNoLeader {
+			return result, err
+		}
+		select {
+		case <-ctx.Done():
+			return result, err
+		case <-n.done:
+			return result, ErrRaftClosed
+		case <-time.After(n.cfg.HeartbeatInterval / 4):
+		}
+	}
+}
+
+func (n *RaftNode) proposeLocal(ctx context.Context, command []byte) (raftResult, error) {
+	n.mu.Lock()
+	if n.state != raftLeader {
+		n.mu.Unlock()
+		return raftResult{}, ErrNotLeader
+	}
+	ch := make(chan raftResult, 1)
+	index, err := n.appendLocal(command)
+	if err != nil {
+		n.mu.Unlock()
+		return raftResult{}, err
+	}
+	n.waiters[index] = raftWaiter{term: n.term, ch: ch}
+	n.mu.Unlock()
+	n.kick()
+
+	select {
+	case result := <-ch:
+		return result, nil
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, index)
+		n.mu.Unlock()
+		return raftResult{}, ctx.Err()
+	}
+}
+
+// readIndex returns a commit index at least as recent as any write
+// completed before it was called, confirming with a majority that this
+// node still leads.
+func (n *RaftNode) readIndex(ctx context.Context) (uint64, error) {
+	n.mu.Lock()
+	if n.state != raftLeader {
+		n.mu.Unlock()
+		return 0, ErrNotLeader
+	}
+	// Until the no-op of this term commits, the commit index may lag
+	// entries committed by an earlier leader.
+	if term, _ := n.termAt(n.commitIndex); term != n.term {
+		n.mu.Unlock()
+		return 0, ErrNoLeader
+	}
+	index, term := n.commitIndex, n.term
+	reqs := map[string]*appendRequest{}
+	for id := range n.cfg.Peers {
+		if id == n.cfg.ID {
+			continue
+		}
+		req, err := n.appendRequest(id)
+		if err != nil {
+			n.mu.Unlock()
+			return 0, err
+		}
+		req.Entries = nil
+		reqs[id] = req
+	}
+	n.mu.Unlock()
+
+	acks := make(chan bool, len(reqs))
+	for id, req := range reqs {
+		go func(id string, req *appendRequest) {
+			var resp appendResponse
+			err := n.transport.call(ctx, id, "append", req, &resp)
+			acks <- err == nil && resp.Term == term
+		}(id, req)
+	}
+	confirmed := 1
+	for i := 0; i < len(reqs) && confirmed < n.quorum(); i++ {
+		select {
+		case ok := <-acks:
+			if ok {
+				confirmed++
+			}
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	if confirmed < n.quorum() {
+		return 0, ErrNotLeader
+	}
+	return index, nil
+}
+
+// barrier waits until this node has applied every write completed
+// before it was called, so that a local read that follows is
+// linearizable.
+func (n *RaftNode) barrier(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.ApplyTimeout)
+	defer cancel()
+	for {
+		n.mu.Lock()
+		state, leader := n.state, n.leader
+		n.mu.Unlock()
+
+		var (
+			index uint64
+			err   error
+		)
+		switch {
+		case state == raftLeader:
+			index, err = n.readIndex(ctx)
+		case leader != "":
+			var resp readIndexResponse
+			err = n.transport.call(ctx, leader, "read", &readIndexRequest{}, &resp)
+			index = resp.Index
+		default:
+			err = ErrNoLeader
+		}
+		if err == nil {
+			return n.waitApplied(ctx, index)
+		}
+		if err != ErrNotLeader && err != ErrNoLeader {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-n.done:
+			return ErrRaftClosed
+		case <-time.After(n.cfg.HeartbeatInterval / 4):
+		}
+	}
+}
+
+func (n *RaftNode) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		n.mu.Lock()
+		applied, ch := n.applied, n.appliedCh
+		n.mu.Unlock()
+		if applied >= index {
+			return nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-n.done:
+			return ErrRaftClosed
+		}
+	}
+}
+
+// bucketWatchers returns the watchers shared by every cache of bucket.
+func (n *RaftNode) bucketWatchers(bucket string) *watchers {
+	n.watchMu.Lock()
+	defer n.watchMu.Unlock()
+	if n.watchers == nil {
+		n.watchers = map[string]*watchers{}
+	}
+	w, ok := n.watchers[bucket]
+	if !ok {
+		w = &watchers{}
+		n.watchers[bucket] = w
+	}
+	return w
+}
+
+func encodeIndex(index uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, index)
+	return b
+}
+
+func decodeIndex(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func encodeEntry(e *raftEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(e)
+	return buf.Bytes(), err
+}
+
+func decodeEntry(data []byte) (*raftEntry, error) {
+	e := &raftEntry{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(e)
+	return e, err
+}
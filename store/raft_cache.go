@@ -0,0 +1,377 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Raft Operations
+const (
+	raftPut byte = iota + 1
+	raftDelete
+	raftGetAndDelete
+	raftPutIfAbsent
+	raftCompareAndSwap
+	raftExpire
+	raftSweep
+)
+
+// raftCommand is a change to a bucket, replicated through the log. The
+// proposer's clock is carried along so that every node judges expiry
+// the same way.
+type raftCommand struct {
+	Op     byte
+	Bucket string
+	Key    string
+	Value  []byte
+	Old    []byte
+	Now    int64
+}
+
+// raftResult is the outcome of applying a command, returned to the node
+// that proposed it.
+type raftResult struct {
+	Index uint64
+	OK    bool
+	N     int
+	Value []byte
+	Err   string
+}
+
+func (r *raftResult) err() error { return raftError(r.Err) }
+
+func encodeCommand(cmd *raftCommand) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(cmd)
+	return buf.Bytes(), err
+}
+
+func decodeCommand(data []byte) (*raftCommand, error) {
+	cmd := &raftCommand{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(cmd)
+	return cmd, err
+}
+
+// applyCommand applies cmd to its bucket, returning the result and the
+// changes to report to watchers. It must be deterministic, as every
+// node applies every command.
+func applyCommand(tx *bolt.Tx, cmd *raftCommand) (raftResult, []Event) {
+	var result raftResult
+	fail := func(err error) (raftResult, []Event) {
+		result.Err = err.Error()
+		return result, nil
+	}
+	b, err := tx.CreateBucketIfNotExists([]byte(raftDataPrefix + cmd.Bucket))
+	if err != nil {
+		return fail(err)
+	}
+	now := time.Unix(0, cmd.Now)
+	key := []byte(cmd.Key)
+	current := func() *cacheValue {
+		data := b.Get(key)
+		if data == nil {
+			return nil
+		}
+		v, err := decodeValue(data)
+		if err != nil {
+			return nil
+		}
+		return v
+	}
+
+	switch cmd.Op {
+	case raftPut:
+		if err = b.Put(key, cmd.Value); err != nil {
+			return fail(err)
+		}
+		result.OK = true
+		return result, []Event{{Type: EventPut, Key: cmd.Key}}
+	case raftDelete, raftGetAndDelete:
+		data := b.Get(key)
+		if data == nil {
+			return fail(ErrNotFound)
+		}
+		result.Value = append([]byte(nil), data...)
+		if err = b.Delete(key); err != nil {
+			return fail(err)
+		}
+		result.OK = true
+		return result, []Event{{Type: EventDelete, Key: cmd.Key}}
+	case raftPutIfAbsent:
+		if v := current(); v != nil && !v.expired(now) {
+			return result, nil
+		}
+		if err = b.Put(key, cmd.Value); err != nil {
+			return fail(err)
+		}
+		result.OK = true
+		return result, []Event{{Type: EventPut, Key: cmd.Key}}
+	case raftCompareAndSwap:
+		v := current()
+		if v == nil || v.expired(now) {
+			return fail(ErrNotFound)
+		}
+		old, err := decodeValue(cmd.Old)
+		if err != nil {
+			return fail(err)
+		}
+		if !reflect.DeepEqual(v.Value, old.Value) {
+			return result, nil
+		}
+		if err = b.Put(key, cmd.Value); err != nil {
+			return fail(err)
+		}
+		result.OK = true
+		return result, []Event{{Type: EventPut, Key: cmd.Key}}
+	case raftExpire:
+		if v := current(); v == nil || !v.expired(now) {
+			return result, nil
+		}
+		if err = b.Delete(key); err != nil {
+			return fail(err)
+		}
+		result.OK = true
+		return result, []Event{{Type: EventExpire, Key: cmd.Key}}
+	case raftSweep:
+		var expired [][]byte
+		_ = b.ForEach(func(k, data []byte) error {
+			if v, err := decodeValue(data); err == nil && v.expired(now) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		events := make([]Event, 0, len(expired))
+		for _, k := range expired {
+			if err = b.Delete(k); err != nil {
+				return fail(err)
+			}
+			events = append(events, Event{Type: EventExpire, Key: string(k)})
+		}
+		result.OK = true
+		result.N = len(expired)
+		return result, events
+	default:
+		return fail(ErrInternal)
+	}
+}
+
+// Cache returns a Cache backed by bucket, replicated to every node. It
+// does not own the node; closing it is a no-op.
+//
+// Reads wait until this node has applied every write completed before
+// they started, so a token written through one node is found through
+// any other.
+func (n *RaftNode) Cache(bucket string) (Cache, error) {
+	if n == nil {
+		return nil, ErrInternal
+	}
+	if bucket == "" {
+		bucket = defaultBucket
+	}
+	return &raftCache{now: time.Now, node: n, bucket: bucket, watch: n.bucketWatchers(bucket)}, nil
+}
+
+type raftCache struct {
+	now    clockFn
+	node   *RaftNode
+	bucket string
+	watch  *watchers
+}
+
+func (m *raftCache) Put(key string, value interface{}) error {
+	return m.PutContext(context.Background(), key, value)
+}
+
+func (m *raftCache) PutUntil(expire time.Time, key string, value interface{}) error {
+	return m.PutUntilContext(context.Background(), expire, key, value)
+}
+
+func (m *raftCache) Get(key string) (interface{}, error) {
+	return m.GetContext(context.Background(), key)
+}
+
+func (m *raftCache) Delete(key string) error {
+	return m.DeleteContext(context.Background(), key)
+}
+
+func (m *raftCache) Keys() ([]string, error) {
+	return m.KeysContext(context.Background())
+}
+
+func (m *raftCache) PutContext(ctx context.Context, key string, value interface{}) error {
+	return m.PutUntilContext(ctx, time.Time{}, key, value)
+}
+
+func (m *raftCache) PutUntilContext(ctx context.Context, expire time.Time, key string, value interface{}) error {
+	data, err := encodeValue(&cacheValue{Key: key, Expire: expire, Value: value})
+	if err != nil {
+		return err
+	}
+	_, err = m.apply(ctx, &raftCommand{Op: raftPut, Key: key, Value: data})
+	return err
+}
+
+func (m *raftCache) GetContext(ctx context.Context, key string) (interface{}, error) {
+	v, err := m.getValue(ctx, key)
+	return v.value(), err
+}
+
+func (m *raftCache) GetWithExpiry(ctx context.Context, key string) (interface{}, time.Time, error) {
+	v, err := m.getValue(ctx, key)
+	return v.value(), v.expiry(), err
+}
+
+func (m *raftCache) getValue(ctx context.Context, key string) (*cacheValue, error) {
+	if m == nil {
+		return nil, ErrInternal
+	}
+	if err := m.node.barrier(ctx); err != nil {
+		return nil, err
+	}
+	var v *cacheValue
+	if err := m.node.db.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(raftDataPrefix + m.bucket))
+		if b == nil {
+			return ErrNotFound
+		}
+		data := b.Get([]byte(key))
+		if data == nil {
+			return ErrNotFound
+		}
+		var err error
+		v, err = decodeValue(data)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if v.expired(m.now()) {
+		_, _ = m.apply(ctx, &raftCommand{Op: raftExpire, Key: key})
+		return v, ErrExpired
+	}
+	return v, nil
+}
+
+func (m *raftCache) DeleteContext(ctx context.Context, key string) error {
+	_, err := m.apply(ctx, &raftCommand{Op: raftDelete, Key: key})
+	return err
+}
+
+func (m *raftCache) KeysContext(ctx context.Context) ([]string, error) {
+	var keys []string
+	if m == nil {
+		return keys, ErrInternal
+	}
+	if err := m.node.barrier(ctx); err != nil {
+		return keys, err
+	}
+	if err := m.node.db.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(raftDataPrefix + m.bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	}); err != nil {
+		return keys, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *raftCache) GetAndDelete(ctx context.Context, key string) (interface{}, error) {
+	result, err := m.apply(ctx, &raftCommand{Op: raftGetAndDelete, Key: key})
+	if err != nil {
+		return nil, err
+	}
+	v, err := decodeValue(result.Value)
+	if err != nil {
+		return nil, err
+	}
+	if v.expired(m.now()) {
+		return v.Value, ErrExpired
+	}
+	return v.Value, nil
+}
+
+func (m *raftCache) PutIfAbsent(ctx context.Context, expire time.Time, key string, value interface{}) (bool, error) {
+	data, err := encodeValue(&cacheValue{Key: key, Expire: expire, Value: value})
+	if err != nil {
+		return false, err
+	}
+	result, err := m.apply(ctx, &raftCommand{Op: raftPutIfAbsent, Key: key, Value: data})
+	return result.OK, err
+}
+
+func (m *raftCache) CompareAndSwap(ctx context.Context, key string, old, new interface{}, expire time.Time) (bool, error) {
+	data, err := encodeValue(&cacheValue{Key: key, Expire: expire, Value: new})
+	if err != nil {
+		return false, err
+	}
+	prev, err := encodeValue(&cacheValue{Key: key, Value: old})
+	if err != nil {
+		return false, err
+	}
+	result, err := m.apply(ctx, &raftCommand{Op: raftCompareAndSwap, Key: key, Value: data, Old: prev})
+	return result.OK, err
+}
+
+// Sweep removes the expired values from every node; running it on one
+// node is enough.
+func (m *raftCache) Sweep(now time.Time) (int, error) {
+	if m == nil {
+		return 0, ErrInternal
+	}
+	cmd := &raftCommand{Op: raftSweep, Bucket: m.bucket, Now: now.UnixNano()}
+	data, err := encodeCommand(cmd)
+	if err != nil {
+		return 0, err
+	}
+	result, err := m.node.propose(context.Background(), data)
+	if err != nil {
+		return 0, err
+	}
+	return result.N, result.err()
+}
+
+func (m *raftCache) SetClock(now func() time.Time) { m.now = now }
+
+// Watch reports the changes applied on this node, whichever node they
+// were made through.
+func (m *raftCache) Watch(prefix string, fn func(Event)) func() { return m.watch.Watch(prefix, fn) }
+
+// Close is a no-op; the node owns the database.
+func (m *raftCache) Close() error {
+	if m == nil {
+		return ErrInternal
+	}
+	return nil
+}
+
+// apply replicates cmd on this cache's bucket at the cache's time.
+func (m *raftCache) apply(ctx context.Context, cmd *raftCommand) (raftResult, error) {
+	if m == nil {
+		return raftResult{}, ErrInternal
+	}
+	if err := ctx.Err(); err != nil {
+		return raftResult{}, err
+	}
+	cmd.Bucket = m.bucket
+	cmd.Now = m.now().UnixNano()
+	data, err := encodeCommand(cmd)
+	if err != nil {
+		return raftResult{}, err
+	}
+	result, err := m.node.propose(ctx, data)
+	if err != nil {
+		return result, err
+	}
+	return result, result.err()
+}
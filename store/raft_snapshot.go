@@ -0,0 +1,247 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// raftSnapshot is the content of every replicated bucket once the
+// entries up to Index are applied.
+type raftSnapshot struct {
+	Index   uint64
+	Term    uint64
+	Buckets map[string]map[string][]byte
+}
+
+// compact drops the applied entries from the log once there are more
+// than SnapshotEntries of them.
+func (n *RaftNode) compact() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.applied-n.snapIndex <= uint64(n.cfg.SnapshotEntries) {
+		return nil
+	}
+	index := n.applied
+	term, ok := n.termAt(index)
+	if !ok {
+		return ErrInternal
+	}
+	err := n.db.db.Update(func(tx *bolt.Tx) error {
+		if err := truncateLog(tx.Bucket([]byte(raftLogBucket)), index); err != nil {
+			return err
+		}
+		return putSnapshotIndex(tx, index, term)
+	})
+	if err != nil {
+		return err
+	}
+	n.snapIndex, n.snapTerm = index, term
+	return nil
+}
+
+// snapshot reads the replicated buckets as of the last applied entry.
+func (n *RaftNode) snapshot() (*raftSnapshot, error) {
+	s := &raftSnapshot{Buckets: map[string]map[string][]byte{}}
+	err := n.db.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(raftMetaBucket))
+		s.Index = decodeIndex(meta.Get(raftAppliedKey))
+		if s.Index == decodeIndex(meta.Get(raftSnapshotKey)) {
+			s.Term = decodeIndex(meta.Get(raftSnapshotTermKey))
+		} else {
+			data := tx.Bucket([]byte(raftLogBucket)).Get(encodeIndex(s.Index))
+			if data == nil {
+				return ErrInternal
+			}
+			e, err := decodeEntry(data)
+			if err != nil {
+				return err
+			}
+			s.Term = e.Term
+		}
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if !bytes.HasPrefix(name, []byte(raftDataPrefix)) {
+				return nil
+			}
+			values := map[string][]byte{}
+			s.Buckets[string(name[len(raftDataPrefix):])] = values
+			return b.ForEach(func(k, v []byte) error {
+				values[string(k)] = append([]byte(nil), v...)
+				return nil
+			})
+		})
+	})
+	return s, err
+}
+
+// sendSnapshot brings a follower behind the compacted entries up to
+// date with the leader's buckets.
+func (n *RaftNode) sendSnapshot(id string, term uint64) {
+	s, err := n.snapshot()
+	var resp installResponse
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ApplyTimeout)
+		err = n.transport.call(ctx, id, "install", &installRequest{Term: term, Leader: n.cfg.ID, Snapshot: *s}, &resp)
+		cancel()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sending[id] = false
+	if err != nil {
+		return
+	}
+	if resp.Term > n.term {
+		_ = n.setTerm(resp.Term)
+		return
+	}
+	if n.state != raftLeader || n.term != term {
+		return
+	}
+	if s.Index > n.matchIndex[id] {
+		n.matchIndex[id] = s.Index
+	}
+	n.nextIndex[id] = n.matchIndex[id] + 1
+	n.advanceCommit()
+	if n.nextIndex[id] <= n.lastIndex {
+		n.kick()
+	}
+}
+
+func (n *RaftNode) handleInstall(req *installRequest) (*installResponse, error) {
+	resp, events, err := n.install(req)
+	for bucket, changes := range events {
+		n.bucketWatchers(bucket).notify(&changes)
+	}
+	return resp, err
+}
+
+// install replaces the buckets with a snapshot from the leader, unless
+// this node has applied its entries already.
+func (n *RaftNode) install(req *installRequest) (*installResponse, map[string][]Event, error) {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.term {
+		if err := n.setTerm(req.Term); err != nil {
+			return nil, nil, err
+		}
+	}
+	resp := &installResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil, nil
+	}
+	n.state = raftFollower
+	n.leader = req.Leader
+	n.resetDeadline()
+
+	s := &req.Snapshot
+	if s.Index <= n.applied {
+		return resp, nil, nil
+	}
+	// Entries following the snapshot are kept if the log agrees with
+	// it, and the log is discarded otherwise.
+	term, ok := n.termAt(s.Index)
+	keep := ok && s.Index <= n.lastIndex && term == s.Term
+	var events map[string][]Event
+	err := n.db.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if events, err = installBuckets(tx, s.Buckets); err != nil {
+			return err
+		}
+		last := s.Index
+		if !keep {
+			last = n.lastIndex
+		}
+		if err = truncateLog(tx.Bucket([]byte(raftLogBucket)), last); err != nil {
+			return err
+		}
+		if err = tx.Bucket([]byte(raftMetaBucket)).Put(raftAppliedKey, encodeIndex(s.Index)); err != nil {
+			return err
+		}
+		return putSnapshotIndex(tx, s.Index, s.Term)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	n.snapIndex, n.snapTerm = s.Index, s.Term
+	if !keep {
+		n.lastIndex, n.lastTerm = s.Index, s.Term
+	}
+	n.applied = s.Index
+	if n.commitIndex < s.Index {
+		n.commitIndex = s.Index
+	}
+	close(n.appliedCh)
+	n.appliedCh = make(chan struct{})
+	n.resetDeadline()
+	return resp, events, nil
+}
+
+// installBuckets replaces the replicated buckets with those of a
+// snapshot, returning the changes to report to watchers.
+func installBuckets(tx *bolt.Tx, buckets map[string]map[string][]byte) (map[string][]Event, error) {
+	events := map[string][]Event{}
+	var names []string
+	_ = tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if bytes.HasPrefix(name, []byte(raftDataPrefix)) {
+			names = append(names, string(name))
+		}
+		return nil
+	})
+	for _, name := range names {
+		bucket := strings.TrimPrefix(name, raftDataPrefix)
+		b := tx.Bucket([]byte(name))
+		var stale [][]byte
+		_ = b.ForEach(func(k, _ []byte) error {
+			if _, ok := buckets[bucket][string(k)]; !ok {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return nil, err
+			}
+			events[bucket] = append(events[bucket], Event{Type: EventDelete, Key: string(k)})
+		}
+	}
+	for bucket, values := range buckets {
+		b, err := tx.CreateBucketIfNotExists([]byte(raftDataPrefix + bucket))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range values {
+			if bytes.Equal(b.Get([]byte(k)), v) {
+				continue
+			}
+			if err = b.Put([]byte(k), v); err != nil {
+				return nil, err
+			}
+			events[bucket] = append(events[bucket], Event{Type: EventPut, Key: k})
+		}
+	}
+	return events, nil
+}
+
+// truncateLog removes the entries up to index from log.
+func truncateLog(log *bolt.Bucket, index uint64) error {
+	c := log.Cursor()
+	for k, _ := c.First(); k != nil && decodeIndex(k) <= index; k, _ = c.First() {
+		if err := log.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putSnapshotIndex(tx *bolt.Tx, index, term uint64) error {
+	meta := tx.Bucket([]byte(raftMetaBucket))
+	if err := meta.Put(raftSnapshotKey, encodeIndex(index)); err != nil {
+		return err
+	}
+	return meta.Put(raftSnapshotTermKey, encodeIndex(term))
+}
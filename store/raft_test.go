@@ -0,0 +1,274 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// raftCluster runs nodes in process, talking over loopback.
+type raftCluster struct {
+	t     *testing.T
+	dir   string
+	peers map[string]string
+	nodes map[string]*RaftNode
+
+	snapshotEntries int
+}
+
+func newRaftCluster(t *testing.T, size int) *raftCluster {
+	return newCompactingRaftCluster(t, size, 0)
+}
+
+// newCompactingRaftCluster runs nodes compacting their logs every
+// snapshotEntries entries.
+func newCompactingRaftCluster(t *testing.T, size, snapshotEntries int) *raftCluster {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &raftCluster{t: t, dir: dir, peers: map[string]string{}, nodes: map[string]*RaftNode{}, snapshotEntries: snapshotEntries}
+	listeners := map[string]net.Listener{}
+	for i := 1; i <= size; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := fmt.Sprintf("n%d", i)
+		listeners[id] = ln
+		c.peers[id] = "http://" + ln.Addr().String()
+	}
+	for id, ln := range listeners {
+		c.start(id, ln)
+	}
+	t.Cleanup(func() {
+		for _, n := range c.nodes {
+			_ = n.Close()
+		}
+		_ = os.RemoveAll(dir)
+	})
+	return c
+}
+
+func (c *raftCluster) start(id string, ln net.Listener) {
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", c.peers[id][len("http://"):]); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	n, err := NewRaftNode(RaftConfig{
+		ID:                id,
+		Peers:             c.peers,
+		Path:              filepath.Join(c.dir, id+".db"),
+		Secret:            "secret",
+		Listener:          ln,
+		HeartbeatInterval: 50 * time.Millisecond,
+		ElectionTimeout:   250 * time.Millisecond,
+		ApplyTimeout:      2 * time.Second,
+		SnapshotEntries:   c.snapshotEntries,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.nodes[id] = n
+}
+
+func (c *raftCluster) stop(id string) {
+	_ = c.nodes[id].Close()
+	delete(c.nodes, id)
+}
+
+// leader waits for one of the running nodes to lead.
+func (c *raftCluster) leader() string {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for id, n := range c.nodes {
+			if n.IsLeader() {
+				return id
+			}
+		}
+	}
+	c.t.Fatal("no leader elected")
+	return ""
+}
+
+func (c *raftCluster) follower() string {
+	leader := c.leader()
+	for id := range c.nodes {
+		if id != leader {
+			return id
+		}
+	}
+	return leader
+}
+
+func (c *raftCluster) cache(id string) Cache {
+	cache, err := c.nodes[id].Cache("tokens")
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return cache
+}
+
+func TestRaftFailover(t *testing.T) {
+	c := newRaftCluster(t, 3)
+	first := c.leader()
+	if err := c.cache(c.follower()).Put("token", "one"); err != nil {
+		t.Fatalf("Put() through a follower unexpected error %v", err)
+	}
+	for id := range c.nodes {
+		if v, err := c.cache(id).Get("token"); v != "one" || err != nil {
+			t.Errorf("%s: Get() expected one, got %v (%v)", id, v, err)
+		}
+	}
+
+	c.stop(first)
+	second := c.leader()
+	if second == first {
+		t.Fatalf("expected a new leader after %s stopped", first)
+	}
+	if err := c.cache(second).Put("token", "two"); err != nil {
+		t.Fatalf("Put() after failover unexpected error %v", err)
+	}
+
+	c.start(first, nil)
+	if v, err := c.cache(first).Get("token"); v != "two" || err != nil {
+		t.Errorf("Get() from a restarted node expected two, got %v (%v)", v, err)
+	}
+	ok, err := c.cache(first).(CacheV2).PutIfAbsent(context.Background(), time.Time{}, "token", "three")
+	if ok || err != nil {
+		t.Errorf("PutIfAbsent() of a replicated key expected false, got %v (%v)", ok, err)
+	}
+}
+
+func TestRaftCompaction(t *testing.T) {
+	c := newCompactingRaftCluster(t, 3, 4)
+	leader := c.leader()
+	lost := c.follower()
+	c.stop(lost)
+	if err := os.Remove(filepath.Join(c.dir, lost+".db")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := c.cache(leader).Put(fmt.Sprintf("token%d", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.cache(leader).Delete("token0"); err != nil {
+		t.Fatal(err)
+	}
+	n := c.nodes[leader]
+	n.mu.Lock()
+	snapIndex, lastIndex := n.snapIndex, n.lastIndex
+	n.mu.Unlock()
+	if snapIndex == 0 || lastIndex-snapIndex > 5 {
+		t.Errorf("expected the log compacted, got entries %d to %d", snapIndex, lastIndex)
+	}
+
+	// A node that lost its file is sent the buckets whole.
+	c.start(lost, nil)
+	if v, err := c.cache(lost).Get("token19"); v != 19 || err != nil {
+		t.Errorf("Get() from a node restored by snapshot expected 19, got %v (%v)", v, err)
+	}
+	if _, err := c.cache(lost).Get("token0"); err != ErrNotFound {
+		t.Errorf("Get() of a deleted key from a node restored by snapshot expected %v, got %v", ErrNotFound, err)
+	}
+	if err := c.cache(lost).Put("token20", 20); err != nil {
+		t.Errorf("Put() through a node restored by snapshot unexpected error %v", err)
+	}
+
+	// A node restarts from its compacted log.
+	c.stop(leader)
+	c.start(leader, nil)
+	for _, key := range []string{"token1", "token20"} {
+		if _, err := c.cache(leader).Get(key); err != nil {
+			t.Errorf("Get(%q) from a restarted node unexpected error %v", key, err)
+		}
+	}
+}
+
+func TestRaftWatch(t *testing.T) {
+	c := newRaftCluster(t, 3)
+	follower := c.follower()
+	r := &recorder{}
+	stop := c.cache(follower).(Watcher).Watch("", r.record)
+	defer stop()
+
+	if err := c.cache(c.leader()).Put("client", "value"); err != nil {
+		t.Fatal(err)
+	}
+	// Reading through the follower waits for it to apply the write.
+	_, _ = c.cache(follower).Get("client")
+	if events := r.take(); len(events) != 1 || events[0] != (Event{Type: EventPut, Key: "client"}) {
+		t.Errorf("Watch() on a follower expected the put, got %v", events)
+	}
+}
+
+func TestRaftNoQuorum(t *testing.T) {
+	c := newRaftCluster(t, 3)
+	leader := c.leader()
+	for id := range c.nodes {
+		if id != leader {
+			c.stop(id)
+		}
+	}
+	cache := c.cache(leader).(CacheV2)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := cache.PutContext(ctx, "token", "value"); err == nil {
+		t.Error("PutContext() without a quorum expected an error")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := cache.GetContext(ctx, "token"); err == nil {
+		t.Error("GetContext() without a quorum expected an error")
+	}
+}
+
+func TestRaftAuth(t *testing.T) {
+	c := newRaftCluster(t, 3)
+	leader := c.leader()
+	if err := c.cache(leader).Put("token", "value"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := encodeCommand(&raftCommand{Op: raftDelete, Bucket: "tokens", Key: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"", "wrong"} {
+		var result raftResult
+		err := newHTTPTransport(c.peers, secret).call(context.Background(), leader, "propose", &proposeRequest{Command: data}, &result)
+		if err != ErrRaftAuth {
+			t.Errorf("propose with secret %q expected %v, got %v", secret, ErrRaftAuth, err)
+		}
+	}
+	if v, err := c.cache(leader).Get("token"); v != "value" || err != nil {
+		t.Errorf("Get() after unauthorized proposals expected value, got %v (%v)", v, err)
+	}
+}
+
+func TestParseRaftPeers(t *testing.T) {
+	peers, err := ParseRaftPeers("a=http://10.0.0.1:42002, b=http://10.0.0.2:42002")
+	if err != nil || len(peers) != 2 || peers["b"] != "http://10.0.0.2:42002" {
+		t.Errorf("ParseRaftPeers() expected 2 peers, got %v (%v)", peers, err)
+	}
+	for _, spec := range []string{"", "a", "=http://host:1", "a=host", "a=http://h:1,a=http://h:2"} {
+		if _, err := ParseRaftPeers(spec); err != ErrRaftPeers {
+			t.Errorf("ParseRaftPeers(%q) expected %v, got %v", spec, ErrRaftPeers, err)
+		}
+	}
+}
+
+func TestRaftConfig(t *testing.T) {
+	if _, err := NewRaftNode(RaftConfig{ID: "n4", Peers: map[string]string{"n1": "http://127.0.0.1:1"}}); err != ErrRaftConfig {
+		t.Errorf("NewRaftNode() of a node outside its peers expected %v, got %v", ErrRaftConfig, err)
+	}
+	if _, err := NewRaftNode(RaftConfig{ID: "n1", Peers: map[string]string{"n1": "http://127.0.0.1:1"}}); err != ErrRaftSecret {
+		t.Errorf("NewRaftNode() without a secret expected %v, got %v", ErrRaftSecret, err)
+	}
+}
@@ -0,0 +1,198 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+type voteRequest struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type voteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+type appendRequest struct {
+	Term      uint64
+	Leader    string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []raftEntry
+	Commit    uint64
+}
+
+type appendResponse struct {
+	Term    uint64
+	Success bool
+	// LastIndex is the follower's last entry, so that a leader can skip
+	// back over a gap in one step.
+	LastIndex uint64
+}
+
+type installRequest struct {
+	Term     uint64
+	Leader   string
+	Snapshot raftSnapshot
+}
+
+type installResponse struct {
+	Term uint64
+}
+
+type proposeRequest struct {
+	Command []byte
+}
+
+type readIndexRequest struct{}
+
+type readIndexResponse struct {
+	Index uint64
+}
+
+// raftTransport carries requests between nodes.
+type raftTransport interface {
+	call(ctx context.Context, peer string, method string, req, resp interface{}) error
+}
+
+// raftErrors are the errors that keep their identity across the
+// transport.
+var raftErrors = []error{
+	ErrNotLeader, ErrNoLeader, ErrRaftClosed, ErrRaftAuth, ErrRaftReplica,
+	ErrNotFound, ErrExpired, ErrInternal,
+}
+
+func raftError(text string) error {
+	if text == "" {
+		return nil
+	}
+	for _, err := range raftErrors {
+		if err.Error() == text {
+			return err
+		}
+	}
+	return errors.New(text)
+}
+
+// httpTransport posts gob encoded requests to {peer URL}/raft/{method}.
+type httpTransport struct {
+	peers  map[string]string
+	secret string
+	client *http.Client
+}
+
+func newHTTPTransport(peers map[string]string, secret string) *httpTransport {
+	return &httpTransport{peers: peers, secret: secret, client: &http.Client{}}
+}
+
+func (t *httpTransport) call(ctx context.Context, peer string, method string, req, resp interface{}) error {
+	base, ok := t.peers[peer]
+	if !ok {
+		return ErrRaftConfig
+	}
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(req); err != nil {
+		return err
+	}
+	r, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(base, "/")+"/raft/"+method, &body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+t.secret)
+	res, err := t.client.Do(r.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		text, _ := ioutil.ReadAll(res.Body)
+		return raftError(strings.TrimSpace(string(text)))
+	}
+	return gob.NewDecoder(res.Body).Decode(resp)
+}
+
+// Handler returns the handler serving this node's transport, which
+// must be reachable at the node's URL in Peers.
+func (n *RaftNode) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/raft/vote", n.serve(func(ctx context.Context, dec *gob.Decoder) (interface{}, error) {
+		var req voteRequest
+		if err := dec.Decode(&req); err != nil {
+			return nil, err
+		}
+		return n.handleVote(&req)
+	}))
+	mux.HandleFunc("/raft/append", n.serve(func(ctx context.Context, dec *gob.Decoder) (interface{}, error) {
+		var req appendRequest
+		if err := dec.Decode(&req); err != nil {
+			return nil, err
+		}
+		return n.handleAppend(&req)
+	}))
+	mux.HandleFunc("/raft/install", n.serve(func(ctx context.Context, dec *gob.Decoder) (interface{}, error) {
+		var req installRequest
+		if err := dec.Decode(&req); err != nil {
+			return nil, err
+		}
+		return n.handleInstall(&req)
+	}))
+	mux.HandleFunc("/raft/propose", n.serve(func(ctx context.Context, dec *gob.Decoder) (interface{}, error) {
+		var req proposeRequest
+		if err := dec.Decode(&req); err != nil {
+			return nil, err
+		}
+		result, err := n.proposeLocal(ctx, req.Command)
+		return &result, err
+	}))
+	mux.HandleFunc("/raft/read", n.serve(func(ctx context.Context, dec *gob.Decoder) (interface{}, error) {
+		var req readIndexRequest
+		if err := dec.Decode(&req); err != nil {
+			return nil, err
+		}
+		index, err := n.readIndex(ctx)
+		return &readIndexResponse{Index: index}, err
+	}))
+	return mux
+}
+
+func (n *RaftNode) serve(fn func(context.Context, *gob.Decoder) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+n.cfg.Secret)) != 1 {
+			http.Error(w, ErrRaftAuth.Error(), http.StatusUnauthorized)
+			return
+		}
+		select {
+		case <-n.done:
+			http.Error(w, ErrRaftClosed.Error(), http.StatusServiceUnavailable)
+			return
+		default:
+		}
+		resp, err := fn(r.Context(), gob.NewDecoder(r.Body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		var buf bytes.Buffer
+		if err = gob.NewEncoder(&buf).Encode(resp); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(buf.Bytes())
+	}
+}
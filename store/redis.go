@@ -0,0 +1,587 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors
+var (
+	ErrRedisProtocol = errors.New("redis protocol error")
+	ErrClosed        = errors.New("cache closed")
+)
+
+// RedisConfig describes connection details to a Redis server
+type RedisConfig struct {
+	Addr        string
+	Password    string
+	DB          int
+	PoolSize    int
+	DialTimeout time.Duration
+}
+
+// NewRedisCache implements Cache with a Redis back-end. Keys are
+// namespaced by bucket, and entries written with PutUntil are given a
+// native TTL so Redis evicts them without a janitor.
+func NewRedisCache(config *RedisConfig, bucket string) (Cache, error) {
+	if config == nil {
+		return nil, ErrInternal
+	}
+	if bucket == "" {
+		bucket = defaultBucket
+	}
+	size := config.PoolSize
+	if size <= 0 {
+		size = 4
+	}
+	c := &redisCache{
+		now:    time.Now,
+		grace:  time.Minute,
+		config: config,
+		prefix: bucket + ":",
+		pool:   make(chan *redisConn, size),
+	}
+	// Fail early on bad addresses or credentials.
+	if _, err := c.do(context.Background(), "PING"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type redisCache struct {
+	now    clockFn
+	grace  time.Duration
+	config *RedisConfig
+	prefix string
+
+	mu     sync.Mutex
+	closed bool
+	pool   chan *redisConn
+}
+
+func (c *redisCache) Put(key string, value interface{}) error {
+	return c.PutContext(context.Background(), key, value)
+}
+
+func (c *redisCache) PutUntil(expire time.Time, key string, value interface{}) error {
+	return c.PutUntilContext(context.Background(), expire, key, value)
+}
+
+func (c *redisCache) Get(key string) (interface{}, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+func (c *redisCache) Delete(key string) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+func (c *redisCache) Keys() ([]string, error) {
+	return c.KeysContext(context.Background())
+}
+
+func (c *redisCache) PutContext(ctx context.Context, key string, value interface{}) error {
+	return c.PutUntilContext(ctx, time.Time{}, key, value)
+}
+
+func (c *redisCache) PutUntilContext(ctx context.Context, expire time.Time, key string, value interface{}) error {
+	if c == nil {
+		return ErrInternal
+	}
+	args, err := c.setArgs(expire, key, value)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, args...)
+	return err
+}
+
+func (c *redisCache) GetContext(ctx context.Context, key string) (interface{}, error) {
+	v, err := c.getValue(ctx, key)
+	return v.value(), err
+}
+
+func (c *redisCache) GetWithExpiry(ctx context.Context, key string) (interface{}, time.Time, error) {
+	v, err := c.getValue(ctx, key)
+	return v.value(), v.expiry(), err
+}
+
+func (c *redisCache) getValue(ctx context.Context, key string) (*cacheValue, error) {
+	if c == nil {
+		return nil, ErrInternal
+	}
+	reply, err := c.do(ctx, "GET", c.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	v, err := decodeReply(reply)
+	if err != nil {
+		return nil, err
+	}
+	if v.expired(c.now()) {
+		_ = c.DeleteContext(ctx, key)
+		return v, ErrExpired
+	}
+	return v, nil
+}
+
+func (c *redisCache) DeleteContext(ctx context.Context, key string) error {
+	if c == nil {
+		return ErrInternal
+	}
+	reply, err := c.do(ctx, "DEL", c.prefix+key)
+	if err != nil {
+		return err
+	}
+	if n, ok := reply.(int64); ok && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (c *redisCache) SetClock(now func() time.Time) { c.now = now }
+
+func (c *redisCache) KeysContext(ctx context.Context) ([]string, error) {
+	var keys []string
+	if c == nil {
+		return keys, ErrInternal
+	}
+	if err := c.scanAll(ctx, "", func(k string) bool {
+		keys = append(keys, k)
+		return true
+	}); err != nil {
+		return keys, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Scan uses the Redis SCAN cursor, so pages are not sorted and limit is
+// only a hint; a page may be empty even though more keys remain.
+func (c *redisCache) Scan(prefix string, cursor string, limit int) ([]string, string, error) {
+	if c == nil {
+		return nil, "", ErrInternal
+	}
+	if limit <= 0 {
+		limit = DefaultScanLimit
+	}
+	if cursor == "" {
+		cursor = "0"
+	}
+	keys, next, err := c.scan(context.Background(), prefix, cursor, limit)
+	if next == "0" {
+		next = ""
+	}
+	return keys, next, err
+}
+
+func (c *redisCache) Range(prefix string, fn func(key string) bool) error {
+	if c == nil {
+		return ErrInternal
+	}
+	return c.scanAll(context.Background(), prefix, fn)
+}
+
+func (c *redisCache) scanAll(ctx context.Context, prefix string, fn func(string) bool) error {
+	cursor := "0"
+	for {
+		keys, next, err := c.scan(ctx, prefix, cursor, DefaultScanLimit)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if !fn(k) {
+				return nil
+			}
+		}
+		if next == "0" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (c *redisCache) scan(ctx context.Context, prefix string, cursor string, limit int) ([]string, string, error) {
+	reply, err := c.do(ctx, "SCAN", cursor, "MATCH", redisGlobEscape(c.prefix+prefix)+"*", "COUNT", strconv.Itoa(limit))
+	if err != nil {
+		return nil, "", err
+	}
+	page, ok := reply.([]interface{})
+	if !ok || len(page) != 2 {
+		return nil, "", ErrRedisProtocol
+	}
+	next, ok := page[0].(string)
+	if !ok {
+		return nil, "", ErrRedisProtocol
+	}
+	var keys []string
+	items, _ := page[1].([]interface{})
+	for _, item := range items {
+		if k, ok := item.(string); ok {
+			keys = append(keys, strings.TrimPrefix(k, c.prefix))
+		}
+	}
+	return keys, next, nil
+}
+
+func (c *redisCache) GetAndDelete(ctx context.Context, key string) (interface{}, error) {
+	if c == nil {
+		return nil, ErrInternal
+	}
+	var reply interface{}
+	err := c.withConn(ctx, func(cn *redisConn) error {
+		res, err := cn.transaction([]string{"GET", c.prefix + key}, []string{"DEL", c.prefix + key})
+		if err != nil {
+			return err
+		}
+		if len(res) != 2 {
+			return ErrRedisProtocol
+		}
+		reply = res[0]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	v, err := decodeReply(reply)
+	if err != nil {
+		return nil, err
+	}
+	if v.expired(c.now()) {
+		return v.Value, ErrExpired
+	}
+	return v.Value, nil
+}
+
+func (c *redisCache) PutIfAbsent(ctx context.Context, expire time.Time, key string, value interface{}) (bool, error) {
+	if c == nil {
+		return false, ErrInternal
+	}
+	args, err := c.setArgs(expire, key, value)
+	if err != nil {
+		return false, err
+	}
+	stored := false
+	err = c.withConn(ctx, func(cn *redisConn) error {
+		return cn.watch(c.prefix+key, func(reply interface{}) ([][]string, error) {
+			if v, err := decodeReply(reply); err == nil && !v.expired(c.now()) {
+				return nil, nil
+			}
+			return [][]string{args}, nil
+		}, func(ok bool) { stored = ok })
+	})
+	return stored, err
+}
+
+func (c *redisCache) CompareAndSwap(ctx context.Context, key string, old, new interface{}, expire time.Time) (bool, error) {
+	if c == nil {
+		return false, ErrInternal
+	}
+	args, err := c.setArgs(expire, key, new)
+	if err != nil {
+		return false, err
+	}
+	swapped := false
+	err = c.withConn(ctx, func(cn *redisConn) error {
+		return cn.watch(c.prefix+key, func(reply interface{}) ([][]string, error) {
+			v, err := decodeReply(reply)
+			if err != nil {
+				return nil, err
+			}
+			if v.expired(c.now()) {
+				return nil, ErrNotFound
+			}
+			if !reflect.DeepEqual(v.Value, old) {
+				return nil, nil
+			}
+			return [][]string{args}, nil
+		}, func(ok bool) { swapped = ok })
+	})
+	return swapped, err
+}
+
+// setArgs builds the SET command for an entry. Entries with an expiry
+// are kept for a grace period past it, so that Get can still report
+// ErrExpired before the key disappears.
+func (c *redisCache) setArgs(expire time.Time, key string, value interface{}) ([]string, error) {
+	data, err := encodeValue(&cacheValue{Key: key, Expire: expire, Value: value})
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"SET", c.prefix + key, string(data)}
+	if !expire.IsZero() {
+		ttl := expire.Sub(c.now())
+		if ttl < 0 {
+			ttl = 0
+		}
+		ttl += c.grace
+		args = append(args, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	}
+	return args, nil
+}
+
+func decodeReply(reply interface{}) (*cacheValue, error) {
+	data, ok := reply.(string)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return decodeValue([]byte(data))
+}
+
+func (c *redisCache) Close() error {
+	if c == nil {
+		return ErrInternal
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.pool)
+	for cn := range c.pool {
+		_ = cn.Close()
+	}
+	return nil
+}
+
+// do runs a single command on a pooled connection.
+func (c *redisCache) do(ctx context.Context, args ...string) (interface{}, error) {
+	var reply interface{}
+	err := c.withConn(ctx, func(cn *redisConn) error {
+		var err error
+		reply, err = cn.do(args...)
+		return err
+	})
+	return reply, err
+}
+
+// withConn runs fn on a pooled connection bounded by the deadline of
+// ctx. Connections that fail with a network or protocol error are
+// discarded rather than returned to the pool.
+func (c *redisCache) withConn(ctx context.Context, fn func(*redisConn) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cn, err := c.get()
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err = cn.SetDeadline(deadline); err != nil {
+		_ = cn.Close()
+		return err
+	}
+	err = fn(cn)
+	switch err.(type) {
+	case nil, redisError:
+		c.put(cn)
+	default:
+		if err != ErrNotFound {
+			_ = cn.Close()
+			return err
+		}
+		c.put(cn)
+	}
+	return err
+}
+
+func (c *redisCache) get() (*redisConn, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	select {
+	case cn := <-c.pool:
+		if cn != nil {
+			return cn, nil
+		}
+		return nil, ErrClosed
+	default:
+		return dialRedis(c.config)
+	}
+}
+
+func (c *redisCache) put(cn *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		_ = cn.Close()
+		return
+	}
+	select {
+	case c.pool <- cn:
+	default:
+		_ = cn.Close()
+	}
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialRedis(config *RedisConfig) (*redisConn, error) {
+	timeout := config.DialTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	nc, err := net.DialTimeout("tcp", config.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	cn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if config.Password != "" {
+		if _, err = cn.do("AUTH", config.Password); err != nil {
+			_ = cn.Close()
+			return nil, err
+		}
+	}
+	if config.DB != 0 {
+		if _, err = cn.do("SELECT", strconv.Itoa(config.DB)); err != nil {
+			_ = cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+func (cn *redisConn) do(args ...string) (interface{}, error) {
+	w := bufio.NewWriter(cn.Conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return readRESP(cn.r)
+}
+
+// transaction runs cmds atomically inside MULTI/EXEC and returns their
+// replies. If watched keys changed, EXEC aborts and it returns nil.
+func (cn *redisConn) transaction(cmds ...[]string) ([]interface{}, error) {
+	if _, err := cn.do("MULTI"); err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		if _, err := cn.do(cmd...); err != nil {
+			_, _ = cn.do("DISCARD")
+			return nil, err
+		}
+	}
+	reply, err := cn.do("EXEC")
+	if err != nil {
+		return nil, err
+	}
+	res, _ := reply.([]interface{})
+	return res, nil
+}
+
+// watch implements optimistic check-and-set on key: it WATCHes key,
+// passes its current value to check, and runs the commands check
+// returns in a transaction. done reports whether the transaction ran;
+// it does not run if check returns no commands or key was modified
+// concurrently.
+func (cn *redisConn) watch(key string, check func(interface{}) ([][]string, error), done func(bool)) error {
+	if _, err := cn.do("WATCH", key); err != nil {
+		return err
+	}
+	reply, err := cn.do("GET", key)
+	if err != nil {
+		_, _ = cn.do("UNWATCH")
+		return err
+	}
+	cmds, err := check(reply)
+	if err != nil || len(cmds) == 0 {
+		_, _ = cn.do("UNWATCH")
+		return err
+	}
+	res, err := cn.transaction(cmds...)
+	if err != nil {
+		return err
+	}
+	done(res != nil)
+	return nil
+}
+
+// readRESP reads one reply. Simple and bulk strings are returned as
+// string, integers as int64, arrays as []interface{}, and nil bulk
+// strings and arrays as nil. Error replies are returned as redisError.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, ErrRedisProtocol
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := readRESP(r)
+			if _, ok := err.(redisError); err != nil && !ok {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	default:
+		return nil, ErrRedisProtocol
+	}
+}
+
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			_, _ = b.WriteRune('\\')
+		}
+		_, _ = b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,51 @@
+package store_test // import "breve.us/authsvc/store"
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"breve.us/authsvc/store"
+	"breve.us/authsvc/store/storetest"
+)
+
+func TestRedisCache(t *testing.T) {
+	srv := storetest.NewRedisServer(t)
+	defer srv.Close()
+
+	redisFactory := func(now func() time.Time) store.Cache {
+		c, err := store.NewRedisCache(&store.RedisConfig{Addr: srv.Addr()}, fmt.Sprintf("b%d", srv.NextBucket()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.(store.Clocked).SetClock(now)
+		return c
+	}
+	store.RunCacheTests(t, redisFactory)
+	storetest.Run(t, func(*testing.T) store.Cache { return redisFactory(time.Now) })
+
+	c, err := store.NewRedisCache(&store.RedisConfig{Addr: srv.Addr()}, "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	_ = c.Put("b", 1)
+	_ = c.Put("a", 2)
+	if keys, err := c.Keys(); err != nil || strings.Join(keys, ",") != "a,b" {
+		t.Errorf("Keys() expected [a b], got %v (%v)", keys, err)
+	}
+
+	_ = c.PutUntil(time.Now().Add(-time.Hour), "gone", 3)
+	if ttl := srv.TTL("keys:gone"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("PutUntil() expected a native TTL within the grace period, got %v", ttl)
+	}
+
+	var got []string
+	if err := store.Range(c, "a", func(k string) bool {
+		got = append(got, k)
+		return true
+	}); err != nil || strings.Join(got, ",") != "a" {
+		t.Errorf("Range() expected [a], got %v (%v)", got, err)
+	}
+}
@@ -0,0 +1,88 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Errors
+var (
+	ErrInvalidCursor = errors.New("invalid scan cursor")
+)
+
+// DefaultScanLimit is the page size used when Scan is given no limit.
+const DefaultScanLimit = 100
+
+// Scanner is implemented by caches that can iterate their keys without
+// loading the whole key set into memory.
+type Scanner interface {
+	// Scan returns up to limit keys starting with prefix, beginning at
+	// cursor, along with the cursor for the next page. Cursors are
+	// opaque; pass "" to start, and an empty next cursor means there
+	// are no more keys.
+	Scan(prefix string, cursor string, limit int) ([]string, string, error)
+	// Range calls fn for each key starting with prefix until fn
+	// returns false.
+	Range(prefix string, fn func(key string) bool) error
+}
+
+// Scan pages through the keys of c, using the native Scanner if c has
+// one and falling back to Keys otherwise.
+func Scan(c Cache, prefix string, cursor string, limit int) ([]string, string, error) {
+	if s, ok := c.(Scanner); ok {
+		return s.Scan(prefix, cursor, limit)
+	}
+	keys, err := c.Keys()
+	if err != nil {
+		return nil, "", err
+	}
+	page, next := scanSorted(keys, prefix, cursor, limit)
+	return page, next, nil
+}
+
+// Range calls fn for each key of c starting with prefix until fn
+// returns false, using the native Scanner if c has one.
+func Range(c Cache, prefix string, fn func(key string) bool) error {
+	if s, ok := c.(Scanner); ok {
+		return s.Range(prefix, fn)
+	}
+	keys, err := c.Keys()
+	if err != nil {
+		return err
+	}
+	rangeSorted(keys, prefix, fn)
+	return nil
+}
+
+// scanSorted pages through sorted keys, using the last key of each
+// page as the cursor for the next.
+func scanSorted(keys []string, prefix string, cursor string, limit int) ([]string, string) {
+	if limit <= 0 {
+		limit = DefaultScanLimit
+	}
+	start := prefix
+	if cursor > start {
+		start = cursor
+	}
+	i := sort.SearchStrings(keys, start)
+	if i < len(keys) && cursor != "" && keys[i] == cursor {
+		i++
+	}
+	var page []string
+	for ; i < len(keys) && strings.HasPrefix(keys[i], prefix); i++ {
+		if len(page) == limit {
+			return page, page[len(page)-1]
+		}
+		page = append(page, keys[i])
+	}
+	return page, ""
+}
+
+func rangeSorted(keys []string, prefix string, fn func(string) bool) {
+	for i := sort.SearchStrings(keys, prefix); i < len(keys) && strings.HasPrefix(keys[i], prefix); i++ {
+		if !fn(keys[i]) {
+			return
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Errors
+var (
+	ErrUnknownDialect = errors.New("unknown sql dialect")
+	ErrInvalidBucket  = errors.New("invalid bucket name")
+)
+
+// SQL Dialects
+const (
+	SQLite   = "sqlite3"
+	Postgres = "postgres"
+)
+
+// DefaultSQLDriver is the database/sql driver used when none is given.
+const DefaultSQLDriver = SQLite
+
+// NewSQLCache implements Cache on a database/sql back-end, storing
+// entries for bucket in their own table. The driver must already be
+// registered with database/sql.
+func NewSQLCache(driver string, dsn string, bucket string) (Cache, error) {
+	db, err := OpenSQLDB(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := db.Cache(bucket)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	cache.(*sqlCache).owned = true
+	return cache, nil
+}
+
+// SQLDB is a database/sql connection pool that can hand out any number
+// of bucket scoped caches.
+type SQLDB struct {
+	db      *sql.DB
+	dialect string
+}
+
+// OpenSQLDB opens a connection pool for driver and dsn.
+func OpenSQLDB(driver string, dsn string) (*SQLDB, error) {
+	if driver == "" {
+		driver = DefaultSQLDriver
+	}
+	dialect, err := sqlDialect(driver)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dialect == SQLite {
+		// SQLite serialises writers; a single connection avoids
+		// spurious "database is locked" errors.
+		db.SetMaxOpenConns(1)
+	}
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &SQLDB{db: db, dialect: dialect}, nil
+}
+
+// Cache returns a Cache backed by the table for bucket, creating the
+// table and its expiry index if needed. The cache does not own the
+// connection pool; closing it is a no-op.
+func (s *SQLDB) Cache(bucket string) (Cache, error) {
+	if s == nil {
+		return nil, ErrInternal
+	}
+	if bucket == "" {
+		bucket = defaultBucket
+	}
+	if !validBucket.MatchString(bucket) {
+		return nil, ErrInvalidBucket
+	}
+	c := &sqlCache{now: time.Now, db: s, table: "authsvc_" + bucket}
+	if err := c.createTable(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the connection pool.
+func (s *SQLDB) Close() error {
+	if s == nil {
+		return ErrInternal
+	}
+	return s.db.Close()
+}
+
+var validBucket = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+func sqlDialect(driver string) (string, error) {
+	switch driver {
+	case "sqlite3", "sqlite":
+		return SQLite, nil
+	case "postgres", "pgx":
+		return Postgres, nil
+	default:
+		return "", ErrUnknownDialect
+	}
+}
+
+type sqlCache struct {
+	now    clockFn
+	db     *SQLDB
+	table  string
+	owned  bool
+	closed sync.Once
+}
+
+func (c *sqlCache) Put(key string, value interface{}) error {
+	return c.PutContext(context.Background(), key, value)
+}
+
+func (c *sqlCache) PutUntil(expire time.Time, key string, value interface{}) error {
+	return c.PutUntilContext(context.Background(), expire, key, value)
+}
+
+func (c *sqlCache) Get(key string) (interface{}, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+func (c *sqlCache) Delete(key string) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+func (c *sqlCache) Keys() ([]string, error) {
+	return c.KeysContext(context.Background())
+}
+
+func (c *sqlCache) PutContext(ctx context.Context, key string, value interface{}) error {
+	return c.PutUntilContext(ctx, time.Time{}, key, value)
+}
+
+func (c *sqlCache) PutUntilContext(ctx context.Context, expire time.Time, key string, value interface{}) error {
+	if c == nil {
+		return ErrInternal
+	}
+	data, err := encodeValue(&cacheValue{Key: key, Expire: expire, Value: value})
+	if err != nil {
+		return err
+	}
+	_, err = c.db.db.ExecContext(ctx, c.query(
+		"INSERT INTO %s (id, value, expires) VALUES (?, ?, ?) "+
+			"ON CONFLICT (id) DO UPDATE SET value = excluded.value, expires = excluded.expires"),
+		key, data, expireNanos(expire))
+	return err
+}
+
+func (c *sqlCache) GetContext(ctx context.Context, key string) (interface{}, error) {
+	v, err := c.getValue(ctx, key)
+	return v.value(), err
+}
+
+func (c *sqlCache) GetWithExpiry(ctx context.Context, key string) (interface{}, time.Time, error) {
+	v, err := c.getValue(ctx, key)
+	return v.value(), v.expiry(), err
+}
+
+func (c *sqlCache) getValue(ctx context.Context, key string) (*cacheValue, error) {
+	if c == nil {
+		return nil, ErrInternal
+	}
+	v, err := c.get(ctx, c.db.db, key, false)
+	if err != nil {
+		return nil, err
+	}
+	if v.expired(c.now()) {
+		_ = c.DeleteContext(ctx, key)
+		return v, ErrExpired
+	}
+	if v.outdated != nil {
+		_ = c.upgrade(ctx, key, v)
+	}
+	return v, nil
+}
+
+// upgrade rewrites an outdated record in the current format, unless it
+// has changed since it was read.
+func (c *sqlCache) upgrade(ctx context.Context, key string, v *cacheValue) error {
+	data, err := encodeValue(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.db.ExecContext(ctx, c.query("UPDATE %s SET value = ? WHERE id = ? AND value = ?"), data, key, v.outdated)
+	return err
+}
+
+func (c *sqlCache) DeleteContext(ctx context.Context, key string) error {
+	if c == nil {
+		return ErrInternal
+	}
+	res, err := c.db.db.ExecContext(ctx, c.query("DELETE FROM %s WHERE id = ?"), key)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (c *sqlCache) KeysContext(ctx context.Context) ([]string, error) {
+	var keys []string
+	if c == nil {
+		return keys, ErrInternal
+	}
+	rows, err := c.db.db.QueryContext(ctx, c.query("SELECT id FROM %s ORDER BY id"))
+	if err != nil {
+		return keys, err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var k string
+		if err = rows.Scan(&k); err != nil {
+			return keys, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (c *sqlCache) GetAndDelete(ctx context.Context, key string) (interface{}, error) {
+	if c == nil {
+		return nil, ErrInternal
+	}
+	var v *cacheValue
+	if err := c.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if v, err = c.get(ctx, tx, key, true); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, c.query("DELETE FROM %s WHERE id = ?"), key)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if v.expired(c.now()) {
+		return v.Value, ErrExpired
+	}
+	return v.Value, nil
+}
+
+// PutIfAbsent relies on the upsert only replacing rows that have
+// already expired, so the affected row count tells whether it stored.
+func (c *sqlCache) PutIfAbsent(ctx context.Context, expire time.Time, key string, value interface{}) (bool, error) {
+	if c == nil {
+		return false, ErrInternal
+	}
+	data, err := encodeValue(&cacheValue{Key: key, Expire: expire, Value: value})
+	if err != nil {
+		return false, err
+	}
+	res, err := c.db.db.ExecContext(ctx, c.query(
+		"INSERT INTO %[1]s (id, value, expires) VALUES (?, ?, ?) "+
+			"ON CONFLICT (id) DO UPDATE SET value = excluded.value, expires = excluded.expires "+
+			"WHERE %[1]s.expires > 0 AND %[1]s.expires < ?"),
+		key, data, expireNanos(expire), c.now().UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (c *sqlCache) CompareAndSwap(ctx context.Context, key string, old, new interface{}, expire time.Time) (bool, error) {
+	if c == nil {
+		return false, ErrInternal
+	}
+	data, err := encodeValue(&cacheValue{Key: key, Expire: expire, Value: new})
+	if err != nil {
+		return false, err
+	}
+	swapped := false
+	err = c.inTx(ctx, func(tx *sql.Tx) error {
+		v, err := c.get(ctx, tx, key, true)
+		if err != nil {
+			return err
+		}
+		if v.expired(c.now()) {
+			return ErrNotFound
+		}
+		if !reflect.DeepEqual(v.Value, old) {
+			return nil
+		}
+		swapped = true
+		_, err = tx.ExecContext(ctx, c.query("UPDATE %s SET value = ?, expires = ? WHERE id = ?"), data, expireNanos(expire), key)
+		return err
+	})
+	return swapped, err
+}
+
+func (c *sqlCache) Scan(prefix string, cursor string, limit int) ([]string, string, error) {
+	if c == nil {
+		return nil, "", ErrInternal
+	}
+	if limit <= 0 {
+		limit = DefaultScanLimit
+	}
+	rows, err := c.db.db.Query(c.query("SELECT id FROM %s WHERE substr(id, 1, ?) = ? AND id > ? ORDER BY id LIMIT ?"),
+		utf8.RuneCountInString(prefix), prefix, cursor, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = rows.Close() }()
+	var page []string
+	for rows.Next() {
+		var k string
+		if err = rows.Scan(&k); err != nil {
+			return nil, "", err
+		}
+		page = append(page, k)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(page) > limit {
+		page = page[:limit]
+		return page, page[limit-1], nil
+	}
+	return page, "", nil
+}
+
+func (c *sqlCache) Range(prefix string, fn func(key string) bool) error {
+	if c == nil {
+		return ErrInternal
+	}
+	rows, err := c.db.db.Query(c.query("SELECT id FROM %s WHERE substr(id, 1, ?) = ? ORDER BY id"),
+		utf8.RuneCountInString(prefix), prefix)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var k string
+		if err = rows.Scan(&k); err != nil {
+			return err
+		}
+		if !fn(k) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+func (c *sqlCache) Sweep(now time.Time) (int, error) {
+	if c == nil {
+		return 0, ErrInternal
+	}
+	res, err := c.db.db.Exec(c.query("DELETE FROM %s WHERE expires > 0 AND expires < ?"), now.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (c *sqlCache) SetClock(now func() time.Time) { c.now = now }
+
+// Close closes the connection pool if this cache owns it.
+func (c *sqlCache) Close() error {
+	if c == nil {
+		return ErrInternal
+	}
+	var err error
+	if c.owned {
+		c.closed.Do(func() { err = c.db.Close() })
+	}
+	return err
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// get reads the stored entry for key; lock requests a row lock where
+// the dialect supports it.
+func (c *sqlCache) get(ctx context.Context, q queryRower, key string, lock bool) (*cacheValue, error) {
+	stmt := "SELECT value FROM %s WHERE id = ?"
+	if lock && c.db.dialect == Postgres {
+		stmt += " FOR UPDATE"
+	}
+	var data []byte
+	switch err := q.QueryRowContext(ctx, c.query(stmt), key).Scan(&data); err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, ErrNotFound
+	default:
+		return nil, err
+	}
+	return decodeValue(data)
+}
+
+func (c *sqlCache) inTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := c.db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func expireNanos(expire time.Time) int64 {
+	if expire.IsZero() {
+		return 0
+	}
+	return expire.UnixNano()
+}
+
+func (c *sqlCache) createTable() error {
+	blob := "BLOB"
+	if c.db.dialect == Postgres {
+		blob = "BYTEA"
+	}
+	stmts := []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id VARCHAR(512) PRIMARY KEY, value %s NOT NULL, expires BIGINT NOT NULL DEFAULT 0)", c.table, blob),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_expires ON %s (expires)", c.table, c.table),
+	}
+	for _, stmt := range stmts {
+		if _, err := c.db.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// query fills in the table name and rewrites ? placeholders into the
+// form expected by the dialect.
+func (c *sqlCache) query(q string) string {
+	q = fmt.Sprintf(q, c.table)
+	if c.db.dialect != Postgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		_, _ = b.WriteRune(r)
+	}
+	return b.String()
+}
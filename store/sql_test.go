@@ -0,0 +1,35 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var sqlFactory factory = func(now func() time.Time) Cache {
+	name, err := tempFile()
+	if err != nil {
+		panic(err)
+	}
+	c, err := NewSQLCache(DefaultSQLDriver, name, "cache_test")
+	if err != nil {
+		panic(err)
+	}
+	c.(*sqlCache).now = now
+	return c
+}
+
+func TestSQLCache(t *testing.T) {
+	testCache(sqlFactory, t)
+	testAtomic(sqlFactory, t)
+	testScan(sqlFactory, t)
+
+	c := sqlFactory(present)
+	defer func() { _ = c.Close() }()
+	_ = c.PutUntil(past(), "old", "value")
+	_ = c.Put("forever", "value")
+	if n, err := c.(Sweeper).Sweep(present()); n != 1 || err != nil {
+		t.Errorf("Sweep() expected 1 eviction, got %d (%v)", n, err)
+	}
+}
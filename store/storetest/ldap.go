@@ -0,0 +1,576 @@
+package storetest // import "breve.us/authsvc/store/storetest"
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "gopkg.in/asn1-ber.v1"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// LDAP protocol operations, by application tag.
+const (
+	ldapBindRequest       = 0
+	ldapBindResponse      = 1
+	ldapUnbindRequest     = 2
+	ldapSearchRequest     = 3
+	ldapSearchResultEntry = 4
+	ldapSearchResultDone  = 5
+	ldapExtendedRequest   = 23
+	ldapExtendedResponse  = 24
+)
+
+// ldapPasswordModify is the OID of the Password Modify extended operation
+// of RFC 3062.
+const ldapPasswordModify = "1.3.6.1.4.1.4203.1.11.1"
+
+// LDAP filter choices, by context tag.
+const (
+	filterAnd         = 0
+	filterOr          = 1
+	filterNot         = 2
+	filterEquality    = 3
+	filterSubstrings  = 4
+	filterGreaterOrEq = 5
+	filterLessOrEq    = 6
+	filterPresent     = 7
+	filterExtensible  = 9
+)
+
+// ldapInChain is Active Directory's LDAP_MATCHING_RULE_IN_CHAIN, which
+// follows a DN valued attribute through the entries it names.
+const ldapInChain = "1.2.840.113556.1.4.1941"
+
+// LDAPServer is an in-memory directory on a loopback port that speaks
+// enough LDAPv3 for the clients in this module: simple binds, subtree
+// searches with the paged results control, and Password Modify. Entries
+// bind with the plain text value of their userPassword attribute, and
+// may change only their own.
+//
+// Like Active Directory, it matches LDAP_MATCHING_RULE_IN_CHAIN, can
+// return long attributes in ranges, and can refer searches elsewhere.
+type LDAPServer struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	entries  map[string]ldapEntry
+	latency  time.Duration
+	limit    int
+	referral string
+	minPass  int
+	open     map[net.Conn]bool
+	closed   bool
+	searches int64
+	conns    int64
+}
+
+// ldapEntry maps lower cased attribute names to attributes.
+type ldapEntry map[string]*ldapAttribute
+
+type ldapAttribute struct {
+	name   string
+	values []string
+}
+
+func (e ldapEntry) values(name string) []string {
+	if a, ok := e[strings.ToLower(name)]; ok {
+		return a.values
+	}
+	return nil
+}
+
+// NewLDAPServer starts a directory server, stopped by Close.
+func NewLDAPServer(t testing.TB) *LDAPServer {
+	return newLDAPServer(t, nil)
+}
+
+// NewLDAPSServer starts a directory server speaking TLS from the start,
+// as LDAPS does, stopped by Close.
+func NewLDAPSServer(t testing.TB, config *tls.Config) *LDAPServer {
+	return newLDAPServer(t, config)
+}
+
+func newLDAPServer(t testing.TB, config *tls.Config) *LDAPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil {
+		ln = tls.NewListener(ln, config)
+	}
+	s := &LDAPServer{ln: ln, entries: map[string]ldapEntry{}, open: map[net.Conn]bool{}}
+	go s.serve()
+	return s
+}
+
+// Host returns the host the server listens on.
+func (s *LDAPServer) Host() string { return s.ln.Addr().(*net.TCPAddr).IP.String() }
+
+// Port returns the port the server listens on.
+func (s *LDAPServer) Port() int { return s.ln.Addr().(*net.TCPAddr).Port }
+
+// Close stops accepting connections and drops those open, as a server
+// going down would.
+func (s *LDAPServer) Close() {
+	_ = s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for cn := range s.open {
+		_ = cn.Close()
+	}
+}
+
+// Add adds or replaces the entry at dn. Attribute names are matched
+// without regard to case.
+func (s *LDAPServer) Add(dn string, attrs map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := ldapEntry{}
+	for k, v := range attrs {
+		entry[strings.ToLower(k)] = &ldapAttribute{name: k, values: append([]string{}, v...)}
+	}
+	s.entries[dn] = entry
+}
+
+// Remove deletes the entry at dn.
+func (s *LDAPServer) Remove(dn string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, dn)
+}
+
+// Searches returns the number of search requests served.
+func (s *LDAPServer) Searches() int { return int(atomic.LoadInt64(&s.searches)) }
+
+// Conns returns the number of connections accepted.
+func (s *LDAPServer) Conns() int { return int(atomic.LoadInt64(&s.conns)) }
+
+// SetLatency delays every reply by d, to stand in for a slow server.
+func (s *LDAPServer) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// SetRangeLimit returns attributes with more than n values in ranges of
+// n, as Active Directory does past its MaxValRange; 0 returns them whole.
+func (s *LDAPServer) SetRangeLimit(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = n
+}
+
+// SetReferral ends every search with a referral to url after its
+// entries, as a server holding only part of the base DN does; "" ends
+// them normally.
+func (s *LDAPServer) SetReferral(url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.referral = url
+}
+
+// SetMinPasswordLength refuses new passwords shorter than n, as a
+// password policy would.
+func (s *LDAPServer) SetMinPasswordLength(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.minPass = n
+}
+
+func (s *LDAPServer) serve() {
+	for {
+		cn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = cn.Close()
+			return
+		}
+		s.open[cn] = true
+		s.mu.Unlock()
+		atomic.AddInt64(&s.conns, 1)
+		go s.handle(cn)
+	}
+}
+
+func (s *LDAPServer) handle(cn net.Conn) {
+	defer func() {
+		_ = cn.Close()
+		s.mu.Lock()
+		delete(s.open, cn)
+		s.mu.Unlock()
+	}()
+	var bound string
+	for {
+		req, err := ber.ReadPacket(cn)
+		if err != nil || len(req.Children) < 2 {
+			return
+		}
+		id, _ := req.Children[0].Value.(int64)
+		op := req.Children[1]
+		var controls []ldap.Control
+		if len(req.Children) > 2 {
+			for _, c := range req.Children[2].Children {
+				if ctrl := ldap.DecodeControl(c); ctrl != nil {
+					controls = append(controls, ctrl)
+				}
+			}
+		}
+
+		var replies []*ber.Packet
+		switch op.Tag {
+		case ldapBindRequest:
+			var reply *ber.Packet
+			reply, bound = s.bind(op)
+			replies = []*ber.Packet{message(id, reply, nil)}
+		case ldapUnbindRequest:
+			return
+		case ldapSearchRequest:
+			atomic.AddInt64(&s.searches, 1)
+			replies = s.search(id, op, controls)
+		case ldapExtendedRequest:
+			replies = []*ber.Packet{message(id, s.extended(bound, op), nil)}
+		default:
+			replies = []*ber.Packet{message(id, result(ber.Tag(op.Tag+1), ldap.LDAPResultUnwillingToPerform, "unsupported operation"), nil)}
+		}
+		s.mu.Lock()
+		latency := s.latency
+		s.mu.Unlock()
+		time.Sleep(latency)
+		for _, r := range replies {
+			if _, err = cn.Write(r.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// bind returns the reply to a bind request, and the DN bound.
+func (s *LDAPServer) bind(op *ber.Packet) (*ber.Packet, string) {
+	if len(op.Children) < 3 {
+		return result(ldapBindResponse, ldap.LDAPResultProtocolError, "malformed bind"), ""
+	}
+	dn, _ := op.Children[1].Value.(string)
+	password := op.Children[2].Data.String()
+	if dn == "" && password == "" {
+		return result(ldapBindResponse, ldap.LDAPResultSuccess, ""), ""
+	}
+	if s.password(dn, password) {
+		return result(ldapBindResponse, ldap.LDAPResultSuccess, ""), dn
+	}
+	return result(ldapBindResponse, ldap.LDAPResultInvalidCredentials, "invalid credentials"), ""
+}
+
+// password reports whether password is the password of dn.
+func (s *LDAPServer) password(dn, password string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[dn]
+	for _, p := range entry.values("userPassword") {
+		if ok && p == password && password != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// extended serves Password Modify for the entry bound, the only extended
+// operation supported.
+func (s *LDAPServer) extended(bound string, op *ber.Packet) *ber.Packet {
+	if len(op.Children) < 1 || op.Children[0].Data.String() != ldapPasswordModify {
+		return result(ldapExtendedResponse, ldap.LDAPResultProtocolError, "unsupported extended operation")
+	}
+	var identity, oldPassword, newPassword string
+	if len(op.Children) > 1 {
+		for _, c := range ber.DecodePacket(op.Children[1].Data.Bytes()).Children {
+			switch c.Tag {
+			case 0:
+				identity = c.Data.String()
+			case 1:
+				oldPassword = c.Data.String()
+			case 2:
+				newPassword = c.Data.String()
+			}
+		}
+	}
+	if identity == "" {
+		identity = bound
+	}
+	switch {
+	case bound == "" || !strings.EqualFold(identity, bound):
+		return result(ldapExtendedResponse, ldap.LDAPResultInsufficientAccessRights, "only your own password may be changed")
+	case oldPassword != "" && !s.password(bound, oldPassword):
+		return result(ldapExtendedResponse, ldap.LDAPResultInvalidCredentials, "old password is incorrect")
+	case newPassword == "":
+		return result(ldapExtendedResponse, ldap.LDAPResultUnwillingToPerform, "password generation is not supported")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(newPassword) < s.minPass {
+		return result(ldapExtendedResponse, ldap.LDAPResultConstraintViolation, "Password fails quality checking policy")
+	}
+	if entry, ok := s.entries[bound]; ok {
+		entry["userpassword"] = &ldapAttribute{name: "userPassword", values: []string{newPassword}}
+	}
+	return result(ldapExtendedResponse, ldap.LDAPResultSuccess, "")
+}
+
+func (s *LDAPServer) search(id int64, op *ber.Packet, controls []ldap.Control) []*ber.Packet {
+	if len(op.Children) < 8 {
+		return []*ber.Packet{message(id, result(ldapSearchResultDone, ldap.LDAPResultProtocolError, "malformed search"), nil)}
+	}
+	base, _ := op.Children[0].Value.(string)
+	filter := op.Children[6]
+	var attrs []string
+	for _, a := range op.Children[7].Children {
+		if name, ok := a.Value.(string); ok {
+			attrs = append(attrs, strings.ToLower(name))
+		}
+	}
+
+	s.mu.Lock()
+	var dns []string
+	for dn, entry := range s.entries {
+		if inSubtree(dn, base) && s.matches(filter, entry) {
+			dns = append(dns, dn)
+		}
+	}
+	sort.Strings(dns)
+	var replies []*ber.Packet
+	var done []ldap.Control
+	if paging, ok := ldap.FindControl(controls, ldap.ControlTypePaging).(*ldap.ControlPaging); ok && paging.PagingSize > 0 {
+		offset, _ := strconv.Atoi(string(paging.Cookie))
+		if offset > len(dns) {
+			offset = len(dns)
+		}
+		end := offset + int(paging.PagingSize)
+		next := ldap.NewControlPaging(paging.PagingSize)
+		if end < len(dns) {
+			next.SetCookie([]byte(strconv.Itoa(end)))
+		} else {
+			end = len(dns)
+		}
+		dns = dns[offset:end]
+		done = []ldap.Control{next}
+	}
+	for _, dn := range dns {
+		replies = append(replies, message(id, searchEntry(dn, s.entries[dn], attrs, s.limit), nil))
+	}
+	referral := s.referral
+	s.mu.Unlock()
+	if referral != "" {
+		done := result(ldapSearchResultDone, ldap.LDAPResultReferral, "")
+		refs := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "Referral")
+		refs.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, referral, "URI"))
+		done.AppendChild(refs)
+		return append(replies, message(id, done, nil))
+	}
+	return append(replies, message(id, result(ldapSearchResultDone, ldap.LDAPResultSuccess, ""), done))
+}
+
+func inSubtree(dn, base string) bool {
+	dn, base = strings.ToLower(dn), strings.ToLower(base)
+	return base == "" || dn == base || strings.HasSuffix(dn, ","+base)
+}
+
+// matches reports whether entry matches filter f; s.mu must be held.
+func (s *LDAPServer) matches(f *ber.Packet, entry ldapEntry) bool {
+	switch f.Tag {
+	case filterAnd:
+		for _, c := range f.Children {
+			if !s.matches(c, entry) {
+				return false
+			}
+		}
+		return true
+	case filterOr:
+		for _, c := range f.Children {
+			if s.matches(c, entry) {
+				return true
+			}
+		}
+		return false
+	case filterNot:
+		return len(f.Children) == 1 && !s.matches(f.Children[0], entry)
+	case filterPresent:
+		return len(entry.values(f.Data.String())) > 0
+	case filterEquality, filterGreaterOrEq, filterLessOrEq:
+		if len(f.Children) != 2 {
+			return false
+		}
+		attr, value := str(f.Children[0]), strings.ToLower(str(f.Children[1]))
+		for _, v := range entry.values(attr) {
+			v = strings.ToLower(v)
+			switch {
+			case f.Tag == filterEquality && v == value,
+				f.Tag == filterGreaterOrEq && v >= value,
+				f.Tag == filterLessOrEq && v <= value:
+				return true
+			}
+		}
+		return false
+	case filterSubstrings:
+		if len(f.Children) != 2 {
+			return false
+		}
+		for _, v := range entry.values(str(f.Children[0])) {
+			if substringsMatch(strings.ToLower(v), f.Children[1].Children) {
+				return true
+			}
+		}
+		return false
+	case filterExtensible:
+		var rule, attr, value string
+		for _, c := range f.Children {
+			switch c.Tag {
+			case 1:
+				rule = str(c)
+			case 2:
+				attr = str(c)
+			case 3:
+				value = str(c)
+			}
+		}
+		return rule == ldapInChain && s.inChain(entry, attr, strings.ToLower(value), map[string]bool{})
+	default:
+		return false
+	}
+}
+
+// inChain reports whether dn is a value of attr in entry, or in an entry
+// named by one of its values, and so on.
+func (s *LDAPServer) inChain(entry ldapEntry, attr, dn string, seen map[string]bool) bool {
+	for _, v := range entry.values(attr) {
+		v = strings.ToLower(v)
+		if v == dn {
+			return true
+		}
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		for name, next := range s.entries {
+			if strings.ToLower(name) == v && s.inChain(next, attr, dn, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func substringsMatch(v string, parts []*ber.Packet) bool {
+	for i, p := range parts {
+		sub := strings.ToLower(p.Data.String())
+		switch {
+		case p.Tag == 0:
+			if !strings.HasPrefix(v, sub) {
+				return false
+			}
+			v = v[len(sub):]
+		case p.Tag == 2 && i == len(parts)-1:
+			return strings.HasSuffix(v, sub)
+		default:
+			j := strings.Index(v, sub)
+			if j < 0 {
+				return false
+			}
+			v = v[j+len(sub):]
+		}
+	}
+	return true
+}
+
+// str returns the text of a primitive packet of any class.
+func str(p *ber.Packet) string {
+	if s, ok := p.Value.(string); ok {
+		return s
+	}
+	return p.Data.String()
+}
+
+func message(id int64, op *ber.Packet, controls []ldap.Control) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	p.AppendChild(op)
+	if len(controls) > 0 {
+		cs := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+		for _, c := range controls {
+			cs.AppendChild(c.Encode())
+		}
+		p.AppendChild(cs)
+	}
+	return p
+}
+
+func result(tag ber.Tag, code int, diagnostic string) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, diagnostic, "Diagnostic Message"))
+	return p
+}
+
+// searchEntry returns the attrs of entry, all of them if attrs is empty
+// or holds "*". Attributes with more than limit values are returned in
+// ranges, as "name;range=low-high", with "*" as the high end of the last;
+// asking for "name;range=low-*" returns the range starting at low.
+func searchEntry(dn string, entry ldapEntry, attrs []string, limit int) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapSearchResultEntry, nil, "Search Result Entry")
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "Object Name"))
+	all := len(attrs) == 0
+	want := map[string]int{}
+	for _, a := range attrs {
+		all = all || a == "*"
+		low := 0
+		if i := strings.Index(a, ";range="); i >= 0 {
+			low, _ = strconv.Atoi(strings.SplitN(a[i+len(";range="):], "-", 2)[0])
+			a = a[:i]
+		}
+		want[a] = low
+	}
+	var names []string
+	for name := range entry {
+		if _, ok := want[name]; all || ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, name := range names {
+		typ, values := entry[name].name, entry[name].values
+		if low := want[name]; limit > 0 && len(values) > limit || low > 0 {
+			if low > len(values) {
+				low = len(values)
+			}
+			high := "*"
+			if end := low + limit; limit > 0 && end < len(values) {
+				values, high = values[low:end], strconv.Itoa(end-1)
+			} else {
+				values = values[low:]
+			}
+			typ = fmt.Sprintf("%s;range=%d-%s", typ, low, high)
+		}
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, typ, "Type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+		attr.AppendChild(vals)
+		list.AppendChild(attr)
+	}
+	p.AppendChild(list)
+	return p
+}
@@ -0,0 +1,223 @@
+package storetest // import "breve.us/authsvc/store/storetest"
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errProtocol = errors.New("protocol error")
+
+// RedisServer is an in-process stand-in for a Redis server on a
+// loopback port, supporting just the commands the Redis cache uses.
+type RedisServer struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	buckets  int
+	data     map[string]string
+	expires  map[string]time.Time
+	versions map[string]int
+}
+
+// NewRedisServer starts a server, stopped by Close.
+func NewRedisServer(t testing.TB) *RedisServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &RedisServer{ln: ln, data: map[string]string{}, expires: map[string]time.Time{}, versions: map[string]int{}}
+	go s.serve()
+	return s
+}
+
+// Addr returns the host:port the server listens on.
+func (s *RedisServer) Addr() string { return s.ln.Addr().String() }
+
+// Close stops accepting connections.
+func (s *RedisServer) Close() { _ = s.ln.Close() }
+
+// NextBucket returns a number not returned before, for naming buckets
+// that do not collide.
+func (s *RedisServer) NextBucket() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets++
+	return s.buckets
+}
+
+// TTL returns the time left before key expires.
+func (s *RedisServer) TTL(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Until(s.expires[key])
+}
+
+func (s *RedisServer) serve() {
+	for {
+		cn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(cn)
+	}
+}
+
+// fakeConn is the per-connection transaction state.
+type fakeConn struct {
+	multi   bool
+	queued  [][]string
+	watched map[string]int
+}
+
+func (s *RedisServer) handle(cn net.Conn) {
+	defer func() { _ = cn.Close() }()
+	r := bufio.NewReader(cn)
+	fc := &fakeConn{watched: map[string]int{}}
+	for {
+		args, err := readCommand(r)
+		if err != nil || len(args) == 0 {
+			return
+		}
+		args[0] = strings.ToUpper(args[0])
+		if _, err = cn.Write([]byte(s.dispatch(fc, args))); err != nil {
+			return
+		}
+	}
+}
+
+func (s *RedisServer) dispatch(fc *fakeConn, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch args[0] {
+	case "MULTI":
+		fc.multi = true
+		return "+OK\r\n"
+	case "DISCARD":
+		fc.multi, fc.queued, fc.watched = false, nil, map[string]int{}
+		return "+OK\r\n"
+	case "WATCH":
+		fc.watched[args[1]] = s.versions[args[1]]
+		return "+OK\r\n"
+	case "UNWATCH":
+		fc.watched = map[string]int{}
+		return "+OK\r\n"
+	case "EXEC":
+		queued, watched := fc.queued, fc.watched
+		fc.multi, fc.queued, fc.watched = false, nil, map[string]int{}
+		for k, v := range watched {
+			if s.versions[k] != v {
+				return "*-1\r\n"
+			}
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "*%d\r\n", len(queued))
+		for _, q := range queued {
+			b.WriteString(s.exec(q[0], q[1:]))
+		}
+		return b.String()
+	}
+	if fc.multi {
+		fc.queued = append(fc.queued, args)
+		return "+QUEUED\r\n"
+	}
+	return s.exec(args[0], args[1:])
+}
+
+// exec runs a single command; callers must hold s.mu.
+func (s *RedisServer) exec(cmd string, args []string) string {
+	for k, exp := range s.expires {
+		if time.Now().After(exp) {
+			delete(s.data, k)
+			delete(s.expires, k)
+			s.versions[k]++
+		}
+	}
+	switch cmd {
+	case "PING":
+		return "+PONG\r\n"
+	case "SET":
+		s.data[args[0]] = args[1]
+		s.versions[args[0]]++
+		delete(s.expires, args[0])
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			ms, _ := strconv.ParseInt(args[3], 10, 64)
+			s.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "GET":
+		v, ok := s.data[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "DEL":
+		_, ok := s.data[args[0]]
+		delete(s.data, args[0])
+		delete(s.expires, args[0])
+		if ok {
+			s.versions[args[0]]++
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "SCAN":
+		var b strings.Builder
+		var matched []string
+		for k := range s.data {
+			if ok, _ := path.Match(args[2], k); ok {
+				matched = append(matched, k)
+			}
+		}
+		fmt.Fprintf(&b, "*2\r\n$1\r\n0\r\n*%d\r\n", len(matched))
+		for _, k := range matched {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(k), k)
+		}
+		return b.String()
+	default:
+		return "-ERR unknown command '" + cmd + "'\r\n"
+	}
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	n, err := readHeader(r, '*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		size, err := readHeader(r, '$')
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readHeader(r *bufio.Reader, kind byte) (int, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 3 || line[0] != kind || !strings.HasSuffix(line, "\r\n") {
+		return 0, errProtocol
+	}
+	n, err := strconv.Atoi(line[1 : len(line)-2])
+	if err != nil || n < 0 {
+		return 0, errProtocol
+	}
+	return n, nil
+}
@@ -0,0 +1,471 @@
+// Package storetest provides a conformance suite for store.Cache
+// implementations, along with in-process stand-ins for the directory
+// and key-value servers that some of them talk to.
+package storetest // import "breve.us/authsvc/store/storetest"
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"breve.us/authsvc/store"
+)
+
+func init() {
+	gob.Register(&Record{})
+	store.RegisterType("storetest.Record", 1, &Record{}, store.JSONCodec)
+}
+
+// Record is a structured value stored by the suite.
+type Record struct {
+	Name  string
+	Count int
+	Tags  []string
+}
+
+// Factory returns a new, empty cache. The suite closes it.
+type Factory func(t *testing.T) store.Cache
+
+// Suite describes the cache under test.
+type Suite struct {
+	// New creates the cache under test.
+	New Factory
+	// ReadOnly caches must reject writes with store.ErrNotSupported,
+	// and are populated through Seed instead.
+	ReadOnly bool
+	// Seed makes key readable from caches created by New, for read-only
+	// caches.
+	Seed func(t *testing.T, key string)
+	// LargeValue is the size of the large values stored by the suite.
+	// Defaults to 1 MiB.
+	LargeValue int
+}
+
+// Run runs the conformance suite against caches created by factory.
+func Run(t *testing.T, factory Factory) {
+	Suite{New: factory}.Run(t)
+}
+
+// Clock is a manually advanced clock, installed in caches implementing
+// store.Clocked.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a clock stopped at now.
+func NewClock(now time.Time) *Clock { return &Clock{now: now} }
+
+// Now returns the clock's current time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Run runs the conformance suite.
+func (s Suite) Run(t *testing.T) {
+	if s.LargeValue <= 0 {
+		s.LargeValue = 1 << 20
+	}
+	if s.ReadOnly {
+		s.run(t, "ReadOnly", s.testReadOnly)
+		s.run(t, "Keys", s.testReadOnlyKeys)
+		s.run(t, "Concurrent", s.testReadOnlyConcurrent)
+		return
+	}
+	s.run(t, "PutGet", s.testPutGet)
+	s.run(t, "Expiry", s.testExpiry)
+	s.run(t, "GetWithExpiry", s.testGetWithExpiry)
+	s.run(t, "Keys", s.testKeys)
+	s.run(t, "Delete", s.testDelete)
+	s.run(t, "Scan", s.testScan)
+	s.run(t, "LargeValues", s.testLargeValues)
+	s.run(t, "Concurrent", s.testConcurrent)
+	s.run(t, "Atomic", s.testAtomic)
+	s.run(t, "Sweep", s.testSweep)
+	s.run(t, "Watch", s.testWatch)
+}
+
+func (s Suite) run(t *testing.T, name string, fn func(*testing.T, store.Cache)) {
+	t.Run(name, func(t *testing.T) {
+		c := s.New(t)
+		defer func() { _ = c.Close() }()
+		fn(t, c)
+	})
+}
+
+// clock installs a fresh clock in c, skipping the test if c has none.
+func clock(t *testing.T, c store.Cache) *Clock {
+	cc, ok := c.(store.Clocked)
+	if !ok {
+		t.Skip("cache does not implement store.Clocked")
+	}
+	clk := NewClock(time.Now())
+	cc.SetClock(clk.Now)
+	return clk
+}
+
+func (s Suite) testPutGet(t *testing.T, c store.Cache) {
+	values := map[string]interface{}{
+		"string": "value",
+		"empty":  "",
+		"slice":  []string{"a", "b"},
+		"record": &Record{Name: "r", Count: 3, Tags: []string{"x"}},
+		"bytes":  []byte{0, 1, 2},
+	}
+	for key, value := range values {
+		if err := c.Put(key, value); err != nil {
+			t.Fatalf("Put(%q) unexpected error %v", key, err)
+		}
+	}
+	for key, value := range values {
+		if v, err := c.Get(key); err != nil || !reflect.DeepEqual(v, value) {
+			t.Errorf("Get(%q) expected %#v, got %#v (%v)", key, value, v, err)
+		}
+	}
+	if err := c.Put("string", "other"); err != nil {
+		t.Errorf("Put() over an existing key unexpected error %v", err)
+	}
+	if v, err := c.Get("string"); v != "other" || err != nil {
+		t.Errorf("Get() after overwrite expected other, got %v (%v)", v, err)
+	}
+	if v, err := c.Get("missing"); v != nil || err != store.ErrNotFound {
+		t.Errorf("Get() of missing key expected %v, got %v (%v)", store.ErrNotFound, v, err)
+	}
+}
+
+func (s Suite) testExpiry(t *testing.T, c store.Cache) {
+	clk := clock(t, c)
+	if err := c.PutUntil(clk.Now().Add(-time.Minute), "past", "value"); err != nil {
+		t.Fatalf("PutUntil() unexpected error %v", err)
+	}
+	if v, err := c.Get("past"); v != "value" || err != store.ErrExpired {
+		t.Errorf("Get() of expired key expected value with %v, got %v (%v)", store.ErrExpired, v, err)
+	}
+	if _, err := c.Get("past"); err != store.ErrNotFound {
+		t.Errorf("Get() of expired key twice expected %v, got %v", store.ErrNotFound, err)
+	}
+
+	_ = c.PutUntil(clk.Now().Add(time.Minute), "soon", "value")
+	_ = c.PutUntil(time.Time{}, "never", "value")
+	if v, err := c.Get("soon"); v != "value" || err != nil {
+		t.Errorf("Get() before expiry expected value, got %v (%v)", v, err)
+	}
+	clk.Advance(2 * time.Minute)
+	if _, err := c.Get("soon"); err != store.ErrExpired {
+		t.Errorf("Get() after the clock passed expiry expected %v, got %v", store.ErrExpired, err)
+	}
+	if v, err := c.Get("never"); v != "value" || err != nil {
+		t.Errorf("Get() of key without expiry expected value, got %v (%v)", v, err)
+	}
+}
+
+func (s Suite) testGetWithExpiry(t *testing.T, cache store.Cache) {
+	c, ok := cache.(store.Expirer)
+	if !ok {
+		t.Skip("cache does not implement store.Expirer")
+	}
+	ctx := context.Background()
+	expire := time.Now().Add(time.Hour).Round(time.Millisecond)
+	_ = cache.PutUntil(expire, "soon", "value")
+	_ = cache.Put("never", "value")
+	if v, exp, err := c.GetWithExpiry(ctx, "soon"); v != "value" || !exp.Equal(expire) || err != nil {
+		t.Errorf("GetWithExpiry() expected value until %v, got %v until %v (%v)", expire, v, exp, err)
+	}
+	if v, exp, err := c.GetWithExpiry(ctx, "never"); v != "value" || !exp.IsZero() || err != nil {
+		t.Errorf("GetWithExpiry() expected value without expiry, got %v until %v (%v)", v, exp, err)
+	}
+	if _, _, err := c.GetWithExpiry(ctx, "missing"); err != store.ErrNotFound {
+		t.Errorf("GetWithExpiry() of missing key expected %v, got %v", store.ErrNotFound, err)
+	}
+}
+
+func (s Suite) testKeys(t *testing.T, c store.Cache) {
+	if keys, err := c.Keys(); len(keys) != 0 || err != nil {
+		t.Errorf("Keys() of empty cache expected none, got %v (%v)", keys, err)
+	}
+	want := []string{"a", "b", "b:1", "c", "z"}
+	for _, i := range []int{3, 0, 4, 2, 1} {
+		if err := c.Put(want[i], i); err != nil {
+			t.Fatalf("Put(%q) unexpected error %v", want[i], err)
+		}
+	}
+	if keys, err := c.Keys(); !reflect.DeepEqual(keys, want) || err != nil {
+		t.Errorf("Keys() expected %v, got %v (%v)", want, keys, err)
+	}
+}
+
+func (s Suite) testDelete(t *testing.T, c store.Cache) {
+	_ = c.Put("key", "value")
+	if err := c.Delete("key"); err != nil {
+		t.Errorf("Delete() unexpected error %v", err)
+	}
+	if _, err := c.Get("key"); err != store.ErrNotFound {
+		t.Errorf("Get() after Delete() expected %v, got %v", store.ErrNotFound, err)
+	}
+	if err := c.Delete("key"); err != store.ErrNotFound {
+		t.Errorf("Delete() of missing key expected %v, got %v", store.ErrNotFound, err)
+	}
+	if keys, _ := c.Keys(); len(keys) != 0 {
+		t.Errorf("Keys() after Delete() expected none, got %v", keys)
+	}
+}
+
+func (s Suite) testScan(t *testing.T, c store.Cache) {
+	var want []string
+	for i := 0; i < 7; i++ {
+		want = append(want, fmt.Sprintf("p:%d", i))
+		_ = c.Put(want[i], i)
+	}
+	_ = c.Put("other", 0)
+
+	var got []string
+	cursor := ""
+	for pages := 0; pages < 100; pages++ {
+		keys, next, err := store.Scan(c, "p:", cursor, 3)
+		if err != nil {
+			t.Fatalf("Scan() unexpected error %v", err)
+		}
+		got = append(got, keys...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan() expected %v, got %v", want, got)
+	}
+
+	n := 0
+	if err := store.Range(c, "p:", func(string) bool {
+		n++
+		return n < 2
+	}); err != nil || n != 2 {
+		t.Errorf("Range() expected to stop after 2 keys, got %d (%v)", n, err)
+	}
+}
+
+func (s Suite) testLargeValues(t *testing.T, c store.Cache) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), s.LargeValue/16)
+	if err := c.Put("bytes", big); err != nil {
+		t.Fatalf("Put() of %d bytes unexpected error %v", len(big), err)
+	}
+	if v, err := c.Get("bytes"); err != nil || !bytes.Equal(v.([]byte), big) {
+		t.Errorf("Get() of %d bytes did not round trip (%v)", len(big), err)
+	}
+	str := strings.Repeat("x", s.LargeValue)
+	_ = c.Put("string", str)
+	if v, err := c.Get("string"); v != str || err != nil {
+		t.Errorf("Get() of %d byte string did not round trip (%v)", len(str), err)
+	}
+}
+
+func (s Suite) testConcurrent(t *testing.T, c store.Cache) {
+	const workers, ops = 8, 25
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < ops; i++ {
+				key := fmt.Sprintf("w%d:%d", w, i)
+				if err := c.Put(key, i); err != nil {
+					t.Errorf("Put(%q) unexpected error %v", key, err)
+					return
+				}
+				if v, err := c.Get(key); v != i || err != nil {
+					t.Errorf("Get(%q) expected %d, got %v (%v)", key, i, v, err)
+				}
+				_ = c.Put("shared", key)
+				if _, err := c.Get("shared"); err != nil {
+					t.Errorf("Get(shared) unexpected error %v", err)
+				}
+				if i%2 == 0 {
+					if err := c.Delete(key); err != nil {
+						t.Errorf("Delete(%q) unexpected error %v", key, err)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	// Each worker keeps its odd numbered keys, and all share one more.
+	want := workers*(ops/2) + 1
+	if keys, err := c.Keys(); len(keys) != want || err != nil {
+		t.Errorf("Keys() expected %d keys, got %d (%v)", want, len(keys), err)
+	}
+}
+
+func (s Suite) testAtomic(t *testing.T, cache store.Cache) {
+	c, ok := cache.(store.CacheV2)
+	if !ok {
+		t.Skip("cache does not implement store.CacheV2")
+	}
+	ctx := context.Background()
+	future := time.Now().Add(time.Hour)
+
+	if ok, err := c.PutIfAbsent(ctx, future, "key", "one"); !ok || err != nil {
+		t.Errorf("PutIfAbsent() on empty key expected true, got %v (%v)", ok, err)
+	}
+	if ok, err := c.PutIfAbsent(ctx, future, "key", "two"); ok || err != nil {
+		t.Errorf("PutIfAbsent() on present key expected false, got %v (%v)", ok, err)
+	}
+	if ok, err := c.CompareAndSwap(ctx, "key", "two", "three", future); ok || err != nil {
+		t.Errorf("CompareAndSwap() with stale value expected false, got %v (%v)", ok, err)
+	}
+	if ok, err := c.CompareAndSwap(ctx, "key", "one", "three", future); !ok || err != nil {
+		t.Errorf("CompareAndSwap() with current value expected true, got %v (%v)", ok, err)
+	}
+	if ok, err := c.CompareAndSwap(ctx, "missing", "one", "three", future); ok || err != store.ErrNotFound {
+		t.Errorf("CompareAndSwap() on missing key expected %v, got %v (%v)", store.ErrNotFound, ok, err)
+	}
+	if v, err := c.GetAndDelete(ctx, "key"); v != "three" || err != nil {
+		t.Errorf("GetAndDelete() expected three, got %v (%v)", v, err)
+	}
+	if v, err := c.GetAndDelete(ctx, "key"); v != nil || err != store.ErrNotFound {
+		t.Errorf("GetAndDelete() twice expected %v, got %v (%v)", store.ErrNotFound, v, err)
+	}
+
+	_ = c.PutUntilContext(ctx, time.Now().Add(-time.Hour), "old", "stale")
+	if ok, err := c.PutIfAbsent(ctx, time.Time{}, "old", "fresh"); !ok || err != nil {
+		t.Errorf("PutIfAbsent() over expired key expected true, got %v (%v)", ok, err)
+	}
+	if err := c.DeleteContext(ctx, "missing"); err != store.ErrNotFound {
+		t.Errorf("DeleteContext() of missing key expected %v, got %v", store.ErrNotFound, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.GetContext(cancelled, "old"); err == nil {
+		t.Errorf("GetContext() with cancelled context expected an error")
+	}
+}
+
+func (s Suite) testSweep(t *testing.T, c store.Cache) {
+	sw, ok := c.(store.Sweeper)
+	if !ok {
+		t.Skip("cache does not implement store.Sweeper")
+	}
+	now := time.Now()
+	_ = c.PutUntil(now.Add(-time.Minute), "old", "value")
+	_ = c.PutUntil(now.Add(time.Hour), "new", "value")
+	_ = c.Put("forever", "value")
+	if n, err := sw.Sweep(now); n != 1 || err != nil {
+		t.Errorf("Sweep() expected 1 eviction, got %d (%v)", n, err)
+	}
+	if keys, _ := c.Keys(); !reflect.DeepEqual(keys, []string{"forever", "new"}) {
+		t.Errorf("Keys() after Sweep() expected [forever new], got %v", keys)
+	}
+}
+
+func (s Suite) testWatch(t *testing.T, c store.Cache) {
+	w, ok := c.(store.Watcher)
+	if !ok {
+		t.Skip("cache does not implement store.Watcher")
+	}
+	var (
+		mu     sync.Mutex
+		events []store.Event
+	)
+	stop := w.Watch("w:", func(e store.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	})
+	clk := clock(t, c)
+	_ = c.Put("w:put", "value")
+	_ = c.Put("other", "value")
+	_ = c.Delete("w:put")
+	_ = c.PutUntil(clk.Now().Add(time.Minute), "w:get", "value")
+	clk.Advance(2 * time.Minute)
+	_, _ = c.Get("w:get")
+	stop()
+	_ = c.Put("w:stopped", "value")
+
+	want := []store.Event{
+		{Type: store.EventPut, Key: "w:put"},
+		{Type: store.EventDelete, Key: "w:put"},
+		{Type: store.EventPut, Key: "w:get"},
+		{Type: store.EventExpire, Key: "w:get"},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("Watch() expected %v, got %v", want, events)
+	}
+}
+
+func (s Suite) seed(t *testing.T, keys ...string) {
+	if s.Seed == nil {
+		t.Fatal("read-only suites need Seed")
+	}
+	for _, k := range keys {
+		s.Seed(t, k)
+	}
+}
+
+func (s Suite) testReadOnly(t *testing.T, c store.Cache) {
+	s.seed(t, "alpha")
+	if v, err := c.Get("alpha"); v == nil || err != nil {
+		t.Errorf("Get() of seeded key expected a value, got %v (%v)", v, err)
+	}
+	if _, err := c.Get("missing"); err != store.ErrNotFound {
+		t.Errorf("Get() of missing key expected %v, got %v", store.ErrNotFound, err)
+	}
+	if err := c.Put("alpha", "value"); err != store.ErrNotSupported {
+		t.Errorf("Put() expected %v, got %v", store.ErrNotSupported, err)
+	}
+	if err := c.PutUntil(time.Now(), "alpha", "value"); err != store.ErrNotSupported {
+		t.Errorf("PutUntil() expected %v, got %v", store.ErrNotSupported, err)
+	}
+	if err := c.Delete("alpha"); err != store.ErrNotSupported {
+		t.Errorf("Delete() expected %v, got %v", store.ErrNotSupported, err)
+	}
+}
+
+func (s Suite) testReadOnlyKeys(t *testing.T, c store.Cache) {
+	s.seed(t, "delta", "alpha", "charlie", "bravo")
+	keys, err := c.Keys()
+	if err != nil || len(keys) != 4 || !sort.StringsAreSorted(keys) {
+		t.Errorf("Keys() expected 4 sorted keys, got %v (%v)", keys, err)
+	}
+	n := 0
+	if err = store.Range(c, "", func(string) bool { n++; return true }); err != nil || n != 4 {
+		t.Errorf("Range() expected 4 keys, got %d (%v)", n, err)
+	}
+}
+
+func (s Suite) testReadOnlyConcurrent(t *testing.T, c store.Cache) {
+	s.seed(t, "alpha", "bravo")
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				for _, k := range []string{"alpha", "bravo"} {
+					if _, err := c.Get(k); err != nil {
+						t.Errorf("Get(%q) unexpected error %v", k, err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
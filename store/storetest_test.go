@@ -0,0 +1,148 @@
+package store_test // import "breve.us/authsvc/store"
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ldap "gopkg.in/ldap.v2"
+
+	"breve.us/authsvc/store"
+	"breve.us/authsvc/store/storetest"
+)
+
+// tempPath returns a path in a directory removed when the test ends.
+func tempPath(t *testing.T, name string) string {
+	dir, err := ioutil.TempDir("", "storetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return filepath.Join(dir, name)
+}
+
+func TestConformance(t *testing.T) {
+	keys, err := store.NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, store.MinKeySize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bolt := func(t *testing.T) store.Cache {
+		c, err := store.NewBoltDBCache(tempPath(t, "cache.db"), "conformance")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	for name, factory := range map[string]storetest.Factory{
+		"memory": func(*testing.T) store.Cache { return store.NewMemoryCache() },
+		"bolt":   bolt,
+		"encrypted": func(t *testing.T) store.Cache {
+			return store.NewEncryptedCache(bolt(t), keys)
+		},
+		"tiered": func(*testing.T) store.Cache {
+			return store.NewTieredCache(store.NewMemoryCache(), store.TieredOptions{})
+		},
+	} {
+		t.Run(name, func(t *testing.T) { storetest.Run(t, factory) })
+	}
+
+	t.Run("sql", func(t *testing.T) {
+		storetest.Run(t, func(t *testing.T) store.Cache {
+			c, err := store.NewSQLCache(store.DefaultSQLDriver, tempPath(t, "cache.db"), "conformance")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c
+		})
+	})
+}
+
+func TestRaftConformance(t *testing.T) {
+	peers := map[string]string{}
+	listeners := map[string]net.Listener{}
+	for _, id := range []string{"a", "b", "c"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[id] = ln
+		peers[id] = "http://" + ln.Addr().String()
+	}
+	var nodes []*store.RaftNode
+	for id, ln := range listeners {
+		n, err := store.NewRaftNode(store.RaftConfig{
+			ID:                id,
+			Peers:             peers,
+			Path:              tempPath(t, id+".db"),
+			Secret:            "secret",
+			Listener:          ln,
+			HeartbeatInterval: 50 * time.Millisecond,
+			ElectionTimeout:   250 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = n.Close() }()
+		nodes = append(nodes, n)
+	}
+
+	// Each cache is a fresh bucket, used through the nodes in turn so
+	// that most operations are forwarded to the leader.
+	var buckets int
+	storetest.Run(t, func(t *testing.T) store.Cache {
+		buckets++
+		c, err := nodes[buckets%len(nodes)].Cache(fmt.Sprintf("conformance%d", buckets))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	})
+}
+
+func TestLDAPConformance(t *testing.T) {
+	srv := storetest.NewLDAPServer(t)
+	defer srv.Close()
+
+	// Each cache gets its own subtree, so seeded entries do not leak
+	// between tests.
+	var (
+		n      int
+		basedn string
+	)
+	suite := storetest.Suite{
+		ReadOnly: true,
+		New: func(*testing.T) store.Cache {
+			n++
+			basedn = fmt.Sprintf("ou=t%d,dc=example,dc=com", n)
+			cfg := &store.LDAPConfig{Host: srv.Host(), Port: srv.Port(), BaseDN: basedn}
+			return store.NewLDAPCache(cfg, "inetOrgPerson", recordFn)
+		},
+		Seed: func(t *testing.T, key string) {
+			srv.Add(fmt.Sprintf("uid=%s,%s", key, basedn), map[string][]string{
+				"objectClass": {"inetOrgPerson"},
+				"uid":         {key},
+			})
+		},
+	}
+	suite.Run(t)
+}
+
+func recordFn(basedn string, key string) (interface{}, func(*ldap.Conn) error) {
+	rec := &storetest.Record{}
+	return rec, func(cn *ldap.Conn) error {
+		res, err := store.SearchLDAP(cn, basedn, fmt.Sprintf("(uid=%s)", ldap.EscapeFilter(key)), "uid")
+		if err != nil {
+			return err
+		}
+		if len(res.Entries) != 1 {
+			return store.ErrNotFound
+		}
+		rec.Name = res.Entries[0].GetAttributeValue("uid")
+		return nil
+	}
+}
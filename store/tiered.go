@@ -0,0 +1,245 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TieredOptions configures a read-through cache.
+type TieredOptions struct {
+	// TTL is how long a value read from the source is served without
+	// asking the source again. Defaults to one minute.
+	TTL time.Duration
+	// NegativeTTL is how long a key the source reported as not found is
+	// remembered as missing. Zero disables negative caching.
+	NegativeTTL time.Duration
+	// StaleTTL is how long past TTL a value may still be served while it
+	// is refreshed in the background. Zero disables serving stale values.
+	StaleTTL time.Duration
+	// MaxEntries bounds the number of keys held locally. Zero leaves it
+	// unbounded.
+	MaxEntries int
+}
+
+// Invalidator is implemented by caches that hold copies of values kept
+// elsewhere, and can be told to forget them.
+type Invalidator interface {
+	// Invalidate drops any local copy of key.
+	Invalidate(key string)
+	// InvalidateAll drops every local copy.
+	InvalidateAll()
+}
+
+// NewTieredCache returns a Cache that reads through to source, keeping
+// what it reads in a local in-memory cache. Writes and deletes go to
+// source and invalidate the local copy, as do changes source reports if
+// it is a Watcher. Closing the tiered cache closes source.
+func NewTieredCache(source Cache, opts TieredOptions) Cache {
+	return newTiered(source, opts, time.Now)
+}
+
+func newTiered(source Cache, opts TieredOptions, now clockFn) *tiered {
+	if opts.TTL <= 0 {
+		opts.TTL = time.Minute
+	}
+	t := &tiered{
+		now:      now,
+		source:   source,
+		local:    newMemory(MemoryOptions{MaxEntries: opts.MaxEntries, SizeFn: func(interface{}) int64 { return 0 }}, now),
+		opts:     opts,
+		inflight: map[string]*fetch{},
+		unwatch:  func() {},
+	}
+	if w, ok := source.(Watcher); ok {
+		t.unwatch = w.Watch("", func(e Event) { t.Invalidate(e.Key) })
+	}
+	return t
+}
+
+type tiered struct {
+	now    clockFn
+	source Cache
+	local  *memory
+	opts   TieredOptions
+	// unwatch stops invalidating on changes reported by source.
+	unwatch func()
+
+	mu       sync.Mutex
+	inflight map[string]*fetch
+	gen      uint64
+	refresh  sync.WaitGroup
+}
+
+// tieredEntry is a local copy of a source value, or of its absence.
+type tieredEntry struct {
+	value   interface{}
+	missing bool
+	fresh   time.Time
+}
+
+// fetch is a source read shared by all callers asking for the same key
+// at the same time.
+type fetch struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+func (t *tiered) Get(key string) (interface{}, error) {
+	if v, err := t.local.Get(key); err == nil {
+		e := v.(*tieredEntry)
+		if t.now().After(e.fresh) {
+			t.revalidate(key)
+		}
+		if e.missing {
+			return nil, ErrNotFound
+		}
+		return e.value, nil
+	}
+	f := t.start(key)
+	<-f.done
+	return f.value, f.err
+}
+
+func (t *tiered) Put(key string, value interface{}) error {
+	defer t.Invalidate(key)
+	return t.source.Put(key, value)
+}
+
+func (t *tiered) PutUntil(expire time.Time, key string, value interface{}) error {
+	defer t.Invalidate(key)
+	return t.source.PutUntil(expire, key, value)
+}
+
+func (t *tiered) Delete(key string) error {
+	defer t.Invalidate(key)
+	return t.source.Delete(key)
+}
+
+func (t *tiered) Keys() ([]string, error) { return t.source.Keys() }
+
+// GetWithExpiry reads through to source, which must implement Expirer.
+func (t *tiered) GetWithExpiry(ctx context.Context, key string) (interface{}, time.Time, error) {
+	if c, ok := t.source.(Expirer); ok {
+		return c.GetWithExpiry(ctx, key)
+	}
+	return nil, time.Time{}, ErrNotSupported
+}
+
+func (t *tiered) Scan(prefix string, cursor string, limit int) ([]string, string, error) {
+	return Scan(t.source, prefix, cursor, limit)
+}
+
+func (t *tiered) Range(prefix string, fn func(key string) bool) error {
+	return Range(t.source, prefix, fn)
+}
+
+// Sweep evicts local copies that are past serving, stale or not, and
+// sweeps source if it supports it. The count is of source evictions.
+func (t *tiered) Sweep(now time.Time) (int, error) {
+	if _, err := t.local.Sweep(now); err != nil {
+		return 0, err
+	}
+	if s, ok := t.source.(Sweeper); ok {
+		return s.Sweep(now)
+	}
+	return 0, nil
+}
+
+// SetClock sets the clock for the local copies and for source.
+func (t *tiered) SetClock(now func() time.Time) {
+	t.now = now
+	t.local.SetClock(now)
+	if c, ok := t.source.(Clocked); ok {
+		c.SetClock(now)
+	}
+}
+
+// Close waits for background refreshes to finish, then closes source.
+func (t *tiered) Close() error {
+	t.unwatch()
+	t.refresh.Wait()
+	t.InvalidateAll()
+	return t.source.Close()
+}
+
+func (t *tiered) Invalidate(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gen++
+	_ = t.local.Delete(key)
+}
+
+func (t *tiered) InvalidateAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gen++
+	for _, s := range t.local.shards {
+		s.mu.Lock()
+		for _, e := range s.items {
+			s.remove(e)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// revalidate refreshes a stale key in the background, unless a read of
+// it is already under way.
+func (t *tiered) revalidate(key string) {
+	t.mu.Lock()
+	_, busy := t.inflight[key]
+	t.mu.Unlock()
+	if busy {
+		return
+	}
+	t.refresh.Add(1)
+	go func() {
+		defer t.refresh.Done()
+		<-t.start(key).done
+	}()
+}
+
+// start returns the in-flight read of key, starting one if needed.
+func (t *tiered) start(key string) *fetch {
+	t.mu.Lock()
+	if f, ok := t.inflight[key]; ok {
+		t.mu.Unlock()
+		return f
+	}
+	f := &fetch{done: make(chan struct{})}
+	t.inflight[key] = f
+	gen := t.gen
+	t.mu.Unlock()
+
+	go func() {
+		f.value, f.err = t.source.Get(key)
+		t.mu.Lock()
+		delete(t.inflight, key)
+		// An invalidation during the read may have made its result
+		// out of date, so only keep results from the same generation.
+		if gen == t.gen {
+			t.keep(key, f.value, f.err)
+		}
+		t.mu.Unlock()
+		close(f.done)
+	}()
+	return f
+}
+
+// keep stores the result of a source read; callers must hold t.mu.
+func (t *tiered) keep(key string, value interface{}, err error) {
+	now := t.now()
+	switch err {
+	case nil:
+		fresh := now.Add(t.opts.TTL)
+		_ = t.local.PutUntil(fresh.Add(t.opts.StaleTTL), key, &tieredEntry{value: value, fresh: fresh})
+	case ErrNotFound:
+		if t.opts.NegativeTTL > 0 {
+			fresh := now.Add(t.opts.NegativeTTL)
+			_ = t.local.PutUntil(fresh, key, &tieredEntry{missing: true, fresh: fresh})
+		} else {
+			_ = t.local.Delete(key)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingSource counts reads, and blocks them while gate is held.
+type countingSource struct {
+	Cache
+	reads int32
+	gate  sync.RWMutex
+	err   error
+}
+
+func (s *countingSource) Get(key string) (interface{}, error) {
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	atomic.AddInt32(&s.reads, 1)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.Cache.Get(key)
+}
+
+func (s *countingSource) count() int { return int(atomic.LoadInt32(&s.reads)) }
+
+func TestTieredCache(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		now = present()
+	)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+
+	src := &countingSource{Cache: NewMemoryCache()}
+	_ = src.Put("alice", "one")
+	c := newTiered(src, TieredOptions{TTL: time.Minute, NegativeTTL: 10 * time.Second, StaleTTL: time.Minute}, clock)
+	defer func() { _ = c.Close() }()
+
+	for i := 0; i < 3; i++ {
+		if v, err := c.Get("alice"); v != "one" || err != nil {
+			t.Errorf("Get() expected one, got %v (%v)", v, err)
+		}
+	}
+	if n := src.count(); n != 1 {
+		t.Errorf("Get() expected a single source read, got %d", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get("bob"); err != ErrNotFound {
+			t.Errorf("Get() of unknown key expected %v, got %v", ErrNotFound, err)
+		}
+	}
+	if n := src.count(); n != 2 {
+		t.Errorf("Get() expected the miss to be cached, got %d source reads", n)
+	}
+	advance(11 * time.Second)
+	_, _ = c.Get("bob")
+	if n := src.count(); n != 3 {
+		t.Errorf("Get() expected the cached miss to expire, got %d source reads", n)
+	}
+
+	_ = src.Put("alice", "two")
+	advance(time.Minute)
+	src.gate.Lock()
+	if v, err := c.Get("alice"); v != "one" || err != nil {
+		t.Errorf("Get() of stale key expected one while revalidating, got %v (%v)", v, err)
+	}
+	src.gate.Unlock()
+	c.refresh.Wait()
+	if v, err := c.Get("alice"); v != "two" || err != nil {
+		t.Errorf("Get() after revalidation expected two, got %v (%v)", v, err)
+	}
+
+	_ = src.Put("alice", "three")
+	c.Invalidate("alice")
+	if v, err := c.Get("alice"); v != "three" || err != nil {
+		t.Errorf("Get() after Invalidate() expected three, got %v (%v)", v, err)
+	}
+
+	advance(3 * time.Minute)
+	src.err = errors.New("down")
+	if _, err := c.Get("alice"); err != src.err {
+		t.Errorf("Get() past the stale window expected the source error, got %v", err)
+	}
+}
+
+func TestTieredCacheCollapsesReads(t *testing.T) {
+	src := &countingSource{Cache: NewMemoryCache()}
+	_ = src.Put("key", "value")
+	c := NewTieredCache(src, TieredOptions{})
+	defer func() { _ = c.Close() }()
+
+	src.gate.Lock()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.Get("key"); v != "value" || err != nil {
+				t.Errorf("Get() expected value, got %v (%v)", v, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	src.gate.Unlock()
+	wg.Wait()
+	if n := src.count(); n != 1 {
+		t.Errorf("concurrent Get() expected one source read, got %d", n)
+	}
+}
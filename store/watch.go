@@ -0,0 +1,188 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType is the kind of change reported to watchers.
+type EventType int
+
+// Event Types
+const (
+	// EventPut is a value stored by any of the Put methods.
+	EventPut EventType = iota + 1
+	// EventDelete is a value removed by Delete or GetAndDelete.
+	EventDelete
+	// EventExpire is a value the cache removed by itself, because it
+	// expired or was evicted.
+	EventExpire
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	default:
+		return "unknown"
+	}
+}
+
+// Event reports a change to a key.
+type Event struct {
+	Type EventType
+	Key  string
+}
+
+// Watcher is implemented by caches that report the changes made to
+// their keys through this process.
+type Watcher interface {
+	// Watch calls fn with every change to keys starting with prefix,
+	// until stop is called. fn is called once the change is made,
+	// outside of the cache's locks, and may be called concurrently.
+	Watch(prefix string, fn func(Event)) (stop func())
+}
+
+// watchers is the set of callbacks watching a cache.
+type watchers struct {
+	mu   sync.RWMutex
+	next int
+	fns  map[int]*watch
+}
+
+type watch struct {
+	prefix string
+	fn     func(Event)
+}
+
+func (w *watchers) Watch(prefix string, fn func(Event)) func() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.fns == nil {
+		w.fns = map[int]*watch{}
+	}
+	id := w.next
+	w.next++
+	w.fns[id] = &watch{prefix: prefix, fn: fn}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			delete(w.fns, id)
+		})
+	}
+}
+
+// notify delivers events to the watchers. It takes a pointer so that it
+// can be deferred before the events are known.
+func (w *watchers) notify(events *[]Event) {
+	if w == nil || len(*events) == 0 {
+		return
+	}
+	w.mu.RLock()
+	fns := make([]*watch, 0, len(w.fns))
+	for _, fn := range w.fns {
+		fns = append(fns, fn)
+	}
+	w.mu.RUnlock()
+	for _, e := range *events {
+		for _, fn := range fns {
+			if strings.HasPrefix(e.Key, fn.prefix) {
+				fn.fn(e)
+			}
+		}
+	}
+}
+
+// Memo remembers the values read from a cache that reports its changes
+// through Watcher and their expiry through Expirer, so that values are
+// only read again once they change or expire. Memos of other caches
+// read through every time. At most memoEntries values are remembered,
+// the least recently used being forgotten first.
+type Memo struct {
+	c        Cache
+	now      clockFn
+	watching bool
+	stop     func()
+
+	mu     sync.Mutex
+	gen    uint64
+	closed bool
+	items  *memory
+}
+
+const memoEntries = 4096
+
+// NewMemo returns a Memo of the values read from c. Close stops it
+// watching c.
+func NewMemo(c Cache) *Memo {
+	m := &Memo{c: c, now: time.Now, stop: func() {}}
+	m.items = m.newItems()
+	w, ok := c.(Watcher)
+	if _, expirer := c.(Expirer); ok && expirer {
+		m.watching = true
+		m.stop = w.Watch("", func(e Event) { m.Forget(e.Key) })
+	}
+	return m
+}
+
+// Get returns the value of key, reading it from the cache unless a
+// copy is remembered.
+func (m *Memo) Get(key string) (interface{}, error) {
+	if !m.watching {
+		return m.c.Get(key)
+	}
+	m.mu.Lock()
+	v, err := m.items.Get(key)
+	gen := m.gen
+	m.mu.Unlock()
+	if err == nil {
+		return v, nil
+	}
+
+	v, expire, err := m.c.(Expirer).GetWithExpiry(context.Background(), key)
+	if err != nil {
+		return v, err
+	}
+	m.mu.Lock()
+	// A change reported during the read may have made it out of date.
+	if gen == m.gen && !m.closed {
+		_ = m.items.PutUntil(expire, key, v)
+	}
+	m.mu.Unlock()
+	return v, nil
+}
+
+// Forget drops any remembered copy of key.
+func (m *Memo) Forget(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gen++
+	_ = m.items.Delete(key)
+}
+
+// Close stops watching the cache, and forgets everything; later reads
+// go to the cache. It does not close the cache.
+func (m *Memo) Close() error {
+	m.stop()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gen++
+	m.closed = true
+	m.items = m.newItems()
+	return nil
+}
+
+// newItems returns the bounded cache remembered values are kept in.
+// Sizes are not estimated, as only the number of entries is bounded.
+func (m *Memo) newItems() *memory {
+	opts := MemoryOptions{MaxEntries: memoEntries, SizeFn: func(interface{}) int64 { return 0 }}
+	return newMemory(opts, func() time.Time { return m.now() })
+}
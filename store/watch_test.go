@@ -0,0 +1,180 @@
+package store // import "breve.us/authsvc/store"
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder collects the events reported to a watcher.
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *recorder) record(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recorder) take() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := r.events
+	r.events = nil
+	return events
+}
+
+func TestWatchSweepAndEvict(t *testing.T) {
+	for name, fn := range map[string]factory{"memory": memoryFactory, "bolt": boltFactory} {
+		c := fn(present)
+		r := &recorder{}
+		stop := c.(Watcher).Watch("", r.record)
+		_ = c.PutUntil(past(), "old", "value")
+		_ = c.Put("new", "value")
+		r.take()
+		if _, err := c.(Sweeper).Sweep(present()); err != nil {
+			t.Fatal(err)
+		}
+		if events := r.take(); !reflect.DeepEqual(events, []Event{{Type: EventExpire, Key: "old"}}) {
+			t.Errorf("%s: Sweep() expected an expire event, got %v", name, events)
+		}
+		stop()
+		_ = c.Close()
+	}
+
+	c := newMemory(MemoryOptions{Shards: 1, MaxEntries: 1}, present)
+	r := &recorder{}
+	c.Watch("", r.record)
+	_ = c.Put("first", "value")
+	_ = c.Put("second", "value")
+	want := []Event{{Type: EventPut, Key: "first"}, {Type: EventPut, Key: "second"}, {Type: EventExpire, Key: "first"}}
+	if events := r.take(); !reflect.DeepEqual(events, want) {
+		t.Errorf("Put() past MaxEntries expected %v, got %v", want, events)
+	}
+}
+
+func TestWatchSharedBucket(t *testing.T) {
+	name, err := tempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenBoltDB(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	writer, _ := db.Cache("clients")
+	watched, _ := db.Cache("clients")
+	other, _ := db.Cache("tokens")
+
+	r := &recorder{}
+	watched.(Watcher).Watch("", r.record)
+	_ = writer.Put("a", "value")
+	_ = other.Put("b", "value")
+	if events := r.take(); !reflect.DeepEqual(events, []Event{{Type: EventPut, Key: "a"}}) {
+		t.Errorf("Watch() expected changes through any cache of the bucket, got %v", events)
+	}
+}
+
+// countingCache counts reads through Get.
+type countingCache struct {
+	*memory
+	reads int
+}
+
+func (c *countingCache) Get(key string) (interface{}, error) {
+	c.reads++
+	return c.memory.Get(key)
+}
+
+func TestMemo(t *testing.T) {
+	now := present()
+	src := newMemory(MemoryOptions{}, func() time.Time { return now })
+	m := NewMemo(src)
+	m.now = func() time.Time { return now }
+	defer func() { _ = m.Close() }()
+
+	_ = src.Put("a", "one")
+	_ = src.PutUntil(now.Add(time.Minute), "b", "two")
+	for i := 0; i < 2; i++ {
+		if v, err := m.Get("a"); v != "one" || err != nil {
+			t.Errorf("Get() expected one, got %v (%v)", v, err)
+		}
+		_, _ = m.Get("b")
+	}
+	if n := remembered(m); n != 2 {
+		t.Errorf("Get() expected 2 remembered values, got %d", n)
+	}
+
+	_ = src.Put("a", "changed")
+	if v, _ := m.Get("a"); v != "changed" {
+		t.Errorf("Get() after the cache changed expected changed, got %v", v)
+	}
+	_ = src.Delete("a")
+	if _, err := m.Get("a"); err != ErrNotFound {
+		t.Errorf("Get() after delete expected %v, got %v", ErrNotFound, err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := m.Get("b"); err != ErrExpired {
+		t.Errorf("Get() past expiry expected %v, got %v", ErrExpired, err)
+	}
+
+	_ = m.Close()
+	_ = src.Put("c", "three")
+	_, _ = m.Get("c")
+	if n := remembered(m); n != 0 {
+		t.Errorf("Get() after Close() expected nothing remembered, got %d", n)
+	}
+
+	plain := &countingCache{memory: src}
+	nm := NewMemo(struct{ Cache }{plain})
+	_, _ = nm.Get("c")
+	_, _ = nm.Get("c")
+	if plain.reads != 2 {
+		t.Errorf("Get() on a cache without Watcher expected to read through, got %d reads", plain.reads)
+	}
+}
+
+func TestMemoBounded(t *testing.T) {
+	src := NewMemoryCache()
+	m := NewMemo(src)
+	defer func() { _ = m.Close() }()
+	for i := 0; i < memoEntries+100; i++ {
+		key := strconv.Itoa(i)
+		_ = src.Put(key, key)
+		_, _ = m.Get(key)
+	}
+	if n := remembered(m); n > memoEntries {
+		t.Errorf("Get() expected at most %d remembered values, got %d", memoEntries, n)
+	}
+}
+
+func remembered(m *Memo) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys, _ := m.items.Keys()
+	return len(keys)
+}
+
+func TestTieredWatchesSource(t *testing.T) {
+	src := &countingSource{Cache: NewMemoryCache()}
+	_ = src.Put("alice", "one")
+	c := newTiered(struct {
+		*countingSource
+		Watcher
+	}{src, src.Cache.(Watcher)}, TieredOptions{TTL: time.Hour}, time.Now)
+	defer func() { _ = c.Close() }()
+
+	_, _ = c.Get("alice")
+	_ = src.Cache.Put("alice", "two")
+	if v, err := c.Get("alice"); v != "two" || err != nil {
+		t.Errorf("Get() after the source changed expected two, got %v (%v)", v, err)
+	}
+	if n := src.count(); n != 2 {
+		t.Errorf("Get() expected 2 source reads, got %d", n)
+	}
+}
@@ -0,0 +1,53 @@
+package user // import "breve.us/authsvc/user"
+
+import (
+	"strconv"
+	"strings"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// ActiveDirectoryMapping looks up Active Directory accounts by
+// sAMAccountName, then userPrincipalName, and identifies them by their
+// objectGUID. Pointing it at a global catalog, on port 3268, avoids the
+// referrals a domain controller returns for other domains of a forest.
+var ActiveDirectoryMapping = LDAPMapping{
+	ObjectClass:     "user",
+	LoginAttributes: []string{"sAMAccountName", "userPrincipalName"},
+	Filter:          "(&(objectCategory=person)(objectClass=user)({attr}={value}))",
+	Username:        "sAMAccountName",
+	Email:           "mail",
+	Name:            "cn",
+	Display:         "displayName",
+	ID:              "objectGUID",
+	Groups:          GroupsInChain,
+	GroupName:       "cn",
+	ActiveDirectory: true,
+}
+
+// Active Directory account control attributes, and their flags.
+const (
+	adAccountControl         = "userAccountControl"
+	adAccountControlComputed = "msDS-User-Account-Control-Computed"
+
+	adAccountDisable = 0x0002
+	adLockout        = 0x0010
+)
+
+// adInactive reports whether the account of e is disabled or locked out.
+// The lockout flag of userAccountControl is not kept up to date by the
+// server, so the computed attribute is checked as well.
+func adInactive(e *ldap.Entry) bool {
+	uac, _ := strconv.ParseUint(e.GetAttributeValue(adAccountControl), 10, 32)
+	computed, _ := strconv.ParseUint(e.GetAttributeValue(adAccountControlComputed), 10, 32)
+	return uac&adAccountDisable != 0 || (uac|computed)&adLockout != 0
+}
+
+// login returns the name to look a login up by: Active Directory users
+// may log in as DOMAIN\name.
+func (m *LDAPMapping) login(name string) string {
+	if i := strings.LastIndex(name, `\`); m.ActiveDirectory && i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
@@ -0,0 +1,187 @@
+package user // import "breve.us/authsvc/user"
+
+import (
+	ldap "gopkg.in/ldap.v2"
+
+	"breve.us/authsvc/store"
+)
+
+// Group Sources
+const (
+	// GroupsMemberOf reads the memberOf attribute of users and groups.
+	GroupsMemberOf = "memberOf"
+	// GroupsOfNames searches for groupOfNames entries with the user as a
+	// member.
+	GroupsOfNames = "groupOfNames"
+	// GroupsPosix searches for posixGroup entries listing the user's uid
+	// as a memberUid. Posix groups do not nest.
+	GroupsPosix = "posixGroup"
+	// GroupsInChain asks Active Directory for every group, nested or
+	// not, in one LDAP_MATCHING_RULE_IN_CHAIN query.
+	GroupsInChain = "inChain"
+)
+
+// groupPageSize is the page size of group searches.
+const groupPageSize = 500
+
+// ldapGroup is a group found for a user.
+type ldapGroup struct {
+	dn   string
+	name string
+	// parents are the DNs of the groups it belongs to, when the source
+	// lists them on the group itself.
+	parents []string
+}
+
+// validGroups checks the group settings of the mapping.
+func (m *LDAPMapping) validGroups() error {
+	switch m.Groups {
+	case "", GroupsMemberOf, GroupsOfNames, GroupsPosix, GroupsInChain:
+	default:
+		return ErrInvalidMapping
+	}
+	if m.GroupDepth < 0 {
+		return ErrInvalidMapping
+	}
+	return nil
+}
+
+// groupName returns the name of a group: its GroupName attribute, or its
+// DN if that is not set or the group has none.
+func (m *LDAPMapping) groupName(e *ldap.Entry) string {
+	if m.GroupName != "" {
+		if name := e.GetAttributeValue(m.GroupName); name != "" {
+			return name
+		}
+	}
+	return e.DN
+}
+
+// groups returns the names of the groups the user at e belongs to,
+// following nested groups up to GroupDepth levels.
+func (m *LDAPMapping) groups(cn *ldap.Conn, basedn string, e *ldap.Entry) ([]string, error) {
+	if m.GroupBaseDN != "" {
+		basedn = m.GroupBaseDN
+	}
+	var (
+		found []ldapGroup
+		err   error
+	)
+	switch m.Groups {
+	case "":
+		return nil, nil
+	case GroupsMemberOf:
+		var direct []string
+		if direct, err = store.LDAPAttributeValues(cn, e, GroupsMemberOf); err != nil {
+			return nil, err
+		}
+		found, err = m.expand(direct, func(dn string) ([]ldapGroup, error) {
+			return m.readGroup(cn, dn)
+		})
+	case GroupsOfNames:
+		found, err = m.expand([]string{e.DN}, func(dn string) ([]ldapGroup, error) {
+			filter := store.LDAPAnd(store.LDAPEqual("objectClass", "groupOfNames"), store.LDAPEqual("member", dn))
+			return m.searchGroups(cn, basedn, filter)
+		})
+	case GroupsPosix:
+		uid := e.GetAttributeValue("uid")
+		if uid == "" {
+			return nil, nil
+		}
+		filter := store.LDAPAnd(store.LDAPEqual("objectClass", "posixGroup"), store.LDAPEqual("memberUid", uid))
+		found, err = m.searchGroups(cn, basedn, filter)
+	case GroupsInChain:
+		filter := store.LDAPAnd(store.LDAPEqual("objectClass", "group"), store.LDAPExtensible("member", store.LDAPMatchingRuleInChain, e.DN))
+		found, err = m.searchGroups(cn, basedn, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(found))
+	for _, g := range found {
+		names = append(names, g.name)
+	}
+	return names, nil
+}
+
+// expand finds the groups of each DN in start with lookup, then the
+// groups of those groups, up to GroupDepth levels of nesting. With
+// memberOf, start holds the groups themselves, found by reading them.
+func (m *LDAPMapping) expand(start []string, lookup func(dn string) ([]ldapGroup, error)) ([]ldapGroup, error) {
+	var (
+		found []ldapGroup
+		seen  = map[string]bool{}
+		level = start
+	)
+	for depth := 0; depth <= m.GroupDepth && len(level) > 0; depth++ {
+		var next []string
+		for _, dn := range level {
+			groups, err := lookup(dn)
+			if err != nil {
+				return nil, err
+			}
+			for _, g := range groups {
+				if seen[g.dn] {
+					continue
+				}
+				seen[g.dn] = true
+				found = append(found, g)
+				if m.Groups == GroupsMemberOf {
+					next = append(next, g.parents...)
+				} else {
+					next = append(next, g.dn)
+				}
+			}
+		}
+		level = next
+	}
+	return found, nil
+}
+
+// readGroup reads the group at dn, with the groups it belongs to. A group
+// that no longer exists is skipped.
+func (m *LDAPMapping) readGroup(cn *ldap.Conn, dn string) ([]ldapGroup, error) {
+	r := ldap.NewSearchRequest(
+		dn,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0, 0, false,
+		"(objectClass=*)", m.groupAttributes(), nil)
+	res, err := cn.Search(r)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var groups []ldapGroup
+	for _, e := range res.Entries {
+		parents, err := store.LDAPAttributeValues(cn, e, GroupsMemberOf)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, ldapGroup{dn: e.DN, name: m.groupName(e), parents: parents})
+	}
+	return groups, nil
+}
+
+// searchGroups returns the groups matching f.
+func (m *LDAPMapping) searchGroups(cn *ldap.Conn, basedn string, f store.LDAPFilter) ([]ldapGroup, error) {
+	filter, err := f.Build()
+	if err != nil {
+		return nil, err
+	}
+	var groups []ldapGroup
+	err = store.SearchLDAPPaged(cn, basedn, filter, groupPageSize, func(e *ldap.Entry) bool {
+		groups = append(groups, ldapGroup{dn: e.DN, name: m.groupName(e)})
+		return true
+	}, m.groupAttributes()...)
+	return groups, err
+}
+
+func (m *LDAPMapping) groupAttributes() []string {
+	attrs := []string{GroupsMemberOf}
+	if m.GroupName != "" {
+		attrs = append(attrs, m.GroupName)
+	}
+	return attrs
+}
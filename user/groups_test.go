@@ -0,0 +1,147 @@
+package user // import "breve.us/authsvc/user"
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"breve.us/authsvc/store"
+	"breve.us/authsvc/store/storetest"
+)
+
+const (
+	annDN    = "uid=ann,ou=people," + baseDN
+	groupsDN = "ou=groups," + baseDN
+)
+
+func groupDN(cn string) string { return "cn=" + cn + "," + groupsDN }
+
+// userGroups returns the sorted groups of ann, read as m says.
+func userGroups(t *testing.T, srv *storetest.LDAPServer, m LDAPMapping) []string {
+	cfg := &store.LDAPConfig{Host: srv.Host(), Port: srv.Port(), BaseDN: baseDN}
+	c := NewLDAPCache(cfg, &m)
+	defer func() { _ = c.Close() }()
+	v, err := c.Get("ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := v.(*Details).Groups
+	sort.Strings(groups)
+	return groups
+}
+
+func addUser(srv *storetest.LDAPServer, attrs map[string][]string) {
+	attrs["objectClass"] = []string{"inetOrgPerson"}
+	attrs["uid"] = []string{"ann"}
+	srv.Add(annDN, attrs)
+}
+
+func TestGroupsMemberOf(t *testing.T) {
+	srv := storetest.NewLDAPServer(t)
+	t.Cleanup(srv.Close)
+	addUser(srv, map[string][]string{"memberOf": {groupDN("dev"), groupDN("ops"), groupDN("gone")}})
+	// ops is also reached through dev, and eng and all nest in each
+	// other.
+	for cn, parents := range map[string][]string{
+		"dev": {groupDN("eng")},
+		"ops": {groupDN("dev")},
+		"eng": {groupDN("all")},
+		"all": {groupDN("eng")},
+	} {
+		srv.Add(groupDN(cn), map[string][]string{"objectClass": {"group"}, "cn": {cn}, "memberOf": parents})
+	}
+
+	m := DefaultLDAPMapping
+	m.Groups = GroupsMemberOf
+	for depth, want := range [][]string{
+		{"dev", "ops"},
+		{"dev", "eng", "ops"},
+		{"all", "dev", "eng", "ops"},
+		{"all", "dev", "eng", "ops"},
+		{"all", "dev", "eng", "ops"},
+	} {
+		m.GroupDepth = depth
+		if got := userGroups(t, srv, m); !reflect.DeepEqual(got, want) {
+			t.Errorf("memberOf groups to depth %d expected %v, got %v", depth, want, got)
+		}
+	}
+	// The cycle is left once every group in it is seen, however deep
+	// groups are followed.
+	searches := srv.Searches()
+	_ = userGroups(t, srv, m)
+	shallow := srv.Searches() - searches
+	m.GroupDepth = 100
+	if got := userGroups(t, srv, m); len(got) != 4 || srv.Searches()-searches-shallow != shallow {
+		t.Errorf("memberOf groups through a cycle expected 4 in %d searches, got %v in %d", shallow, got, srv.Searches()-searches-shallow)
+	}
+
+	// Groups without a name are known by DN.
+	m.GroupDepth, m.GroupName = 0, "description"
+	if got, want := userGroups(t, srv, m), []string{groupDN("dev"), groupDN("ops")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("memberOf groups without names expected %v, got %v", want, got)
+	}
+}
+
+func TestGroupsOfNames(t *testing.T) {
+	srv := storetest.NewLDAPServer(t)
+	t.Cleanup(srv.Close)
+	addUser(srv, map[string][]string{})
+	// ops holds ann and dev, and eng and all hold each other.
+	for cn, members := range map[string][]string{
+		"dev":    {annDN},
+		"ops":    {annDN, groupDN("dev")},
+		"eng":    {groupDN("dev"), groupDN("all")},
+		"all":    {groupDN("eng")},
+		"others": {"uid=bob,ou=people," + baseDN},
+	} {
+		srv.Add(groupDN(cn), map[string][]string{"objectClass": {"groupOfNames"}, "cn": {cn}, "member": members})
+	}
+
+	m := DefaultLDAPMapping
+	m.Groups = GroupsOfNames
+	m.GroupBaseDN = groupsDN
+	for depth, want := range [][]string{
+		{"dev", "ops"},
+		{"dev", "eng", "ops"},
+		{"all", "dev", "eng", "ops"},
+		{"all", "dev", "eng", "ops"},
+	} {
+		m.GroupDepth = depth
+		if got := userGroups(t, srv, m); !reflect.DeepEqual(got, want) {
+			t.Errorf("groupOfNames groups to depth %d expected %v, got %v", depth, want, got)
+		}
+	}
+	m.GroupDepth = 100
+	if got := userGroups(t, srv, m); len(got) != 4 {
+		t.Errorf("groupOfNames groups through a cycle expected 4, got %v", got)
+	}
+
+	// Groups outside GroupBaseDN are not found.
+	m.GroupBaseDN = "ou=elsewhere," + baseDN
+	if got := userGroups(t, srv, m); len(got) != 0 {
+		t.Errorf("groupOfNames groups outside the group base expected none, got %v", got)
+	}
+}
+
+func TestGroupsPosix(t *testing.T) {
+	srv := storetest.NewLDAPServer(t)
+	t.Cleanup(srv.Close)
+	addUser(srv, map[string][]string{})
+	srv.Add(groupDN("staff"), map[string][]string{"objectClass": {"posixGroup"}, "cn": {"staff"}, "memberUid": {"ann", "bob"}})
+	srv.Add(groupDN("admins"), map[string][]string{"objectClass": {"posixGroup"}, "memberUid": {"bob"}})
+	srv.Add(groupDN("wheel"), map[string][]string{"objectClass": {"posixGroup"}, "memberUid": {"ann"}})
+	// Posix groups do not nest, however deep groups are followed.
+	srv.Add(groupDN("all"), map[string][]string{"objectClass": {"posixGroup"}, "cn": {"all"}, "memberUid": {"staff"}})
+
+	m := DefaultLDAPMapping
+	m.Groups = GroupsPosix
+	m.GroupDepth = 3
+	if got, want := userGroups(t, srv, m), []string{groupDN("wheel"), "staff"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("posixGroup groups expected %v, got %v", want, got)
+	}
+
+	m.Groups = ""
+	if got := userGroups(t, srv, m); got != nil {
+		t.Errorf("groups without a source expected none, got %v", got)
+	}
+}
@@ -0,0 +1,163 @@
+package user // import "breve.us/authsvc/user"
+
+import (
+	"context"
+	"encoding/hex"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"breve.us/authsvc/store"
+)
+
+// ID Table Key Prefixes
+const (
+	idBySource = "source:"
+	idByID     = "id:"
+)
+
+// maxIDCandidates bounds the IDs tried for a user before giving up; each
+// is taken only when another user already holds those before it.
+const maxIDCandidates = 16
+
+// IDTable keeps the IDs issued to LDAP users, keyed by the stable
+// identifier of their entries, such as entryUUID or objectGUID. A user
+// keeps their ID when renamed or moved, and no two users share one.
+//
+// Entries without a stable identifier are recorded by DN, so they are
+// issued a new ID when renamed. Until the table is given a cache, IDs
+// are derived without being recorded.
+type IDTable struct {
+	// Legacy issues users the ID derived from their DN when first seen,
+	// as IDs were before stable identifiers, so that accounts created
+	// with those IDs keep working.
+	Legacy bool
+
+	mu    sync.RWMutex
+	cache store.Cache
+}
+
+// NewIDTable returns a table recording IDs in cache.
+func NewIDTable(cache store.Cache, legacy bool) *IDTable {
+	return &IDTable{cache: cache, Legacy: legacy}
+}
+
+// SetCache sets the cache the IDs are recorded in, for tables created
+// before their storage is opened.
+func (t *IDTable) SetCache(cache store.Cache) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cache = cache
+}
+
+// Resolve returns the ID of the entry at dn whose stable identifier is
+// source, issuing one if the entry has none yet. Entries without a
+// stable identifier are known by their DN.
+//
+// A table without a cache issues the first ID it would record without
+// recording it; a nil table does so as a Legacy one, the default.
+func (t *IDTable) Resolve(ctx context.Context, source []byte, dn string) (uint64, error) {
+	legacy, seed, key := true, []byte(dn), "dn:"+dn
+	if len(source) > 0 {
+		seed = normalizeSource(source)
+		key = hex.EncodeToString(seed)
+	}
+	var cache store.Cache
+	if t != nil {
+		t.mu.RLock()
+		cache = t.cache
+		t.mu.RUnlock()
+		legacy = t.Legacy
+	}
+
+	var candidates []uint64
+	if legacy && len(source) > 0 {
+		candidates = append(candidates, hashID([]byte(dn)))
+	}
+	for i := 0; len(candidates) < maxIDCandidates; i++ {
+		s := seed
+		if i > 0 {
+			s = append(append([]byte{}, seed...), strconv.Itoa(i)...)
+		}
+		candidates = append(candidates, hashID(s))
+	}
+	if cache == nil {
+		return candidates[0], nil
+	}
+
+	if id, err := t.lookup(ctx, cache, idBySource+key); err != store.ErrNotFound {
+		return id, err
+	}
+	for _, id := range candidates {
+		ok, err := claim(ctx, cache, idByID+strconv.FormatUint(id, 10), key)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+		// Another node may have issued an ID for the same entry at
+		// the same time; the first recorded wins.
+		if ok, err = claim(ctx, cache, idBySource+key, strconv.FormatUint(id, 10)); err != nil || ok {
+			return id, err
+		}
+		return t.lookup(ctx, cache, idBySource+key)
+	}
+	return 0, ErrInvalidUser
+}
+
+func (t *IDTable) lookup(ctx context.Context, cache store.Cache, key string) (uint64, error) {
+	v, err := getContext(ctx, cache, key)
+	if err != nil {
+		return 0, err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return 0, ErrInvalidUser
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// claim records value at key unless another value is there, reporting
+// whether key now holds value.
+func claim(ctx context.Context, cache store.Cache, key, value string) (bool, error) {
+	if c, ok := cache.(store.CacheV2); ok {
+		if ok, err := c.PutIfAbsent(ctx, time.Time{}, key, value); err != nil || ok {
+			return ok, err
+		}
+	} else if _, err := cache.Get(key); err == store.ErrNotFound {
+		return true, cache.Put(key, value)
+	}
+	v, err := getContext(ctx, cache, key)
+	if err != nil {
+		return false, err
+	}
+	return v == value, nil
+}
+
+func getContext(ctx context.Context, cache store.Cache, key string) (interface{}, error) {
+	if c, ok := cache.(store.CacheV2); ok {
+		return c.GetContext(ctx, key)
+	}
+	return cache.Get(key)
+}
+
+// hashID derives an ID from data.
+func hashID(data []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	return h.Sum64()
+}
+
+// normalizeSource returns the 16 bytes of a UUID written as text, as
+// entryUUID and nsUniqueId are, so that each entry has one form; other
+// identifiers, such as the binary objectGUID, are returned as they are.
+func normalizeSource(source []byte) []byte {
+	s := strings.Replace(string(source), "-", "", -1)
+	if b, err := hex.DecodeString(s); err == nil && len(b) == 16 {
+		return b
+	}
+	return source
+}
@@ -0,0 +1,158 @@
+package user // import "breve.us/authsvc/user"
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"breve.us/authsvc/store"
+)
+
+const (
+	testUUID = "3f2504e0-4f89-11d3-9a0c-0305e82c3301"
+	testDN   = "uid=ann,ou=people,dc=example,dc=com"
+)
+
+func TestIDTableLegacy(t *testing.T) {
+	ctx := context.Background()
+	legacy := NewIDTable(store.NewMemoryCache(), true)
+	id, err := legacy.Resolve(ctx, []byte(testUUID), testDN)
+	if err != nil || id != hashID([]byte(testDN)) {
+		t.Errorf("Resolve() on a legacy table expected the DN hash %d, got %d (%v)", hashID([]byte(testDN)), id, err)
+	}
+	// The ID stays with the entry when it is renamed.
+	if renamed, err := legacy.Resolve(ctx, []byte(testUUID), "uid=ann2,ou=people,dc=example,dc=com"); err != nil || renamed != id {
+		t.Errorf("Resolve() after a rename expected %d, got %d (%v)", id, renamed, err)
+	}
+
+	table := NewIDTable(store.NewMemoryCache(), false)
+	want := hashID(normalizeSource([]byte(testUUID)))
+	if id, err = table.Resolve(ctx, []byte(testUUID), testDN); err != nil || id != want {
+		t.Errorf("Resolve() expected the source hash %d, got %d (%v)", want, id, err)
+	}
+	// Text UUIDs are matched however they are written.
+	upper := strings.ToUpper(strings.Replace(testUUID, "-", "", -1))
+	if id, err = table.Resolve(ctx, []byte(upper), testDN); err != nil || id != want {
+		t.Errorf("Resolve() of %q expected %d, got %d (%v)", upper, want, id, err)
+	}
+}
+
+func TestIDTableCollisions(t *testing.T) {
+	ctx := context.Background()
+	cache := store.NewMemoryCache()
+	table := NewIDTable(cache, true)
+	seed := normalizeSource([]byte(testUUID))
+
+	// Another user holds the legacy ID and the first derived one.
+	for _, id := range []uint64{hashID([]byte(testDN)), hashID(seed)} {
+		_ = cache.Put(idByID+strconv.FormatUint(id, 10), "other")
+	}
+	want := hashID(append(append([]byte{}, seed...), '1'))
+	if id, err := table.Resolve(ctx, []byte(testUUID), testDN); err != nil || id != want {
+		t.Errorf("Resolve() past collisions expected %d, got %d (%v)", want, id, err)
+	}
+
+	// With every candidate taken, no ID is issued.
+	cache = store.NewMemoryCache()
+	table = NewIDTable(cache, true)
+	_ = cache.Put(idByID+strconv.FormatUint(hashID([]byte(testDN)), 10), "other")
+	for i := 0; i < maxIDCandidates-1; i++ {
+		s := seed
+		if i > 0 {
+			s = append(append([]byte{}, seed...), strconv.Itoa(i)...)
+		}
+		_ = cache.Put(idByID+strconv.FormatUint(hashID(s), 10), "other")
+	}
+	if id, err := table.Resolve(ctx, []byte(testUUID), testDN); err != ErrInvalidUser {
+		t.Errorf("Resolve() with every candidate taken expected %v, got %d (%v)", ErrInvalidUser, id, err)
+	}
+}
+
+// racingCache records an ID for every entry just before the table does,
+// as another node issuing one at the same time would.
+type racingCache struct {
+	store.Cache
+	store.CacheV2
+	id string
+}
+
+func (c *racingCache) PutIfAbsent(ctx context.Context, expire time.Time, key string, value interface{}) (bool, error) {
+	if strings.HasPrefix(key, idBySource) {
+		_, _ = c.CacheV2.PutIfAbsent(ctx, expire, key, c.id)
+	}
+	return c.CacheV2.PutIfAbsent(ctx, expire, key, value)
+}
+
+func TestIDTableRace(t *testing.T) {
+	ctx := context.Background()
+	cache := store.NewMemoryCache()
+	racing := &racingCache{Cache: cache, CacheV2: cache.(store.CacheV2), id: "42"}
+	if id, err := NewIDTable(racing, false).Resolve(ctx, []byte(testUUID), testDN); err != nil || id != 42 {
+		t.Errorf("Resolve() losing a race expected the other node's 42, got %d (%v)", id, err)
+	}
+
+	// Nodes sharing a cache agree on the ID of an entry.
+	cache = store.NewMemoryCache()
+	ids := make([]uint64, 8)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if ids[i], err = NewIDTable(cache, i%2 == 0).Resolve(ctx, []byte(testUUID), testDN); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, id := range ids[1:] {
+		if id != ids[0] {
+			t.Fatalf("Resolve() on nodes sharing a cache expected one ID, got %v", ids)
+		}
+	}
+}
+
+func TestIDTableWithoutSource(t *testing.T) {
+	ctx := context.Background()
+	cache := store.NewMemoryCache()
+	table := NewIDTable(cache, false)
+	id, err := table.Resolve(ctx, nil, testDN)
+	if err != nil || id != hashID([]byte(testDN)) {
+		t.Errorf("Resolve() without source expected the DN hash, got %d (%v)", id, err)
+	}
+	if v, err := cache.Get(idBySource + "dn:" + testDN); err != nil || v != strconv.FormatUint(id, 10) {
+		t.Errorf("Resolve() without source expected the ID recorded by DN, got %v (%v)", v, err)
+	}
+	// The entry is known by DN, so a renamed one is a new user.
+	if renamed, err := table.Resolve(ctx, nil, "uid=ann2,ou=people,dc=example,dc=com"); err != nil || renamed == id {
+		t.Errorf("Resolve() after a rename expected a new ID, got %d (%v)", renamed, err)
+	}
+}
+
+func TestIDTableWithoutCache(t *testing.T) {
+	ctx := context.Background()
+	var table *IDTable
+	for _, source := range [][]byte{nil, []byte(testUUID)} {
+		if id, err := table.Resolve(ctx, source, testDN); err != nil || id != hashID([]byte(testDN)) {
+			t.Errorf("Resolve(%q) on a nil table expected the DN hash, got %d (%v)", source, id, err)
+		}
+	}
+
+	table = NewIDTable(nil, false)
+	want := hashID(normalizeSource([]byte(testUUID)))
+	if id, err := table.Resolve(ctx, []byte(testUUID), testDN); err != nil || id != want {
+		t.Errorf("Resolve() without cache expected %d, got %d (%v)", want, id, err)
+	}
+
+	// Nothing was recorded, so the ID is issued once a cache is set.
+	cache := store.NewMemoryCache()
+	_ = cache.Put(idByID+strconv.FormatUint(want, 10), "other")
+	table.SetCache(cache)
+	if id, err := table.Resolve(ctx, []byte(testUUID), testDN); err != nil || id == want {
+		t.Errorf("Resolve() once cached expected an ID past %d, got %d (%v)", want, id, err)
+	}
+}
@@ -1,9 +1,10 @@
 package user // import "breve.us/authsvc/user"
 
 import (
+	"context"
 	"errors"
-	"fmt"
-	"hash/fnv"
+	"log"
+	"strings"
 
 	ldap "gopkg.in/ldap.v2"
 
@@ -13,75 +14,282 @@ import (
 
 // Errors
 var (
-	ErrNotFound = errors.New("not found")
+	// ErrNotFound is store.ErrNotFound, so that caches in front of LDAP
+	// can remember misses.
+	ErrNotFound = store.ErrNotFound
+
+	ErrInvalidMapping = errors.New("invalid ldap attribute mapping")
+	ErrAmbiguousLogin = errors.New("login matches more than one ldap entry")
 )
 
-// NewLDAPChecker returns a password checker using LDAP
-func NewLDAPChecker(config *store.LDAPConfig) common.PasswordChecker {
-	return &checker{cfg: config}
+// LDAPMapping describes how directory entries are found and turned into
+// Details, so that schemas other than inetOrgPerson can be used.
+type LDAPMapping struct {
+	// ObjectClass is the class of the entries listed as users.
+	ObjectClass string
+	// LoginAttributes are the attributes a login name is looked up by,
+	// in turn.
+	LoginAttributes []string
+	// Filter is the search filter for a login, in which {attr} is
+	// replaced by the login attribute and {value} by the login name,
+	// escaped so that it matches only itself.
+	Filter string
+
+	// Username is the attribute of the username; when empty it is the
+	// login attribute that matched.
+	Username string
+	Email    string
+	Name     string
+	// Display is the attribute of the name shown in place of Name, if
+	// the entry has it.
+	Display  string
+	Password string
+	// Extra lists further attributes carried through in
+	// Details.Attributes.
+	Extra []string
+	// ID is the attribute holding the stable identifier of an entry,
+	// such as entryUUID, objectGUID or nsUniqueId, that Details.ID is
+	// derived from; when empty, or missing from an entry, the DN is used,
+	// and the ID changes when the entry is renamed.
+	ID string
+	// IDs, if set, records the IDs issued, so that they are kept when
+	// the ID attribute changes or differing identifiers derive the same
+	// ID.
+	IDs *IDTable
+
+	// Groups is where group membership is read from: GroupsMemberOf,
+	// GroupsOfNames, GroupsPosix or GroupsInChain; when empty it is not.
+	Groups string
+	// GroupDepth is how many levels of nested groups are followed; 0
+	// finds only the groups users belong to directly.
+	GroupDepth int
+	// GroupBaseDN is where groups are searched for; when empty it is the
+	// base DN of users.
+	GroupBaseDN string
+	// GroupName is the attribute naming a group in Details.Groups; when
+	// empty, or missing from a group, its DN is used.
+	GroupName string
+
+	// ActiveDirectory marks disabled and locked out accounts Inactive,
+	// and accepts DOMAIN\name logins; see ActiveDirectoryMapping.
+	ActiveDirectory bool
+}
+
+// DefaultLDAPMapping looks up inetOrgPerson entries by uid, then mail.
+var DefaultLDAPMapping = LDAPMapping{
+	ObjectClass:     "inetOrgPerson",
+	LoginAttributes: []string{"uid", "mail"},
+	Filter:          "({attr}={value})",
+	Email:           "mail",
+	Name:            "cn",
+	Display:         "displayName",
+	Password:        "userPassword",
+	ID:              "entryUUID",
+	GroupName:       "cn",
+}
+
+// Validate checks that the mapping can find users.
+func (m *LDAPMapping) Validate() error {
+	if m.ObjectClass == "" || len(m.LoginAttributes) == 0 || !strings.Contains(m.Filter, "{value}") {
+		return ErrInvalidMapping
+	}
+	for _, attr := range m.LoginAttributes {
+		if _, err := m.filter(attr, "").Build(); err != nil {
+			return ErrInvalidMapping
+		}
+	}
+	for _, attr := range append([]string{m.Username, m.Email, m.Name, m.Display, m.Password, m.ID, m.GroupName}, m.Extra...) {
+		if attr != "" && !store.ValidLDAPAttribute(attr) {
+			return ErrInvalidMapping
+		}
+	}
+	return m.validGroups()
+}
+
+// filter returns the search filter for value in attr.
+func (m *LDAPMapping) filter(attr, value string) store.LDAPFilter {
+	return store.LDAPTemplate(m.Filter, attr, value)
+}
+
+// attributes returns the attributes to request for a user's entry.
+func (m *LDAPMapping) attributes() []string {
+	var attrs []string
+	seen := map[string]bool{}
+	fields := []string{m.Username, m.Email, m.Name, m.Display, m.Password, m.ID}
+	if m.ActiveDirectory {
+		fields = append(fields, adAccountControl, adAccountControlComputed)
+	}
+	switch m.Groups {
+	case GroupsMemberOf:
+		fields = append(fields, GroupsMemberOf)
+	case GroupsPosix:
+		fields = append(fields, "uid")
+	}
+	for _, group := range [][]string{m.LoginAttributes, fields, m.Extra} {
+		for _, attr := range group {
+			if attr != "" && !seen[strings.ToLower(attr)] {
+				seen[strings.ToLower(attr)] = true
+				attrs = append(attrs, attr)
+			}
+		}
+	}
+	return attrs
+}
+
+// orDefault returns m, or DefaultLDAPMapping if m is nil.
+func (m *LDAPMapping) orDefault() *LDAPMapping {
+	if m == nil {
+		return &DefaultLDAPMapping
+	}
+	return m
+}
+
+// NewLDAPChecker returns a password checker using LDAP, finding users as
+// mapping says, or as DefaultLDAPMapping does if it is nil.
+func NewLDAPChecker(config *store.LDAPConfig, mapping *LDAPMapping) common.PasswordChecker {
+	return &checker{cfg: config, mapping: mapping.orDefault()}
 }
 
 type checker struct {
-	cfg *store.LDAPConfig
+	cfg     *store.LDAPConfig
+	mapping *LDAPMapping
 }
 
 func (c *checker) IsAuthenticated(username string, password string) bool {
-	cn, err := c.cfg.Connect()
+	ctx := context.Background()
+	dns, err := c.find(ctx, username)
 	if err != nil {
+		log.Printf("ldap: cannot find %q to authenticate: %v", username, err)
 		return false
 	}
-	defer cn.Close()
+	for _, dn := range dns {
+		if c.cfg.Authenticate(ctx, dn, password) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// NewLDAPPasswordChanger returns a password changer using the LDAP
+// Password Modify extended operation, finding users as mapping says, or
+// as DefaultLDAPMapping does if it is nil. Refusals by the server's
+// password policy are returned as common.PasswordPolicyError.
+func NewLDAPPasswordChanger(config *store.LDAPConfig, mapping *LDAPMapping) common.PasswordChanger {
+	return &checker{cfg: config, mapping: mapping.orDefault()}
+}
 
-	var res *ldap.SearchResult
-	for _, attr := range usernameAttributes {
-		if res, err = store.SearchLDAP(cn, c.cfg.BaseDN, fmt.Sprintf("(%s=%s)", attr, username), "cn"); err != nil {
-			// TODO: ?
-			continue
+func (c *checker) ChangePassword(username, oldPassword, newPassword string) error {
+	ctx := context.Background()
+	dns, err := c.find(ctx, username)
+	if err != nil {
+		return err
+	}
+	if len(dns) == 0 {
+		return common.ErrUnknownUser
+	}
+	// The entry whose password oldPassword is, is the user.
+	for _, dn := range dns {
+		if err = c.cfg.ChangePassword(ctx, dn, oldPassword, newPassword); err != store.ErrInvalidCredentials {
+			return passwordError(err)
 		}
-		switch len(res.Entries) {
-		case 1:
-			e := res.Entries[0]
-			if err = cn.Bind(e.DN, password); err == nil {
-				// TODO: ?
-				return true
+	}
+	return common.ErrWrongPassword
+}
+
+// find returns the DN of each entry that the login name may be: the one
+// matching each login attribute. A login matching several entries
+// through one attribute is refused with ErrAmbiguousLogin.
+func (c *checker) find(ctx context.Context, username string) ([]string, error) {
+	// Every entry matching one of the login attributes may be the user;
+	// each is tried in turn.
+	var dns []string
+	login := c.mapping.login(username)
+	if login == "" {
+		return nil, nil
+	}
+	err := c.cfg.Do(ctx, func(cn *ldap.Conn) error {
+		dns = dns[:0]
+		for _, attr := range c.mapping.LoginAttributes {
+			filter, err := c.mapping.filter(attr, login).Build()
+			if err != nil {
+				return err
+			}
+			res, err := store.SearchLDAP(cn, c.cfg.BaseDN, filter, "dn")
+			if err != nil {
+				return err
+			}
+			switch len(res.Entries) {
+			case 0:
+			case 1:
+				dns = append(dns, res.Entries[0].DN)
+			default:
+				return ErrAmbiguousLogin
 			}
-		case 0:
-			continue
-		default:
-			// TODO: ?
-			continue
 		}
-	}
-	return false
+		return nil
+	})
+	return dns, err
 }
 
-// NewLDAPCache returns a cache suitable for interacting with LDAP
-func NewLDAPCache(config *store.LDAPConfig) store.Cache {
-	return store.NewLDAPCache(config, "inetOrgPerson", recordFn)
+// passwordDefaults describe the password changes refused by the server
+// that it gives no reason for.
+var passwordDefaults = map[uint8]string{
+	ldap.LDAPResultConstraintViolation:      "the new password does not meet the password policy",
+	ldap.LDAPResultInvalidAttributeSyntax:   "the new password is not valid",
+	ldap.LDAPResultInsufficientAccessRights: "you are not allowed to change your password",
+	ldap.LDAPResultUnwillingToPerform:       "the directory refused to change the password",
 }
 
-var usernameAttributes = []string{"uid", "mail"}
+// passwordError returns err, or a common.PasswordPolicyError with the
+// server's reason if it refused the new password.
+func passwordError(err error) error {
+	e, ok := err.(*ldap.Error)
+	if !ok {
+		return err
+	}
+	reason, ok := passwordDefaults[e.ResultCode]
+	if !ok {
+		return err
+	}
+	if e.Err != nil && e.Err.Error() != "" {
+		reason = e.Err.Error()
+	}
+	return &common.PasswordPolicyError{Reason: reason}
+}
+
+// NewLDAPCache returns a cache suitable for interacting with LDAP, finding
+// users as mapping says, or as DefaultLDAPMapping does if it is nil.
+func NewLDAPCache(config *store.LDAPConfig, mapping *LDAPMapping) store.Cache {
+	mapping = mapping.orDefault()
+	return store.NewLDAPCache(config, mapping.ObjectClass, mapping.recordFn)
+}
 
-func recordFn(basedn string, key string) (interface{}, func(*ldap.Conn) error) {
+func (m *LDAPMapping) recordFn(basedn string, key string) (interface{}, func(*ldap.Conn) error) {
 	det := &Details{}
+	login := m.login(key)
 	fn := func(cn *ldap.Conn) error {
 		var (
-			err error
-			res *ldap.SearchResult
+			err    error
+			filter string
+			res    *ldap.SearchResult
 		)
-		for _, attr := range usernameAttributes {
-			if res, err = store.SearchLDAP(cn, basedn, fmt.Sprintf("(%s=%s)", attr, key), "*"); err != nil {
-				// TODO: ?
-				continue
+		if login == "" {
+			return ErrNotFound
+		}
+		for _, attr := range m.LoginAttributes {
+			if filter, err = m.filter(attr, login).Build(); err != nil {
+				return err
+			}
+			if res, err = store.SearchLDAP(cn, basedn, filter, m.attributes()...); err != nil {
+				return err
 			}
 			switch len(res.Entries) {
 			case 0:
 				continue
 			case 1:
-				return populateDetails(attr, det, res.Entries[0])
+				return m.populateDetails(cn, basedn, attr, det, res.Entries[0])
 			default:
-				// TODO: ?
-				continue
+				return ErrAmbiguousLogin
 			}
 		}
 		return ErrNotFound
@@ -89,16 +297,44 @@ func recordFn(basedn string, key string) (interface{}, func(*ldap.Conn) error) {
 	return det, fn
 }
 
-func populateDetails(key string, d *Details, m *ldap.Entry) error {
-	// Generate hash as a probably-unique ID placeholder
-	h := fnv.New64a()
-	fmt.Fprintf(h, m.DN)
-	d.ID = h.Sum64()
+func (m *LDAPMapping) populateDetails(cn *ldap.Conn, basedn, key string, d *Details, e *ldap.Entry) error {
+	var (
+		source []byte
+		err    error
+	)
+	if m.ID != "" {
+		source = e.GetRawAttributeValue(m.ID)
+	}
+	if d.ID, err = m.IDs.Resolve(context.Background(), source, e.DN); err != nil {
+		return err
+	}
 
-	d.Username = m.GetAttributeValue(key)
-	d.Password = m.GetAttributeValue("userPassword")
-	d.Email = m.GetAttributeValue("mail")
-	d.Name = m.GetAttributeValue("cn")
+	if m.Username != "" {
+		key = m.Username
+	}
+	d.Username = e.GetAttributeValue(key)
+	d.Password = e.GetAttributeValue(m.Password)
+	d.Email = e.GetAttributeValue(m.Email)
+	d.Name = e.GetAttributeValue(m.Name)
+	d.Display = e.GetAttributeValue(m.Display)
 	d.State = Active
+	if m.ActiveDirectory && adInactive(e) {
+		d.State = Inactive
+	}
+	if d.Groups, err = m.groups(cn, basedn, e); err != nil {
+		return err
+	}
+	for _, attr := range m.Extra {
+		values, err := store.LDAPAttributeValues(cn, e, attr)
+		if err != nil {
+			return err
+		}
+		if len(values) > 0 {
+			if d.Attributes == nil {
+				d.Attributes = map[string][]string{}
+			}
+			d.Attributes[attr] = values
+		}
+	}
 	return nil
 }
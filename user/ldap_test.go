@@ -0,0 +1,147 @@
+package user // import "breve.us/authsvc/user"
+
+import (
+	"reflect"
+	"testing"
+
+	"breve.us/authsvc/store"
+	"breve.us/authsvc/store/storetest"
+)
+
+const baseDN = "dc=example,dc=com"
+
+// newTestDirectory returns a directory of people, and a config that
+// searches it anonymously.
+func newTestDirectory(t *testing.T) (*storetest.LDAPServer, *store.LDAPConfig) {
+	srv := storetest.NewLDAPServer(t)
+	t.Cleanup(srv.Close)
+	srv.Add("uid=ann,ou=people,"+baseDN, map[string][]string{
+		"objectClass":     {"inetOrgPerson"},
+		"uid":             {"ann"},
+		"mail":            {"ann@example.com"},
+		"cn":              {"Ann Lee"},
+		"displayName":     {"Ann"},
+		"telephoneNumber": {"555-0100", "555-0101"},
+		"entryUUID":       {"3f2504e0-4f89-11d3-9a0c-0305e82c3301"},
+		"userPassword":    {"ann-secret"},
+	})
+	for _, uid := range []string{"bob", "bea"} {
+		srv.Add("uid="+uid+",ou=people,"+baseDN, map[string][]string{
+			"objectClass":  {"inetOrgPerson"},
+			"uid":          {uid},
+			"mail":         {"shared@example.com"},
+			"cn":           {uid},
+			"userPassword": {uid + "-secret"},
+		})
+	}
+	return srv, &store.LDAPConfig{Host: srv.Host(), Port: srv.Port(), BaseDN: baseDN}
+}
+
+func TestLDAPMappingValidate(t *testing.T) {
+	with := func(fn func(*LDAPMapping)) LDAPMapping {
+		m := DefaultLDAPMapping
+		m.LoginAttributes = append([]string{}, m.LoginAttributes...)
+		fn(&m)
+		return m
+	}
+	for _, tc := range []struct {
+		name    string
+		mapping LDAPMapping
+		valid   bool
+	}{
+		{"standard", DefaultLDAPMapping, true},
+		{"ad", ActiveDirectoryMapping, true},
+		{"custom filter", with(func(m *LDAPMapping) { m.Filter = "(&(objectClass=person)({attr}={value}))" }), true},
+		{"no object class", with(func(m *LDAPMapping) { m.ObjectClass = "" }), false},
+		{"no login attributes", with(func(m *LDAPMapping) { m.LoginAttributes = nil }), false},
+		{"filter without value", with(func(m *LDAPMapping) { m.Filter = "({attr}=ann)" }), false},
+		{"unbalanced filter", with(func(m *LDAPMapping) { m.Filter = "(&({attr}={value})" }), false},
+		{"invalid login attribute", with(func(m *LDAPMapping) { m.LoginAttributes[1] = "mail)(uid=*" }), false},
+		{"invalid username", with(func(m *LDAPMapping) { m.Username = "user name" }), false},
+		{"invalid extra", with(func(m *LDAPMapping) { m.Extra = []string{"mobile", "a,b"} }), false},
+		{"invalid groups", with(func(m *LDAPMapping) { m.Groups = "roles" }), false},
+		{"negative group depth", with(func(m *LDAPMapping) { m.Groups, m.GroupDepth = GroupsOfNames, -1 }), false},
+	} {
+		if err := tc.mapping.Validate(); (err == nil) != tc.valid {
+			t.Errorf("%s: Validate() expected valid %v, got %v", tc.name, tc.valid, err)
+		} else if err != nil && err != ErrInvalidMapping {
+			t.Errorf("%s: Validate() expected %v, got %v", tc.name, ErrInvalidMapping, err)
+		}
+	}
+}
+
+func TestLDAPMappingAttributes(t *testing.T) {
+	m := DefaultLDAPMapping
+	m.Username = "UID"
+	m.Extra = []string{"telephoneNumber", "CN"}
+	m.Groups = GroupsMemberOf
+	want := []string{"uid", "mail", "cn", "displayName", "userPassword", "entryUUID", "memberOf", "telephoneNumber"}
+	if got := m.attributes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("attributes() expected %v, got %v", want, got)
+	}
+}
+
+func TestLDAPMappingDetails(t *testing.T) {
+	_, cfg := newTestDirectory(t)
+	get := func(m *LDAPMapping, login string) (*Details, error) {
+		c := NewLDAPCache(cfg, m)
+		defer func() { _ = c.Close() }()
+		v, err := c.Get(login)
+		d, _ := v.(*Details)
+		return d, err
+	}
+
+	m := DefaultLDAPMapping
+	m.Extra = []string{"telephoneNumber", "mobile"}
+	d, err := get(&m, "ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Username != "ann" || d.Email != "ann@example.com" || d.Name != "Ann Lee" || d.Display != "Ann" || d.State != Active {
+		t.Errorf("Get(ann) expected ann's details, got %+v", d)
+	}
+	if want := map[string][]string{"telephoneNumber": {"555-0100", "555-0101"}}; !reflect.DeepEqual(d.Attributes, want) {
+		t.Errorf("Get(ann) expected the extra attributes the entry has, got %v", d.Attributes)
+	}
+
+	// The username is the login attribute that matched, unless the
+	// mapping names one.
+	if d, err = get(&m, "ann@example.com"); err != nil || d.Username != "ann@example.com" {
+		t.Errorf("Get() by mail expected the mail as username, got %+v (%v)", d, err)
+	}
+	m.Username = "uid"
+	if d, err = get(&m, "ann@example.com"); err != nil || d.Username != "ann" {
+		t.Errorf("Get() by mail with Username uid expected ann, got %+v (%v)", d, err)
+	}
+
+	m.Filter = "(&(objectClass=inetOrgPerson)({attr}={value}))"
+	if d, err = get(&m, "ann"); err != nil || d.Username != "ann" {
+		t.Errorf("Get() through a filter template expected ann, got %+v (%v)", d, err)
+	}
+	// Logins are escaped, so they match only themselves.
+	for _, login := range []string{"a*", "*", "ann)(uid=*"} {
+		if _, err = get(&m, login); err != ErrNotFound {
+			t.Errorf("Get(%q) expected %v, got %v", login, ErrNotFound, err)
+		}
+	}
+	if _, err = get(&m, "shared@example.com"); err != ErrAmbiguousLogin {
+		t.Errorf("Get() of a mail two entries share expected %v, got %v", ErrAmbiguousLogin, err)
+	}
+}
+
+func TestLDAPCheckerAmbiguousLogin(t *testing.T) {
+	_, cfg := newTestDirectory(t)
+	c := NewLDAPChecker(cfg, nil)
+	if !c.IsAuthenticated("ann@example.com", "ann-secret") {
+		t.Error("IsAuthenticated() by mail expected ann accepted")
+	}
+	if c.IsAuthenticated("shared@example.com", "bob-secret") {
+		t.Error("IsAuthenticated() of a mail two entries share expected a refusal")
+	}
+	if !c.IsAuthenticated("bob", "bob-secret") {
+		t.Error("IsAuthenticated() by uid of an entry sharing its mail expected bob accepted")
+	}
+	if err := NewLDAPPasswordChanger(cfg, nil).ChangePassword("shared@example.com", "bob-secret", "new-secret"); err != ErrAmbiguousLogin {
+		t.Errorf("ChangePassword() of a mail two entries share expected %v, got %v", ErrAmbiguousLogin, err)
+	}
+}
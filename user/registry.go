@@ -4,6 +4,7 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 
 	"golang.org/x/crypto/bcrypt"
@@ -19,6 +20,7 @@ var (
 
 func init() {
 	gob.Register(&Details{})
+	store.RegisterType("user.Details", 1, &Details{}, store.JSONCodec)
 }
 
 // State describes User States
@@ -38,29 +40,56 @@ type Details struct {
 	Email    string `json:"email"`
 	Name     string `json:"name"`
 	State    State  `json:"state"`
+	// Display, if set, is shown in place of Name.
+	Display string `json:"display,omitempty"`
+	// Attributes carries further directory attributes of the user.
+	Attributes map[string][]string `json:"attributes,omitempty"`
+	// Groups names the groups the user belongs to.
+	Groups []string `json:"groups,omitempty"`
 }
 
 func (d *Details) toFilteredMap() map[string]interface{} {
+	name := d.Name
+	if d.Display != "" {
+		name = d.Display
+	}
 	return map[string]interface{}{
 		"id":       int64(d.ID),
 		"username": d.Username,
 		"login":    d.Username,
 		"email":    d.Email,
-		"name":     d.Name,
+		"name":     name,
+		"groups":   d.groups(),
+	}
+}
+
+// groups returns the user's groups, as an empty list rather than null
+// when there are none.
+func (d *Details) groups() []string {
+	if d.Groups == nil {
+		return []string{}
 	}
+	return d.Groups
 }
 
 // Registry maintains the known users
 type Registry struct {
 	cache store.Cache
+	memo  *store.Memo
 }
 
 // NewRegistry returns an initialized UserRegistry
-func NewRegistry(cache store.Cache) *Registry { return &Registry{cache: cache} }
+func NewRegistry(cache store.Cache) *Registry {
+	return &Registry{cache: cache, memo: store.NewMemo(cache)}
+}
+
+// Close stops the registry following changes to its cache. It does not
+// close the cache.
+func (u *Registry) Close() error { return u.memo.Close() }
 
 // Get returns a user registration by username, or an error if not found
 func (u *Registry) Get(username string) (*Details, error) {
-	v, err := u.cache.Get(username)
+	v, err := u.memo.Get(username)
 	if err != nil {
 		return nil, err
 	}
@@ -76,6 +105,15 @@ func (u *Registry) Put(user *Details) error { return u.cache.Put(user.Username,
 // Delete removes the user registration
 func (u *Registry) Delete(username string) error { return u.cache.Delete(username) }
 
+// Invalidate drops any locally cached copy of the user, so the next Get
+// reads it from the source again.
+func (u *Registry) Invalidate(username string) {
+	u.memo.Forget(username)
+	if i, ok := u.cache.(store.Invalidator); ok {
+		i.Invalidate(username)
+	}
+}
+
 // LoadFromJSON loads users encoded in JSON
 func (u *Registry) LoadFromJSON(r io.Reader) error {
 	var (
@@ -155,6 +193,57 @@ func (b *bchecker) IsAuthenticated(username, password string) bool {
 	return false
 }
 
+// Local password limits
+const (
+	MinPasswordLength = 8
+	// MaxPasswordLength is the most bytes bcrypt hashes; the rest would
+	// be ignored.
+	MaxPasswordLength = 72
+)
+
+// BcryptChanger creates an implementation of common.PasswordChanger that
+// stores a bcrypt hash of the new password in the user details, for
+// users whose current password BcryptChecker accepts
+func (u *Registry) BcryptChanger() common.PasswordChanger {
+	return &bchanger{r: u}
+}
+
+type bchanger struct {
+	r *Registry
+}
+
+// ChangePassword requires that the user is valid and oldPassword is
+// theirs, and that newPassword is from MinPasswordLength to
+// MaxPasswordLength bytes long
+func (b *bchanger) ChangePassword(username, oldPassword, newPassword string) error {
+	d, err := b.r.Get(username)
+	if err == store.ErrNotFound {
+		return common.ErrUnknownUser
+	} else if err != nil {
+		return err
+	}
+	if !b.r.BcryptChecker().IsAuthenticated(username, oldPassword) {
+		return common.ErrWrongPassword
+	}
+	switch {
+	case len(newPassword) < MinPasswordLength:
+		return &common.PasswordPolicyError{Reason: fmt.Sprintf("the new password must be at least %d characters long", MinPasswordLength)}
+	case len(newPassword) > MaxPasswordLength:
+		return &common.PasswordPolicyError{Reason: fmt.Sprintf("the new password must be at most %d bytes long", MaxPasswordLength)}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	changed := *d
+	changed.Password = string(hash)
+	if err = b.r.Put(&changed); err != nil {
+		return err
+	}
+	b.r.Invalidate(username)
+	return nil
+}
+
 // PlainTextChecker creates in implementation of common.Checker that uses
 // simple text comparison to verify password against the plain text
 // password field in the user details
@@ -5,6 +5,7 @@ import axios from 'axios';
 import Account from './Account';
 import OAuthAsk from './OAuthAsk';
 import Login from './Login';
+import Password from './Password';
 import './App.css';
 
 class App extends React.Component {
@@ -33,6 +34,7 @@ class App extends React.Component {
           <Route path="/" render={props => {return <Account user={this.state.user} {...props} />}} />
           <Route path="/oauth/ask" exact={true} component={OAuthAsk} />
           <Route path="/auth/login/" exact={true} render={() => {return <Login user={this.state.user} />}} />
+          <Route path="/auth/password" exact={true} render={() => {return <Password user={this.state.user} />}} />
         </div>
       </Router>
     );
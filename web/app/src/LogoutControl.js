@@ -5,6 +5,7 @@ export class LogoutControl extends React.Component {
     return (
       <form action="/auth/logout/" method="POST">
         <span style={{ fontWeight: 'bold', marginRight: 10 }}>{this.props.user.name}</span>
+        <a href="/auth/password" style={{ marginRight: 10 }}>Change password</a>
         <input type="submit" name="submit" value="Logout" />
       </form>
     )
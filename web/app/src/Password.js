@@ -0,0 +1,18 @@
+import React from 'react';
+
+class Password extends React.Component {
+  render() {
+    return this.props.user
+      ? <div>
+        <h3>Change password</h3>
+        <form action="/auth/password" method="POST">
+          <input type="password" placeholder="current password" name="current" />
+          <input type="password" placeholder="new password" name="password" />
+          <input type="password" placeholder="confirm new password" name="confirm" />
+          <input type="submit" name="submit" value="Change" />
+        </form>
+      </div>
+      : <span className="nothing-here" />
+  }
+}
+export default Password;